@@ -0,0 +1,330 @@
+// Package admin manages prompts and tunables at runtime, see packages
+// prompts and settings. Requests must carry ADMIN_API_KEY, or the key of a
+// named admin in ADMIN_KEYS, in X-Admin-Key; the function refuses every
+// request when neither is set. Every change is recorded in the audit log
+// with the admin's name, see package audit.
+//
+//	GET  .../prompts?name=detect-hazards                  list versions
+//	PUT  .../prompts?name=detect-hazards&version=v6       upload a version (text body)
+//	POST .../prompts/validate?name=detect-hazards         validate a prompt (text body)
+//	GET  .../settings?function=detect-hazards             read tunables
+//	PUT  .../settings?function=detect-hazards             replace tunables (JSON body)
+//	POST .../activate?function=detect-hazards&version=v6  activate a prompt version
+//
+// Changes reach running instances within SETTINGS_CACHE_TTL, and only when
+// they run with RUNTIME_SETTINGS=true. Deploy this function with it too, so
+// uploaded versions can be activated.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/internal/audit"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// maxBody bounds request bodies; prompts are limited further by package
+// prompts.
+const maxBody = 64 << 10
+
+type PromptsResponse struct {
+	Name     string            `json:"name"`
+	Versions []prompts.Version `json:"versions"`
+}
+
+type ValidateResponse struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+type SettingsResponse struct {
+	Function string            `json:"function"`
+	Settings settings.Settings `json:"settings"`
+}
+
+// Admin is the Cloud Function entry point
+func Admin(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "admin"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Verify admin key
+	actor, err := validateAdminKey(r)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, apierror.CodeForbidden, "Invalid admin key")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	query := r.URL.Query()
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case strings.HasSuffix(path, "/prompts/validate") && r.Method == http.MethodPost:
+		validatePrompt(w, r, query.Get("name"))
+	case strings.HasSuffix(path, "/prompts") && r.Method == http.MethodGet:
+		listPrompts(ctx, w, logger, query.Get("name"))
+	case strings.HasSuffix(path, "/prompts") && r.Method == http.MethodPut:
+		uploadPrompt(ctx, w, r, logger, actor, query.Get("name"), query.Get("version"))
+	case strings.HasSuffix(path, "/settings") && r.Method == http.MethodGet:
+		getSettings(ctx, w, logger, query.Get("function"))
+	case strings.HasSuffix(path, "/settings") && r.Method == http.MethodPut:
+		putSettings(ctx, w, r, logger, actor, query.Get("function"))
+	case strings.HasSuffix(path, "/activate") && r.Method == http.MethodPost:
+		activate(ctx, w, r, logger, actor, query.Get("function"), query.Get("version"))
+	default:
+		respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Not found")
+	}
+}
+
+func listPrompts(ctx context.Context, w http.ResponseWriter, logger *log.Logger, name string) {
+	if !prompts.ValidName(name) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid name")
+		return
+	}
+
+	versions, err := prompts.Versions(ctx, name)
+	if err != nil {
+		logger.Printf("Error listing prompts: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error listing prompts")
+		return
+	}
+	if len(versions) == 0 {
+		respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Unknown prompt")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, PromptsResponse{Name: name, Versions: versions})
+}
+
+func validatePrompt(w http.ResponseWriter, r *http.Request, name string) {
+	if !prompts.ValidName(name) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid name")
+		return
+	}
+
+	text, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	response := ValidateResponse{Valid: true}
+	if err := prompts.Validate(name, string(text)); err != nil {
+		response = ValidateResponse{Error: err.Error()}
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func uploadPrompt(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *log.Logger, actor, name, version string) {
+	if !prompts.ValidName(name) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid name")
+		return
+	}
+	if !prompts.ValidVersion(version) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid version")
+		return
+	}
+
+	text, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	// Template errors are the caller's; anything else is ours
+	if err := prompts.Validate(name, string(text)); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid prompt: %v", err))
+		return
+	}
+
+	err = prompts.Upload(ctx, name, version, string(text))
+	if errors.Is(err, prompts.ErrExists) {
+		respondWithError(w, http.StatusConflict, apierror.CodeConflict, "Version exists")
+		return
+	}
+	if err != nil {
+		logger.Printf("Error uploading prompt %s %s: %v", name, version, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error uploading prompt")
+		return
+	}
+
+	logger.Printf("Uploaded prompt %s %s", name, version)
+	record(r, logger, audit.Entry{
+		Action:  audit.ActionPromptUpload,
+		Actor:   actor,
+		Target:  name,
+		Details: map[string]string{"version": version},
+	})
+	respondWithJSON(w, http.StatusCreated, prompts.Version{Version: version, Uploaded: true})
+}
+
+func getSettings(ctx context.Context, w http.ResponseWriter, logger *log.Logger, function string) {
+	if !settings.ValidFunction(function) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid function")
+		return
+	}
+
+	s, err := settings.Load(ctx, function)
+	if err != nil {
+		logger.Printf("Error loading settings: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, SettingsResponse{Function: function, Settings: s})
+}
+
+func putSettings(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *log.Logger, actor, function string) {
+	if !settings.ValidFunction(function) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid function")
+		return
+	}
+
+	var s settings.Settings
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	save(ctx, w, r, logger, audit.Entry{Action: audit.ActionSettingsUpdate, Actor: actor}, function, s)
+}
+
+func activate(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *log.Logger, actor, function, version string) {
+	if !settings.ValidFunction(function) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid function")
+		return
+	}
+
+	s, err := settings.Load(ctx, function)
+	if err != nil {
+		logger.Printf("Error loading settings: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading settings")
+		return
+	}
+	s.PromptVersion = version
+
+	save(ctx, w, r, logger, audit.Entry{Action: audit.ActionPromptActivate, Actor: actor}, function, s)
+}
+
+// save stores the settings of function once their prompt version is known
+// to load for every prompt of the function, and records the change as
+// entry.
+func save(ctx context.Context, w http.ResponseWriter, r *http.Request, logger *log.Logger, entry audit.Entry, function string, s settings.Settings) {
+	if err := s.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if s.PromptVersion != "" {
+		names := prompts.Names(function)
+		if len(names) == 0 {
+			respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Unknown function")
+			return
+		}
+		for _, name := range names {
+			if !prompts.Exists(ctx, name, s.PromptVersion) {
+				respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Prompt %s has no version %s", name, s.PromptVersion))
+				return
+			}
+		}
+	}
+
+	// The version replaced, for the audit log
+	previous, err := settings.Load(ctx, function)
+	if err != nil {
+		logger.Printf("Error loading settings: %v", err)
+	}
+
+	if err := settings.Save(ctx, function, s); err != nil {
+		logger.Printf("Error saving settings: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error saving settings")
+		return
+	}
+
+	logger.Printf("Settings of %s updated: promptVersion=%q", function, s.PromptVersion)
+	entry.Target = function
+	entry.Details = map[string]string{
+		"promptVersion":         s.PromptVersion,
+		"previousPromptVersion": previous.PromptVersion,
+	}
+	if settingsJSON, err := json.Marshal(s); err == nil {
+		entry.Details["settings"] = string(settingsJSON)
+	}
+	record(r, logger, entry)
+	respondWithJSON(w, http.StatusOK, SettingsResponse{Function: function, Settings: s})
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// record writes entry to the audit log. The change is made by then, so a
+// failure is only logged.
+func record(r *http.Request, logger *log.Logger, entry audit.Entry) {
+	if err := audit.Record(r.Context(), entry); err != nil {
+		logger.Printf("Error recording %s of %s by %s in the audit log: %v", entry.Action, entry.Target, entry.Actor, err)
+	}
+}
+
+// validateAdminKey returns the actor of the request's admin key, "admin"
+// for ADMIN_API_KEY and "admin:{name}" for a key of ADMIN_KEYS.
+func validateAdminKey(r *http.Request) (string, error) {
+	cfg := config.Get()
+	if cfg.AdminAPIKey == "" && len(cfg.AdminKeys) == 0 {
+		// Unlike the client API key, the admin key is never optional
+		return "", errors.New("admin API disabled")
+	}
+
+	key := []byte(r.Header.Get("X-Admin-Key"))
+	actor := ""
+	if cfg.AdminAPIKey != "" && subtle.ConstantTimeCompare(key, []byte(cfg.AdminAPIKey)) == 1 {
+		actor = "admin"
+	}
+	for _, named := range cfg.AdminKeys {
+		name, expected, _ := strings.Cut(named, ":")
+		if subtle.ConstantTimeCompare(key, []byte(expected)) == 1 {
+			actor = "admin:" + name
+		}
+	}
+	if actor == "" {
+		return "", errors.New("invalid admin key")
+	}
+	return actor, nil
+}
@@ -0,0 +1,395 @@
+package checkexpiry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request carries the user's IANA timezone (e.g. "Asia/Bangkok") so "today"
+// matches the user's calendar rather than the server's.
+type Request struct {
+	Image    string `json:"image"`
+	Timezone string `json:"timezone"`
+	Model    string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string        `json:"speechText"`
+	Status     string        `json:"status"`
+	ExpiryDate string        `json:"expiryDate,omitempty"`
+	DaysLeft   *int          `json:"daysLeft,omitempty"`
+	Dates      []PrintedDate `json:"dates"`
+}
+
+type DateDetection struct {
+	Dates []PrintedDate `json:"dates"`
+}
+
+// PrintedDate is a date found on the packaging. Raw is the text as printed
+// and Date the model's normalized reading (YYYY-MM-DD or YYYY-MM).
+type PrintedDate struct {
+	Kind string `json:"kind"`
+	Raw  string `json:"raw"`
+	Date string `json:"date"`
+}
+
+const (
+	StatusExpired = "EXPIRED"
+	StatusValid   = "VALID"
+	StatusNoDate  = "NO_DATE"
+)
+
+const (
+	KindExpiry       = "EXPIRY"
+	KindUseBy        = "USE_BY"
+	KindBestBefore   = "BEST_BEFORE"
+	KindManufactured = "MANUFACTURED"
+)
+
+var kindLabels = map[string]string{
+	KindExpiry:     "Expiry date",
+	KindUseBy:      "Use by date",
+	KindBestBefore: "Best before date",
+}
+
+// rawLayouts are tried, in order, when the normalized date is missing or
+// unparsable. Numeric dates are read day-first, which is far more common on
+// packaging than month-first.
+var rawLayouts = []string{
+	"2006-01-02",
+	"2/1/2006",
+	"2.1.2006",
+	"2-1-2006",
+	"2/1/06",
+	"2.1.06",
+	"2 Jan 2006",
+	"2 January 2006",
+	"Jan 2 2006",
+	"January 2 2006",
+	"2006/1/2",
+	"20060102",
+}
+
+var monthLayouts = []string{
+	"2006-01",
+	"1/2006",
+	"1.2006",
+	"1-2006",
+	"1/06",
+	"Jan 2006",
+	"January 2006",
+}
+
+// CheckExpiry is the Cloud Function entry point
+func CheckExpiry(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "check-expiry"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	location := time.UTC
+	if req.Timezone != "" {
+		location, err = time.LoadLocation(req.Timezone)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid timezone")
+			return
+		}
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.1,
+		MaxOutputTokens: 512,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "check-expiry", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var detection DateDetection
+	err = json.Unmarshal([]byte(jsonStr), &detection)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	today := time.Now().In(location)
+	response := checkDates(detection.Dates, today)
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// checkDates picks the earliest expiry-type date and compares it against
+// today in the user's timezone.
+func checkDates(dates []PrintedDate, today time.Time) Response {
+	response := Response{Status: StatusNoDate, Dates: []PrintedDate{}}
+
+	var expiry time.Time
+	var expiryKind string
+	for _, d := range dates {
+		d.Kind = strings.ToUpper(d.Kind)
+		parsed, ok := parseDate(d)
+		if ok {
+			d.Date = parsed.Format("2006-01-02")
+		}
+		response.Dates = append(response.Dates, d)
+
+		if !ok || d.Kind == KindManufactured {
+			continue
+		}
+		if expiry.IsZero() || parsed.Before(expiry) {
+			expiry = parsed
+			expiryKind = d.Kind
+		}
+	}
+
+	if expiry.IsZero() {
+		response.SpeechText = "No expiry date found. Try turning the package slowly to show the printed date."
+		return response
+	}
+
+	todayDate := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	daysLeft := int(expiry.Sub(todayDate).Hours() / 24)
+
+	label, ok := kindLabels[expiryKind]
+	if !ok {
+		label = kindLabels[KindExpiry]
+	}
+	spokenDate := expiry.Format("January 2, 2006")
+
+	response.ExpiryDate = expiry.Format("2006-01-02")
+	response.DaysLeft = &daysLeft
+
+	switch {
+	case daysLeft < 0:
+		response.Status = StatusExpired
+		response.SpeechText = fmt.Sprintf("Expired. %s was %s, %s ago.", label, spokenDate, pluralDays(-daysLeft))
+	case daysLeft == 0:
+		response.Status = StatusValid
+		response.SpeechText = fmt.Sprintf("Expires today. %s is %s.", label, spokenDate)
+	case daysLeft == 1:
+		response.Status = StatusValid
+		response.SpeechText = fmt.Sprintf("Expires tomorrow. %s is %s.", label, spokenDate)
+	default:
+		response.Status = StatusValid
+		response.SpeechText = fmt.Sprintf("Expires in %s. %s is %s.", pluralDays(daysLeft), label, spokenDate)
+	}
+
+	return response
+}
+
+// parseDate reads the normalized date first and falls back to the printed
+// text. Month-only dates expire at the end of that month.
+func parseDate(d PrintedDate) (time.Time, bool) {
+	candidates := []string{strings.TrimSpace(d.Date), cleanRaw(d.Raw)}
+
+	for _, value := range candidates {
+		if value == "" {
+			continue
+		}
+		for _, layout := range rawLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, true
+			}
+		}
+		for _, layout := range monthLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.AddDate(0, 1, -1), true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// cleanRaw strips the label from a printed date, e.g. "EXP: 12/2025" or
+// "BEST BEFORE Jan 2026".
+func cleanRaw(raw string) string {
+	fields := strings.Fields(strings.NewReplacer(",", " ", ":", " ").Replace(raw))
+	for i, field := range fields {
+		if (field[0] >= '0' && field[0] <= '9') || isMonthName(field) {
+			return strings.Join(fields[i:], " ")
+		}
+	}
+	return ""
+}
+
+func isMonthName(s string) bool {
+	for _, layout := range []string{"Jan", "January"} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func pluralDays(n int) string {
+	if n == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", n)
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package checklighting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"net/http"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+type Request struct {
+	Image string `json:"image"`
+}
+
+type Response struct {
+	SpeechText string  `json:"speechText"`
+	Status     string  `json:"status"`
+	Usable     bool    `json:"usable"`
+	Metrics    Metrics `json:"metrics"`
+}
+
+// Metrics are measured on a downscaled grayscale copy of the frame.
+// Brightness and Contrast are on a 0-255 scale, ratios are 0-1.
+type Metrics struct {
+	Brightness   float64 `json:"brightness"`
+	Contrast     float64 `json:"contrast"`
+	DarkRatio    float64 `json:"darkRatio"`
+	ClippedRatio float64 `json:"clippedRatio"`
+	Sharpness    float64 `json:"sharpness"`
+}
+
+const (
+	StatusOK          = "OK"
+	StatusTooDark     = "TOO_DARK"
+	StatusGlare       = "GLARE"
+	StatusLowContrast = "LOW_CONTRAST"
+	StatusBlurry      = "BLURRY"
+)
+
+const (
+	// analysisSize is the longest side of the downscaled frame.
+	analysisSize = 256
+
+	darkLevel     = 20
+	clippedLevel  = 250
+	minBrightness = 40
+	maxDarkRatio  = 0.7
+	// maxClippedRatio flags glare: a large share of blown-out pixels means
+	// a light source or reflection is washing out the scene.
+	maxClippedRatio = 0.25
+	minContrast     = 12
+	// minSharpness is the minimum variance of the Laplacian.
+	minSharpness = 15
+)
+
+// CheckLighting is the Cloud Function entry point. It runs entirely on local
+// pixel statistics so clients can check a frame before paying for a model
+// call.
+func CheckLighting(w http.ResponseWriter, r *http.Request) {
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	imageData, _, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	img, err := imagedata.DecodeImage(imageData)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	metrics := measure(grayscale(img))
+	status := classify(metrics)
+
+	// Return response
+	response := Response{
+		SpeechText: advice(status),
+		Status:     status,
+		Usable:     status == StatusOK,
+		Metrics:    metrics,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// grayscale returns the luminance of a downscaled copy of the image, row by
+// row, using nearest-neighbour sampling.
+func grayscale(img image.Image) [][]float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	scale := math.Max(float64(width), float64(height)) / analysisSize
+	if scale < 1 {
+		scale = 1
+	}
+	w, h := int(float64(width)/scale), int(float64(height)/scale)
+
+	gray := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		gray[y] = make([]float64, w)
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+int(float64(x)*scale), bounds.Min.Y+int(float64(y)*scale)).RGBA()
+			gray[y][x] = (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 257
+		}
+	}
+
+	return gray
+}
+
+func measure(gray [][]float64) Metrics {
+	var sum, sumSq float64
+	var dark, clipped, n int
+	for _, row := range gray {
+		for _, v := range row {
+			sum += v
+			sumSq += v * v
+			n++
+			if v < darkLevel {
+				dark++
+			}
+			if v > clippedLevel {
+				clipped++
+			}
+		}
+	}
+	if n == 0 {
+		return Metrics{}
+	}
+
+	mean := sum / float64(n)
+	variance := sumSq/float64(n) - mean*mean
+
+	return Metrics{
+		Brightness:   round(mean),
+		Contrast:     round(math.Sqrt(math.Max(variance, 0))),
+		DarkRatio:    round(float64(dark) / float64(n)),
+		ClippedRatio: round(float64(clipped) / float64(n)),
+		Sharpness:    round(laplacianVariance(gray)),
+	}
+}
+
+// laplacianVariance is a standard focus measure: blurry frames have few
+// strong edges and therefore a low variance.
+func laplacianVariance(gray [][]float64) float64 {
+	var sum, sumSq float64
+	var n int
+	for y := 1; y < len(gray)-1; y++ {
+		for x := 1; x < len(gray[y])-1; x++ {
+			l := gray[y-1][x] + gray[y+1][x] + gray[y][x-1] + gray[y][x+1] - 4*gray[y][x]
+			sum += l
+			sumSq += l * l
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+
+	mean := sum / float64(n)
+	return sumSq/float64(n) - mean*mean
+}
+
+// classify reports the most limiting problem first: nothing else can be
+// judged in a frame that is too dark.
+func classify(m Metrics) string {
+	switch {
+	case m.Brightness < minBrightness || m.DarkRatio > maxDarkRatio:
+		return StatusTooDark
+	case m.ClippedRatio > maxClippedRatio:
+		return StatusGlare
+	case m.Contrast < minContrast:
+		return StatusLowContrast
+	case m.Sharpness < minSharpness:
+		return StatusBlurry
+	default:
+		return StatusOK
+	}
+}
+
+func advice(status string) string {
+	switch status {
+	case StatusTooDark:
+		return persona.Speech("It's too dark for Buddy to see. Turn on the flashlight.")
+	case StatusGlare:
+		return "Severe glare. Tilt the camera down a little, away from the light."
+	case StatusLowContrast:
+		return "The picture looks washed out. Move the camera away from bright light."
+	case StatusBlurry:
+		return "The picture is blurry. Hold your device steady."
+	default:
+		return "Lighting looks good."
+	}
+}
+
+func round(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
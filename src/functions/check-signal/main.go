@@ -0,0 +1,294 @@
+package checksignal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+	"example.com/buddy-paws/pkg/model"
+	"example.com/buddy-paws/pkg/severity"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+type Request struct {
+	Image string `json:"image"`
+	Model string `json:"model,omitempty"`
+}
+
+// Response is the state of the pedestrian light. Severity is HIGH for a red
+// light, with the same STOP guidance as detect-hazards, see package
+// severity.
+type Response struct {
+	SpeechText string          `json:"speechText"`
+	Earcon     severity.Earcon `json:"earcon,omitempty"`
+	Signal     string          `json:"signal"`
+	Countdown  *int            `json:"countdown"`
+	Severity   model.Severity  `json:"severity"`
+}
+
+// SignalDetection is the model output for a single frame.
+type SignalDetection struct {
+	Signal    string `json:"signal"`
+	Countdown *int   `json:"countdown"`
+}
+
+const (
+	SignalRed   = "RED"
+	SignalGreen = "GREEN"
+	SignalNone  = "NONE"
+)
+
+// defaultModelName is a small, fast model; the signal state is polled every
+// second while the user waits at a crossing.
+const defaultModelName = "gemini-1.5-flash-8b"
+
+// CheckSignal is the Cloud Function entry point
+func CheckSignal(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.SignalModelName
+	if modelName == "" {
+		modelName = defaultModelName
+	}
+
+	// Creates a logger.
+	logName := "check-signal"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0,
+		MaxOutputTokens: 64,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "check-signal", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var detection SignalDetection
+	err = json.Unmarshal([]byte(jsonStr), &detection)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	signal := safeguardSignal(&detection)
+
+	level := signalSeverity(signal)
+	response := Response{
+		SpeechText: severity.Guidance(level, signalSpeech(signal, detection.Countdown)),
+		Signal:     signal,
+		Countdown:  detection.Countdown,
+		Severity:   level,
+	}
+	if signal == SignalGreen {
+		// A green light is the crosswalk cue, whatever the wording
+		response.Earcon = severity.EarconCrosswalk
+	} else {
+		response.Earcon = severity.EarconOf(level, response.SpeechText)
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// safeguardSignal normalizes the model output. Anything that isn't clearly
+// RED or GREEN is reported as NONE so the user is never told to cross on an
+// uncertain reading.
+func safeguardSignal(detection *SignalDetection) string {
+	signal := strings.ToUpper(strings.TrimSpace(detection.Signal))
+
+	if detection.Countdown != nil && *detection.Countdown < 0 {
+		detection.Countdown = nil
+	}
+
+	switch signal {
+	case SignalRed, SignalGreen:
+		return signal
+	default:
+		detection.Countdown = nil
+		return SignalNone
+	}
+}
+
+// signalSeverity is HIGH for a red light, which calls for a STOP, and LOW
+// otherwise.
+func signalSeverity(signal string) model.Severity {
+	if signal == SignalRed {
+		return model.SeverityHigh
+	}
+	return model.SeverityLow
+}
+
+// signalSpeech describes the signal, without the prefix of its severity.
+func signalSpeech(signal string, countdown *int) string {
+	switch signal {
+	case SignalRed:
+		if countdown != nil {
+			return fmt.Sprintf("Red light, %d seconds.", *countdown)
+		}
+		return "Red light, wait."
+	case SignalGreen:
+		if countdown != nil {
+			return fmt.Sprintf("Green light, %d seconds left.", *countdown)
+		}
+		return "Green light."
+	default:
+		return "No pedestrian light found."
+	}
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Package buddypaws is a Go client for the Buddy Paws Cloud Functions API.
+//
+//	c := buddypaws.NewClient("https://asia-southeast1-my-project.cloudfunctions.net", apiKey)
+//	result, err := c.DetectHazards(ctx, jpeg)
+package buddypaws
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// Function paths, relative to the base URL. Hazard requests use API v2,
+// which the HazardResult fields depend on.
+const (
+	PathDetectHazards = "/detect-hazards/v2"
+	PathReadObject    = "/object-reader"
+)
+
+// Verbosity levels of HazardOptions and ObjectOptions. Terse suits
+// continuous navigation, e.g. "STOP. Pole ahead.", and detailed exploring
+// a place. The default is the deployment's.
+const (
+	VerbosityTerse    = "terse"
+	VerbosityNormal   = "normal"
+	VerbosityDetailed = "detailed"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultBackoff    = 200 * time.Millisecond
+	maxBackoff        = 5 * time.Second
+)
+
+// Client calls the Buddy Paws functions. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+	appCheck   func(context.Context) (string, error)
+	access     func(context.Context) (string, error)
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets how many times a failed request is retried. Only network
+// errors, 429 and 5xx responses are retried.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+	}
+}
+
+// WithBackoff sets the initial delay between retries. It doubles on every
+// attempt, with jitter, up to 5 seconds.
+func WithBackoff(d time.Duration) Option {
+	return func(c *Client) {
+		c.backoff = d
+	}
+}
+
+// WithAppCheck sends an App Check token from token with every request.
+// It is called for every attempt, as tokens expire; Firebase SDKs cache
+// them.
+func WithAppCheck(token func(context.Context) (string, error)) Option {
+	return func(c *Client) {
+		c.appCheck = token
+	}
+}
+
+// WithAccessToken sends an access token of register-device from token
+// with every request, as "Authorization: Bearer". It is called for every
+// attempt; the caller renews the token before it expires.
+func WithAccessToken(token func(context.Context) (string, error)) Option {
+	return func(c *Client) {
+		c.access = token
+	}
+}
+
+// NewClient returns a client for the functions deployed under baseURL,
+// authenticating with the X-API-Key header.
+func NewClient(baseURL, apiKey string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: defaultMaxRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is returned for non-2xx responses. Code is a machine-readable
+// reason, one of the apierror codes, e.g. "CONTENT_BLOCKED", and SpeechText
+// a message for the user, when the server gave them. RequestID identifies
+// the request in the server logs.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Code       string
+	SpeechText string
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("buddypaws: %d %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// post sends payload as JSON to path and decodes the response into out,
+// retrying temporary failures. All attempts share an Idempotency-Key, so the
+// server answers a retry of a request it already handled without running
+// it again.
+func (c *Client) post(ctx context.Context, path string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	key := newID()
+
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.send(ctx, path, key, body, out)
+		if err == nil || attempt >= c.maxRetries || !retryable(ctx, err) {
+			return err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		delay = min(delay*2, maxBackoff)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes a single attempt. It returns the server's Retry-After delay,
+// if any, alongside the error.
+func (c *Client) send(ctx context.Context, path, idempotencyKey string, body []byte, out interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", c.apiKey)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	if c.appCheck != nil {
+		token, err := c.appCheck(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("getting App Check token: %w", err)
+		}
+		req.Header.Set("X-Firebase-AppCheck", token)
+	}
+	if c.access != nil {
+		token, err := c.access(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("getting access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		var problem apierror.Problem
+		if json.Unmarshal(data, &problem) == nil && problem.Error != "" {
+			apiErr.Message = problem.Error
+			apiErr.Code = string(problem.Code)
+			apiErr.SpeechText = problem.SpeechText
+			apiErr.RequestID = problem.RequestID
+		}
+		retryAfter := time.Duration(problem.RetryAfterMs) * time.Millisecond
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, apiErr
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		return 0, fmt.Errorf("buddypaws: decoding response: %w", err)
+	}
+	return 0, nil
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// encodeImage turns raw image bytes into the data URI the functions expect.
+func encodeImage(img []byte) string {
+	contentType := http.DetectContentType(img)
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = "image/jpeg"
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(img)
+}
@@ -0,0 +1,260 @@
+package buddypaws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"example.com/buddy-paws/pkg/haptic"
+	"example.com/buddy-paws/pkg/model"
+	"example.com/buddy-paws/pkg/severity"
+)
+
+// Location is the phone's GPS fix. Heading is the direction the camera
+// faces, in degrees clockwise from north.
+type Location struct {
+	Lat     float64  `json:"lat"`
+	Lng     float64  `json:"lng"`
+	Heading *float64 `json:"heading,omitempty"`
+}
+
+// Motion is the phone's motion, from its sensors. Speed is the walking speed
+// in m/s, Acceleration the magnitude of the user's acceleration without
+// gravity in m/s², Heading the direction the camera faces when there's no
+// Location, and Pitch the camera tilt in degrees, negative pointing down.
+type Motion struct {
+	Speed        *float64 `json:"speed,omitempty"`
+	Acceleration *float64 `json:"acceleration,omitempty"`
+	Heading      *float64 `json:"heading,omitempty"`
+	Pitch        *float64 `json:"pitch,omitempty"`
+}
+
+// Weather is the current weather, for clients that know it. Condition is
+// one of "clear", "cloudy", "fog", "rain", "snow", "ice" or "storm", and
+// Temperature is in degrees Celsius. Without it, the server looks the
+// weather up from the Location.
+type Weather struct {
+	Condition   string   `json:"condition"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// Mobility modes of HazardOptions. The guidance is written for cane users
+// by default; with a guide dog the obstacles the dog leads around aren't
+// announced, and in a wheelchair steps, curbs and slopes ahead are
+// barriers, with directions to a ramp or curb cut.
+const (
+	MobilityCane       = "cane"
+	MobilityGuideDog   = "guide-dog"
+	MobilityWheelchair = "wheelchair"
+)
+
+// HazardOptions are the optional inputs of a hazard request. Frames sent
+// with the same SessionID are tracked together, so hazards are only
+// announced when they are new or get worse. Model asks for a model other
+// than the deployment's default; it must be on the server's allowlist.
+// Verbose asks for the detected hazards in the result. Debug has the server
+// archive the frame for a bug report, if archival is configured. Motion
+// lets the guidance adapt to the user's pace, e.g. looking further ahead
+// when walking fast, and Weather makes wet and icy ground easier to tell.
+// Verbosity is one of the Verbosity constants. Positions "clock" has hazard
+// positions given as clock positions, e.g. "car at 2 o'clock, about 4
+// meters", in SpeechText and Hazards. Annotate asks for the frame with the
+// hazards drawn on it, for low-vision users. TopHazards, from 1 to 20,
+// caps the hazards reported; nil leaves the server's default, usually 3.
+// IncludeCategories and ExcludeCategories, e.g.
+// model.CategoryEnvironmentalHazards, limit them to some categories for
+// less chatty guidance; HIGH hazards are always reported. MobilityMode is
+// one of the Mobility constants.
+type HazardOptions struct {
+	SessionID string
+	Location  *Location
+	Motion    *Motion
+	Weather   *Weather
+	Model     string
+	Verbosity string
+	Verbose   bool
+	Debug     bool
+	Positions string
+	Annotate  bool
+
+	TopHazards        *int
+	IncludeCategories []model.Category
+	ExcludeCategories []model.Category
+	MobilityMode      string
+}
+
+// HazardResult is the response of the detect-hazards function. SpeechText is
+// empty when a session frame has nothing new to announce, and Severity is
+// SeverityUnchanged when the view hasn't changed since the last analyzed
+// frame of the session. Rescan is set when the view was too unclear for
+// directions; SpeechText then asks the user to scan again.
+type HazardResult struct {
+	SpeechText       string         `json:"speechText"`
+	Severity         model.Severity `json:"severity"`
+	NearestSteps     *int           `json:"nearestSteps,omitempty"`
+	CompassDirection string         `json:"compassDirection,omitempty"`
+	// BearingDegrees is the way SpeechText points, in degrees off the
+	// camera axis, negative to the left, e.g. for haptic steering.
+	BearingDegrees *int     `json:"bearingDegrees,omitempty"`
+	Confidence     *float64 `json:"confidence,omitempty"`
+	Rescan         bool     `json:"rescan,omitempty"`
+	// Upcoming are the mapped crossings, stairways and transit stops ahead,
+	// for requests with a Location and a heading.
+	Upcoming []model.Feature `json:"upcoming,omitempty"`
+	// Hazards is only set for verbose requests.
+	Hazards []model.Hazard `json:"hazards,omitempty"`
+	// DebugPath is where the frame was archived, for a bug report.
+	DebugPath string `json:"debugPath,omitempty"`
+	// SuggestedIntervalMs is how long to wait before sending the next
+	// frame, longer when the backend is loaded.
+	SuggestedIntervalMs int64 `json:"suggestedIntervalMs,omitempty"`
+	// Earcon is a sound to play before SpeechText, and Haptic the guidance
+	// as a vibration, see package haptic. Both are only set along with
+	// SpeechText.
+	Earcon severity.Earcon `json:"earcon,omitempty"`
+	Haptic *haptic.Haptic  `json:"haptic,omitempty"`
+	// AnnotatedImage is the frame with the hazards drawn on it, as a data
+	// URI, for Annotate requests.
+	AnnotatedImage string `json:"annotatedImage,omitempty"`
+}
+
+// SeverityUnchanged is the Severity of a session frame showing the same view
+// as the previous one. The previous guidance still applies.
+const SeverityUnchanged = model.SeverityUnchanged
+
+type hazardRequest struct {
+	Image     string    `json:"image"`
+	SessionID string    `json:"sessionId,omitempty"`
+	Location  *Location `json:"location,omitempty"`
+	Motion    *Motion   `json:"motion,omitempty"`
+	Weather   *Weather  `json:"weather,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Verbosity string    `json:"verbosity,omitempty"`
+	Verbose   bool      `json:"verbose,omitempty"`
+	Debug     bool      `json:"debug,omitempty"`
+	Positions string    `json:"positions,omitempty"`
+	Annotate  bool      `json:"annotate,omitempty"`
+
+	TopHazards        *int             `json:"topHazards,omitempty"`
+	IncludeCategories []model.Category `json:"includeCategories,omitempty"`
+	ExcludeCategories []model.Category `json:"excludeCategories,omitempty"`
+	MobilityMode      string           `json:"mobilityMode,omitempty"`
+}
+
+// DetectHazards analyzes a single camera frame for walking hazards.
+func (c *Client) DetectHazards(ctx context.Context, img []byte) (*HazardResult, error) {
+	return c.DetectHazardsWithOptions(ctx, img, HazardOptions{})
+}
+
+// DetectHazardsWithOptions is DetectHazards with a session and location.
+func (c *Client) DetectHazardsWithOptions(ctx context.Context, img []byte, opts HazardOptions) (*HazardResult, error) {
+	req := hazardRequest{
+		Image:     encodeImage(img),
+		SessionID: opts.SessionID,
+		Location:  opts.Location,
+		Motion:    opts.Motion,
+		Weather:   opts.Weather,
+		Model:     opts.Model,
+		Verbosity: opts.Verbosity,
+		Verbose:   opts.Verbose,
+		Debug:     opts.Debug,
+		Positions: opts.Positions,
+		Annotate:  opts.Annotate,
+
+		TopHazards:        opts.TopHazards,
+		IncludeCategories: opts.IncludeCategories,
+		ExcludeCategories: opts.ExcludeCategories,
+		MobilityMode:      opts.MobilityMode,
+	}
+
+	var result HazardResult
+	if err := c.post(ctx, PathDetectHazards, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// StreamResult is one result of StreamHazards.
+type StreamResult struct {
+	Result *HazardResult
+	Err    error
+}
+
+// StreamHazards analyzes frames from a camera feed as one session. Frames are
+// sent one at a time; frames that arrive while a request is in flight are
+// dropped except for the latest, so results never lag behind the camera.
+// Frames are spaced by the interval the server suggests. The returned
+// channel is closed when frames is closed or ctx is done.
+func (c *Client) StreamHazards(ctx context.Context, frames <-chan []byte, opts HazardOptions) <-chan StreamResult {
+	if opts.SessionID == "" {
+		opts.SessionID = newID()
+	}
+
+	results := make(chan StreamResult)
+	go func() {
+		defer close(results)
+
+		var next time.Time
+		for {
+			var frame []byte
+			select {
+			case <-ctx.Done():
+				return
+			case f, ok := <-frames:
+				if !ok {
+					return
+				}
+				frame = f
+			}
+
+			// Wait out the suggested interval, then send the newest frame
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(next)):
+			}
+			frame, closed := latestFrame(frames, frame)
+
+			sent := time.Now()
+			result, err := c.DetectHazardsWithOptions(ctx, frame, opts)
+			if result != nil {
+				next = sent.Add(time.Duration(result.SuggestedIntervalMs) * time.Millisecond)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case results <- StreamResult{Result: result, Err: err}:
+			}
+
+			if closed {
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// latestFrame drains frames that are already queued and returns the newest
+// one, and whether the channel was closed while draining.
+func latestFrame(frames <-chan []byte, frame []byte) ([]byte, bool) {
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				return frame, true
+			}
+			frame = f
+		default:
+			return frame, false
+		}
+	}
+}
+
+// newID returns a random ID, e.g. for a session or an idempotency key.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,238 @@
+package buddypaws
+
+import (
+	"context"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Ways to read text in another language than the user's, see
+// ObjectOptions.
+const (
+	ForeignTextRead          = "read"
+	ForeignTextTransliterate = "transliterate"
+	ForeignTextTranslate     = "translate"
+)
+
+// IntentReadTable is the ObjectOptions.Intent that reads a table row by
+// row, e.g. a medication schedule, and returns it in ObjectResult.Table.
+const IntentReadTable = "read-table"
+
+// ObjectResult is the response of the object-reader function. Segments
+// splits text read out as written into runs of one script, e.g. Thai and
+// English, for a TTS voice per language; it is only set when there are
+// several. A translated SpeechText keeps the original in OriginalText, and
+// its language, if known, in TranslatedFrom. Truncated is set when the
+// model ran out of time and SpeechText is the beginning of its answer.
+// Objects are the objects the answer is about, for Locate requests; their
+// boxes are in fractions of the whole image. Winner is the image, 1 or 2,
+// that answers a Compare question, nil when neither or both do, and
+// Differences are what tells the two images apart. Table is the table of
+// an IntentReadTable request, which SpeechText reads row by row.
+// Allergens are the allergens of the user's allergy list that a label
+// mentions, for requests with a user; SpeechText then starts with a
+// warning. Conversions are the prices SpeechText reads in another currency
+// than the user's home one, each followed by its converted amount.
+// HasMore is set when SpeechText is a page of a long answer, e.g. a
+// letter, and ContinueReading returns the next one. Pages is the number of
+// pages of a document after AddPage.
+type ObjectResult struct {
+	SpeechText     string             `json:"speechText"`
+	Segments       []TextSegment      `json:"segments,omitempty"`
+	OriginalText   string             `json:"originalText,omitempty"`
+	TranslatedFrom string             `json:"translatedFrom,omitempty"`
+	Truncated      bool               `json:"truncated,omitempty"`
+	Objects        []model.Object     `json:"objects,omitempty"`
+	Winner         *int               `json:"winner,omitempty"`
+	Differences    []string           `json:"differences,omitempty"`
+	Table          *model.Table       `json:"table,omitempty"`
+	Allergens      []string           `json:"allergens,omitempty"`
+	Conversions    []model.Conversion `json:"conversions,omitempty"`
+	HasMore        bool               `json:"hasMore,omitempty"`
+	Pages          int                `json:"pages,omitempty"`
+}
+
+// TextSegment is a run of text in one script. Language is the BCP 47 code
+// of the script when only one language uses it, e.g. "th" for Thai.
+type TextSegment struct {
+	Text     string `json:"text"`
+	Script   string `json:"script"`
+	Language string `json:"language,omitempty"`
+}
+
+// ObjectOptions are the optional inputs of an object-reader request. ROI
+// limits the question to a region of the image, e.g. the label the user
+// points at; JPEG and PNG images are cropped by the server, other formats
+// are read whole. Location lets "where am I" questions name the places
+// around the user. ForeignText is how text in another language than the
+// user's is read, one of the ForeignText constants; it defaults to reading
+// it as written. TranslateTo, a language code such as "en", has the answer
+// translated into that language. Verbosity is one of the Verbosity
+// constants. Locate asks for the bounding boxes of the objects the answer
+// is about, e.g. to highlight them on screen or zoom in. SessionID starts
+// a conversation about the image, for FollowUp questions. Intent is
+// IntentReadTable for a table; questions like "read this table" are read
+// as one without it. HomeCurrency, an ISO 4217 code such as "USD", has
+// prices converted into it; it defaults to the one of the user's profile.
+type ObjectOptions struct {
+	ROI          *model.Region
+	Location     *Location
+	ForeignText  string
+	TranslateTo  string
+	Verbosity    string
+	Locate       bool
+	SessionID    string
+	Intent       string
+	HomeCurrency string
+}
+
+type objectRequest struct {
+	Image       string        `json:"image"`
+	Text        string        `json:"text"`
+	ROI         *model.Region `json:"roi,omitempty"`
+	Location    *Location     `json:"location,omitempty"`
+	ForeignText string        `json:"foreignText,omitempty"`
+	TranslateTo string        `json:"translateTo,omitempty"`
+	Verbosity   string        `json:"verbosity,omitempty"`
+	Locate      bool          `json:"locate,omitempty"`
+	SessionID   string        `json:"sessionId,omitempty"`
+	FollowUp    bool          `json:"followUp,omitempty"`
+
+	CompareImage string `json:"compareImage,omitempty"`
+	Intent       string `json:"intent,omitempty"`
+	HomeCurrency string `json:"homeCurrency,omitempty"`
+
+	ContinueReading bool `json:"continueReading,omitempty"`
+	AddPage         bool `json:"addPage,omitempty"`
+	FinishDocument  bool `json:"finishDocument,omitempty"`
+}
+
+// ReadObject asks about the object in the image; text is the user's
+// question, e.g. "what does this label say".
+func (c *Client) ReadObject(ctx context.Context, img []byte, text string) (*ObjectResult, error) {
+	return c.ReadObjectWithOptions(ctx, img, text, ObjectOptions{})
+}
+
+// ReadObjectRegion is ReadObject limited to a region of the image.
+func (c *Client) ReadObjectRegion(ctx context.Context, img []byte, text string, roi model.Region) (*ObjectResult, error) {
+	return c.ReadObjectWithOptions(ctx, img, text, ObjectOptions{ROI: &roi})
+}
+
+// WhereAmI asks where the user is. With a Places API key configured on the
+// server, the answer names the places around loc that are in view, e.g.
+// "You are near the entrance of Central Station".
+func (c *Client) WhereAmI(ctx context.Context, img []byte, loc Location) (*ObjectResult, error) {
+	return c.ReadObjectWithOptions(ctx, img, "Where am I?", ObjectOptions{Location: &loc})
+}
+
+// ReadObjectWithOptions is ReadObject with a region, location or foreign
+// text handling.
+func (c *Client) ReadObjectWithOptions(ctx context.Context, img []byte, text string, opts ObjectOptions) (*ObjectResult, error) {
+	req := objectRequest{
+		Image:        encodeImage(img),
+		Text:         text,
+		ROI:          opts.ROI,
+		Location:     opts.Location,
+		ForeignText:  opts.ForeignText,
+		TranslateTo:  opts.TranslateTo,
+		Verbosity:    opts.Verbosity,
+		Locate:       opts.Locate,
+		SessionID:    opts.SessionID,
+		Intent:       opts.Intent,
+		HomeCurrency: opts.HomeCurrency,
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// FollowUp asks another question about the image of a conversation
+// started with ObjectOptions.SessionID, e.g. "what's the price of the
+// second one", without uploading it again. The server keeps conversations
+// for a few minutes; an expired one fails with an APIError of status 404,
+// and the image must be sent again.
+func (c *Client) FollowUp(ctx context.Context, sessionID, text string) (*ObjectResult, error) {
+	req := objectRequest{
+		Text:      text,
+		SessionID: sessionID,
+		FollowUp:  true,
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Compare asks a question about two images, e.g. "which of these is decaf"
+// with a photo of each coffee pod, or "which door is open".
+func (c *Client) Compare(ctx context.Context, img1, img2 []byte, text string) (*ObjectResult, error) {
+	req := objectRequest{
+		Image:        encodeImage(img1),
+		Text:         text,
+		CompareImage: encodeImage(img2),
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ContinueReading returns the next page of a long answer in a conversation
+// started with ObjectOptions.SessionID, while ObjectResult.HasMore is set.
+// Past the last page, SpeechText says the text has ended. An expired
+// conversation fails with an APIError of status 404.
+func (c *Client) ContinueReading(ctx context.Context, sessionID string) (*ObjectResult, error) {
+	req := objectRequest{
+		SessionID:       sessionID,
+		ContinueReading: true,
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// AddPage adds a photographed page to the document of a conversation, e.g.
+// a letter or a bill of several pages, starting it with the first page.
+// Its pages are read once FinishDocument is called; a document has at most
+// 10 pages, and a full one fails with an APIError of status 409.
+func (c *Client) AddPage(ctx context.Context, sessionID string, img []byte) (*ObjectResult, error) {
+	req := objectRequest{
+		Image:     encodeImage(img),
+		SessionID: sessionID,
+		AddPage:   true,
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// FinishDocument reads the pages added with AddPage as one document, with
+// the text photographed twice read once. text is the user's question, by
+// default to read the document. A long document is read a page at a time,
+// see ContinueReading.
+func (c *Client) FinishDocument(ctx context.Context, sessionID, text string) (*ObjectResult, error) {
+	req := objectRequest{
+		Text:           text,
+		SessionID:      sessionID,
+		FinishDocument: true,
+	}
+
+	var result ObjectResult
+	if err := c.post(ctx, PathReadObject, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
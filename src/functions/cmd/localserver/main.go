@@ -0,0 +1,38 @@
+// Command localserver serves every function on one port for local
+// development:
+//
+//	go run ./cmd/localserver
+//	curl -X POST localhost:8080/detect-hazards -H "X-API-Key: $API_KEY" -H "Content-Type: application/json" -d @frame.json
+//
+// Functions read the same environment variables as when deployed. PORT sets
+// the listen port (default 8080).
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	api "example.com/buddy-paws"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	mux := http.NewServeMux()
+	for _, f := range api.Functions {
+		// The trailing-slash pattern also serves sub-paths such as
+		// /detect-hazards/version and /detect-hazards/v2.
+		mux.Handle(f.Path, f)
+		mux.Handle(f.Path+"/", f)
+		log.Printf("%s -> http://localhost:%s%s", f.Name, port, f.Path)
+	}
+
+	log.Printf("Listening on :%s", port)
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
+		log.Fatal(err)
+	}
+}
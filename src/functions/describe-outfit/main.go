@@ -0,0 +1,329 @@
+package describeoutfit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request holds one garment image, or two when the user asks whether the
+// garments go together.
+type Request struct {
+	Image        string `json:"image"`
+	CompareImage string `json:"compareImage,omitempty"`
+	Model        string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string    `json:"speechText"`
+	Garments   []Garment `json:"garments"`
+	Match      *Match    `json:"match,omitempty"`
+}
+
+type OutfitDescription struct {
+	Garments []Garment `json:"garments"`
+	Match    *Match    `json:"match"`
+}
+
+// Garment is one clothing item. Image is 1 or 2, the image it appears in.
+type Garment struct {
+	Image   int      `json:"image"`
+	Item    string   `json:"item"`
+	Colors  []string `json:"colors"`
+	Pattern string   `json:"pattern"`
+	Details string   `json:"details"`
+}
+
+type Match struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+const (
+	VerdictGood  = "GOOD"
+	VerdictOK    = "OK"
+	VerdictClash = "CLASH"
+)
+
+var verdictPhrases = map[string]string{
+	VerdictGood:  "These go well together.",
+	VerdictOK:    "These can go together.",
+	VerdictClash: "These don't really go together.",
+}
+
+// DescribeOutfit is the Cloud Function entry point
+func DescribeOutfit(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "describe-outfit"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	compare := req.CompareImage != ""
+	promptName := "describe-outfit/describe"
+	if compare {
+		promptName = "describe-outfit/compare"
+	}
+
+	prompt, err := prompts.Render(ctx, promptName, promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+
+	parts := []provider.Part{provider.Text(prompt), provider.ImageData(format, imageData)}
+
+	if compare {
+		compareData, compareFormat, err := processBase64Image(req.CompareImage)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid compare image data: %v", err))
+			return
+		}
+		parts = []provider.Part{
+			provider.Text(prompt),
+			provider.Text("Image 1:"), provider.ImageData(format, imageData),
+			provider.Text("Image 2:"), provider.ImageData(compareFormat, compareData),
+		}
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.3,
+		MaxOutputTokens: 1024,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	jsonStr, err := model.Generate(ctx, parts...)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var description OutfitDescription
+	err = json.Unmarshal([]byte(jsonStr), &description)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	response := Response{Garments: description.Garments}
+	if response.Garments == nil {
+		response.Garments = []Garment{}
+	}
+	if compare && description.Match != nil {
+		description.Match.Verdict = strings.ToUpper(description.Match.Verdict)
+		if _, ok := verdictPhrases[description.Match.Verdict]; ok {
+			response.Match = description.Match
+		}
+	}
+	response.SpeechText = describeOutfit(response, compare)
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+func describeOutfit(response Response, compare bool) string {
+	if len(response.Garments) == 0 {
+		return "I can't see any clothing. Hold the garment up in front of the camera, with good light."
+	}
+
+	var sentences []string
+	for _, g := range response.Garments {
+		sentences = append(sentences, describeGarment(g))
+	}
+
+	if compare {
+		if response.Match == nil {
+			sentences = append(sentences, "I couldn't compare them. Make sure each picture shows one garment clearly.")
+		} else {
+			sentences = append(sentences, verdictPhrases[response.Match.Verdict])
+			if response.Match.Reason != "" {
+				sentences = append(sentences, strings.TrimSuffix(response.Match.Reason, ".")+".")
+			}
+		}
+	}
+
+	return strings.Join(sentences, " ")
+}
+
+func describeGarment(g Garment) string {
+	var words []string
+	if len(g.Colors) > 0 {
+		words = append(words, joinList(g.Colors))
+	}
+	if g.Pattern != "" && !strings.EqualFold(g.Pattern, "solid") {
+		words = append(words, g.Pattern)
+	}
+	words = append(words, g.Item)
+
+	phrase := strings.Join(words, " ")
+	article := "A "
+	if phrase != "" && strings.ContainsAny(strings.ToLower(phrase[:1]), "aeiou") {
+		article = "An "
+	}
+
+	sentence := article + phrase
+	if g.Details != "" {
+		sentence += ", " + strings.TrimSuffix(g.Details, ".")
+	}
+	return sentence + "."
+}
+
+func joinList(items []string) string {
+	switch len(items) {
+	case 1:
+		return items[0]
+	case 2:
+		return items[0] + " and " + items[1]
+	default:
+		return strings.Join(items[:len(items)-1], ", ") + " and " + items[len(items)-1]
+	}
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package detecthazards
+
+import (
+	"encoding/base64"
+	"image/color"
+
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// severityColors are the colors hazards are drawn in, by severity.
+var severityColors = map[model.Severity]color.RGBA{
+	model.SeverityHigh:   {0xe5, 0x39, 0x35, 0xff},
+	model.SeverityMedium: {0xff, 0xb3, 0x00, 0xff},
+	model.SeverityLow:    {0x43, 0xa0, 0x47, 0xff},
+}
+
+// annotations returns the hazards as boxes to draw on the frame, labeled
+// with their severity and type. A hazard the model gave no box for is
+// drawn around the part of the frame of its position.
+func annotations(hazards []Hazard) []imagedata.Annotation {
+	var boxes []imagedata.Annotation
+	for _, h := range hazards {
+		region, ok := positionRegions[h.Position]
+		if box := validBox(h.Box); box != nil {
+			region, ok = *box, true
+		}
+		if !ok {
+			continue
+		}
+
+		c, ok := severityColors[h.Severity]
+		if !ok {
+			c = severityColors[model.SeverityMedium]
+		}
+		boxes = append(boxes, imagedata.Annotation{
+			Region: region,
+			Label:  string(h.Severity) + " " + h.Type,
+			Color:  c,
+		})
+	}
+	return boxes
+}
+
+// dataURI returns an image as a data URI, as requests send them.
+func dataURI(data []byte, format string) string {
+	return "data:image/" + format + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
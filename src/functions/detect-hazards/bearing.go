@@ -0,0 +1,70 @@
+package detecthazards
+
+import (
+	"math"
+	"strings"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// fieldOfView is the horizontal field of view of a phone camera, in
+// degrees.
+const fieldOfView = 70
+
+// positionBearings are the bearings of the coarse positions, the middle of
+// each third of the field of view.
+var positionBearings = map[model.Position]int{
+	model.PositionFront: 0,
+	model.PositionLeft:  -23,
+	model.PositionRight: 23,
+}
+
+// hazardBearing is the bearing of a hazard in degrees off the camera axis,
+// negative to the left, from its clock position if the model gave one, else
+// from the middle of its box, else from its position.
+func hazardBearing(h Hazard) *int {
+	if clock := validClock(h.Clock); clock != 0 {
+		bearing := clockBearing(clock)
+		return &bearing
+	}
+	if box := validBox(h.Box); box != nil {
+		bearing := int(math.Round((box.X + box.W/2 - 0.5) * fieldOfView))
+		return &bearing
+	}
+	if bearing, ok := positionBearings[h.Position]; ok {
+		return &bearing
+	}
+	return nil
+}
+
+// clockBearing is the bearing of a clock position, e.g. -60 for 10 o'clock.
+func clockBearing(clock int) int {
+	bearing := clock % 12 * 30
+	if bearing > 180 {
+		bearing -= 360
+	}
+	return bearing
+}
+
+// directionBearing is the bearing of the way safe_direction points, in
+// degrees off the camera axis, negative to the left. The first direction
+// mentioned counts, "slightly" turning a third as far. It returns false
+// when safe_direction gives no direction, e.g. for a STOP.
+func directionBearing(safeDirection string) (int, bool) {
+	upper := strings.ToUpper(safeDirection)
+
+	bearing, found, first := 0, false, len(upper)
+	for keyword, angle := range map[string]int{"STRAIGHT": 0, "LEFT": -90, "RIGHT": 90} {
+		if i := strings.Index(upper, keyword); i >= 0 && i < first {
+			bearing, found, first = angle, true, i
+		}
+	}
+	if !found {
+		return 0, false
+	}
+
+	if bearing != 0 && strings.Contains(upper[:first], "SLIGHTLY") {
+		bearing /= 3
+	}
+	return bearing, true
+}
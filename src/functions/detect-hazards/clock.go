@@ -0,0 +1,99 @@
+package detecthazards
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Position formats, see HazardDetectionRequest.Positions.
+const (
+	positionsRelative = "relative"
+	positionsClock    = "clock"
+)
+
+var positionFormats = map[string]bool{
+	"":                true,
+	positionsRelative: true,
+	positionsClock:    true,
+}
+
+// clockContext asks the model for clock positions, in the hazards and in
+// safe_direction.
+const clockContext = `# Positions:
+The user prefers clock positions: 12 o'clock is straight ahead, 3 o'clock to the right and 9 o'clock to the left. Give each hazard a "clock" field, the hour from 1 to 12, and name hazards in safe_direction by clock position and distance in meters, e.g. "CAUTION, car at 2 o'clock, about 4 meters."`
+
+// positionClocks are the clock positions of the coarse positions, for
+// hazards the model gave no clock position for.
+var positionClocks = map[model.Position]int{
+	model.PositionFront: 12,
+	model.PositionLeft:  10,
+	model.PositionRight: 2,
+}
+
+// validClock returns a clock position given by the model, 0 when it is out
+// of range.
+func validClock(clock *int) int {
+	if clock == nil || *clock < 1 || *clock > 12 {
+		return 0
+	}
+	return *clock
+}
+
+// withClocks fills in the clock position of the hazards without one.
+func withClocks(hazards []model.Hazard) []model.Hazard {
+	for i := range hazards {
+		if hazards[i].Clock == 0 {
+			hazards[i].Clock = positionClocks[hazards[i].Position]
+		}
+	}
+	return hazards
+}
+
+// withClockDistance appends the clock position and distance of the nearest
+// hazard to the guidance, e.g. "Bicycle at 12 o'clock, about 2 meters.",
+// unless the model already gave a clock position or there is nothing to
+// say.
+func withClockDistance(speechText string, nearest Hazard, steps int) string {
+	if speechText == "" || strings.Contains(strings.ToLower(speechText), "o'clock") {
+		return speechText
+	}
+
+	clock := validClock(nearest.Clock)
+	if clock == 0 {
+		clock = positionClocks[nearest.Position]
+	}
+	if clock == 0 {
+		clock = 12
+	}
+
+	name := strings.TrimSpace(nearest.Type)
+	if name == "" {
+		name = "hazard"
+	}
+	first, size := utf8.DecodeRuneInString(name)
+	name = string(unicode.ToUpper(first)) + name[size:]
+
+	return fmt.Sprintf("%s %s at %d o'clock, %s.", strings.TrimSpace(speechText), name, clock, spokenMeters(nearest, steps))
+}
+
+// spokenMeters is the distance of hazard in meters, as measured or from
+// the near end of the model's range, else from its steps.
+func spokenMeters(hazard Hazard, steps int) string {
+	low, _, _ := strings.Cut(hazard.MetersRange, "-")
+	meters, err := strconv.ParseFloat(strings.TrimSpace(low), 64)
+	if err != nil || meters < 0 {
+		meters = float64(steps) * metersPerStep
+	}
+
+	rounded := max(int(math.Round(meters)), 1)
+	if rounded == 1 {
+		return "about 1 meter"
+	}
+	return fmt.Sprintf("about %d meters", rounded)
+}
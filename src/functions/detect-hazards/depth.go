@@ -0,0 +1,57 @@
+package detecthazards
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+
+	"example.com/buddy-paws/internal/depth"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// positionRegions are the parts of the frame a hazard at each position is
+// measured in: a third of the width, without the top of the frame, mostly
+// beyond the path, and the bottom, the ground at the user's feet.
+var positionRegions = map[model.Position]model.Region{
+	model.PositionLeft:  {X: 0, Y: 0.2, W: 1.0 / 3, H: 0.6},
+	model.PositionFront: {X: 1.0 / 3, Y: 0.2, W: 1.0 / 3, H: 0.6},
+	model.PositionRight: {X: 2.0 / 3, Y: 0.2, W: 1.0 / 3, H: 0.6},
+}
+
+// measureDistances replaces the distances the model guessed with those of
+// the depth map, where it has enough samples, in the hazard's box or else
+// the part of the frame of its position. It returns the number of hazards
+// measured.
+func measureDistances(hazards []Hazard, samples *depth.Samples) int {
+	measured := 0
+	for i := range hazards {
+		region, ok := positionRegions[hazards[i].Position]
+		if box := validBox(hazards[i].Box); box != nil {
+			region, ok = *box, true
+		}
+		if !ok {
+			continue
+		}
+		meters, ok := samples.Distance(region)
+		if !ok {
+			continue
+		}
+
+		steps := max(int(math.Round(meters/metersPerStep)), 1)
+		hazards[i].Steps = &steps
+		hazards[i].MetersRange = strconv.FormatFloat(meters, 'f', 1, 64)
+		hazards[i].measured = true
+		measured++
+	}
+	return measured
+}
+
+// stepCountPattern matches the distances the model puts in its guidance,
+// e.g. "three steps".
+var stepCountPattern = regexp.MustCompile(`(?i)\s*\b(\d+|one|two|three|four|five|six|seven|eight|nine|ten|a few|several) steps?\b`)
+
+// withoutStepCounts removes the distances the model guessed from its
+// guidance, so that the measured one replaces them, see withDistance.
+func withoutStepCounts(speechText string) string {
+	return stepCountPattern.ReplaceAllString(speechText, "")
+}
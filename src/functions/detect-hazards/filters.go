@@ -0,0 +1,146 @@
+package detecthazards
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"example.com/buddy-paws/internal/calibration"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// defaultTopHazards is how many hazards the prompts ask for.
+const defaultTopHazards = 3
+
+// hazardFilter is the hazards a user wants to hear about, see
+// HazardDetectionRequest.TopHazards.
+type hazardFilter struct {
+	top     int
+	include map[model.Category]bool
+	exclude map[model.Category]bool
+}
+
+// newHazardFilter returns the filter of a request. The number of hazards
+// is the request's, else the topHazards tunable, else defaultTopHazards.
+func newHazardFilter(req HazardDetectionRequest, tunables settings.Settings) (hazardFilter, error) {
+	filter := hazardFilter{top: defaultTopHazards}
+	switch {
+	case req.TopHazards != nil:
+		if *req.TopHazards < 1 || *req.TopHazards > settings.MaxTopHazards {
+			return filter, fmt.Errorf("Invalid topHazards, expected 1 to %d", settings.MaxTopHazards)
+		}
+		filter.top = *req.TopHazards
+	case tunables.TopHazards != nil:
+		filter.top = *tunables.TopHazards
+	}
+
+	var err error
+	if filter.include, err = categorySet(req.IncludeCategories); err != nil {
+		return filter, fmt.Errorf("Invalid includeCategories: %v", err)
+	}
+	if filter.exclude, err = categorySet(req.ExcludeCategories); err != nil {
+		return filter, fmt.Errorf("Invalid excludeCategories: %v", err)
+	}
+	return filter, nil
+}
+
+func categorySet(names []string) (map[model.Category]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := make(map[model.Category]bool, len(names))
+	for _, name := range names {
+		category, ok := model.CategoryOf(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+		set[category] = true
+	}
+	return set, nil
+}
+
+// wanted reports whether the user wants to hear about a hazard. HIGH
+// hazards are always wanted, whatever their category, as are hazards of
+// no known category.
+func (f hazardFilter) wanted(h Hazard) bool {
+	category, ok := model.CategoryOf(h.Type)
+	if !ok || h.Severity == model.SeverityHigh {
+		return true
+	}
+	if f.include != nil && !f.include[category] {
+		return false
+	}
+	return !f.exclude[category]
+}
+
+// apply returns the wanted hazards, at most top of them, the most severe
+// first and in the model's order otherwise.
+func (f hazardFilter) apply(hazards []Hazard) []Hazard {
+	wanted := hazards[:0]
+	for _, h := range hazards {
+		if f.wanted(h) {
+			wanted = append(wanted, h)
+		}
+	}
+
+	if len(wanted) > f.top {
+		sort.SliceStable(wanted, func(i, j int) bool {
+			return wanted[i].Severity.Rank() > wanted[j].Severity.Rank()
+		})
+		wanted = wanted[:f.top]
+	}
+	return wanted
+}
+
+// calibrate rates the hazards as the user's profile says, dropping those
+// it ignores, and returns them with the most severe rating.
+func calibrate(hazards []Hazard, profile calibration.Profile) ([]Hazard, model.Severity) {
+	rated := hazards[:0]
+	var worst model.Severity
+	for _, h := range hazards {
+		severity, ok := profile.Apply(h.Type, h.Description, h.Severity)
+		if !ok {
+			continue
+		}
+		h.Severity = severity
+		if severity.Rank() > worst.Rank() {
+			worst = severity
+		}
+		rated = append(rated, h)
+	}
+	return rated, worst
+}
+
+// context renders the filter as prompt text, which overrides the prompt's
+// own limit on hazards. It is empty for a request without a filter.
+func (f hazardFilter) context() string {
+	var lines []string
+	if f.top != defaultTopHazards {
+		lines = append(lines, fmt.Sprintf("Return at most %d hazards, the most severe first, instead of the top %d.", f.top, defaultTopHazards))
+	}
+	if f.include != nil {
+		lines = append(lines, fmt.Sprintf("Only report hazards of these categories: %s.", categoryList(f.include)))
+	}
+	if f.exclude != nil {
+		lines = append(lines, fmt.Sprintf("Do not report or mention hazards of these categories: %s.", categoryList(f.exclude)))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	if f.include != nil || f.exclude != nil {
+		lines = append(lines, "Always report HIGH severity hazards and give directions around them, whatever their category.")
+	}
+	return "# Hazards to report:\n" + strings.Join(lines, "\n")
+}
+
+// categoryList lists the categories of set in the order of the prompt.
+func categoryList(set map[model.Category]bool) string {
+	var names []string
+	for _, category := range model.Categories {
+		if set[category] {
+			names = append(names, string(category))
+		}
+	}
+	return strings.Join(names, ", ")
+}
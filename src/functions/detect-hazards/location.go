@@ -0,0 +1,328 @@
+package detecthazards
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Location is the optional GPS fix of the phone. Heading is the compass
+// direction the camera faces, in degrees clockwise from north.
+type Location struct {
+	Lat     float64  `json:"lat"`
+	Lng     float64  `json:"lng"`
+	Heading *float64 `json:"heading,omitempty"`
+}
+
+const (
+	// osmRadius is the search radius around the user, in meters.
+	osmRadius = 30
+	// osmTimeout bounds the map lookup; the hazard analysis must not wait
+	// on it for long.
+	osmTimeout  = 2 * time.Second
+	earthRadius = 6371000.0
+
+	// osmGrid is the size of the grid cells sharing a lookup, in degrees,
+	// about 20 m, and osmGridMargin the distance in meters from the center
+	// of a cell to beyond its corners.
+	osmGrid       = 0.0002
+	osmGridMargin = 20
+	// osmCacheTTL is how long the places of a cell are reused, and
+	// osmCacheSize how many cells are kept.
+	osmCacheTTL  = time.Hour
+	osmCacheSize = 4096
+)
+
+var compassPoints = []string{"north", "north-east", "east", "south-east", "south", "south-west", "west", "north-west"}
+
+// osmFeature is a map feature near the user that matters for walking.
+type osmFeature struct {
+	Kind     string
+	Name     string
+	Distance float64
+	Bearing  float64
+}
+
+// osmPlace is a mapped place, as cached.
+type osmPlace struct {
+	Kind     string
+	Name     string
+	Lat, Lng float64
+}
+
+type cachedPlaces struct {
+	places    []osmPlace
+	fetchedAt time.Time
+}
+
+var (
+	osmMu    sync.Mutex
+	osmCache = map[string]cachedPlaces{}
+)
+
+type overpassResponse struct {
+	Elements []struct {
+		Lat    float64 `json:"lat"`
+		Lon    float64 `json:"lon"`
+		Center *struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"center"`
+		Tags map[string]string `json:"tags"`
+	} `json:"elements"`
+}
+
+func (l *Location) valid() bool {
+	if l.Lat < -90 || l.Lat > 90 || l.Lng < -180 || l.Lng > 180 {
+		return false
+	}
+	return l.Heading == nil || (*l.Heading >= 0 && *l.Heading < 360)
+}
+
+// nearbyFeatures returns the crossings, traffic signals, stairways and
+// transit stops around the location, nearest first, from OpenStreetMap
+// (Overpass API). Map data rarely changes, so lookups are cached per area.
+func nearbyFeatures(ctx context.Context, loc *Location) ([]osmFeature, error) {
+	places, err := nearbyPlaces(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	var features []osmFeature
+	for _, p := range places {
+		distance := distanceMeters(loc.Lat, loc.Lng, p.Lat, p.Lng)
+		if distance > osmRadius {
+			continue
+		}
+		features = append(features, osmFeature{
+			Kind:     p.Kind,
+			Name:     p.Name,
+			Distance: distance,
+			Bearing:  bearingDegrees(loc.Lat, loc.Lng, p.Lat, p.Lng),
+		})
+	}
+
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Distance < features[j].Distance
+	})
+
+	return features, nil
+}
+
+// nearbyPlaces returns the mapped places of the grid cell of the location,
+// and around it, from the cache or Overpass.
+func nearbyPlaces(ctx context.Context, loc *Location) ([]osmPlace, error) {
+	lat := math.Round(loc.Lat/osmGrid) * osmGrid
+	lng := math.Round(loc.Lng/osmGrid) * osmGrid
+	key := fmt.Sprintf("%.4f,%.4f", lat, lng)
+
+	osmMu.Lock()
+	entry, ok := osmCache[key]
+	osmMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < osmCacheTTL {
+		return entry.places, nil
+	}
+
+	places, err := queryOverpass(ctx, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+
+	osmMu.Lock()
+	if len(osmCache) >= osmCacheSize {
+		// Cells are cheap to fetch again; start over rather than track use
+		clear(osmCache)
+	}
+	osmCache[key] = cachedPlaces{places: places, fetchedAt: time.Now()}
+	osmMu.Unlock()
+
+	return places, nil
+}
+
+// queryOverpass fetches the places within reach of any point of the grid
+// cell centered on lat, lng.
+func queryOverpass(ctx context.Context, lat, lng float64) ([]osmPlace, error) {
+	endpoint := config.Get().OverpassURL
+
+	ctx, cancel := context.WithTimeout(ctx, osmTimeout)
+	defer cancel()
+
+	around := fmt.Sprintf("(around:%d,%f,%f)", osmRadius+osmGridMargin, lat, lng)
+	query := fmt.Sprintf(`[out:json][timeout:2];
+(
+  node%[1]s[highway=crossing];
+  node%[1]s[highway=traffic_signals];
+  way%[1]s[highway=steps];
+  node%[1]s[highway=bus_stop];
+  node%[1]s[public_transport=platform];
+  node%[1]s[railway=subway_entrance];
+);
+out center;`, around)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(url.Values{"data": {query}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("overpass returned %s", resp.Status)
+	}
+
+	var result overpassResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	places := []osmPlace{}
+	for _, e := range result.Elements {
+		lat, lon := e.Lat, e.Lon
+		if e.Center != nil {
+			lat, lon = e.Center.Lat, e.Center.Lon
+		}
+		kind := featureKind(e.Tags)
+		if kind == "" {
+			continue
+		}
+		places = append(places, osmPlace{Kind: kind, Name: e.Tags["name"], Lat: lat, Lng: lon})
+	}
+	return places, nil
+}
+
+func featureKind(tags map[string]string) string {
+	switch {
+	case tags["highway"] == "crossing":
+		if tags["crossing"] == "traffic_signals" {
+			return "pedestrian crossing with traffic lights"
+		}
+		return "pedestrian crossing"
+	case tags["highway"] == "traffic_signals":
+		return "intersection with traffic lights"
+	case tags["highway"] == "steps":
+		return "stairway"
+	case tags["railway"] == "subway_entrance":
+		return "subway entrance"
+	case tags["highway"] == "bus_stop", tags["public_transport"] == "platform":
+		return "transit stop"
+	default:
+		return ""
+	}
+}
+
+// locationContext renders the location as extra prompt text. The model is
+// told to use map data only to confirm what it sees.
+func locationContext(loc *Location, features []osmFeature) string {
+	var lines []string
+	lines = append(lines, "# Location Context:")
+
+	if loc.Heading != nil {
+		lines = append(lines, fmt.Sprintf("The user is facing %s (%.0f degrees).", compassPoint(*loc.Heading), *loc.Heading))
+	}
+
+	if len(features) == 0 {
+		lines = append(lines, "Map data shows no crossings, stairways or transit stops nearby.")
+	} else {
+		lines = append(lines, "Map data shows nearby:")
+		for _, f := range features {
+			where := "to the " + compassPoint(f.Bearing)
+			if loc.Heading != nil {
+				where = relativeDirection(f.Bearing - *loc.Heading)
+			}
+			name := ""
+			if f.Name != "" {
+				name = fmt.Sprintf(" (%s)", f.Name)
+			}
+			lines = append(lines, fmt.Sprintf("- a %s%s about %.0f meters %s", f.Kind, name, f.Distance, where))
+		}
+	}
+
+	lines = append(lines, "Use the map data to interpret what is visible, for example to recognize a crossing or stairway earlier. Never report a hazard that is not visible in the image.")
+
+	return strings.Join(lines, "\n")
+}
+
+// compassDirection turns the guidance in safe_direction into a compass
+// point, using the heading of the camera.
+func compassDirection(safeDirection string, heading float64) string {
+	offset, ok := directionBearing(safeDirection)
+	if !ok {
+		return ""
+	}
+	return compassPoint(heading + float64(offset))
+}
+
+func compassPoint(degrees float64) string {
+	degrees = math.Mod(math.Mod(degrees, 360)+360, 360)
+	return compassPoints[int(math.Round(degrees/45))%len(compassPoints)]
+}
+
+// upcomingAngle is how far off the heading, in degrees, a feature is
+// still on the way.
+const upcomingAngle = 60
+
+// upcomingFeatures returns the features ahead of a user facing heading,
+// nearest first.
+func upcomingFeatures(features []osmFeature, heading float64) []model.Feature {
+	var upcoming []model.Feature
+	for _, f := range features {
+		offset := math.Mod(f.Bearing-heading+540, 360) - 180
+		if math.Abs(offset) > upcomingAngle {
+			continue
+		}
+		upcoming = append(upcoming, model.Feature{
+			Kind:      f.Kind,
+			Name:      f.Name,
+			Meters:    int(math.Round(f.Distance)),
+			Direction: relativeDirection(offset),
+		})
+	}
+	return upcoming
+}
+
+func relativeDirection(angle float64) string {
+	angle = math.Mod(math.Mod(angle, 360)+360, 360)
+	switch {
+	case angle < 30 || angle >= 330:
+		return "ahead"
+	case angle < 150:
+		return "to the right"
+	case angle < 210:
+		return "behind"
+	default:
+		return "to the left"
+	}
+}
+
+func distanceMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func bearingDegrees(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
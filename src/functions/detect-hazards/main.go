@@ -2,59 +2,180 @@ package detecthazards
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"cloud.google.com/go/logging"
 	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+
+	"example.com/buddy-paws/internal/analytics"
+	"example.com/buddy-paws/internal/apiversion"
+	"example.com/buddy-paws/internal/archive"
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/calibration"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/consensus"
+	"example.com/buddy-paws/internal/consent"
+	"example.com/buddy-paws/internal/depth"
+	"example.com/buddy-paws/internal/experiments"
+	"example.com/buddy-paws/internal/framecache"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/pacing"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/internal/verbosity"
+	"example.com/buddy-paws/pkg/apierror"
+	"example.com/buddy-paws/pkg/haptic"
+	"example.com/buddy-paws/pkg/model"
+	"example.com/buddy-paws/pkg/severity"
 )
 
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v5"
+
+// HazardDetectionRequest is a single camera frame. Frames sharing a SessionID
+// are tracked together so known hazards aren't announced on every frame.
 type HazardDetectionRequest struct {
-	Image string `json:"image"`
+	Image     string    `json:"image"`
+	SessionID string    `json:"sessionId"`
+	Location  *Location `json:"location,omitempty"`
+	Motion    *Motion   `json:"motion,omitempty"`
+	// Weather overrides the weather looked up from the location.
+	Weather *Weather `json:"weather,omitempty"`
+	// Depth is the depth map of the frame, from phones that have one. It
+	// overrides the distances the model estimates, see package depth.
+	Depth *depth.Map `json:"depth,omitempty"`
+	Model string     `json:"model,omitempty"`
+	// Verbosity is "terse" for continuous navigation, "normal" or
+	// "detailed" for exploring. It defaults to the deployment's VERBOSITY.
+	Verbosity string `json:"verbosity,omitempty"`
+	Verbose   bool   `json:"verbose,omitempty"`
+	// Positions is "clock" for hazard positions as clock positions, "at 2
+	// o'clock", in the hazards and the speech, or "relative" (the default)
+	// for LEFT, RIGHT and ahead.
+	Positions string `json:"positions,omitempty"`
+	// Debug archives the frame and the model answer, see package archive.
+	Debug bool `json:"debug,omitempty"`
+	// Annotate returns the frame with the hazards drawn on it, for
+	// low-vision users.
+	Annotate bool `json:"annotate,omitempty"`
+	// TopHazards caps the hazards reported, by default to the topHazards
+	// tunable, see package settings, else to 3, and IncludeCategories and
+	// ExcludeCategories, e.g. "Environmental Hazards", limit them to some
+	// categories, for users who want less chatty guidance. HIGH hazards
+	// are reported whatever their category.
+	TopHazards        *int     `json:"topHazards,omitempty"`
+	IncludeCategories []string `json:"includeCategories,omitempty"`
+	ExcludeCategories []string `json:"excludeCategories,omitempty"`
+	// MobilityMode is "cane" (the default), "guide-dog", with which the
+	// obstacles the dog leads around aren't announced, or "wheelchair",
+	// with which steps, curbs and slopes ahead are barriers.
+	MobilityMode string `json:"mobilityMode,omitempty"`
 }
 
+// HazardDetectionResponse is the guidance for a frame. Degraded is set when
+// the frame couldn't be analyzed and the guidance is a generic caution.
+// Severity is model.SeverityUnchanged, with no speech, when a session frame
+// shows the same view as the last analyzed one. Rescan is set when the model
+// wasn't confident enough to give directions, LowConfidence when the
+// consensus samples disagreed on the severity, see package consensus.
+// Upcoming are the mapped crossings, stairways and transit stops ahead of
+// the user, before the camera sees them. BearingDegrees is the way the
+// guidance points in degrees off the camera axis, negative to the left, for
+// clients steering by compass. Hazards is only returned for verbose
+// requests, DebugPath for archived ones, and AnnotatedImage, a data URI of
+// the frame with the hazards drawn on it, for annotate ones.
 type HazardDetectionResponse struct {
-	SpeechText string `json:"speechText"`
-	Severity   string `json:"severity"`
+	SpeechText       string          `json:"speechText"`
+	Severity         model.Severity  `json:"severity"`
+	NearestSteps     *int            `json:"nearestSteps,omitempty"`
+	CompassDirection string          `json:"compassDirection,omitempty"`
+	BearingDegrees   *int            `json:"bearingDegrees,omitempty"`
+	Confidence       *float64        `json:"confidence,omitempty"`
+	Rescan           bool            `json:"rescan,omitempty"`
+	LowConfidence    bool            `json:"lowConfidence,omitempty"`
+	Upcoming         []model.Feature `json:"upcoming,omitempty"`
+	Hazards          []model.Hazard  `json:"hazards,omitempty"`
+	Degraded         bool            `json:"degraded,omitempty"`
+	DebugPath        string          `json:"debugPath,omitempty"`
+	// SuggestedIntervalMs is how long the client should wait before
+	// sending the next frame, see package pacing.
+	SuggestedIntervalMs int64 `json:"suggestedIntervalMs,omitempty"`
+	// Earcon is a sound to play before the speech, and Haptic the
+	// guidance as a vibration, for users with the speech muted. Both are
+	// only set along with speech.
+	Earcon         severity.Earcon `json:"earcon,omitempty"`
+	Haptic         *haptic.Haptic  `json:"haptic,omitempty"`
+	AnnotatedImage string          `json:"annotatedImage,omitempty"`
+}
+
+// minConfidence is the overall confidence below which the user is asked to
+// re-scan instead of being given directions.
+const minConfidence = 0.5
+
+const rescanSpeech = "CAUTION, Buddy can't see the path clearly. Please re-scan slowly."
+
+// unavailableResponse is returned when no model could analyze the frame.
+var unavailableResponse = HazardDetectionResponse{
+	SpeechText: "Caution, analysis unavailable, proceed carefully.",
+	Severity:   model.SeverityMedium,
+	Degraded:   true,
 }
 
+// HazardDetection is the model's answer. Confidence (0-1) is how sure the
+// model is of SafeDirection; older prompts don't give one.
 type HazardDetection struct {
-	Hazards       []Hazard `json:"hazards"`
-	Severity      string   `json:"severity"`
-	SafeDirection string   `json:"safe_direction"`
+	Hazards       []Hazard       `json:"hazards"`
+	Severity      model.Severity `json:"severity"`
+	Confidence    *float64       `json:"confidence,omitempty"`
+	SafeDirection string         `json:"safe_direction"`
 }
 
 type Hazard struct {
-	Position    string `json:"position"`
-	Type        string `json:"type"`
-	Severity    string `json:"severity"`
-	Description string `json:"description"`
+	ID          string         `json:"id,omitempty"`
+	Position    model.Position `json:"position"`
+	Type        string         `json:"type"`
+	Severity    model.Severity `json:"severity"`
+	Description string         `json:"description"`
+	Clock       *int           `json:"clock,omitempty"`
+	Steps       *int           `json:"steps,omitempty"`
+	MetersRange string         `json:"meters_range,omitempty"`
+	Confidence  *float64       `json:"confidence,omitempty"`
+	Box         *model.Region  `json:"box,omitempty"`
+
+	// measured is set when the distance is from the depth map
+	measured bool
 }
 
 // DetectHazards is the Cloud Function entry point
 func DetectHazards(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
+	start := time.Now()
 
-	projectID := os.Getenv("PROJECT_ID")
-	vertexApiKey := os.Getenv("VERTEX_AI_API_KEY")
-	modelName := os.Getenv("MODEL_NAME")
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
 
-	// Creates a client.
-	logClient, err := logging.NewClient(ctx, projectID)
+	// Creates a logger.
+	logName := "detect-hazards"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
-	defer logClient.Close()
-
-	logName := "detect-hazards"
-	logger := logClient.Logger(logName).StandardLogger(logging.Info)
+	defer closeLog()
 
 	// Handle CORS
 	if r.Method == http.MethodOptions {
@@ -65,387 +186,689 @@ func DetectHazards(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for the main request
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
 	// Verify method
 	if r.Method != http.MethodPost {
-		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	// Verify API key
 	if err := validateAPIKey(r); err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
 		return
 	}
 
 	// Parse request
 	var req HazardDetectionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	imageData, format, err := processBase64Image(req.Image)
+	// Response shape, see package apiversion
+	version := apiversion.FromContext(r.Context())
+
+	if req.SessionID != "" && !sessionIDPattern.MatchString(req.SessionID) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid sessionId")
+		return
+	}
+
+	// Experiment variant, assigned by session so a walk sees one
+	// configuration. Its model is the default a request may override, and
+	// the spend guardrail has the last word on either.
+	experiment := experiments.Assign(req.SessionID)
+	if experiment.Experiment != "" {
+		w.Header().Set("X-Experiment-Variant", experiment.Label())
+		if experiment.PromptVersion != "" {
+			promptVersion = experiment.PromptVersion
+			w.Header().Set("X-Prompt-Version", promptVersion)
+		}
+		if experiment.Model != "" && req.Model == "" {
+			modelName = experiment.Model
+		}
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid image data: %v", err))
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
 		return
 	}
 
-	client, err := genai.NewClient(ctx, option.WithAPIKey(vertexApiKey))
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
 	if err != nil {
-		logger.Printf("Error creating client: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error creating new client")
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
 		return
 	}
-	defer client.Close()
-
-	model := client.GenerativeModel(modelName)
-	model.SetTemperature(0.45)
-	model.GenerationConfig = genai.GenerationConfig{
-		ResponseMIMEType: "application/json",
-	}
-	model.SetMaxOutputTokens(1024)
-
-	prompt := `
-
-	You are a navigation assistant for blind users. Your task is to analyze an image and identify any potential hazards for a blind person walking in the scene, paying special attention to objects that are directly in front of the user and centered in their field of view. This includes, but is not limited to, advertisement screens, other fixed objects, and moving objects. Your goal is to guide the user toward the safest, most comfortable, and most natural path, considering the surrounding environment and pedestrian flow.
-
-	# Follow these rules for hazard classification:
-	
-	## Position-Based Categories:
-	[FRONT]: 0-3 steps ahead. HIGH severity if centered, MEDIUM severity if not centered. Requires immediate attention. Direct impact on path. [LEFT/RIGHT]: Side areas. MEDIUM severity. Important for orientation. May escalate based on context.
-	
-	## Hazard Categories:
-	### Path Obstructions:
-	- HIGH Severity: Blocking fixed obstacles, fast-moving objects, construction barriers, complete path blockages, objects that are directly in front of the user and centered.
-	- MEDIUM Severity: Partial blockages, slow-moving objects, temporary obstacles, side path obstacles, objects that are in front of the user but not centered.
-	### Ground Conditions:
-	- HIGH Severity: Open holes/manholes, missing pavement, ice patches, steep slopes (>15°).
-	- MEDIUM Severity: Uneven surfaces, minor cracks, wet surfaces, moderate slopes (8-15°), stair steps.
-	### Environmental Hazards:
-	- HIGH Severity: Complete darkness, sudden light changes, major flooding, heavy snow coverage.
-	- MEDIUM Severity: Partial shadows, light rain, wet patches, gradual light changes.
-	### Proximity Hazards:
-	- HIGH Severity: Unmarked drop-offs, traffic zones, water bodies, platform edges.
-	- MEDIUM Severity: Marked curbs, pedestrian crossings, protected edges, side barriers, handrails.
-	
-	# Output Format: Return a JSON object with the following structure: 
-	
-	{ 
-		"hazards": 
-		[ 
-			{ 
-				"position": "[FRONT/LEFT/RIGHT]", 
-				"type": "[Hazard Category]", 
-				"severity": "[HIGH/MEDIUM]", 
-				"description": "[Detailed description of the hazard for TTS]" 
-				
-			}, 
-			// ... more hazards ], 
-		"severity": [IF found any HIGH in hazards, then HIGH else MEDIUM, but if empty then LOW], 
-		"safe_direction": "[Recommended direction for the user: LEFT, RIGHT, STRAIGHT, 'Move slightly to the [LEFT/RIGHT] to [avoid [shortened name of object in FRONT/ OPPOSITE DIRECTION or follow the pedestrian [FLOW/SIGN] ] - you can add CAUTION as prefix]], 'STOP', 'Crosswalk in front of you. Please find assistance.', 'CAUTION, Crosswalk in front of you. Proceed with caution.', 'STOP. Wait for pedestrian light.', 'Please find assistance to navigate the stairs', or a combination of these with a context with [CAUTION/STOP/SLOW] prefix if needed" 
-	}
-	
-	 Criteria: There is no [STOP/SLOW/CAUTIOUS] in the final safe_direction. If MEDIUM then SLOW or CAUTION
-	
-	# Instructions: 
-	Analyze the provided image. Identify all hazards present in the image based on the above classification system. For each identified hazard, create a hazard object with the correct position, type, severity, and a detailed description suitable for Text-to-Speech output. Prioritize hazards that are closer to the user's path and those that are more unpredictable or unstable. Provide detailed descriptions of each hazard, including its location relative to the user's path and the nature of the obstacle. If the hazard is a ground condition with medium severity, start the description with 'CAUTION,' followed by the detailed description. For example, 'CAUTION, Wet surface' or 'CAUTION, Uneven surface ahead.' For high-severity ground conditions, do not use the 'CAUTION' prefix.
-	
-	You can return only top 3 hazards
-	
-	## Crosswalk Handling: 
-	If a crosswalk is detected directly [FRONT CENTERED] in front of the user
-	
-	### Pedestrian Crossing Check:
-	Check if people are actively crossing the crosswalk.
-	If people are crossing, set "safe_direction" to "CAUTION, Crosswalk in front of you. Proceed with caution." and skip the pedestrian light check.
-	Pedestrian Light Detection: If no people are crossing, then check for the presence of a pedestrian traffic light.
-	If a pedestrian light is GREEN, set "safe_direction" to "CAUTION, Crosswalk in front of you. Proceed with caution."
-	If a pedestrian light is RED, set "safe_direction" to "STOP. Wait for pedestrian light."
-	If NO pedestrian light is detected, set "safe_direction" to "Crosswalk in front of you. Please find assistance."
-	If the crosswalk is in the front but not centered, ignore the crosswalk.
-	
-	## Stair Handling: 
-	If stair steps are detected as a [FRONT] ground condition:
-	1. **Flow Analysis:**
-		 - Check for both UP and DOWN pedestrian flows
-		 - Note which side (LEFT/RIGHT) people are going DOWN
-		 - Note which side (LEFT/RIGHT) people are going UP
-		 - If pedestrian flow exists, always follow the matching direction (DOWN flow for going down, UP flow for going up)
-	
-	2. **Direction-Specific Rules:**
-		 For going DOWN stairs:
-		 - If people going DOWN on LEFT: "CAUTION, Move to the left handrail and follow the pedestrian flow to go down the stairs."
-		 - If people going DOWN on RIGHT: "CAUTION, Move to the right handrail and follow the pedestrian flow to go down the stairs."
-		 - If no DOWN flow visible: "CAUTION, Move to the left handrail to go down the stairs." (default to left side)
-		 - If no handrail visible: "STOP. Please find assistance to navigate down the stairs."
-	
-		 For going UP stairs:
-		 - If people going UP on LEFT: "CAUTION, Move to the left handrail and follow the pedestrian flow to go up the stairs."
-		 - If people going UP on RIGHT: "CAUTION, Move to the right handrail and follow the pedestrian flow to go up the stairs."
-		 - If no UP flow visible: "CAUTION, Move to the right handrail to go up the stairs." (default to right side)
-		 - If no handrail visible: "STOP. Please find assistance to navigate up the stairs."
-	
-	3. **Priority Rules:**
-		 - Always prioritize matching the flow direction (DOWN flow for descending, UP flow for ascending)
-		 - Keep to the same side as others going in your direction
-		 - If flows are visible on both sides, follow conventional pattern (DOWN on left, UP on right)
-		 - Default to requesting assistance if flow patterns are unclear or conflicting
-	
-	4. **Hazard Reporting:**
-		 - Report both UP and DOWN flows as separate hazards when present
-		 - Include flow direction and side in hazard descriptions
-		 - Mark all stair-related hazards as MEDIUM severity
-	
-	
-	If there is no crosswalk in front of the user, and no stairs, but there are other hazards, prioritize guiding the user to follow the natural flow of pedestrian traffic when present. When selecting a safe direction, prioritize guiding the user towards a clear and unobstructed path.
-	
-	## Escalator Handling:
-	For escalators detected as [FRONT] path condition:
-	CAUTION. Escalator ahead. Please find assistance
-	
-	## Elevator Handling:
-	For elevators detected in [FRONT]:
-	### Door States:
-	
-	Open: "STRAIGHT, [LEFT/RIGHT/FRONT] Elevator doors open. Move forward to enter."
-	Closed: "STOP, Elevator ahead. Wait for elevator"
-	Crowded: "SLOW, Crowded elevator. Wait for next or find assistance."
-	
-	### Location Guidance:
-	
-	Clear path: "STRAIGHT, Elevator entrance [X] steps forward."
-	Obstructed: "SLOW, Move [slightly left/right] to reach elevator."
-	Multiple elevators: "STOP, Multiple elevators. Please find assistance."
-	Out of service: "STOP, Elevator out of service. Find assistance for alternate route."
-	
-	## Platform Priority Rules:
-	
-	Prioritize elevator over escalator when both present
-	Default to assistance requests in unclear situations
-	Consider crowd density in guidance
-	Maintain right-side preference for handrails
-	Include directional context for escalators
-	
-	## Safety Emphasis:
-	
-	Always mention handrail usage for moving platforms
-	Provide clear waiting instructions
-	Include crowd awareness
-	Default to assistance in complex scenarios
-	Treat stationary escalators as stairs
-	
-	# General Guidance:
-	## Primary Rules
-	When faced with obstacles on both sides: Guide user away from the most significant obstacle (FIND Pedestrian FLOW OR SIGN) Default to following pedestrian flow if it's safer Use "Move slightly to [LEFT/RIGHT]" + [shortened reason] Adjust movement magnitude based on obstacle severity/proximity
-	
-	## Movement Instructions
-	For pedestrian [flow/sign]: Use "SLOW, Move slightly to the [LEFT/RIGHT] to follow the pedestrian [flow/sign]" + [shorten reason e.g. blocking object on the [OPPOSITE DIRECTION]] Prioritize this guidance when it provides a safe path
-	For clear paths: Use "Walk straight, but be aware of obstacles on the [LEFT/RIGHT]"
-	Vehicle Obstruction Protocol
-	When vehicle blocks path [FRONT]: Prioritize following pedestrian flow if present This guidance takes precedence over other directions Focus on safest path around vehicle
-	Safety Priorities
-	For HIGH severity hazards (non-crosswalk): Prioritize "STOP" command immediately
-	
-	## Default/Unclear Situations
-	If image is blurry or no clear hazards: Set "hazards" array to empty Set "safe_direction" to "STRAIGHT" and "severity" to "LOW"
-	
-	## Movement Scale Guide
-	Closer obstacles = more significant sideways movement
-	
-	More severe obstacles = more significant sideways movement
-	
-	If severity is HIGH (and not a crosswalk or stairs):
-	
-	Extract the description of the first HIGH severity hazard.
-	Prepend "STOP [shortened description]. " to the safe_direction. Shorten the description to be concise (e.g., "Open hole ahead", "[FRONT AND CENTERED] Fast moving vehicle, "Construction ahead").
-	If severity is MEDIUM and there is a moving object or crosswalk or stairs in the hazards: Prepend "CAUTION, " to the safe_direction.
-	If severity is MEDIUM and there is a ground hazard in the hazards: Prepend "SLOW, [shortened description] " to the safe_direction.
-	Otherwise: Do not add any prefix.
-	
-	Example If found stairs:
-	{
-	"hazards": [
-	{
-	"position": "FRONT",
-	"type": "Ground Conditions",
-	"severity": "MEDIUM",
-	"description": "Stair steps going down ahead."
-	},
-	{
-	"position": "RIGHT",
-	"type": "Proximity Hazard",
-	"severity": "MEDIUM",
-	"description": "People going down stairs on the RIGHT."
-	}
-	
-	],
-	"severity": "MEDIUM",
-	"safe_direction": "SLOW, Move to the RIGHT handrail and follow the pedestrian flow to down the stairs."
-	}
-	
-	
-	Example If not found stairs:
-	{
-	"hazards": [
-	{
-	"position": "LEFT",
-	"type": "Path Obstructions",
-	"severity": "MEDIUM",
-	"description": "A row of parked scooters is blocking the left side of the path."
-	},
-	{
-	"position": "RIGHT",
-	"type": "Path Obstructions",
-	"severity": "MEDIUM",
-	"description": "Stanchions and ropes are on the right side of the path."
-	},
-	{
-	"position": "FRONT",
-	"type": "Ground Conditions",
-	"severity": "MEDIUM",
-	"description": "CAUTION, Wet surface."
-	},
-	{
-	"position": "FRONT",
-	"type": "Ground Conditions",
-	"severity": "HIGH",
-	"description": "Open manhole ahead!"
-	}
-	],
-	"severity": "HIGH",
-	"safe_direction": "STOP (Open manhole ahead). Move slightly to the right - Construction barriers on the left, be aware of the wet surface"
-	}
-	
-	Example with fast moving object:
-	{
-	"hazards": [
-	{
-	"position": "FRONT",
-	"type": "Path Obstructions",
-	"severity": "HIGH",
-	"description": "A fast-moving bicycle is approaching from the front."
-	}
-	],
-	"severity": "HIGH",
-	"safe_direction": "STOP,  Fast moving bicycle. Move slightly to the left to avoid the bicycle."
-	}
-	Example with ground hazard:
-	{
-	"hazards": [
-	{
-	"position": "LEFT",
-	"type": "Path Obstructions",
-	"severity": "MEDIUM",
-	"description": "A row of parked bicycles"
-	}, 
-	{
-		"position": "FRONT",
-		"type": "Ground Conditions",
-		"severity": "MEDIUM",
-		"description": "CAUTION, Wet surface."
-	}
-	],
-	"severity": "MEDIUM",
-	"safe_direction": "SLOW Wet surface. Move slightly to the left to avoid the bicycle and follow pedestrian flow."
-	}	
-	`
-	resp, err := model.GenerateContent(ctx,
-		genai.Text(prompt),
-		genai.ImageData(format, imageData),
-	)
+
+	if req.Location != nil && !req.Location.valid() {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid location")
+		return
+	}
+
+	if req.Motion != nil && !req.Motion.valid() {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid motion")
+		return
+	}
+
+	if req.Weather != nil && !req.Weather.valid() {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid weather")
+		return
+	}
+
+	if !verbosity.Valid(req.Verbosity) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid verbosity")
+		return
+	}
+	verbosityLevel := verbosity.Level(req.Verbosity)
+
+	if !positionFormats[req.Positions] {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid positions")
+		return
+	}
+	clockPositions := req.Positions == positionsClock
+
+	if !mobilityModes[req.MobilityMode] {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid mobilityMode")
+		return
+	}
+
+	tunables := settings.Get(ctx, logName)
+	filter, err := newHazardFilter(req, tunables)
 	if err != nil {
-		logger.Printf("Error at processing: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error at processing")
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
 		return
 	}
 
-	if len(resp.Candidates) == 0 {
-		respondWithError(w, http.StatusInternalServerError, "No response - candidates")
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
 		return
 	}
 
-	if len(resp.Candidates[0].Content.Parts) == 0 {
-		respondWithError(w, http.StatusInternalServerError, "No response - parts")
+	var depthSamples *depth.Samples
+	if req.Depth != nil {
+		depthSamples, err = req.Depth.Decode()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid depth map: %v", err))
+			return
+		}
+	}
+
+	// What the frame showed is only logged and analyzed with the consent
+	// of the signed-in user, see package consent
+	uid := auth.Caller(ctx, r)
+	analyzed := consent.Analytics(ctx, uid)
+	contentLog := consent.Logger(ctx, uid, logger)
+
+	// Every answer feeds the guidance quality analytics
+	respond := func(response HazardDetectionResponse) {
+		// The frame cadence follows the load of the backend
+		pacing.Observe(time.Since(start))
+		response.SuggestedIntervalMs = pacing.Suggest(r.Context()).Milliseconds()
+		if response.SpeechText != "" {
+			response.Earcon = severity.EarconOf(response.Severity, response.SpeechText)
+			response.Haptic = haptic.For(response.Severity, response.SpeechText)
+		}
+		respondWithHazards(w, version, response)
+		if !analyzed {
+			return
+		}
+		analytics.RecordGuidance(r.Context(), analytics.Guidance{
+			Function:      logName,
+			PromptVersion: promptVersion,
+			Model:         modelName,
+			Severity:      string(response.Severity),
+			Rescan:        response.Rescan,
+			Degraded:      response.Degraded,
+		})
+	}
+
+	// Perceptual hash of the frame, to spot a view that hasn't changed. It is
+	// 0 for formats that can't be decoded, which are always analyzed.
+	frameHash, _ := framecache.Hash(imageData)
+
+	// The user is standing still: skip the model and the speech. v1 clients
+	// don't know the UNCHANGED severity.
+	if version >= apiversion.V2 && req.SessionID != "" && frameHash != 0 {
+		unchanged, err := unchangedFrame(ctx, projectID, req.SessionID, uid, frameHash)
+		if err != nil {
+			logger.Printf("Error comparing frames: %v", err)
+		} else if unchanged {
+			respond(HazardDetectionResponse{Severity: model.SeverityUnchanged})
+			return
+		}
+	}
+
+	opts := provider.Options{
+		Temperature:     0.45,
+		MaxOutputTokens: 1024,
+		JSON:            true,
+	}
+	opts = tunables.Tune(opts)
+	opts.MaxOutputTokens = verbosity.Tokens(verbosityLevel, opts.MaxOutputTokens, terseTokens)
+	if experiment.Temperature != nil {
+		opts.Temperature = *experiment.Temperature
+	}
+
+	// One set of models per consensus sample, as the samples run at once
+	samplers := make([]provider.VisionModel, config.Get().ConsensusSamples)
+	var models *provider.Hedge
+	for i := range samplers {
+		hedge, err := newModels(ctx, modelName, opts)
+		if err != nil {
+			logger.Printf("Error creating client: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+			return
+		}
+		defer hedge.Close()
+
+		samplers[i] = hedge
+		if models == nil {
+			models = hedge
+		}
+	}
+	defer usage.Track(ctx, logName, uid, samplers...)
+
+	// The day prompt makes up detail in dark frames
+	promptName := "detect-hazards"
+	if lowLight(imageData, req.Location, time.Now()) {
+		promptName = nightPrompt
+	}
+	prompt, err := prompts.Render(ctx, promptName, promptVersion, prompts.DefaultVars())
+	if err != nil && promptName == nightPrompt {
+		logger.Printf("Error loading night prompt, using the day prompt: %v", err)
+		prompt, err = prompts.Render(ctx, "detect-hazards", promptVersion, prompts.DefaultVars())
+	}
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
 		return
 	}
+	// The weather is looked up alongside the map features
+	weather := req.Weather
+	var weatherLookup chan *Weather
+	if weather == nil && req.Location != nil {
+		weatherLookup = make(chan *Weather, 1)
+		go func() {
+			current, err := currentWeather(ctx, req.Location)
+			if err != nil {
+				// Like map context, the weather is a hint only
+				logger.Printf("Error looking up the weather: %v", err)
+			}
+			weatherLookup <- current
+		}()
+	}
 
-	jsonStr := resp.Candidates[0].Content.Parts[0].(genai.Text)
-	var detection HazardDetection
-	err = json.Unmarshal([]byte(jsonStr), &detection)
+	parts := []provider.Part{provider.Text(prompt)}
 
+	// What matters depends on how the user gets around
+	if name := mobilityPrompt(req.MobilityMode); name != "" {
+		text, err := prompts.Render(ctx, name, mobilityPromptVersion, prompts.DefaultVars())
+		if err != nil {
+			logger.Printf("Error loading prompt: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+			return
+		}
+		parts = append(parts, provider.Text(text))
+	}
+
+	var features []osmFeature
+	if req.Location != nil {
+		features, err = nearbyFeatures(ctx, req.Location)
+		if err != nil {
+			// Map context is a hint only; analyze the image without it
+			logger.Printf("Error looking up map features: %v", err)
+		}
+		parts = append(parts, provider.Text(locationContext(req.Location, features)))
+	}
+	if weatherLookup != nil {
+		weather = <-weatherLookup
+	}
+	if weather != nil {
+		if text := weatherContext(weather); text != "" {
+			parts = append(parts, provider.Text(text))
+		}
+	}
+	if req.Motion != nil {
+		if text := motionContext(req.Motion); text != "" {
+			parts = append(parts, provider.Text(text))
+		}
+	}
+	if text := verbosityPrompts.Context(verbosityLevel); text != "" {
+		parts = append(parts, provider.Text(text))
+	}
+	if clockPositions {
+		parts = append(parts, provider.Text(clockContext))
+	}
+	if text := filter.context(); text != "" {
+		parts = append(parts, provider.Text(text))
+	}
+	parts = append(parts, provider.ImageData(format, imageData))
+
+	// A user standing still sends near-identical frames; reuse the analysis
+	// of a recent one instead of calling the model again
+	cacheKey := frameKey(modelName, parts)
+	var answers []string
+	cached := false
+	if frameHash != 0 {
+		answers, cached = recentFrames.Get(cacheKey, frameHash)
+	}
+
+	if !cached {
+		// The user may be mid-crossing: when no model can answer, fall back
+		// to a spoken caution rather than an error.
+		answers, err = consensus.Sample(ctx, samplers, parts...)
+		if err != nil {
+			logger.Printf("Error at processing: %v", err)
+			respond(unavailableResponse)
+			return
+		}
+		if models.Answered != modelName {
+			logger.Printf("Model %s unavailable, answered by %s", modelName, models.Answered)
+		}
+	}
+
+	// Keep the frame and the raw answer, to reproduce a bad direction
+	debugPath := ""
+	if archive.Wanted(ctx, req.Debug, uid) {
+		answered := modelName
+		if models.Answered != "" {
+			answered = models.Answered
+		}
+		debugPath, err = archive.Save(r.Context(), archive.Record{
+			Function:      logName,
+			Model:         answered,
+			PromptVersion: promptVersion,
+			UserID:        uid,
+			Output:        strings.Join(answers, "\n"),
+		}, imageData, format)
+		if err != nil {
+			logger.Printf("Error archiving frame: %v", err)
+		}
+	}
+
+	detection, agreed, err := reconcile(answers)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error unmarshaling JSON")
 		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		degraded := unavailableResponse
+		degraded.DebugPath = debugPath
+		respond(degraded)
 		return
 	}
 
+	if !cached && frameHash != 0 {
+		recentFrames.Put(cacheKey, frameHash, answers)
+	}
+	if !agreed {
+		logger.Printf("Samples disagree on severity, acting on the most severe")
+	}
+
+	// Measured distances beat estimated ones
+	if depthSamples != nil {
+		n := measureDistances(detection.Hazards, depthSamples)
+		logger.Printf("Measured %d of %d hazard distances from the depth map", n, len(detection.Hazards))
+	}
+
+	// Steps are barriers in a wheelchair, and the user's own ratings, e.g.
+	// stairs as HIGH, may escalate the scene too
+	profile, err := calibration.Get(ctx, uid)
+	if err != nil {
+		logger.Printf("Error reading calibration of %s: %v", uid, err)
+	}
+	hazards, worst := calibrate(adaptToMobility(detection.Hazards, req.MobilityMode), profile)
+	detection.Hazards = hazards
+	if worst.Rank() > detection.Severity.Rank() {
+		detection.Severity = worst
+	}
+
+	// The model may still report muted hazards, or too many
+	reported := len(detection.Hazards)
+	detection.Hazards = filter.apply(detection.Hazards)
+	if dropped := reported - len(detection.Hazards); dropped > 0 {
+		logger.Printf("Filtered out %d of %d hazards", dropped, reported)
+	}
+
+	// The TTS layer keys on the exact prefixes of safe_direction
+	direction, valid := severity.Normalize(detection.SafeDirection, detection.Severity)
+	if !valid {
+		contentLog.Printf("Rewrote out-of-vocabulary safe_direction %q to %q", detection.SafeDirection, direction)
+	}
+	detection.SafeDirection = direction
+
+	// The instruction must match the hazards, e.g. a HIGH hazard calls for a
+	// STOP, not only a HIGH severity
+	direction, reconciled, changed := severity.Reconcile(detection.SafeDirection, detection.Severity, hazardDetails(detection.Hazards))
+	if changed {
+		contentLog.Printf("Reconciled safe_direction %q (%s) to %q (%s)", detection.SafeDirection, detection.Severity, direction, reconciled)
+		detection.SafeDirection, detection.Severity = direction, reconciled
+	}
+
 	// Return response
-	severity := safeguardSeverity(&detection)
+	level := severity.Safeguard(detection.Severity, detection.SafeDirection)
+	speechText := detection.SafeDirection
+
+	// Rather than uncertain STOP or GO advice, ask for another look. The
+	// hazards aren't tracked, as they may not be real.
+	confidence := validConfidence(detection.Confidence)
+	if confidence != nil && *confidence < minConfidence {
+		logger.Printf("Confidence %.2f too low, asking to re-scan", *confidence)
+		rescan := HazardDetectionResponse{
+			SpeechText: persona.Speech(rescanSpeech),
+			Severity:   model.SeverityMedium,
+			Confidence: confidence,
+			Rescan:     true,
+			DebugPath:  debugPath,
+		}
+		if level.Rank() > rescan.Severity.Rank() {
+			rescan.Severity = level
+		}
+		respond(rescan)
+		return
+	}
+
+	// Within a session, stay quiet unless something new or escalated shows up
+	if req.SessionID != "" {
+		surfaced, err := updateSession(ctx, projectID, req.SessionID, uid, detection.Hazards, frameHash)
+		if err != nil {
+			// Tracking is best effort; announcing everything is the safe fallback
+			logger.Printf("Error tracking session: %v", err)
+		} else if len(surfaced) == 0 {
+			speechText = ""
+		}
+	}
 
 	response := HazardDetectionResponse{
-		SpeechText: detection.SafeDirection,
-		Severity:   severity,
+		SpeechText:    speechText,
+		Severity:      level,
+		Confidence:    confidence,
+		LowConfidence: !agreed,
+		DebugPath:     debugPath,
+	}
+
+	if nearest, steps, ok := nearestHazard(detection.Hazards); ok {
+		response.NearestSteps = &steps
+		if nearest.measured {
+			response.SpeechText = withoutStepCounts(response.SpeechText)
+		}
+		if clockPositions {
+			response.SpeechText = withClockDistance(response.SpeechText, nearest, steps)
+		} else {
+			response.SpeechText = withDistance(response.SpeechText, nearest, steps)
+		}
+	}
+
+	// Per-hazard detail, e.g. for a haptic or visual overlay
+	if req.Verbose {
+		response.Hazards = hazardDetails(detection.Hazards)
+		if clockPositions {
+			response.Hazards = withClocks(response.Hazards)
+		}
 	}
 
+	// The hazards drawn on the frame, for the user and for support to
+	// review with a report on an archived frame
+	boxes := annotations(detection.Hazards)
+	if req.Annotate || (debugPath != "" && len(boxes) > 0) {
+		annotated, err := imagedata.Annotate(imageData, format, boxes)
+		if err != nil {
+			logger.Printf("Error annotating frame: %v", err)
+		} else {
+			if req.Annotate {
+				response.AnnotatedImage = dataURI(annotated, format)
+			}
+			if debugPath != "" && len(boxes) > 0 {
+				if err := archive.SaveAnnotated(r.Context(), debugPath, uid, annotated, format); err != nil {
+					logger.Printf("Error archiving annotated frame: %v", err)
+				}
+			}
+		}
+	}
+
+	if bearing, ok := directionBearing(detection.SafeDirection); ok {
+		response.BearingDegrees = &bearing
+	}
+
+	if heading := requestHeading(req); heading != nil {
+		response.CompassDirection = compassDirection(detection.SafeDirection, *heading)
+		response.Upcoming = upcomingFeatures(features, *heading)
+	}
+
+	if experiment.Experiment != "" {
+		contentLog.Printf("Experiment %s: severity=%s safe_direction=%q", experiment.Label(), level, detection.SafeDirection)
+	}
+
+	respond(response)
+
+}
+
+// recentFrames holds the model answers for recent frames. The raw answers
+// are cached rather than the decoded detection, as session tracking
+// modifies the hazards.
+var recentFrames = framecache.New[[]string](256)
+
+// frameKey identifies the request apart from the image: the model and the
+// prompt text, which includes the location context.
+func frameKey(modelName string, parts []provider.Part) string {
+	texts := []string{modelName}
+	for _, part := range parts {
+		if text, ok := part.(provider.Text); ok {
+			texts = append(texts, string(text))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// modelChain is the primary model followed by the configured fallbacks.
+func modelChain(primary string) []string {
+	chain := []string{primary}
+	for _, name := range config.Get().FallbackModels {
+		if name != primary {
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+// newModels returns the model chain from modelName, hedged by HEDGE_MODEL.
+func newModels(ctx context.Context, modelName string, opts provider.Options) (*provider.Hedge, error) {
+	chain, err := provider.NewFallback(ctx, modelChain(modelName), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// A slow answer on a safety endpoint is worse than a second call
+	models, err := provider.NewHedge(ctx, chain, hedgeModel(modelName), opts, acceptable)
+	if err != nil {
+		chain.Close()
+		return nil, err
+	}
+	return models, nil
+}
+
+// reconcile decodes the sampled answers and picks the one to act on, the
+// most severe, see package consensus. Answers that don't decode are left
+// out; agreed is false when the others are far apart.
+func reconcile(answers []string) (detection HazardDetection, agreed bool, err error) {
+	var detections []HazardDetection
+	var severities []model.Severity
+	for _, answer := range answers {
+		var d HazardDetection
+		if decodeErr := json.Unmarshal([]byte(answer), &d); decodeErr != nil {
+			err = decodeErr
+			continue
+		}
+		detections = append(detections, d)
+		severities = append(severities, severity.Safeguard(d.Severity, d.SafeDirection))
+	}
+	if len(detections) == 0 {
+		return HazardDetection{}, false, err
+	}
+
+	i, agreed := consensus.Decide(severities)
+	return detections[i], agreed, nil
+}
+
+// hedgeModel is the model to hedge primary with, if any.
+func hedgeModel(primary string) string {
+	if name := config.Get().HedgeModel; name != primary {
+		return name
+	}
+	return ""
+}
+
+// acceptable reports whether a model answer can be used, so that a hedged
+// call waits for the other model when the first answer is malformed.
+func acceptable(text string) bool {
+	var detection HazardDetection
+	return json.Unmarshal([]byte(text), &detection) == nil
+}
+
+// hazardResponseV1 is the frozen v1 shape of HazardDetectionResponse.
+type hazardResponseV1 struct {
+	SpeechText string         `json:"speechText"`
+	Severity   model.Severity `json:"severity"`
+}
+
+// respondWithHazards writes response in the shape of the API version.
+func respondWithHazards(w http.ResponseWriter, version apiversion.Version, response HazardDetectionResponse) {
+	if version == apiversion.V1 {
+		respondWithJSON(w, http.StatusOK, hazardResponseV1{
+			SpeechText: response.SpeechText,
+			Severity:   response.Severity,
+		})
+		return
+	}
 	respondWithJSON(w, http.StatusOK, response)
+}
 
+// hazardDetails converts the model's hazards for the response, with the
+// distance in steps filled in from meters_range where needed.
+func hazardDetails(hazards []Hazard) []model.Hazard {
+	details := make([]model.Hazard, 0, len(hazards))
+	for _, h := range hazards {
+		detail := model.Hazard{
+			ID:          h.ID,
+			Position:    h.Position,
+			Type:        h.Type,
+			Severity:    h.Severity,
+			Description: h.Description,
+			Clock:       validClock(h.Clock),
+			Bearing:     hazardBearing(h),
+			MetersRange: h.MetersRange,
+			Confidence:  validConfidence(h.Confidence),
+			Measured:    h.measured,
+			Box:         validBox(h.Box),
+		}
+		if steps, ok := hazardSteps(h); ok {
+			detail.Steps = &steps
+		}
+		details = append(details, detail)
+	}
+	return details
 }
 
-func safeguardSeverity(detection *HazardDetection) string {
-	// If original severity is already HIGH, return HIGH
-	if detection.Severity == "HIGH" {
-		return "HIGH"
+// validBox returns box if it is a region of the frame, else nil.
+func validBox(box *model.Region) *model.Region {
+	if box == nil || box.Validate() != nil {
+		return nil
 	}
+	return box
+}
 
-	if detection.Severity == "MEDIUM" {
-		return "MEDIUM"
+// validConfidence returns c if it is a confidence between 0 and 1, else nil.
+func validConfidence(c *float64) *float64 {
+	if c == nil || *c < 0 || *c > 1 {
+		return nil
 	}
+	return c
+}
+
+// metersPerStep converts model distances in meters to walking steps.
+const metersPerStep = 0.7
 
-	// Convert safe direction to uppercase for case-insensitive comparison
-	safeDir := strings.ToUpper(detection.SafeDirection)
+var stepWords = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
 
-	// Check for STOP - always escalates to HIGH
-	if strings.HasPrefix(safeDir, "STOP") {
-		return "HIGH"
+// hazardSteps returns the estimated distance of a hazard in steps, derived
+// from meters_range when the model gave no step count.
+func hazardSteps(hazard Hazard) (int, bool) {
+	if hazard.Steps != nil && *hazard.Steps >= 0 {
+		return max(*hazard.Steps, 1), true
 	}
 
-	// Check for CAUTION or SLOW - escalates to MEDIUM
-	if strings.HasPrefix(safeDir, "CAUTION") || strings.HasPrefix(safeDir, "SLOW") {
-		return "MEDIUM"
+	// Use the near end of the range: it's the safer estimate
+	low, _, _ := strings.Cut(hazard.MetersRange, "-")
+	meters, err := strconv.ParseFloat(strings.TrimSpace(low), 64)
+	if err != nil || meters < 0 {
+		return 0, false
 	}
 
-	// If no special prefixes, return LOW or original severity
-	return "LOW"
+	return max(int(math.Round(meters/metersPerStep)), 1), true
 }
 
-func processBase64Image(base64Image string) ([]byte, string, error) {
-	// Check if the string starts with data URI scheme
-	parts := strings.Split(base64Image, ",")
-	var b64Data string
-	var format string
-
-	if len(parts) == 2 {
-		// Data URI scheme present
-		metaParts := strings.Split(parts[0], ";")
-		if len(metaParts) != 2 || !strings.HasPrefix(metaParts[0], "data:image/") {
-			return nil, "", errors.New("invalid image format in data URI")
+// nearestHazard returns the closest hazard with a distance estimate,
+// preferring FRONT hazards at equal distance.
+func nearestHazard(hazards []Hazard) (Hazard, int, bool) {
+	var nearest Hazard
+	nearestSteps, found := 0, false
+
+	for _, hazard := range hazards {
+		steps, ok := hazardSteps(hazard)
+		if !ok {
+			continue
+		}
+		if !found || steps < nearestSteps || (steps == nearestSteps && isFront(hazard.Position) && !isFront(nearest.Position)) {
+			nearest, nearestSteps, found = hazard, steps, true
 		}
-		format = strings.TrimPrefix(metaParts[0], "data:image/")
-		b64Data = parts[1]
-	} else {
-		// Assume it's just base64 data and try to determine format
-		b64Data = base64Image
-		// Default to JPEG if we can't determine format
-		format = "jpeg"
 	}
 
-	// Decode base64 data
-	imageData, err := base64.StdEncoding.DecodeString(b64Data)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode base64 data: %v", err)
+	return nearest, nearestSteps, found
+}
+
+// withDistance appends the nearest hazard distance to the guidance, unless
+// the model already mentioned a distance or there is nothing to say.
+func withDistance(speechText string, nearest Hazard, steps int) string {
+	if speechText == "" || strings.Contains(strings.ToLower(speechText), "step") {
+		return speechText
+	}
+
+	direction := "ahead"
+	switch nearest.Position {
+	case model.PositionLeft:
+		direction = "to your left"
+	case model.PositionRight:
+		direction = "to your right"
 	}
 
-	return imageData, format, nil
+	return fmt.Sprintf("%s Nearest hazard %s %s.", strings.TrimSpace(speechText), spokenSteps(steps), direction)
+}
+
+func spokenSteps(steps int) string {
+	if steps == 1 {
+		return "one step"
+	}
+	if steps < len(stepWords) {
+		return stepWords[steps] + " steps"
+	}
+	return fmt.Sprintf("%d steps", steps)
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
 }
 
 func printResponse(resp *genai.GenerateContentResponse, logger *log.Logger) {
@@ -462,13 +885,13 @@ func printResponse(resp *genai.GenerateContentResponse, logger *log.Logger) {
 func handleCORS(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
 	w.Header().Set("Access-Control-Max-Age", "3600")
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -490,7 +913,7 @@ func validateAPIKey(r *http.Request) error {
 		return errors.New("missing API key")
 	}
 
-	expectedAPIKey := os.Getenv("API_KEY")
+	expectedAPIKey := config.Get().APIKey
 	if expectedAPIKey == "" {
 		// If API_KEY is not set in environment, log a warning and allow the request
 		log.Println("Warning: API_KEY environment variable not set")
@@ -0,0 +1,69 @@
+package detecthazards
+
+import (
+	"regexp"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Mobility modes, see HazardDetectionRequest.MobilityMode. The main prompt
+// is written for cane users.
+const (
+	mobilityCane       = "cane"
+	mobilityGuideDog   = "guide-dog"
+	mobilityWheelchair = "wheelchair"
+)
+
+var mobilityModes = map[string]bool{
+	"":                 true,
+	mobilityCane:       true,
+	mobilityGuideDog:   true,
+	mobilityWheelchair: true,
+}
+
+// mobilityPromptVersion is the version of the mode prompts. They add to
+// the main prompt, so they are versioned apart from it.
+const mobilityPromptVersion = "v1"
+
+// mobilityPrompt returns the name of the prompt adding to the main one for
+// mode, "" for cane users.
+func mobilityPrompt(mode string) string {
+	if mode == "" || mode == mobilityCane {
+		return ""
+	}
+	return "detect-hazards/" + mode
+}
+
+var (
+	// wheelchairBarriers are hazards a wheelchair can't get past, which
+	// the main prompt rates MEDIUM, e.g. stair steps. A bare "steps" is
+	// usually a distance, "three steps ahead".
+	wheelchairBarriers = regexp.MustCompile(`(?i)\b(stairs?|staircases?|steps? (up|down)|escalators?|curbs?|kerbs?|slopes?|inclines?|gravel|sand|gaps?)\b`)
+	// wheelchairAccess are ways around the barriers, which aren't hazards
+	// themselves.
+	wheelchairAccess = regexp.MustCompile(`(?i)\b(curb cuts?|kerb cuts?|dropped kerbs?|ramps?|elevators?|lifts?)\b`)
+)
+
+// adaptToMobility applies the severity rules of mode to the hazards:
+//
+//   - In a wheelchair, barriers ahead such as steps and curbs are HIGH.
+//   - With a guide dog, path obstructions below HIGH are dropped, as the
+//     dog leads the user around them.
+func adaptToMobility(hazards []Hazard, mode string) []Hazard {
+	adapted := hazards[:0]
+	for _, h := range hazards {
+		description := h.Type + " " + h.Description
+		switch mode {
+		case mobilityWheelchair:
+			if h.Position == model.PositionFront && wheelchairBarriers.MatchString(description) && !wheelchairAccess.MatchString(description) {
+				h.Severity = model.SeverityHigh
+			}
+		case mobilityGuideDog:
+			if category, _ := model.CategoryOf(h.Type); category == model.CategoryPathObstructions && h.Severity != model.SeverityHigh {
+				continue
+			}
+		}
+		adapted = append(adapted, h)
+	}
+	return adapted
+}
@@ -0,0 +1,109 @@
+package detecthazards
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Motion is the optional motion of the phone, from its sensors. Speed is
+// the walking speed in m/s, from GPS or the pedometer, and Acceleration the
+// magnitude of the user's acceleration without gravity, in m/s². Heading is
+// the compass direction the camera faces, for clients without a location
+// fix, and Pitch the tilt of the camera in degrees, negative when pointing
+// down.
+type Motion struct {
+	Speed        *float64 `json:"speed,omitempty"`
+	Acceleration *float64 `json:"acceleration,omitempty"`
+	Heading      *float64 `json:"heading,omitempty"`
+	Pitch        *float64 `json:"pitch,omitempty"`
+}
+
+const (
+	// stillSpeed and stillAcceleration are the most a user standing still
+	// reads, allowing for sensor noise and a swaying hand.
+	stillSpeed        = 0.2
+	stillAcceleration = 0.3
+	// fastSpeed is a brisk walk, about two steps per second.
+	fastSpeed = 1.6
+	// steepPitch is the downward tilt from which the camera sees only the
+	// ground close by.
+	steepPitch = -50
+)
+
+// gait is how the user is moving.
+type gait int
+
+const (
+	gaitUnknown gait = iota
+	gaitStill
+	gaitWalking
+	gaitFast
+)
+
+func (m *Motion) valid() bool {
+	switch {
+	case m.Speed != nil && (*m.Speed < 0 || *m.Speed > 15):
+		return false
+	case m.Acceleration != nil && (*m.Acceleration < 0 || *m.Acceleration > 50):
+		return false
+	case m.Heading != nil && (*m.Heading < 0 || *m.Heading >= 360):
+		return false
+	case m.Pitch != nil && (*m.Pitch < -90 || *m.Pitch > 90):
+		return false
+	}
+	return true
+}
+
+func (m *Motion) gait() gait {
+	switch {
+	case m.Speed != nil && *m.Speed >= fastSpeed:
+		return gaitFast
+	case m.Speed != nil && *m.Speed > stillSpeed:
+		return gaitWalking
+	case m.Acceleration != nil && *m.Acceleration > stillAcceleration:
+		// Moving, at a speed the sensors can't tell
+		return gaitWalking
+	case m.Speed != nil || m.Acceleration != nil:
+		return gaitStill
+	default:
+		return gaitUnknown
+	}
+}
+
+// motionContext renders the motion as extra prompt text, which adjusts what
+// the guidance should focus on. Values are rounded so that the text, part of
+// the frame cache key, stays the same while the user keeps their pace.
+func motionContext(m *Motion) string {
+	var lines []string
+	lines = append(lines, "# Motion Context:")
+
+	switch m.gait() {
+	case gaitFast:
+		lines = append(lines, fmt.Sprintf("The user is walking fast, about %.1f meters per second. Extend the lookahead: treat hazards up to 6 steps ahead in the path as [FRONT] hazards, and announce them early.", *m.Speed))
+	case gaitWalking:
+		lines = append(lines, "The user is walking at a normal pace.")
+	case gaitStill:
+		lines = append(lines, "The user is standing still. If they are at a curb or crossing, report the pedestrian signal and the traffic first, before obstacles on the path.")
+	}
+
+	if m.Pitch != nil && *m.Pitch <= steepPitch {
+		lines = append(lines, "The camera points steeply down and shows only the ground close by. If the path ahead can't be judged, say so.")
+	}
+
+	if len(lines) == 1 {
+		return ""
+	}
+	return strings.Join(lines, "\n")
+}
+
+// requestHeading is the heading of the camera, preferably the one sent with
+// the location.
+func requestHeading(req HazardDetectionRequest) *float64 {
+	if req.Location != nil && req.Location.Heading != nil {
+		return req.Location.Heading
+	}
+	if req.Motion != nil {
+		return req.Motion.Heading
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package detecthazards
+
+import (
+	"math"
+	"time"
+
+	"example.com/buddy-paws/internal/imagedata"
+)
+
+// nightPrompt is the variant of the prompt for low-light frames. It shares
+// the versions of the day prompt.
+const nightPrompt = "detect-hazards/night"
+
+const (
+	// darkBrightness is the mean luminance below which a frame is low-light
+	// at any time of day, e.g. in an unlit underpass.
+	darkBrightness = 0.15
+	// duskBrightness is the mean luminance below which a frame taken after
+	// sunset is low-light; street lighting brightens parts of the frame
+	// without revealing the rest.
+	duskBrightness = 0.3
+	// civilTwilight is the sun elevation, in degrees, below which it is
+	// dark outdoors.
+	civilTwilight = -6.0
+)
+
+// lowLight reports whether the frame calls for the night prompt, from its
+// brightness and, with a location, the position of the sun. Frames that
+// can't be decoded are judged by the sun alone.
+func lowLight(imageData []byte, loc *Location, now time.Time) bool {
+	afterDusk := loc != nil && sunElevation(loc.Lat, loc.Lng, now) < civilTwilight
+
+	brightness, err := imagedata.Brightness(imageData)
+	if err != nil {
+		return afterDusk
+	}
+	return brightness < darkBrightness || (afterDusk && brightness < duskBrightness)
+}
+
+// sunElevation returns the elevation of the sun above the horizon, in
+// degrees, using the low-precision formulas of the Astronomical Almanac,
+// accurate to about a degree.
+func sunElevation(lat, lng float64, t time.Time) float64 {
+	const rad = math.Pi / 180
+
+	// Days since J2000.0
+	d := t.Sub(time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)).Hours() / 24
+
+	meanAnomaly := (357.529 + 0.98560028*d) * rad
+	meanLongitude := 280.459 + 0.98564736*d
+	eclipticLongitude := (meanLongitude + 1.915*math.Sin(meanAnomaly) + 0.020*math.Sin(2*meanAnomaly)) * rad
+	obliquity := (23.439 - 0.00000036*d) * rad
+
+	rightAscension := math.Atan2(math.Cos(obliquity)*math.Sin(eclipticLongitude), math.Cos(eclipticLongitude))
+	declination := math.Asin(math.Sin(obliquity) * math.Sin(eclipticLongitude))
+
+	siderealTime := (280.46061837 + 360.98564736629*d + lng) * rad
+	hourAngle := siderealTime - rightAscension
+
+	latitude := lat * rad
+	elevation := math.Asin(math.Sin(latitude)*math.Sin(declination) + math.Cos(latitude)*math.Cos(declination)*math.Cos(hourAngle))
+	return elevation / rad
+}
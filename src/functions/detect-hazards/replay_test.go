@@ -0,0 +1,89 @@
+package detecthazards
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"example.com/buddy-paws/internal/apiversion"
+	"example.com/buddy-paws/internal/replaytest"
+	"example.com/buddy-paws/pkg/model"
+	"example.com/buddy-paws/pkg/severity"
+)
+
+func TestDetectHazardsReplay(t *testing.T) {
+	tests := []struct {
+		cassette     string
+		wantSpeech   string
+		wantSeverity model.Severity
+		wantEarcon   severity.Earcon
+		wantHazards  int
+		wantRescan   bool
+		wantDegraded bool
+	}{
+		{
+			cassette:     "bicycle",
+			wantSpeech:   "CAUTION, Parked bicycle three steps ahead. Move slightly to the left to avoid the bicycle.",
+			wantSeverity: model.SeverityMedium,
+			wantEarcon:   severity.EarconCaution,
+			wantHazards:  1,
+		},
+		{
+			// The model said CAUTION about a HIGH hazard
+			cassette:     "manhole",
+			wantSpeech:   "STOP. Open manhole two steps ahead. Move slightly to the right",
+			wantSeverity: model.SeverityHigh,
+			wantEarcon:   severity.EarconStop,
+			wantHazards:  1,
+		},
+		{
+			cassette:     "clear",
+			wantSpeech:   "STRAIGHT",
+			wantSeverity: model.SeverityLow,
+			wantEarcon:   severity.EarconClear,
+		},
+		{
+			cassette:     "dark",
+			wantSpeech:   rescanSpeech,
+			wantSeverity: model.SeverityMedium,
+			wantEarcon:   severity.EarconCaution,
+			wantRescan:   true,
+		},
+		{
+			cassette:     "blocked",
+			wantSpeech:   unavailableResponse.SpeechText,
+			wantSeverity: model.SeverityMedium,
+			wantEarcon:   severity.EarconCaution,
+			wantDegraded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cassette, func(t *testing.T) {
+			req := HazardDetectionRequest{Image: replaytest.Image(t), Verbose: true}
+			w := replaytest.Serve(t, tt.cassette, "/detect-hazards/v2", apiversion.Negotiate(DetectHazards), req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+
+			var got HazardDetectionResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.SpeechText != tt.wantSpeech {
+				t.Errorf("speechText = %q, want %q", got.SpeechText, tt.wantSpeech)
+			}
+			if got.Severity != tt.wantSeverity {
+				t.Errorf("severity = %s, want %s", got.Severity, tt.wantSeverity)
+			}
+			if got.Earcon != tt.wantEarcon {
+				t.Errorf("earcon = %q, want %q", got.Earcon, tt.wantEarcon)
+			}
+			if len(got.Hazards) != tt.wantHazards {
+				t.Errorf("%d hazards, want %d", len(got.Hazards), tt.wantHazards)
+			}
+			if got.Rescan != tt.wantRescan || got.Degraded != tt.wantDegraded {
+				t.Errorf("rescan, degraded = %v, %v, want %v, %v", got.Rescan, got.Degraded, tt.wantRescan, tt.wantDegraded)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package detecthazards
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/framecache"
+	"example.com/buddy-paws/pkg/model"
+)
+
+const (
+	// sessionTTL is how long a session's hazards are remembered. After a
+	// longer pause every hazard is announced again.
+	sessionTTL = 30 * time.Second
+	// unchangedDistance is the largest hash distance (see package
+	// framecache) between a frame and the last analyzed frame of its session
+	// for the view to count as unchanged. It is stricter than the frame
+	// cache, as an unchanged frame is not announced at all.
+	unchangedDistance = 2
+	// minSimilarity is the share of description words two detections of the
+	// same hazard type must have in common to be considered the same hazard.
+	minSimilarity = 0.3
+)
+
+var (
+	sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+	wordPattern      = regexp.MustCompile(`[a-z]+`)
+)
+
+// stopWords are ignored when comparing hazard descriptions; they describe
+// where a hazard is rather than what it is.
+var stopWords = map[string]bool{
+	"the": true, "and": true, "are": true, "is": true, "on": true, "in": true,
+	"of": true, "to": true, "with": true, "from": true, "ahead": true,
+	"caution": true, "left": true, "right": true, "front": true, "side": true,
+	"path": true, "your": true, "you": true, "there": true, "near": true,
+}
+
+// hazardSession is the tracking state of one walking session. FrameHash is
+// the perceptual hash of the last analyzed frame, 0 if unknown. UserID is
+// the verified user walking, if known, who owns the session and can delete
+// it.
+type hazardSession struct {
+	UserID    string
+	Hazards   []Hazard
+	NextID    int64
+	FrameHash uint64
+	UpdatedAt time.Time
+}
+
+// sessionStore keeps hazard sessions in Firestore under
+// hazardSessions/{uid}:{sessionId}, so consecutive frames can land on any
+// instance. The session ID is chosen by the client, so it is scoped by the
+// verified caller: another user reusing it gets a session of their own
+// rather than silencing the announcements of the first. Sessions of
+// anonymous callers are stored under hazardSessions/{sessionId}, which
+// can't contain the colon.
+type sessionStore struct {
+	fs       *firestore.Service
+	database string
+}
+
+func newSessionStore(ctx context.Context, projectID string) (*sessionStore, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionStore{
+		fs:       fs,
+		database: fmt.Sprintf("projects/%s/databases/(default)/documents", projectID),
+	}, nil
+}
+
+func (s *sessionStore) document(userID, sessionID string) string {
+	if userID == "" {
+		return fmt.Sprintf("%s/hazardSessions/%s", s.database, sessionID)
+	}
+	return fmt.Sprintf("%s/hazardSessions/%s:%s", s.database, userID, sessionID)
+}
+
+// load returns the stored session of the caller, or an empty one if it
+// doesn't exist.
+func (s *sessionStore) load(ctx context.Context, userID, sessionID string) (hazardSession, error) {
+	doc, err := s.fs.Projects.Databases.Documents.Get(s.document(userID, sessionID)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return hazardSession{}, nil
+		}
+		return hazardSession{}, err
+	}
+
+	session := hazardSession{UserID: doc.Fields["userId"].StringValue, NextID: doc.Fields["nextId"].IntegerValue}
+	session.FrameHash, _ = strconv.ParseUint(doc.Fields["frameHash"].StringValue, 16, 64)
+	session.UpdatedAt, _ = time.Parse(time.RFC3339Nano, doc.Fields["updatedAt"].TimestampValue)
+	if hazards := doc.Fields["hazards"].ArrayValue; hazards != nil {
+		for _, v := range hazards.Values {
+			if v.MapValue == nil {
+				continue
+			}
+			fields := v.MapValue.Fields
+			session.Hazards = append(session.Hazards, Hazard{
+				ID:          fields["id"].StringValue,
+				Position:    model.Position(fields["position"].StringValue),
+				Type:        fields["type"].StringValue,
+				Severity:    model.Severity(fields["severity"].StringValue),
+				Description: fields["description"].StringValue,
+			})
+		}
+	}
+
+	return session, nil
+}
+
+// save stores the session under the key of its user. expiresAt is meant
+// for a Firestore TTL policy so abandoned sessions get cleaned up.
+func (s *sessionStore) save(ctx context.Context, sessionID string, session hazardSession) error {
+	hazards := &firestore.ArrayValue{}
+	for _, h := range session.Hazards {
+		hazards.Values = append(hazards.Values, &firestore.Value{
+			MapValue: &firestore.MapValue{
+				Fields: map[string]firestore.Value{
+					"id":          {StringValue: h.ID},
+					"position":    {StringValue: string(h.Position)},
+					"type":        {StringValue: h.Type},
+					"severity":    {StringValue: string(h.Severity)},
+					"description": {StringValue: h.Description},
+				},
+			},
+		})
+	}
+
+	doc := &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"hazards":   {ArrayValue: hazards},
+			"nextId":    {IntegerValue: session.NextID, ForceSendFields: []string{"IntegerValue"}},
+			"frameHash": {StringValue: strconv.FormatUint(session.FrameHash, 16)},
+			"updatedAt": {TimestampValue: session.UpdatedAt.Format(time.RFC3339Nano)},
+			"expiresAt": {TimestampValue: session.UpdatedAt.Add(sessionTTL).Format(time.RFC3339Nano)},
+		},
+	}
+
+	if session.UserID != "" {
+		doc.Fields["userId"] = firestore.Value{StringValue: session.UserID}
+	}
+
+	_, err := s.fs.Projects.Databases.Documents.Patch(s.document(session.UserID, sessionID), doc).Context(ctx).Do()
+	return err
+}
+
+// trackHazards matches the detected hazards against the previous frame of the
+// session, assigning each one a session-scoped ID, and returns the hazards
+// worth announcing: new ones, escalated ones, and HIGH hazards still in front
+// of the user. The session is updated to the current frame.
+func trackHazards(session *hazardSession, hazards []Hazard, now time.Time) []Hazard {
+	previous := session.Hazards
+	if now.Sub(session.UpdatedAt) > sessionTTL {
+		previous = nil
+	}
+
+	matched := make([]bool, len(previous))
+	var surfaced []Hazard
+	for i := range hazards {
+		h := &hazards[i]
+
+		best, bestScore := -1, 0.0
+		for j, p := range previous {
+			if matched[j] || !strings.EqualFold(p.Type, h.Type) {
+				continue
+			}
+			if score := similarity(p.Description, h.Description); score >= minSimilarity && score > bestScore {
+				best, bestScore = j, score
+			}
+		}
+
+		if best < 0 {
+			session.NextID++
+			h.ID = "h" + strconv.FormatInt(session.NextID, 10)
+			surfaced = append(surfaced, *h)
+			continue
+		}
+
+		matched[best] = true
+		p := previous[best]
+		h.ID = p.ID
+
+		escalated := h.Severity.Rank() > p.Severity.Rank() ||
+			(isFront(h.Position) && !isFront(p.Position))
+		persistent := isFront(h.Position) && h.Severity == model.SeverityHigh
+		if escalated || persistent {
+			surfaced = append(surfaced, *h)
+		}
+	}
+
+	session.Hazards = hazards
+	session.UpdatedAt = now
+
+	return surfaced
+}
+
+// similarity is the Jaccard index of the significant words of two hazard
+// descriptions.
+func similarity(a, b string) float64 {
+	wordsA, wordsB := significantWords(a), significantWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	common := 0
+	for w := range wordsA {
+		if wordsB[w] {
+			common++
+		}
+	}
+
+	return float64(common) / float64(len(wordsA)+len(wordsB)-common)
+}
+
+func significantWords(s string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range wordPattern.FindAllString(strings.ToLower(s), -1) {
+		if len(w) < 3 || stopWords[w] {
+			continue
+		}
+		words[strings.TrimSuffix(w, "s")] = true
+	}
+	return words
+}
+
+func isFront(position model.Position) bool {
+	return position == model.PositionFront
+}
+
+// updateSession runs trackHazards against the stored session of the
+// verified user, if any, and persists the result along with the hash of the
+// analyzed frame.
+func updateSession(ctx context.Context, projectID, sessionID, userID string, hazards []Hazard, frameHash uint64) ([]Hazard, error) {
+	store, err := newSessionStore(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := store.load(ctx, userID, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("loading session: %w", err)
+	}
+
+	surfaced := trackHazards(&session, hazards, time.Now().UTC())
+	session.FrameHash = frameHash
+	session.UserID = userID
+
+	if err := store.save(ctx, sessionID, session); err != nil {
+		return nil, fmt.Errorf("saving session: %w", err)
+	}
+
+	return surfaced, nil
+}
+
+// unchangedFrame reports whether a frame looks like the last analyzed frame
+// of its session, i.e. neither the user nor anything in view has moved.
+// The comparison is always against the analyzed frame, so a slow drift
+// still adds up to a change, and only within FRAME_CACHE_TTL of its
+// analysis, as a hazard may walk into an unchanged view.
+func unchangedFrame(ctx context.Context, projectID, sessionID, userID string, frameHash uint64) (bool, error) {
+	store, err := newSessionStore(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+
+	session, err := store.load(ctx, userID, sessionID)
+	if err != nil {
+		return false, fmt.Errorf("loading session: %w", err)
+	}
+
+	ttl := config.Get().FrameCacheTTL
+	if session.FrameHash == 0 || ttl <= 0 || time.Since(session.UpdatedAt) > ttl {
+		return false, nil
+	}
+	return framecache.Distance(session.FrameHash, frameHash) <= unchangedDistance, nil
+}
@@ -0,0 +1,19 @@
+package detecthazards
+
+import "testing"
+
+func TestSessionDocumentScopedByCaller(t *testing.T) {
+	store := &sessionStore{database: "projects/test/databases/(default)/documents"}
+
+	owner := store.document("alice", "walk-1")
+	for _, userID := range []string{"bob", ""} {
+		if got := store.document(userID, "walk-1"); got == owner {
+			t.Errorf("caller %q reusing the session ID of alice got her session %s", userID, got)
+		}
+	}
+
+	// An anonymous caller can't name the session of a user as its own
+	if sessionIDPattern.MatchString("alice:walk-1") {
+		t.Error("session IDs may contain the separator of the caller")
+	}
+}
@@ -0,0 +1,15 @@
+package detecthazards
+
+import "example.com/buddy-paws/internal/verbosity"
+
+// terseTokens divides the output token limit of a terse answer, see
+// verbosity.Tokens.
+const terseTokens = 2
+
+// verbosityPrompts describe the levels of HazardDetectionRequest.Verbosity.
+var verbosityPrompts = verbosity.Prompts{
+	Terse: `The user is walking and needs guidance at a glance. Keep safe_direction to the command and at most three more words, e.g. "STOP. Pole ahead." or "LEFT". Keep hazard descriptions to a few words.
+Always start safe_direction with the command the severity calls for.`,
+	Detailed: `The user is exploring and wants to know the surroundings. After the command, safe_direction may describe the hazards and the layout of the path in two short sentences of under 25 words in all, e.g. "CAUTION, bicycle parked on the right edge of the sidewalk, about 3 steps ahead. The path continues straight past a bus stop."
+Always start safe_direction with the command the severity calls for.`,
+}
@@ -0,0 +1,201 @@
+package detecthazards
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// Weather is the current weather at the user, sent by the client or looked
+// up from the location. Temperature is in degrees Celsius.
+type Weather struct {
+	Condition   string   `json:"condition"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// Weather conditions.
+const (
+	WeatherClear  = "clear"
+	WeatherCloudy = "cloudy"
+	WeatherFog    = "fog"
+	WeatherRain   = "rain"
+	WeatherSnow   = "snow"
+	WeatherIce    = "ice"
+	WeatherStorm  = "storm"
+)
+
+var weatherConditions = map[string]bool{
+	WeatherClear:  true,
+	WeatherCloudy: true,
+	WeatherFog:    true,
+	WeatherRain:   true,
+	WeatherSnow:   true,
+	WeatherIce:    true,
+	WeatherStorm:  true,
+}
+
+const (
+	// weatherTimeout bounds the weather lookup, like osmTimeout.
+	weatherTimeout = 2 * time.Second
+	// weatherTTL is how long a lookup is reused for the same area.
+	weatherTTL = 10 * time.Minute
+	// weatherGrid is the size of the areas sharing a lookup, in degrees,
+	// about 10 km.
+	weatherGrid = 0.1
+)
+
+type cachedWeather struct {
+	weather   Weather
+	fetchedAt time.Time
+}
+
+var (
+	weatherMu    sync.Mutex
+	weatherCache = map[string]cachedWeather{}
+)
+
+type openMeteoResponse struct {
+	Current struct {
+		Temperature   float64 `json:"temperature_2m"`
+		Precipitation float64 `json:"precipitation"`
+		WeatherCode   int     `json:"weather_code"`
+	} `json:"current"`
+}
+
+func (w *Weather) valid() bool {
+	if !weatherConditions[strings.ToLower(w.Condition)] {
+		return false
+	}
+	return w.Temperature == nil || (*w.Temperature > -60 && *w.Temperature < 60)
+}
+
+// currentWeather looks up the weather at the location with the Open-Meteo
+// API, unless WEATHER_DISABLED is set. Lookups are cached per area.
+func currentWeather(ctx context.Context, loc *Location) (*Weather, error) {
+	cfg := config.Get()
+	if cfg.WeatherDisabled {
+		return nil, nil
+	}
+
+	lat := math.Round(loc.Lat/weatherGrid) * weatherGrid
+	lng := math.Round(loc.Lng/weatherGrid) * weatherGrid
+	key := fmt.Sprintf("%.1f,%.1f", lat, lng)
+
+	weatherMu.Lock()
+	entry, ok := weatherCache[key]
+	weatherMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < weatherTTL {
+		return &entry.weather, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, weatherTimeout)
+	defer cancel()
+
+	query := url.Values{
+		"latitude":  {fmt.Sprintf("%.2f", lat)},
+		"longitude": {fmt.Sprintf("%.2f", lng)},
+		"current":   {"temperature_2m,precipitation,weather_code"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.WeatherURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("weather API returned %s", resp.Status)
+	}
+
+	var result openMeteoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	temperature := result.Current.Temperature
+	weather := Weather{
+		Condition:   weatherCondition(result.Current.WeatherCode, temperature, result.Current.Precipitation),
+		Temperature: &temperature,
+	}
+
+	weatherMu.Lock()
+	weatherCache[key] = cachedWeather{weather: weather, fetchedAt: time.Now()}
+	weatherMu.Unlock()
+
+	return &weather, nil
+}
+
+// weatherCondition maps a WMO weather code to a condition. Rain at freezing
+// temperatures is ice.
+func weatherCondition(code int, temperature, precipitation float64) string {
+	var condition string
+	switch {
+	case code == 56, code == 57, code == 66, code == 67:
+		// Freezing drizzle and rain
+		return WeatherIce
+	case code >= 95:
+		condition = WeatherStorm
+	case code >= 71 && code <= 77, code == 85, code == 86:
+		return WeatherSnow
+	case code >= 51 && code <= 65, code >= 80 && code <= 82:
+		condition = WeatherRain
+	case code == 45, code == 48:
+		return WeatherFog
+	case code >= 2:
+		condition = WeatherCloudy
+	default:
+		condition = WeatherClear
+	}
+
+	if condition != WeatherClear && condition != WeatherCloudy && temperature <= 0 && precipitation > 0 {
+		return WeatherIce
+	}
+	return condition
+}
+
+// weatherContext renders the weather as extra prompt text, for the wet,
+// snowy and icy ground conditions it makes likely. Weather that doesn't
+// affect the ground renders as nothing.
+func weatherContext(w *Weather) string {
+	temperature := ""
+	freezing := false
+	if w.Temperature != nil {
+		temperature = fmt.Sprintf(" (%.0f°C)", *w.Temperature)
+		freezing = *w.Temperature <= 0
+	}
+
+	var line string
+	switch strings.ToLower(w.Condition) {
+	case WeatherRain, WeatherStorm:
+		line = "It is currently raining" + temperature + ". Surfaces are likely wet and slippery: classify visible wet surfaces, puddles and slippery paving as Ground Conditions."
+	case WeatherSnow:
+		line = "It is currently snowing" + temperature + ". Snow may cover curbs, steps and holes: lower your confidence where the ground is covered."
+	case WeatherIce:
+		line = "It is icy" + temperature + ". Shiny or wet-looking surfaces may be ice: classify them as HIGH severity ice patches."
+	case WeatherFog:
+		line = "It is foggy" + temperature + ". Distant objects may be hidden: lower your confidence about the path further ahead."
+	default:
+		if !freezing {
+			return ""
+		}
+		line = "It is freezing" + temperature + ". Wet-looking surfaces may be icy."
+	}
+
+	return strings.Join([]string{
+		"# Weather Context:",
+		line,
+		"Use the weather to interpret what is visible. Never report a hazard that is not visible in the image.",
+	}, "\n")
+}
@@ -0,0 +1,306 @@
+package emergencyassist
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/pubsub/v1"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request describes the user's surroundings in an emergency. Location is
+// required: a summary without coordinates is of little use to responders.
+// NotifyCaregiver alerts the caregivers of the signed-in user, see package
+// auth.
+type Request struct {
+	Image           string    `json:"image"`
+	Location        *Location `json:"location"`
+	Text            string    `json:"text"`
+	NotifyCaregiver bool      `json:"notifyCaregiver"`
+	Model           string    `json:"model,omitempty"`
+}
+
+type Location struct {
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Accuracy float64 `json:"accuracy,omitempty"`
+}
+
+// Response is the summary for responders. Degraded is set when no model
+// could describe the surroundings, and the summary only gives the location.
+type Response struct {
+	SpeechText string `json:"speechText"`
+	Summary    string `json:"summary"`
+	MapsURL    string `json:"mapsUrl"`
+	Notified   bool   `json:"notified"`
+	Degraded   bool   `json:"degraded,omitempty"`
+}
+
+// unavailableSummary stands in for the description of the surroundings
+// when no model could give one.
+const unavailableSummary = "I need help. My surroundings couldn't be described."
+
+// CaregiverAlert is the message published for the notification service,
+// which looks up the caregivers of the UID and contacts them.
+type CaregiverAlert struct {
+	UID       string   `json:"uid"`
+	Summary   string   `json:"summary"`
+	Location  Location `json:"location"`
+	MapsURL   string   `json:"mapsUrl"`
+	UserNote  string   `json:"userNote,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+// EmergencyAssist is the Cloud Function entry point
+func EmergencyAssist(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+	caregiverTopic := cfg.CaregiverTopic
+
+	// Creates a logger.
+	logName := "emergency-assist"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail, which only ever downgrades the model of an
+	// emergency
+	modelName = budget.Downgrade(ctx, modelName)
+
+	if req.Location == nil || req.Location.Lat < -90 || req.Location.Lat > 90 || req.Location.Lng < -180 || req.Location.Lng > 180 {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid location")
+		return
+	}
+
+	// Only signed-in users can alert caregivers, their own
+	uid := auth.Caller(ctx, r)
+	if req.NotifyCaregiver && uid == "" {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Sign in to notify a caregiver")
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	// A model outage must not hold back the caregiver alert: the summary
+	// then gives the location alone
+	text, err := describe(ctx, logName, uid, modelName, promptVersion, req.Text, format, imageData)
+	degraded := err != nil
+	if degraded {
+		logger.Printf("Error at processing, summarizing the location only: %v", err)
+		text = unavailableSummary
+	}
+
+	// The coordinates are added here rather than by the model so they are
+	// never misread or rounded.
+	mapsURL := fmt.Sprintf("https://www.google.com/maps/search/?api=1&query=%.6f,%.6f", req.Location.Lat, req.Location.Lng)
+	summary := fmt.Sprintf("%s My GPS location is %.5f, %.5f.", strings.TrimSpace(text), req.Location.Lat, req.Location.Lng)
+
+	response := Response{
+		SpeechText: summary,
+		Summary:    summary,
+		MapsURL:    mapsURL,
+		Degraded:   degraded,
+	}
+
+	if req.NotifyCaregiver {
+		alert := CaregiverAlert{
+			UID:       uid,
+			Summary:   summary,
+			Location:  *req.Location,
+			MapsURL:   mapsURL,
+			UserNote:  req.Text,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+		if err := notifyCaregiver(ctx, projectID, caregiverTopic, alert); err != nil {
+			logger.Printf("Error notifying caregiver: %v", err)
+			response.SpeechText += persona.Speech(" Buddy couldn't reach your caregiver. Please call for help directly.")
+		} else {
+			response.Notified = true
+			response.SpeechText += " Your caregiver has been notified."
+		}
+	}
+
+	// Return response
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// describe has the model describe the surroundings in the image for
+// responders, with the note of the user.
+func describe(ctx context.Context, logName, uid, modelName, promptVersion, note, format string, imageData []byte) (string, error) {
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.2,
+		MaxOutputTokens: 256,
+	}))
+	if err != nil {
+		return "", fmt.Errorf("creating client: %w", err)
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, uid, model)
+
+	vars := prompts.DefaultVars()
+	vars.Text = note
+	prompt, err := prompts.Render(ctx, "emergency-assist", promptVersion, vars)
+	if err != nil {
+		return "", fmt.Errorf("loading prompt: %w", err)
+	}
+
+	return model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+}
+
+// notifyCaregiver publishes the alert to the caregiver topic.
+func notifyCaregiver(ctx context.Context, projectID, topic string, alert CaregiverAlert) error {
+	if topic == "" {
+		return errors.New("CAREGIVER_TOPIC is not set")
+	}
+
+	svc, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.Projects.Topics.Publish(fmt.Sprintf("projects/%s/topics/%s", projectID, topic), &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"uid": alert.UID, "type": "emergency"},
+		}},
+	}).Context(ctx).Do()
+
+	return err
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package healthz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	secretmanager "google.golang.org/api/secretmanager/v1"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/gemini"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+type Response struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// Component is the health of one dependency. Detail never contains secret
+// values, only names of missing settings or error messages.
+type Component struct {
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	CheckedAt string `json:"checkedAt,omitempty"`
+	Cached    bool   `json:"cached,omitempty"`
+}
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+	// StatusSkipped is reported for checks that are not configured.
+	StatusSkipped = "skipped"
+)
+
+const (
+	checkTimeout = 5 * time.Second
+)
+
+// geminiProbe caches the last Gemini check across requests on the same
+// instance, so frequent uptime checks don't hammer the API.
+var geminiProbe struct {
+	sync.Mutex
+	result    Component
+	checkedAt time.Time
+}
+
+// Healthz is the Cloud Function entry point. It is meant for uptime checks:
+// it accepts GET without an API key and never calls the model with an image.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	response := Response{
+		Status: StatusOK,
+		Components: map[string]Component{
+			"config":  checkConfig(),
+			"secrets": checkSecrets(ctx),
+			"gemini":  checkGemini(ctx),
+		},
+	}
+
+	code := http.StatusOK
+	for name, c := range response.Components {
+		if c.Status == StatusError {
+			log.Printf("Health check %s failed: %s", name, c.Detail)
+			response.Status = StatusError
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	respondWithJSON(w, code, response)
+
+}
+
+func checkConfig() Component {
+	if _, err := config.Load(); err != nil {
+		return Component{Status: StatusError, Detail: err.Error()}
+	}
+	if config.Get().APIKey == "" {
+		return Component{Status: StatusError, Detail: "missing API_KEY"}
+	}
+	return Component{Status: StatusOK}
+}
+
+// checkSecrets accesses each Secret Manager version listed in
+// HEALTHZ_SECRETS (comma-separated resource names such as
+// projects/p/secrets/api-key/versions/latest). The payload is discarded.
+func checkSecrets(ctx context.Context) Component {
+	names := config.Get().HealthzSecrets
+	if len(names) == 0 {
+		return Component{Status: StatusSkipped}
+	}
+
+	sm, err := secretmanager.NewService(ctx)
+	if err != nil {
+		return Component{Status: StatusError, Detail: fmt.Sprintf("creating client: %v", err)}
+	}
+
+	var failed []string
+	for _, name := range names {
+		if _, err := sm.Projects.Secrets.Versions.Access(name).Context(ctx).Do(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return Component{Status: StatusError, Detail: strings.Join(failed, "; ")}
+	}
+	return Component{Status: StatusOK}
+}
+
+// checkGemini fetches the configured model's metadata, which proves the API
+// key and model name are valid without generating anything. The result is
+// cached for HEALTHZ_PROBE_TTL (a Go duration, default 5m).
+func checkGemini(ctx context.Context) Component {
+	ttl := config.Get().HealthzProbeTTL
+
+	geminiProbe.Lock()
+	defer geminiProbe.Unlock()
+
+	if !geminiProbe.checkedAt.IsZero() && time.Since(geminiProbe.checkedAt) < ttl {
+		result := geminiProbe.result
+		result.Cached = true
+		return result
+	}
+
+	result := probeGemini(ctx)
+	geminiProbe.checkedAt = time.Now()
+	result.CheckedAt = geminiProbe.checkedAt.UTC().Format(time.RFC3339)
+	geminiProbe.result = result
+
+	return result
+}
+
+func probeGemini(ctx context.Context) Component {
+	cfg := config.Get()
+	vertexApiKey := cfg.VertexAIAPIKey
+	modelName := cfg.ModelName
+	if !provider.UsesGemini() {
+		return Component{Status: StatusSkipped, Detail: "provider " + cfg.ModelProvider}
+	}
+	if (vertexApiKey == "" && gemini.NeedsAPIKey()) || modelName == "" {
+		return Component{Status: StatusSkipped, Detail: "not configured"}
+	}
+
+	if err := provider.Probe(ctx, modelName); err != nil {
+		return Component{Status: StatusError, Detail: err.Error()}
+	}
+	return Component{Status: StatusOK}
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
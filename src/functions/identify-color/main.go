@@ -0,0 +1,534 @@
+package identifycolor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request identifies the colors around a point of the image. X and Y are
+// normalized (0-1) tap coordinates and default to the image center.
+type Request struct {
+	Image   string   `json:"image"`
+	X       *float64 `json:"x,omitempty"`
+	Y       *float64 `json:"y,omitempty"`
+	Nuanced bool     `json:"nuanced"`
+	Model   string   `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string  `json:"speechText"`
+	Colors     []Color `json:"colors"`
+}
+
+type Color struct {
+	Name       string  `json:"name"`
+	Hex        string  `json:"hex"`
+	Percentage float64 `json:"percentage"`
+}
+
+const (
+	// regionSize is the side of the analyzed square, relative to the
+	// shorter image dimension.
+	regionSize = 0.2
+	// maxSamples caps the number of pixels fed to the clustering.
+	maxSamples = 4096
+	clusters   = 4
+	iterations = 10
+	// minShare drops colors covering less than this fraction of the region.
+	minShare = 0.1
+)
+
+// IdentifyColor is the Cloud Function entry point
+func IdentifyColor(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "identify-color"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	imageData, _, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	img, err := imagedata.DecodeImage(imageData)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	x, y := 0.5, 0.5
+	if req.X != nil {
+		x = *req.X
+	}
+	if req.Y != nil {
+		y = *req.Y
+	}
+	if x < 0 || x > 1 || y < 0 || y > 1 {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Coordinates must be between 0 and 1")
+		return
+	}
+
+	colors := dominantColors(img, x, y)
+
+	// Only ask the model when the caller wants shade names beyond the basic
+	// palette; the pixel analysis above is free. Past the daily spend
+	// guardrail in reject mode, the basic names are answered.
+	if req.Nuanced && len(colors) > 0 {
+		modelName, err := budget.Apply(ctx, modelName)
+		var names []string
+		if err == nil {
+			names, err = nameShades(ctx, usage.UserID(r), modelName, promptVersion, colors)
+		}
+		if err != nil {
+			logger.Printf("Error naming shades: %v", err)
+		} else {
+			for i := range colors {
+				colors[i].Name = names[i]
+			}
+		}
+	}
+
+	// Return response
+	response := Response{
+		SpeechText: describeColors(colors),
+		Colors:     colors,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// nameShades asks the model for precise shade names of the given colors,
+// returned in the same order.
+func nameShades(ctx context.Context, userID, modelName, promptVersion string, colors []Color) ([]string, error) {
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, "identify-color", provider.Options{
+		Temperature:     0.2,
+		MaxOutputTokens: 256,
+		JSON:            true,
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("creating client: %w", err)
+	}
+	defer model.Close()
+	defer usage.Track(ctx, "identify-color", userID, model)
+
+	hexes := make([]string, len(colors))
+	for i, c := range colors {
+		hexes[i] = c.Hex
+	}
+
+	prompt, err := prompts.Render(ctx, "identify-color/shades", promptVersion, struct {
+		prompts.Vars
+		Colors string
+	}{prompts.DefaultVars(), strings.Join(hexes, ", ")})
+	if err != nil {
+		return nil, err
+	}
+
+	jsonStr, err := model.Generate(ctx, provider.Text(prompt))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if err := json.Unmarshal([]byte(jsonStr), &names); err != nil {
+		return nil, err
+	}
+	if len(names) != len(colors) {
+		return nil, fmt.Errorf("expected %d names, got %d", len(colors), len(names))
+	}
+
+	return names, nil
+}
+
+type rgb struct {
+	r, g, b float64
+}
+
+// dominantColors clusters the pixels of a square region centered on the
+// normalized point (x, y) and returns the main colors, largest first.
+func dominantColors(img image.Image, x, y float64) []Color {
+	samples := sampleRegion(img, x, y)
+	if len(samples) == 0 {
+		return nil
+	}
+
+	centers, counts := kmeans(samples)
+
+	// Merge clusters that read the same so the answer doesn't say
+	// "blue, blue" for two slightly different shades.
+	type group struct {
+		sum   rgb
+		count int
+	}
+	groups := map[string]*group{}
+	for i, c := range centers {
+		if counts[i] == 0 {
+			continue
+		}
+		name := basicColorName(c)
+		g, ok := groups[name]
+		if !ok {
+			g = &group{}
+			groups[name] = g
+		}
+		g.sum.r += c.r * float64(counts[i])
+		g.sum.g += c.g * float64(counts[i])
+		g.sum.b += c.b * float64(counts[i])
+		g.count += counts[i]
+	}
+
+	var colors []Color
+	for name, g := range groups {
+		share := float64(g.count) / float64(len(samples))
+		if share < minShare {
+			continue
+		}
+		mean := rgb{g.sum.r / float64(g.count), g.sum.g / float64(g.count), g.sum.b / float64(g.count)}
+		colors = append(colors, Color{
+			Name:       name,
+			Hex:        fmt.Sprintf("#%02X%02X%02X", uint8(mean.r), uint8(mean.g), uint8(mean.b)),
+			Percentage: math.Round(share * 100),
+		})
+	}
+
+	sort.Slice(colors, func(i, j int) bool {
+		if colors[i].Percentage != colors[j].Percentage {
+			return colors[i].Percentage > colors[j].Percentage
+		}
+		return colors[i].Name < colors[j].Name
+	})
+
+	return colors
+}
+
+func sampleRegion(img image.Image, x, y float64) []rgb {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	side := int(float64(min(width, height)) * regionSize)
+	if side < 1 {
+		side = 1
+	}
+	cx := bounds.Min.X + int(x*float64(width))
+	cy := bounds.Min.Y + int(y*float64(height))
+	region := image.Rect(cx-side/2, cy-side/2, cx+side/2+1, cy+side/2+1).Intersect(bounds)
+
+	step := 1
+	for (region.Dx()/step)*(region.Dy()/step) > maxSamples {
+		step++
+	}
+
+	var samples []rgb
+	for py := region.Min.Y; py < region.Max.Y; py += step {
+		for px := region.Min.X; px < region.Max.X; px += step {
+			r, g, b, _ := img.At(px, py).RGBA()
+			samples = append(samples, rgb{float64(r >> 8), float64(g >> 8), float64(b >> 8)})
+		}
+	}
+
+	return samples
+}
+
+// kmeans runs a small deterministic k-means over the samples. Centers are
+// seeded from evenly spaced samples ordered by brightness.
+func kmeans(samples []rgb) ([]rgb, []int) {
+	sorted := make([]rgb, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return luminance(sorted[i]) < luminance(sorted[j])
+	})
+
+	k := min(clusters, len(samples))
+	centers := make([]rgb, k)
+	for i := range centers {
+		centers[i] = sorted[(2*i+1)*len(sorted)/(2*k)]
+	}
+
+	counts := make([]int, k)
+	for iter := 0; iter < iterations; iter++ {
+		sums := make([]rgb, k)
+		for i := range counts {
+			counts[i] = 0
+		}
+
+		for _, s := range samples {
+			best, bestDist := 0, math.MaxFloat64
+			for j, c := range centers {
+				if d := distance(s, c); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			counts[best]++
+			sums[best].r += s.r
+			sums[best].g += s.g
+			sums[best].b += s.b
+		}
+
+		for j := range centers {
+			if counts[j] > 0 {
+				centers[j] = rgb{sums[j].r / float64(counts[j]), sums[j].g / float64(counts[j]), sums[j].b / float64(counts[j])}
+			}
+		}
+	}
+
+	return centers, counts
+}
+
+func distance(a, b rgb) float64 {
+	dr, dg, db := a.r-b.r, a.g-b.g, a.b-b.b
+	return dr*dr + dg*dg + db*db
+}
+
+func luminance(c rgb) float64 {
+	return 0.2126*c.r + 0.7152*c.g + 0.0722*c.b
+}
+
+// toHSL converts a color to hue (0-360), saturation and lightness (0-1).
+func toHSL(c rgb) (float64, float64, float64) {
+	r, g, b := c.r/255, c.g/255, c.b/255
+	maxC := math.Max(r, math.Max(g, b))
+	minC := math.Min(r, math.Min(g, b))
+	l := (maxC + minC) / 2
+
+	if maxC == minC {
+		return 0, 0, l
+	}
+
+	d := maxC - minC
+	s := d / (1 - math.Abs(2*l-1))
+
+	var h float64
+	switch maxC {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+
+	return h, s, l
+}
+
+// basicColorName maps a color to a plain everyday name.
+func basicColorName(c rgb) string {
+	h, s, l := toHSL(c)
+
+	switch {
+	case l < 0.12:
+		return "black"
+	case l > 0.92:
+		return "white"
+	case s < 0.15:
+		switch {
+		case l < 0.35:
+			return "dark gray"
+		case l > 0.7:
+			return "light gray"
+		default:
+			return "gray"
+		}
+	}
+
+	var name string
+	switch {
+	case h < 15 || h >= 335:
+		name = "red"
+		if l > 0.7 {
+			return "pink"
+		}
+	case h < 40:
+		name = "orange"
+		if l < 0.45 {
+			return "brown"
+		}
+		if s < 0.5 && l > 0.7 {
+			return "beige"
+		}
+	case h < 65:
+		name = "yellow"
+		if l < 0.4 {
+			return "olive"
+		}
+		if s < 0.5 && l > 0.7 {
+			return "beige"
+		}
+	case h < 160:
+		name = "green"
+	case h < 190:
+		name = "teal"
+	case h < 250:
+		name = "blue"
+		if l < 0.3 {
+			return "navy"
+		}
+	case h < 290:
+		name = "purple"
+	default:
+		name = "pink"
+	}
+
+	switch {
+	case l < 0.3:
+		return "dark " + name
+	case l > 0.7:
+		return "light " + name
+	default:
+		return name
+	}
+}
+
+func describeColors(colors []Color) string {
+	if len(colors) == 0 {
+		return persona.Speech("Oops! Buddy couldn't make out any color here. Hold your device steady.")
+	}
+
+	if len(colors) == 1 {
+		return fmt.Sprintf("It's %s.", colors[0].Name)
+	}
+
+	names := make([]string, len(colors))
+	for i, c := range colors {
+		names[i] = fmt.Sprintf("%s (%.0f percent)", c.Name, c.Percentage)
+	}
+
+	return fmt.Sprintf("Mostly %s, with %s.", names[0], strings.Join(names[1:], " and "))
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,374 @@
+// Package abuse throttles and quarantines clients that keep sending junk,
+// each piece of which may cost a model call: images that don't decode,
+// content the model blocks and oversized bodies. Rejections are counted per
+// client, the device of its access token (see package devicetoken) or else
+// its address, as the static API key is shared by every install.
+//
+// Within ten minutes, ABUSE_THROTTLE rejections making up at least half of
+// a client's requests get it 429s for the rest of the window, on the
+// instance that counted them; requests ignoring the throttle count as
+// rejections too. ABUSE_QUARANTINE rejections quarantine it on
+// every instance for ABUSE_QUARANTINE_TTL: the quarantine is stored in
+// Firestore, abuse/{client}, logged to the "abuse" log and published on
+// ABUSE_TOPIC for alerting. Delete the document to lift it early.
+package abuse
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+const (
+	// window is the period rejections are counted over.
+	window = 10 * time.Minute
+	// throttleShare is the share of rejected requests that throttles.
+	throttleShare = 0.5
+	// quarantineCacheTTL is how long an instance trusts its copy of a
+	// client's quarantine.
+	quarantineCacheTTL = time.Minute
+	// maxTracked bounds the clients counted; expired windows are dropped
+	// beyond it.
+	maxTracked = 10000
+	// maxErrorBody is how much of an error response is kept to read its
+	// code.
+	maxErrorBody = 1 << 10
+
+	logName = "abuse"
+)
+
+// rejected are the error codes counted against a client.
+var rejected = map[apierror.Code]bool{
+	apierror.CodeImageInvalid:    true,
+	apierror.CodeContentBlocked:  true,
+	apierror.CodeRequestTooLarge: true,
+}
+
+// Alert is the message published on ABUSE_TOPIC.
+type Alert struct {
+	Client           string    `json:"client"`
+	Function         string    `json:"function"`
+	Requests         int       `json:"requests"`
+	Rejections       int       `json:"rejections"`
+	QuarantinedUntil time.Time `json:"quarantinedUntil"`
+}
+
+type counter struct {
+	start      time.Time
+	requests   int
+	rejections int
+	// quarantined is set once the client is quarantined, so it is
+	// announced once.
+	quarantined bool
+}
+
+type quarantine struct {
+	until     time.Time
+	checkedAt time.Time
+}
+
+var (
+	mu          sync.Mutex
+	counters    = map[string]*counter{}
+	quarantines = map[string]quarantine{}
+)
+
+// Handle refuses requests to function from throttled or quarantined
+// clients and counts the rejections of the others.
+func Handle(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Get()
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		ctx := r.Context()
+		id := client(r)
+
+		if until := quarantinedUntil(ctx, id); time.Now().Before(until) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+			apierror.Write(w, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Client quarantined after too many rejected requests"))
+			return
+		}
+		if retryAfter, throttled := throttled(id); throttled {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			apierror.Write(w, apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many rejected requests, please slow down"))
+			// Ignoring the throttle leads to quarantine
+			count(ctx, function, id, true)
+			return
+		}
+
+		// Absurd sizes are refused before anyone reads them
+		if r.ContentLength > int64(cfg.MaxRequestBytes) {
+			apierror.Write(w, apierror.New(http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request too large"))
+			count(ctx, function, id, true)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxRequestBytes))
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		count(ctx, function, id, rec.rejected())
+	}
+}
+
+// client identifies the sender of r.
+func client(r *http.Request) string {
+	if c, ok := devicetoken.FromContext(r.Context()); ok {
+		return "device-" + c.DeviceID
+	}
+
+	// Only the last hop, the one the load balancer appends, can be trusted:
+	// the client can send any hops before it
+	forwarded := r.Header.Get("X-Forwarded-For")
+	addr := strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+	if addr == "" {
+		addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	// Addresses aren't kept as such
+	sum := sha256.Sum256([]byte(addr))
+	return "addr-" + hex.EncodeToString(sum[:8])
+}
+
+// throttled reports whether client is throttled, and for how long.
+func throttled(client string) (time.Duration, bool) {
+	threshold := config.Get().AbuseThrottle
+	if threshold == 0 {
+		return 0, false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := counters[client]
+	if !ok || time.Since(c.start) > window {
+		return 0, false
+	}
+	if c.rejections >= threshold && float64(c.rejections) >= throttleShare*float64(c.requests) {
+		return time.Until(c.start.Add(window)), true
+	}
+	return 0, false
+}
+
+// count counts a request of client, and quarantines the client when it
+// has had too many rejected.
+func count(ctx context.Context, function, client string, rejection bool) {
+	cfg := config.Get()
+
+	mu.Lock()
+	now := time.Now()
+	if len(counters) > maxTracked {
+		for id, c := range counters {
+			if now.Sub(c.start) > window {
+				delete(counters, id)
+			}
+		}
+	}
+	c, ok := counters[client]
+	if !ok || now.Sub(c.start) > window {
+		c = &counter{start: now}
+		counters[client] = c
+	}
+	c.requests++
+	if rejection {
+		c.rejections++
+	}
+	quarantine := cfg.AbuseQuarantine > 0 && c.rejections >= cfg.AbuseQuarantine && !c.quarantined
+	if quarantine {
+		c.quarantined = true
+	}
+	alert := Alert{
+		Client:           client,
+		Function:         function,
+		Requests:         c.requests,
+		Rejections:       c.rejections,
+		QuarantinedUntil: now.Add(cfg.AbuseQuarantineTTL).UTC(),
+	}
+	mu.Unlock()
+
+	if quarantine {
+		// The response is written; the client's next request is refused
+		if err := quarantineClient(context.WithoutCancel(ctx), alert); err != nil {
+			log.Printf("Error quarantining %s: %v", client, err)
+		}
+	}
+}
+
+// quarantineClient stores the quarantine of a client and announces it.
+func quarantineClient(ctx context.Context, alert Alert) error {
+	cfg := config.Get()
+
+	mu.Lock()
+	quarantines[alert.Client] = quarantine{until: alert.QuarantinedUntil, checkedAt: time.Now()}
+	mu.Unlock()
+
+	logger, closeLog, err := cloudlog.New(ctx, cfg.ProjectID, logName)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	logger.Printf("Quarantined %s until %s: %d of %d requests rejected, last to %s",
+		alert.Client, alert.QuarantinedUntil.Format(time.RFC3339), alert.Rejections, alert.Requests, alert.Function)
+
+	if cfg.MockModel || cfg.ModelReplay != "" {
+		return nil
+	}
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = fs.Projects.Databases.Documents.Patch(document(alert.Client), &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"quarantinedUntil": {TimestampValue: alert.QuarantinedUntil.Format(time.RFC3339Nano)},
+			"requests":         {IntegerValue: int64(alert.Requests)},
+			"rejections":       {IntegerValue: int64(alert.Rejections)},
+			"function":         {StringValue: alert.Function},
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("storing quarantine: %w", err)
+	}
+
+	if cfg.AbuseTopic == "" {
+		return nil
+	}
+	return publish(ctx, cfg.ProjectID, cfg.AbuseTopic, alert)
+}
+
+// quarantinedUntil returns the end of the quarantine of client, zero if
+// it isn't quarantined. A quarantine that can't be read is ignored.
+func quarantinedUntil(ctx context.Context, client string) time.Time {
+	cfg := config.Get()
+	if cfg.AbuseQuarantine == 0 {
+		return time.Time{}
+	}
+
+	mu.Lock()
+	q, ok := quarantines[client]
+	mu.Unlock()
+	if ok && (time.Since(q.checkedAt) < quarantineCacheTTL || cfg.MockModel || cfg.ModelReplay != "") {
+		return q.until
+	}
+	if cfg.MockModel || cfg.ModelReplay != "" {
+		return time.Time{}
+	}
+
+	q = quarantine{checkedAt: time.Now()}
+	until, err := loadQuarantine(ctx, client)
+	if err != nil {
+		log.Printf("Error loading quarantine of %s: %v", client, err)
+	} else {
+		q.until = until
+	}
+
+	mu.Lock()
+	if len(quarantines) > maxTracked {
+		for id, q := range quarantines {
+			if time.Since(q.checkedAt) > quarantineCacheTTL {
+				delete(quarantines, id)
+			}
+		}
+	}
+	quarantines[client] = q
+	mu.Unlock()
+	return q.until
+}
+
+func loadQuarantine(ctx context.Context, client string) (time.Time, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(client)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	until, err := time.Parse(time.RFC3339Nano, doc.Fields["quarantinedUntil"].TimestampValue)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// publish announces a quarantine on topic.
+func publish(ctx context.Context, projectID, topic string, alert Alert) error {
+	svc, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.Projects.Topics.Publish(fmt.Sprintf("projects/%s/topics/%s", projectID, topic), &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"client": alert.Client, "type": "abuse"},
+		}},
+	}).Context(ctx).Do()
+	return err
+}
+
+func document(client string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/abuse/%s", config.Get().ProjectID, client)
+}
+
+// recorder passes a response through, keeping the start of error bodies
+// to read their code.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status >= http.StatusBadRequest && r.body.Len() < maxErrorBody {
+		r.body.Write(b[:min(len(b), maxErrorBody-r.body.Len())])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// rejected reports whether the response rejected junk.
+func (r *recorder) rejected() bool {
+	if r.status < http.StatusBadRequest {
+		return false
+	}
+	var problem struct {
+		Code apierror.Code `json:"code"`
+	}
+	json.Unmarshal(r.body.Bytes(), &problem)
+	return rejected[problem.Code]
+}
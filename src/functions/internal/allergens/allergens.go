@@ -0,0 +1,285 @@
+// Package allergens holds the allergens of users, in their Firestore
+// profile, users/{uid}:
+//
+//	allergens: e.g. ["peanuts", "milk", "kiwi"]
+//	allergensUpdatedAt: when they last changed them
+//
+// Functions read the list of the signed-in user, see auth.Caller. Check
+// finds them in the text of a label or a menu without the model, so a
+// warning never depends on the model noticing. A common allergen also
+// matches the ingredients made of it, e.g. milk matches "whey" and
+// "butter"; other allergens match their name.
+package allergens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// cacheTTL is how long a user's allergens are cached. A change takes up
+// to this long to reach other instances.
+const cacheTTL = 5 * time.Minute
+
+const (
+	maxAllergens = 20
+	maxLength    = 40
+)
+
+// ingredients are the ingredients each common allergen matches, by the
+// allergen's name, in the singular.
+var ingredients = map[string][]string{
+	"peanuts":   {"peanut", "groundnut", "arachis"},
+	"tree nuts": {"tree nut", "almond", "cashew", "walnut", "hazelnut", "pecan", "pistachio", "macadamia", "brazil nut", "praline", "marzipan"},
+	"milk":      {"milk", "dairy", "lactose", "whey", "casein", "caseinate", "butter", "cream", "cheese", "yogurt", "yoghurt", "ghee"},
+	"eggs":      {"egg", "albumin", "mayonnaise"},
+	"gluten":    {"gluten", "wheat", "barley", "rye", "spelt", "semolina", "couscous", "malt"},
+	"wheat":     {"wheat", "spelt", "semolina", "durum", "couscous"},
+	"soy":       {"soy", "soya", "soybean", "tofu", "edamame", "miso"},
+	"fish":      {"fish", "anchovy", "anchovies", "cod", "salmon", "tuna", "sardine", "mackerel"},
+	"shellfish": {"shellfish", "shrimp", "prawn", "crab", "lobster", "crayfish", "langoustine"},
+	"molluscs":  {"mollusc", "mollusk", "mussel", "oyster", "squid", "clam", "scallop", "octopus"},
+	"sesame":    {"sesame", "tahini"},
+	"mustard":   {"mustard"},
+	"celery":    {"celery", "celeriac"},
+	"lupin":     {"lupin"},
+	"sulphites": {"sulphite", "sulfite", "sulphur dioxide", "sulfur dioxide"},
+}
+
+// lookalikes are ingredients named like those of an allergen that don't
+// contain it, e.g. "cocoa butter".
+var lookalikes = map[string][]string{
+	"milk": {"cocoa butter", "shea butter", "peanut butter", "nut butter", "almond butter", "coconut milk", "coconut cream", "almond milk", "oat milk", "soy milk", "soya milk", "rice milk", "cream of tartar"},
+}
+
+// aliases are other names of the common allergens.
+var aliases = map[string]string{
+	"peanut":     "peanuts",
+	"nuts":       "tree nuts",
+	"nut":        "tree nuts",
+	"tree nut":   "tree nuts",
+	"dairy":      "milk",
+	"lactose":    "milk",
+	"egg":        "eggs",
+	"soya":       "soy",
+	"soybeans":   "soy",
+	"mollusks":   "molluscs",
+	"sulfites":   "sulphites",
+	"sulphite":   "sulphites",
+	"sulfite":    "sulphites",
+	"shell fish": "shellfish",
+}
+
+// Profile is a user's allergens, by name, e.g. "peanuts".
+type Profile struct {
+	Allergens []string   `json:"allergens"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// Validate checks the allergens, normalizing them to lower case and the
+// names of the common allergens, e.g. "Peanut" to "peanuts", without
+// duplicates.
+func (p *Profile) Validate() error {
+	if len(p.Allergens) > maxAllergens {
+		return fmt.Errorf("Invalid allergens, expected at most %d", maxAllergens)
+	}
+	seen := map[string]bool{}
+	normalized := []string{}
+	for i, allergen := range p.Allergens {
+		allergen = strings.Join(strings.Fields(strings.ToLower(allergen)), " ")
+		if allergen == "" || len(allergen) > maxLength {
+			return fmt.Errorf("Invalid allergen %d, expected 1 to %d characters", i+1, maxLength)
+		}
+		if name, ok := aliases[allergen]; ok {
+			allergen = name
+		}
+		if seen[allergen] {
+			continue
+		}
+		seen[allergen] = true
+		normalized = append(normalized, allergen)
+	}
+	p.Allergens = normalized
+	return nil
+}
+
+// patterns caches the pattern of each allergen.
+var patterns sync.Map
+
+// pattern matches the ingredients of allergen, in the singular or plural.
+func pattern(allergen string) *regexp.Regexp {
+	if p, ok := patterns.Load(allergen); ok {
+		return p.(*regexp.Regexp)
+	}
+
+	terms, ok := ingredients[allergen]
+	if !ok {
+		terms = []string{strings.TrimSuffix(allergen, "s")}
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	p := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)(s|es)?\b`)
+	patterns.Store(allergen, p)
+	return p
+}
+
+// freePattern matches the end of a "peanut-free" or "gluten free" claim.
+var freePattern = regexp.MustCompile(`(?i)^[- ]free\b`)
+
+// Check returns the allergens that text mentions, in the order of
+// allergens. Claims like "peanut-free" and lookalikes like "cocoa butter"
+// don't count; "may contain peanuts" does.
+func Check(text string, allergens []string) []string {
+	var found []string
+	for _, allergen := range allergens {
+		checked := strings.ToLower(text)
+		for _, lookalike := range lookalikes[allergen] {
+			checked = strings.ReplaceAll(checked, lookalike, strings.Repeat(" ", len(lookalike)))
+		}
+		for _, match := range pattern(allergen).FindAllStringIndex(checked, -1) {
+			if !freePattern.MatchString(checked[match[1]:]) {
+				found = append(found, allergen)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// Warning is the spoken warning about the allergens found, e.g. "Warning:
+// contains peanuts, which is on your allergy list."
+func Warning(found []string) string {
+	switch len(found) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("Warning: contains %s, which is on your allergy list.", found[0])
+	default:
+		list := strings.Join(found[:len(found)-1], ", ") + " and " + found[len(found)-1]
+		return fmt.Sprintf("Warning: contains %s, which are on your allergy list.", list)
+	}
+}
+
+// Context renders the allergens as extra prompt text, so the model names
+// the ingredients that Check looks for.
+func Context(allergens []string) string {
+	return fmt.Sprintf(`# Allergies:
+The user is allergic to: %s. Name every ingredient you can read that is or contains one of them, e.g. "whey" for milk, and say when a label says "may contain" one of them.`, strings.Join(allergens, ", "))
+}
+
+type cached struct {
+	profile   Profile
+	expiresAt time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]cached{}
+)
+
+// Get returns the allergens of userID, none for a request without a user.
+func Get(ctx context.Context, userID string) (Profile, error) {
+	if userID == "" {
+		return Profile{}, nil
+	}
+
+	mu.Lock()
+	c, ok := cache[userID]
+	mu.Unlock()
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.profile, nil
+	}
+
+	profile, err := load(ctx, userID)
+	if err != nil {
+		return Profile{}, err
+	}
+	remember(userID, profile)
+	return profile, nil
+}
+
+// Save replaces the allergens of userID with profile, which must be valid,
+// and returns them as stored.
+func Save(ctx context.Context, userID string, profile Profile) (Profile, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	values := make([]*firestore.Value, 0, len(profile.Allergens))
+	for _, allergen := range profile.Allergens {
+		values = append(values, &firestore.Value{StringValue: allergen})
+	}
+	doc := &firestore.Document{Fields: map[string]firestore.Value{
+		"allergens":          {ArrayValue: &firestore.ArrayValue{Values: values}},
+		"allergensUpdatedAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}}
+
+	saved, err := fs.Projects.Databases.Documents.Patch(document(userID), doc).
+		UpdateMaskFieldPaths("allergens", "allergensUpdatedAt").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	profile = fromDocument(saved)
+	remember(userID, profile)
+	return profile, nil
+}
+
+func load(ctx context.Context, userID string) (Profile, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(userID)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Profile{}, nil
+		}
+		return Profile{}, err
+	}
+	return fromDocument(doc), nil
+}
+
+func fromDocument(doc *firestore.Document) Profile {
+	profile := Profile{Allergens: []string{}}
+	if v, ok := doc.Fields["allergens"]; ok && v.ArrayValue != nil {
+		for _, value := range v.ArrayValue.Values {
+			if value.StringValue != "" {
+				profile.Allergens = append(profile.Allergens, value.StringValue)
+			}
+		}
+	}
+	if v, ok := doc.Fields["allergensUpdatedAt"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v.TimestampValue); err == nil {
+			profile.UpdatedAt = &t
+		}
+	}
+	return profile
+}
+
+func remember(userID string, profile Profile) {
+	mu.Lock()
+	cache[userID] = cached{profile: profile, expiresAt: time.Now().Add(cacheTTL)}
+	mu.Unlock()
+}
+
+func document(userID string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/users/%s", config.Get().ProjectID, userID)
+}
@@ -0,0 +1,137 @@
+// Package analytics turns guidance and user feedback into prompt-tuning
+// data. The guidance given for each hazard frame and every feedback are
+// streamed into BigQuery, and Aggregate rolls them up per day, function and
+// prompt version into the quality table.
+//
+// Tables live in ANALYTICS_DATASET ("dataset" in PROJECT_ID, or
+// "project.dataset"), with the schemas
+//
+//	guidance: time:TIMESTAMP, requestId:STRING, function:STRING,
+//	  promptVersion:STRING, model:STRING, severity:STRING, rescan:BOOLEAN,
+//	  degraded:BOOLEAN
+//	feedback: time:TIMESTAMP, requestId:STRING, rating:INTEGER,
+//	  userId:STRING, hasOutcome:BOOLEAN
+//	quality: day:DATE, function:STRING, promptVersion:STRING,
+//	  frames:INTEGER, low:INTEGER, medium:INTEGER, high:INTEGER,
+//	  unchanged:INTEGER, rescans:INTEGER, degraded:INTEGER,
+//	  rated:INTEGER, ratingSum:INTEGER, accurate:INTEGER,
+//	  ratedStops:INTEGER, falseStops:INTEGER
+//
+// Without ANALYTICS_DATASET nothing is recorded.
+package analytics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/requestid"
+)
+
+// insertTimeout bounds an insert; analytics must not hold up a response for
+// long.
+const insertTimeout = 2 * time.Second
+
+// Table names in ANALYTICS_DATASET.
+const (
+	GuidanceTable = "guidance"
+	FeedbackTable = "feedback"
+	QualityTable  = "quality"
+)
+
+// Guidance is the answer given for one frame.
+type Guidance struct {
+	Function      string
+	PromptVersion string
+	Model         string
+	Severity      string
+	Rescan        bool
+	Degraded      bool
+}
+
+// Feedback is a user's rating of the answer to a request.
+type Feedback struct {
+	RequestID  string
+	Rating     int
+	UserID     string
+	HasOutcome bool
+}
+
+// RecordGuidance streams the guidance of the request in ctx into the
+// guidance table. Failures are only logged.
+func RecordGuidance(ctx context.Context, g Guidance) {
+	err := insert(ctx, GuidanceTable, map[string]bigquery.JsonValue{
+		"time":          time.Now().UTC().Format(time.RFC3339Nano),
+		"requestId":     requestid.FromContext(ctx),
+		"function":      g.Function,
+		"promptVersion": g.PromptVersion,
+		"model":         g.Model,
+		"severity":      g.Severity,
+		"rescan":        g.Rescan,
+		"degraded":      g.Degraded,
+	})
+	if err != nil {
+		log.Printf("Error recording guidance: %v", err)
+	}
+}
+
+// RecordFeedback streams f into the feedback table.
+func RecordFeedback(ctx context.Context, f Feedback) error {
+	return insert(ctx, FeedbackTable, map[string]bigquery.JsonValue{
+		"time":       time.Now().UTC().Format(time.RFC3339Nano),
+		"requestId":  f.RequestID,
+		"rating":     f.Rating,
+		"userId":     f.UserID,
+		"hasOutcome": f.HasOutcome,
+	})
+}
+
+func insert(ctx context.Context, table string, row map[string]bigquery.JsonValue) error {
+	cfg := config.Get()
+	if cfg.AnalyticsDataset == "" {
+		return nil
+	}
+
+	project, dataset := splitDataset(cfg.AnalyticsDataset, cfg.ProjectID)
+
+	ctx, cancel := context.WithTimeout(ctx, insertTimeout)
+	defer cancel()
+
+	svc, err := bigquery.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := svc.Tabledata.InsertAll(project, dataset, table, &bigquery.TableDataInsertAllRequest{
+		Rows: []*bigquery.TableDataInsertAllRequestRows{{InsertId: insertID(), Json: row}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if len(resp.InsertErrors) > 0 && len(resp.InsertErrors[0].Errors) > 0 {
+		return fmt.Errorf("inserting into %s: %s", table, resp.InsertErrors[0].Errors[0].Message)
+	}
+	return nil
+}
+
+// splitDataset splits "project.dataset" or "dataset".
+func splitDataset(name, defaultProject string) (project, dataset string) {
+	if project, dataset, ok := strings.Cut(name, "."); ok {
+		return project, dataset
+	}
+	return defaultProject, name
+}
+
+// insertID lets BigQuery drop a row that is sent twice by a retry.
+func insertID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
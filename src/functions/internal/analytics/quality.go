@@ -0,0 +1,224 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+const (
+	// queryTimeout bounds an aggregation or summary query.
+	queryTimeout = 2 * time.Minute
+
+	// feedbackWindow is how long after a frame its feedback is counted.
+	feedbackWindow = 7
+)
+
+// ErrDisabled is returned when ANALYTICS_DATASET is not set.
+var ErrDisabled = errors.New("analytics are not configured")
+
+// A rating of at least goodRating means the guidance was right; at most
+// badRating, wrong. A badly rated HIGH severity is a false STOP: the user
+// was stopped for nothing.
+const (
+	goodRating = 4
+	badRating  = 2
+)
+
+// aggregateSQL replaces the quality rows of @day. Feedback is matched to the
+// guidance it rates by request ID; a request rated twice counts its latest
+// rating.
+const aggregateSQL = `
+DELETE FROM %[1]s WHERE day = @day;
+
+INSERT INTO %[1]s (day, function, promptVersion, frames, low, medium, high,
+  unchanged, rescans, degraded, rated, ratingSum, accurate, ratedStops, falseStops)
+SELECT
+  @day, g.function, g.promptVersion,
+  COUNT(*),
+  COUNTIF(g.severity = 'LOW'),
+  COUNTIF(g.severity = 'MEDIUM'),
+  COUNTIF(g.severity = 'HIGH'),
+  COUNTIF(g.severity = 'UNCHANGED'),
+  COUNTIF(g.rescan),
+  COUNTIF(g.degraded),
+  COUNT(f.rating),
+  IFNULL(SUM(f.rating), 0),
+  COUNTIF(f.rating >= @goodRating),
+  COUNTIF(g.severity = 'HIGH' AND f.rating IS NOT NULL),
+  COUNTIF(g.severity = 'HIGH' AND f.rating <= @badRating)
+FROM %[2]s AS g
+LEFT JOIN (
+  SELECT requestId, ARRAY_AGG(rating ORDER BY time DESC LIMIT 1)[OFFSET(0)] AS rating
+  FROM %[3]s
+  WHERE DATE(time) BETWEEN @day AND DATE_ADD(@day, INTERVAL %[4]d DAY)
+  GROUP BY requestId
+) AS f ON f.requestId = g.requestId
+WHERE DATE(g.time) = @day
+GROUP BY g.function, g.promptVersion`
+
+// summarySQL adds up the quality rows of the last @days days.
+const summarySQL = `
+SELECT
+  function, promptVersion,
+  SUM(frames), SUM(low), SUM(medium), SUM(high), SUM(unchanged),
+  SUM(rescans), SUM(degraded), SUM(rated), SUM(ratingSum), SUM(accurate),
+  SUM(ratedStops), SUM(falseStops)
+FROM %s
+WHERE day > DATE_SUB(CURRENT_DATE(), INTERVAL @days DAY)
+GROUP BY function, promptVersion
+ORDER BY function, promptVersion`
+
+// Aggregate rolls up the guidance and feedback of day (UTC) into the
+// quality table. Running it again for the same day replaces its rows, so
+// late feedback can be picked up by re-running it.
+func Aggregate(ctx context.Context, day time.Time) error {
+	sql := fmt.Sprintf(aggregateSQL, table(QualityTable), table(GuidanceTable), table(FeedbackTable), feedbackWindow)
+	_, err := query(ctx, sql, map[string]string{
+		"day":        day.UTC().Format("2006-01-02"),
+		"goodRating": strconv.Itoa(goodRating),
+		"badRating":  strconv.Itoa(badRating),
+	})
+	return err
+}
+
+// Quality is the guidance quality of a prompt version of a function over a
+// period. Rates are nil when nothing was rated.
+type Quality struct {
+	Function      string           `json:"function"`
+	PromptVersion string           `json:"promptVersion"`
+	Frames        int64            `json:"frames"`
+	Severities    map[string]int64 `json:"severities"`
+	Rescans       int64            `json:"rescans"`
+	Degraded      int64            `json:"degraded"`
+	Rated         int64            `json:"rated"`
+	MeanRating    *float64         `json:"meanRating"`
+	// Accuracy is the share of rated answers rated well.
+	Accuracy *float64 `json:"accuracy"`
+	// FalseStopRate is the share of rated HIGH answers rated badly.
+	FalseStopRate *float64 `json:"falseStopRate"`
+}
+
+// Summary returns the quality of every function and prompt version over
+// the last days days.
+func Summary(ctx context.Context, days int) ([]Quality, error) {
+	rows, err := query(ctx, fmt.Sprintf(summarySQL, table(QualityTable)), map[string]string{
+		"days": strconv.Itoa(days),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := []Quality{}
+	for _, row := range rows {
+		if len(row.F) != 14 {
+			return nil, fmt.Errorf("unexpected summary row of %d columns", len(row.F))
+		}
+		n := make([]int64, len(row.F))
+		for i := 2; i < len(row.F); i++ {
+			n[i], _ = strconv.ParseInt(fmt.Sprint(row.F[i].V), 10, 64)
+		}
+
+		q := Quality{
+			Function:      fmt.Sprint(row.F[0].V),
+			PromptVersion: fmt.Sprint(row.F[1].V),
+			Frames:        n[2],
+			Severities:    map[string]int64{"LOW": n[3], "MEDIUM": n[4], "HIGH": n[5], "UNCHANGED": n[6]},
+			Rescans:       n[7],
+			Degraded:      n[8],
+			Rated:         n[9],
+			MeanRating:    ratio(n[10], n[9]),
+			Accuracy:      ratio(n[11], n[9]),
+			FalseStopRate: ratio(n[13], n[12]),
+		}
+		summary = append(summary, q)
+	}
+	return summary, nil
+}
+
+func ratio(a, b int64) *float64 {
+	if b == 0 {
+		return nil
+	}
+	r := float64(a) / float64(b)
+	return &r
+}
+
+// table is the quoted name of a table of ANALYTICS_DATASET.
+func table(name string) string {
+	cfg := config.Get()
+	project, dataset := splitDataset(cfg.AnalyticsDataset, cfg.ProjectID)
+	return fmt.Sprintf("`%s.%s.%s`", project, dataset, name)
+}
+
+// query runs a standard SQL query or script with named parameters, whose
+// types are inferred from their names, and returns the rows of its last
+// statement.
+func query(ctx context.Context, sql string, params map[string]string) ([]*bigquery.TableRow, error) {
+	cfg := config.Get()
+	if cfg.AnalyticsDataset == "" {
+		return nil, ErrDisabled
+	}
+	project, _ := splitDataset(cfg.AnalyticsDataset, cfg.ProjectID)
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	svc, err := bigquery.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &bigquery.QueryRequest{
+		Query:         sql,
+		UseLegacySql:  new(bool),
+		ParameterMode: "NAMED",
+		TimeoutMs:     queryTimeout.Milliseconds(),
+	}
+	for name, value := range params {
+		typ := "INT64"
+		if name == "day" {
+			typ = "DATE"
+		}
+		req.QueryParameters = append(req.QueryParameters, &bigquery.QueryParameter{
+			Name:           name,
+			ParameterType:  &bigquery.QueryParameterType{Type: typ},
+			ParameterValue: &bigquery.QueryParameterValue{Value: value},
+		})
+	}
+
+	resp, err := svc.Jobs.Query(project, req).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Errors) > 0 {
+		return nil, errors.New(resp.Errors[0].Message)
+	}
+	if resp.JobComplete {
+		return resp.Rows, nil
+	}
+
+	// Long queries are finished by polling the job
+	for {
+		results, err := svc.Jobs.GetQueryResults(project, resp.JobReference.JobId).
+			Location(resp.JobReference.Location).
+			TimeoutMs(10000).
+			Context(ctx).
+			Do()
+		if err != nil {
+			return nil, err
+		}
+		if len(results.Errors) > 0 {
+			return nil, errors.New(results.Errors[0].Message)
+		}
+		if results.JobComplete {
+			return results.Rows, nil
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package apiversion negotiates the API version from the URL path, e.g.
+// POST .../detect-hazards/v2. A request without a version segment is served
+// as v1, the shape the apps already in the field were built against.
+//
+// The response shape of a released version is frozen: schema changes go
+// into a new version, and functions render older versions from it.
+package apiversion
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// Version is an API version.
+type Version int
+
+const (
+	// V1 is the original API: hazard responses carry speechText and
+	// severity only.
+	V1 Version = 1
+	// V2 adds distances, compass directions, confidence, the UNCHANGED
+	// severity and verbose hazard lists to hazard responses.
+	V2 Version = 2
+
+	Latest = V2
+)
+
+var segmentPattern = regexp.MustCompile(`^v([0-9]+)$`)
+
+type contextKey struct{}
+
+func (v Version) String() string {
+	return "v" + strconv.Itoa(int(v))
+}
+
+// FromPath returns the version named by a /vN segment of path, V1 when
+// there is none, and false for a version that doesn't exist.
+func FromPath(path string) (Version, bool) {
+	for _, segment := range strings.Split(path, "/") {
+		m := segmentPattern.FindStringSubmatch(segment)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < int(V1) || n > int(Latest) {
+			return 0, false
+		}
+		return Version(n), true
+	}
+	return V1, true
+}
+
+// FromContext returns the version negotiated for a request, V1 outside of
+// Negotiate.
+func FromContext(ctx context.Context) Version {
+	if v, ok := ctx.Value(contextKey{}).(Version); ok {
+		return v
+	}
+	return V1
+}
+
+// Negotiate serves requests for known versions with next, with the version
+// in the request context and the API-Version response header. Unknown
+// versions get a 404.
+func Negotiate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := FromPath(r.URL.Path)
+		if !ok {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			apierror.Write(w, apierror.New(http.StatusNotFound, apierror.CodeUnsupportedVersion, "Unsupported API version"))
+			return
+		}
+
+		w.Header().Set("API-Version", v.String())
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, v)))
+	}
+}
@@ -0,0 +1,184 @@
+// Package appcheck lets only genuine builds of the app call the API: the
+// static API key ships inside the APK and is easily extracted, while a
+// Firebase App Check token, sent in X-Firebase-AppCheck, is issued only to
+// an app that passed Play Integrity or App Attest.
+//
+// APP_CHECK=grace logs requests without a valid token but still serves
+// them, to see which clients would break before turning on
+// APP_CHECK=enforce. Requests with a device token, which was issued
+// against an App Check token, are not checked again, see package
+// devicetoken, nor is anything in the offline modes.
+package appcheck
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+const (
+	// Header carries the App Check token.
+	Header = "X-Firebase-AppCheck"
+
+	// jwksURL publishes the keys App Check tokens are signed with.
+	jwksURL = "https://firebaseappcheck.googleapis.com/v1/jwks"
+	// issuerPrefix is the issuer of the tokens of a project, followed by
+	// the project number.
+	issuerPrefix = "https://firebaseappcheck.googleapis.com/"
+
+	fetchTimeout = 2 * time.Second
+	// keysTTL is how long keys are cached, as Firebase recommends.
+	keysTTL = 6 * time.Hour
+	// leeway allows for clock skew.
+	leeway = time.Minute
+)
+
+var (
+	keysMu        sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysExpiresAt time.Time
+)
+
+type claims struct {
+	Issuer   string   `json:"iss"`
+	Audience []string `json:"aud"`
+	Subject  string   `json:"sub"`
+	Expires  int64    `json:"exp"`
+}
+
+// Handle checks the App Check token of requests to function before passing
+// them to next.
+func Handle(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Get()
+		_, device := devicetoken.FromContext(r.Context())
+		if cfg.AppCheck == config.AppCheckOff || cfg.MockModel || cfg.ModelReplay != "" ||
+			device || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		_, err := Verify(r.Context(), r.Header.Get(Header))
+		switch {
+		case err == nil:
+			next(w, r)
+		case cfg.AppCheck == config.AppCheckGrace:
+			log.Printf("App Check: %s request without a valid token served in grace mode: %v", function, err)
+			next(w, r)
+		case errors.Is(err, auth.ErrUnauthenticated):
+			log.Printf("App Check: %s request refused: %v", function, err)
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid App Check token"))
+		default:
+			log.Printf("App Check: %s request refused, can't verify tokens: %v", function, err)
+			apierror.Write(w, apierror.New(http.StatusServiceUnavailable, apierror.CodeAuthUnavailable, "Error verifying App Check token"))
+		}
+	}
+}
+
+// Verify checks an App Check token and returns the ID of the app it was
+// issued to. Invalid tokens are reported with auth.ErrUnauthenticated.
+func Verify(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: no token", auth.ErrUnauthenticated)
+	}
+
+	keys, err := publicKeys(ctx)
+	if err != nil {
+		return "", fmt.Errorf("loading App Check keys: %w", err)
+	}
+
+	payload, err := auth.VerifyRS256(token, keys)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", auth.ErrUnauthenticated, err)
+	}
+
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return "", fmt.Errorf("%w: %v", auth.ErrUnauthenticated, err)
+	}
+
+	cfg := config.Get()
+	switch {
+	case c.Issuer != issuerPrefix+cfg.AppCheckProject || !slices.Contains(c.Audience, "projects/"+cfg.AppCheckProject):
+		return "", fmt.Errorf("%w: token of another project", auth.ErrUnauthenticated)
+	case time.Now().After(time.Unix(c.Expires, 0).Add(leeway)):
+		return "", fmt.Errorf("%w: token expired", auth.ErrUnauthenticated)
+	case len(cfg.AppCheckAppIDs) > 0 && !slices.Contains(cfg.AppCheckAppIDs, c.Subject):
+		return "", fmt.Errorf("%w: unknown app %q", auth.ErrUnauthenticated, c.Subject)
+	}
+	return c.Subject, nil
+}
+
+// publicKeys returns the keys App Check tokens are signed with, by key ID.
+func publicKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if keys != nil && time.Now().Before(keysExpiresAt) {
+		return keys, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keys endpoint returned %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	fetched := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+		fetched[k.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(fetched) == 0 {
+		return nil, errors.New("no keys published")
+	}
+
+	keys, keysExpiresAt = fetched, time.Now().Add(keysTTL)
+	return keys, nil
+}
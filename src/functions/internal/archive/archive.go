@@ -0,0 +1,242 @@
+// Package archive keeps the frame and raw model output of a request in
+// DEBUG_BUCKET, so a report such as "it told me to walk into a pole" can be
+// reproduced. A request is archived when its user consented to keeping
+// frames, or when it asks for it with "debug": true and its user didn't
+// refuse, see package consent.
+//
+// Objects are named {function}/{date}/{request ID}.{ext} and .json, and
+// the frame with the hazards drawn on it, if any, .annotated.{ext}. Faces
+// and license plates are pixelated before a frame is stored, see blur.go,
+// and frames that can't be blurred, such as WebP and HEIC ones, are not
+// stored. Frames can show homes, so the reap-expired function deletes them
+// after FRAME_RETENTION.
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/consent"
+	"example.com/buddy-paws/internal/requestid"
+)
+
+// userIDKey is the object metadata key of the user an object belongs to.
+const userIDKey = "userId"
+
+// Record is the JSON object stored next to the frame.
+type Record struct {
+	Function      string    `json:"function"`
+	RequestID     string    `json:"requestId"`
+	Time          time.Time `json:"time"`
+	Model         string    `json:"model"`
+	PromptVersion string    `json:"promptVersion"`
+	UserID        string    `json:"userId,omitempty"`
+	Image         string    `json:"image"`
+	Output        string    `json:"output"`
+}
+
+// Wanted reports whether a request is archived: archival is configured and
+// the request's user consented, see package consent.
+func Wanted(ctx context.Context, debug bool, userID string) bool {
+	if config.Get().DebugBucket == "" {
+		return false
+	}
+	return consent.Frames(ctx, debug, userID)
+}
+
+// Save stores the frame, in the given image format, and record, returning
+// the gs:// path of the record. The request ID is taken from ctx, which
+// must be the request's context.
+func Save(ctx context.Context, record Record, image []byte, format string) (string, error) {
+	bucket := config.Get().DebugBucket
+
+	image, err := blur(ctx, image, format)
+	if err != nil {
+		return "", fmt.Errorf("blurring frame: %w", err)
+	}
+
+	record.Time = time.Now().UTC()
+	record.RequestID = requestid.FromContext(ctx)
+	if record.RequestID == "" {
+		record.RequestID = fmt.Sprintf("%d", record.Time.UnixNano())
+	}
+	prefix := fmt.Sprintf("%s/%s/%s", record.Function, record.Time.Format("2006-01-02"), record.RequestID)
+	record.Image = prefix + "." + format
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	// The user is kept in the metadata too, to find their objects, see
+	// UserObjects
+	var metadata map[string]string
+	if record.UserID != "" {
+		metadata = map[string]string{userIDKey: record.UserID}
+	}
+	objects := []struct {
+		name, contentType string
+		data              []byte
+	}{
+		{record.Image, "image/" + format, image},
+		{prefix + ".json", "application/json", data},
+	}
+	for _, o := range objects {
+		if err := upload(ctx, gcs, bucket, o.name, o.contentType, o.data, metadata); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("gs://%s/%s.json", bucket, prefix), nil
+}
+
+// SaveAnnotated stores an annotated copy of the frame of the record at
+// path, as returned by Save, for support to review with the report.
+func SaveAnnotated(ctx context.Context, path, userID string, image []byte, format string) error {
+	bucket := config.Get().DebugBucket
+	prefix, ok := strings.CutPrefix(path, "gs://"+bucket+"/")
+	if !ok {
+		return fmt.Errorf("record %s not in the debug bucket", path)
+	}
+	prefix = strings.TrimSuffix(prefix, ".json")
+
+	image, err := blur(ctx, image, format)
+	if err != nil {
+		return fmt.Errorf("blurring frame: %w", err)
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	var metadata map[string]string
+	if userID != "" {
+		metadata = map[string]string{userIDKey: userID}
+	}
+	return upload(ctx, gcs, bucket, prefix+".annotated."+format, "image/"+format, image, metadata)
+}
+
+// upload stores an object in the bucket.
+func upload(ctx context.Context, gcs *storage.Service, bucket, name, contentType string, data []byte, metadata map[string]string) error {
+	_, err := gcs.Objects.
+		Insert(bucket, &storage.Object{Name: name, ContentType: contentType, Metadata: metadata}).
+		Media(bytes.NewReader(data)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", name, err)
+	}
+	return nil
+}
+
+// Find returns the gs:// path of the record archived for a request, "" if
+// there is none.
+func Find(ctx context.Context, requestID string) (string, error) {
+	bucket := config.Get().DebugBucket
+	if bucket == "" || !requestid.Valid(requestID) {
+		return "", nil
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	objects, err := gcs.Objects.List(bucket).
+		MatchGlob("*/*/" + requestID + ".json").
+		MaxResults(1).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return "", err
+	}
+	if len(objects.Items) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("gs://%s/%s", bucket, objects.Items[0].Name), nil
+}
+
+// UserObjects returns the names of the objects archived for a user, frames
+// and records alike.
+func UserObjects(ctx context.Context, userID string) ([]string, error) {
+	bucket := config.Get().DebugBucket
+	if bucket == "" || userID == "" {
+		return nil, nil
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = gcs.Objects.List(bucket).
+		Fields("nextPageToken", "items(name,metadata)").
+		Pages(ctx, func(objects *storage.Objects) error {
+			for _, o := range objects.Items {
+				if o.Metadata[userIDKey] == userID {
+					names = append(names, o.Name)
+				}
+			}
+			return nil
+		})
+	return names, err
+}
+
+// Reap deletes the archived objects created before cutoff, and those of
+// the users drop returns true for, returning how many it deleted.
+func Reap(ctx context.Context, cutoff time.Time, drop func(userID string) bool) (int, error) {
+	bucket := config.Get().DebugBucket
+	if bucket == "" {
+		return 0, nil
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	err = gcs.Objects.List(bucket).
+		Fields("nextPageToken", "items(name,metadata,timeCreated)").
+		Pages(ctx, func(objects *storage.Objects) error {
+			for _, o := range objects.Items {
+				created, err := time.Parse(time.RFC3339, o.TimeCreated)
+				if err != nil || created.Before(cutoff) {
+					names = append(names, o.Name)
+					continue
+				}
+				if userID := o.Metadata[userIDKey]; userID != "" && drop(userID) {
+					names = append(names, o.Name)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, name := range names {
+		err := gcs.Objects.Delete(bucket, name).Context(ctx).Do()
+		var apiErr *googleapi.Error
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
+			return deleted, fmt.Errorf("deleting %s: %w", name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
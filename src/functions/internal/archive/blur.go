@@ -0,0 +1,100 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"time"
+
+	"google.golang.org/api/vision/v1"
+
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// blurTimeout bounds the Vision call finding faces and plates.
+const blurTimeout = 5 * time.Second
+
+// licensePlate is the Vision object name of license plates.
+const licensePlate = "License plate"
+
+// blur returns the frame with the faces and license plates Cloud Vision
+// finds in it pixelated. A frame that can't be blurred must not be
+// stored, so any failure is an error.
+func blur(ctx context.Context, data []byte, format string) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, imagedata.ErrPixelateUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blurTimeout)
+	defer cancel()
+
+	svc, err := vision.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := svc.Images.Annotate(&vision.BatchAnnotateImagesRequest{
+		Requests: []*vision.AnnotateImageRequest{{
+			Image: &vision.Image{Content: base64.StdEncoding.EncodeToString(data)},
+			Features: []*vision.Feature{
+				{Type: "FACE_DETECTION", MaxResults: 50},
+				{Type: "OBJECT_LOCALIZATION", MaxResults: 50},
+			},
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Responses) == 0 {
+		return nil, errors.New("no Vision response")
+	}
+	result := resp.Responses[0]
+	if result.Error != nil {
+		return nil, errors.New(result.Error.Message)
+	}
+
+	var regions []model.Region
+	w, h := float64(cfg.Width), float64(cfg.Height)
+	for _, face := range result.FaceAnnotations {
+		if face.BoundingPoly == nil {
+			continue
+		}
+		var points [][2]float64
+		for _, v := range face.BoundingPoly.Vertices {
+			points = append(points, [2]float64{float64(v.X) / w, float64(v.Y) / h})
+		}
+		regions = appendBounds(regions, points)
+	}
+	for _, object := range result.LocalizedObjectAnnotations {
+		if object.Name != licensePlate || object.BoundingPoly == nil {
+			continue
+		}
+		var points [][2]float64
+		for _, v := range object.BoundingPoly.NormalizedVertices {
+			points = append(points, [2]float64{v.X, v.Y})
+		}
+		regions = appendBounds(regions, points)
+	}
+
+	if len(regions) == 0 {
+		return data, nil
+	}
+	return imagedata.Pixelate(data, format, regions)
+}
+
+// appendBounds appends the bounding box of normalized points to regions.
+func appendBounds(regions []model.Region, points [][2]float64) []model.Region {
+	if len(points) == 0 {
+		return regions
+	}
+	minX, minY, maxX, maxY := points[0][0], points[0][1], points[0][0], points[0][1]
+	for _, p := range points[1:] {
+		minX, maxX = min(minX, p[0]), max(maxX, p[0])
+		minY, maxY = min(minY, p[1]), max(maxY, p[1])
+	}
+	return append(regions, model.Region{X: minX, Y: minY, W: maxX - minX, H: maxY - minY})
+}
@@ -0,0 +1,84 @@
+// Package audit keeps an append-only trail of admin actions and of access
+// to user data, so "who changed the prompt that caused bad guidance last
+// Tuesday" has an answer. Entries go to the dedicated "audit" Cloud Logging
+// log as JSON payloads with the fields of Entry, and from there into
+// BigQuery through a log sink:
+//
+//	gcloud logging sinks create audit-bigquery \
+//	  bigquery.googleapis.com/projects/PROJECT/datasets/audit \
+//	  --log-filter='logName="projects/PROJECT/logs/audit"' \
+//	  --use-partitioned-tables
+//
+// Log entries can't be changed once written. Keep the dataset's tables
+// writable by the sink's service account only.
+//
+// In MOCK_MODEL and MODEL_REPLAY modes entries are written to stderr.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/logging"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/requestid"
+)
+
+// logName is the Cloud Logging log of the trail.
+const logName = "audit"
+
+// Actions recorded.
+const (
+	ActionPromptUpload   = "prompt.upload"
+	ActionPromptActivate = "prompt.activate"
+	ActionSettingsUpdate = "settings.update"
+	ActionKeyIssue       = "key.issue"
+	ActionDataExport     = "data.export"
+	ActionDataDeletion   = "data.delete"
+	ActionConsentUpdate  = "consent.update"
+)
+
+// Entry is one audited action. Actor is who acted, e.g. "admin:alice" or
+// "user:{uid}"; Target what they acted on, e.g. "detect-hazards".
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"`
+	Actor     string            `json:"actor"`
+	Target    string            `json:"target,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Record writes e, stamped with the time and the request ID of ctx, and
+// waits until it is stored.
+func Record(ctx context.Context, e Entry) error {
+	e.Time = time.Now().UTC()
+	e.RequestID = requestid.FromContext(ctx)
+
+	cfg := config.Get()
+	if cfg.MockModel || cfg.ModelReplay != "" {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		log.New(os.Stderr, logName+": ", log.LstdFlags).Println(string(data))
+		return nil
+	}
+
+	client, err := logging.NewClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Logger(logName).LogSync(ctx, logging.Entry{
+		Timestamp: e.Time,
+		Severity:  logging.Notice,
+		Labels:    map[string]string{"action": e.Action},
+		Payload:   e,
+	})
+}
@@ -0,0 +1,249 @@
+// Package auth authenticates users with Firebase ID tokens, sent as
+// "Authorization: Bearer <token>", for functions acting on a user's own
+// data, where the X-User-ID header can't be trusted. Tokens are verified
+// locally against Google's published keys, cached as long as Google allows.
+//
+// A device token issued to a signed-in user, see package devicetoken,
+// stands in for the ID token. In the offline modes there is no Firebase
+// project, and the X-User-ID header is trusted instead.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+)
+
+const (
+	// certsURL publishes the keys Firebase ID tokens are signed with.
+	certsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+	// issuerPrefix is the issuer of the tokens of a project, followed by
+	// the project ID.
+	issuerPrefix = "https://securetoken.google.com/"
+
+	fetchTimeout = 2 * time.Second
+	// defaultKeysTTL is how long keys are cached when Google doesn't say.
+	defaultKeysTTL = time.Hour
+	// leeway allows for clock skew.
+	leeway = time.Minute
+)
+
+// ErrUnauthenticated is returned by UID for requests without a valid token.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+var (
+	maxAgePattern = regexp.MustCompile(`max-age=(\d+)`)
+	uidPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+)
+
+var (
+	keysMu        sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysExpiresAt time.Time
+)
+
+type claims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Subject  string `json:"sub"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying uid, verified earlier, such as
+// the user of a job verified when it was queued.
+func NewContext(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, contextKey{}, uid)
+}
+
+// UID returns the Firebase UID of the user making the request.
+func UID(ctx context.Context, r *http.Request) (string, error) {
+	if uid, ok := r.Context().Value(contextKey{}).(string); ok {
+		return uid, nil
+	}
+	if c, ok := devicetoken.FromContext(r.Context()); ok {
+		if c.UserID == "" {
+			return "", fmt.Errorf("%w: device token without a user", ErrUnauthenticated)
+		}
+		return c.UserID, nil
+	}
+
+	cfg := config.Get()
+	if cfg.MockModel || cfg.ModelReplay != "" {
+		if uid := r.Header.Get("X-User-ID"); uidPattern.MatchString(uid) {
+			return uid, nil
+		}
+		return "", ErrUnauthenticated
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", ErrUnauthenticated
+	}
+
+	keys, err := publicKeys(ctx)
+	if err != nil {
+		return "", fmt.Errorf("loading Firebase keys: %w", err)
+	}
+
+	payload, err := VerifyRS256(token, keys)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	now := time.Now()
+	switch {
+	case c.Audience != cfg.ProjectID || c.Issuer != issuerPrefix+cfg.ProjectID:
+		return "", fmt.Errorf("%w: token of another project", ErrUnauthenticated)
+	case now.After(time.Unix(c.Expires, 0).Add(leeway)):
+		return "", fmt.Errorf("%w: token expired", ErrUnauthenticated)
+	case time.Unix(c.IssuedAt, 0).After(now.Add(leeway)):
+		return "", fmt.Errorf("%w: token issued in the future", ErrUnauthenticated)
+	case !uidPattern.MatchString(c.Subject):
+		return "", fmt.Errorf("%w: invalid subject", ErrUnauthenticated)
+	}
+	return c.Subject, nil
+}
+
+// Caller returns the UID of the user making the request, or "" when it
+// has no valid token. Functions open to anonymous callers use it to find
+// the user's own settings, e.g. the consent, which X-User-ID would let
+// anyone read or spoof.
+func Caller(ctx context.Context, r *http.Request) string {
+	uid, err := UID(ctx, r)
+	if err != nil {
+		if !errors.Is(err, ErrUnauthenticated) {
+			log.Printf("Error verifying ID token: %v", err)
+		}
+		return ""
+	}
+	return uid
+}
+
+// VerifyRS256 checks the signature of a JWT signed with RS256 by one of
+// keys, by key ID, and returns its payload. The claims are left to the
+// caller.
+func VerifyRS256(token string, keys map[string]*rsa.PublicKey) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Algorithm)
+	}
+	key, ok := keys[header.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.KeyID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	return payload, nil
+}
+
+// publicKeys returns the keys Firebase ID tokens are signed with, by key
+// ID.
+func publicKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if keys != nil && time.Now().Before(keysExpiresAt) {
+		return keys, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, certsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keys endpoint returned %s", resp.Status)
+	}
+
+	var certs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, err
+	}
+
+	fetched := map[string]*rsa.PublicKey{}
+	for id, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			fetched[id] = key
+		}
+	}
+	if len(fetched) == 0 {
+		return nil, errors.New("no keys published")
+	}
+
+	ttl := defaultKeysTTL
+	if m := maxAgePattern.FindStringSubmatch(resp.Header.Get("Cache-Control")); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+
+	keys, keysExpiresAt = fetched, time.Now().Add(ttl)
+	return keys, nil
+}
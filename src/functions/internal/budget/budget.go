@@ -0,0 +1,230 @@
+// Package budget enforces a daily limit on model spend across all functions.
+//
+// The estimated cost of every model call is added to a Firestore counter,
+// budgets/{YYYY-MM-DD} (UTC). Once it reaches DAILY_BUDGET_USD the functions
+// degrade according to BUDGET_MODE:
+//
+//   - "cheaper" (the default) switches to BUDGET_MODEL, a cheaper model.
+//   - "reject" answers 429 with a spoken explanation until the next day,
+//     except to emergencies, which get BUDGET_MODEL, see Downgrade.
+//   - "interval" keeps the model but suggests clients send frames at most
+//     every BUDGET_MIN_INTERVAL, see package pacing.
+//
+// Without DAILY_BUDGET_USD there is no limit.
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// refreshInterval is how long an instance trusts its copy of the day's
+// spend before reading the counter again.
+const refreshInterval = time.Minute
+
+// timeout bounds a read or an update of the counter.
+const timeout = 2 * time.Second
+
+// ErrExhausted is returned by Apply when the daily budget is used up and
+// requests are rejected.
+var ErrExhausted = errors.New("daily budget exhausted")
+
+// Exhausted returns the 429 response for ErrExhausted, sent instead of an
+// analysis.
+func Exhausted() apierror.Problem {
+	return apierror.New(http.StatusTooManyRequests, apierror.CodeBudgetExhausted, "Daily budget exhausted").
+		WithSpeech(persona.Speech("Buddy has reached today's usage limit and can't look at images right now. Please try again tomorrow."))
+}
+
+var spend struct {
+	sync.Mutex
+	day       string
+	total     float64
+	fetchedAt time.Time
+}
+
+// Apply returns the model to use for a request that would use model: the
+// model itself within budget or in interval mode, the cheaper BUDGET_MODEL
+// once the budget is used up, or ErrExhausted in reject mode.
+func Apply(ctx context.Context, model string) (string, error) {
+	cfg := config.Get()
+	if !exceeded(ctx) {
+		return model, nil
+	}
+
+	switch cfg.BudgetMode {
+	case config.BudgetReject:
+		return "", ErrExhausted
+	case config.BudgetInterval:
+		return model, nil
+	default:
+		return cfg.BudgetModel, nil
+	}
+}
+
+// Downgrade is Apply for requests that are never rejected, such as
+// emergencies: once the budget is used up they get BUDGET_MODEL in reject
+// mode too.
+func Downgrade(ctx context.Context, model string) string {
+	cfg := config.Get()
+	if cfg.BudgetMode == config.BudgetInterval || !exceeded(ctx) {
+		return model
+	}
+	return cfg.BudgetModel
+}
+
+// MinInterval is the shortest interval between frames clients are asked
+// to leave: BUDGET_MIN_INTERVAL once the budget is used up in interval
+// mode, else 0.
+func MinInterval(ctx context.Context) time.Duration {
+	cfg := config.Get()
+	if cfg.BudgetMode != config.BudgetInterval || !exceeded(ctx) {
+		return 0
+	}
+	return cfg.BudgetMinInterval
+}
+
+// exceeded reports whether the day's spend reached DAILY_BUDGET_USD.
+func exceeded(ctx context.Context) bool {
+	cfg := config.Get()
+	if cfg.DailyBudgetUSD <= 0 {
+		return false
+	}
+
+	total, err := today(ctx)
+	if err != nil {
+		// The guardrail must not take the functions down with it
+		log.Printf("Error reading budget: %v", err)
+		return false
+	}
+	return total >= cfg.DailyBudgetUSD
+}
+
+// RetryAfter is the Retry-After header value for ErrExhausted: the seconds
+// until the next budget day starts.
+func RetryAfter() string {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return strconv.Itoa(int(midnight.Sub(now).Seconds()) + 1)
+}
+
+// Spend adds cost (USD) to the day's counter.
+func Spend(ctx context.Context, cost float64) error {
+	cfg := config.Get()
+	if cfg.DailyBudgetUSD <= 0 || cost <= 0 {
+		return nil
+	}
+
+	day := dayKey(time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	svc, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.Projects.Databases.Documents.Commit(database(cfg.ProjectID), &firestore.CommitRequest{
+		Writes: []*firestore.Write{{
+			Transform: &firestore.DocumentTransform{
+				Document: document(cfg.ProjectID, day),
+				FieldTransforms: []*firestore.FieldTransform{{
+					FieldPath: "costUsd",
+					Increment: &firestore.Value{DoubleValue: cost, ForceSendFields: []string{"DoubleValue"}},
+				}},
+			},
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	spend.Lock()
+	if spend.day == day {
+		spend.total += cost
+	}
+	spend.Unlock()
+
+	return nil
+}
+
+// reads shares a read of the counter between the requests that need it at
+// once.
+var reads singleflight.Group
+
+// today returns the day's spend, read from Firestore at most once per
+// refreshInterval. Requests don't wait on each other while it is read.
+func today(ctx context.Context) (float64, error) {
+	day := dayKey(time.Now())
+
+	spend.Lock()
+	total, fresh := spend.total, spend.day == day && time.Since(spend.fetchedAt) < refreshInterval
+	spend.Unlock()
+	if fresh {
+		return total, nil
+	}
+
+	v, err, _ := reads.Do(day, func() (interface{}, error) {
+		// Shared, so not canceled with the request that started it
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		return read(ctx, day)
+	})
+	if err != nil {
+		return 0, err
+	}
+	total = v.(float64)
+
+	spend.Lock()
+	spend.day, spend.total, spend.fetchedAt = day, total, time.Now()
+	spend.Unlock()
+	return total, nil
+}
+
+// read returns the spend of day from its counter.
+func read(ctx context.Context, day string) (float64, error) {
+	projectID := config.Get().ProjectID
+
+	svc, err := firestore.NewService(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	doc, err := svc.Projects.Databases.Documents.Get(document(projectID, day)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	v := doc.Fields["costUsd"]
+	return v.DoubleValue + float64(v.IntegerValue), nil
+}
+
+func dayKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func database(projectID string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)", projectID)
+}
+
+func document(projectID, day string) string {
+	return fmt.Sprintf("%s/documents/budgets/%s", database(projectID), day)
+}
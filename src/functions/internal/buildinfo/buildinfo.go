@@ -0,0 +1,42 @@
+// Package buildinfo describes what served a request, the build and the
+// prompt and model of the function, for regression reports. The functions
+// return it for GET .../version.
+package buildinfo
+
+import "example.com/buddy-paws/internal/config"
+
+// gitSHA and buildTime can be stamped at build time with
+// -ldflags "-X example.com/buddy-paws/internal/buildinfo.gitSHA=... -X example.com/buddy-paws/internal/buildinfo.buildTime=...".
+// The GIT_SHA and BUILD_TIME environment variables, set at deploy time, take
+// precedence.
+var (
+	gitSHA    = "unknown"
+	buildTime = "unknown"
+)
+
+// Info is the response to GET .../version.
+type Info struct {
+	GitSHA        string `json:"gitSha"`
+	BuildTime     string `json:"buildTime"`
+	PromptVersion string `json:"promptVersion"`
+	Model         string `json:"model"`
+}
+
+// Get returns the build info of a function serving model with the prompt
+// of promptVersion.
+func Get(model, promptVersion string) Info {
+	info := Info{
+		GitSHA:        gitSHA,
+		BuildTime:     buildTime,
+		PromptVersion: promptVersion,
+		Model:         model,
+	}
+	cfg := config.Get()
+	if cfg.GitSHA != "" {
+		info.GitSHA = cfg.GitSHA
+	}
+	if cfg.BuildTime != "" {
+		info.BuildTime = cfg.BuildTime
+	}
+	return info
+}
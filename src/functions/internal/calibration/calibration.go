@@ -0,0 +1,238 @@
+// Package calibration holds how users want hazards rated, in their
+// Firestore profile, users/{uid}:
+//
+//	calibration: the rules, e.g. [{"match": "stairs", "severity": "HIGH"},
+//	  {"match": "wet surface", "severity": "IGNORE"}]
+//	calibrationUpdatedAt: when they last changed them
+//
+// detect-hazards applies the rules of the signed-in user, see auth.Caller,
+// to the model's hazards before giving guidance, see Apply. Rules may
+// raise, lower or ignore MEDIUM and LOW hazards, but can't hide or lower a
+// HIGH one.
+package calibration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// cacheTTL is how long a user's profile is cached, sparing a profile read
+// per frame. A change takes up to this long to reach other instances.
+const cacheTTL = 5 * time.Minute
+
+// Ignore is the Severity of a rule muting the hazards it matches.
+const Ignore = "IGNORE"
+
+const (
+	maxRules       = 20
+	maxMatchLength = 40
+)
+
+// Rule rates the hazards whose type or description mentions Match, in any
+// case, e.g. "stairs". Category, if set, limits it to hazards of that
+// category. Severity is the severity they are given, or Ignore.
+type Rule struct {
+	Match    string         `json:"match"`
+	Category model.Category `json:"category,omitempty"`
+	Severity string         `json:"severity"`
+}
+
+// Profile is a user's calibration. The first rule matching a hazard
+// applies.
+type Profile struct {
+	Rules     []Rule     `json:"rules"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+}
+
+// Validate checks the rules, normalizing their categories and severities.
+func (p *Profile) Validate() error {
+	if len(p.Rules) > maxRules {
+		return fmt.Errorf("Invalid calibration, expected at most %d rules", maxRules)
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.Match = strings.TrimSpace(rule.Match)
+		if rule.Match == "" || len(rule.Match) > maxMatchLength {
+			return fmt.Errorf("Invalid match of rule %d, expected 1 to %d characters", i+1, maxMatchLength)
+		}
+		if rule.Category != "" {
+			category, ok := model.CategoryOf(string(rule.Category))
+			if !ok {
+				return fmt.Errorf("Invalid category of rule %d", i+1)
+			}
+			rule.Category = category
+		}
+		rule.Severity = strings.ToUpper(strings.TrimSpace(rule.Severity))
+		if rule.Severity != Ignore {
+			severity, err := model.ParseSeverity(rule.Severity)
+			if err != nil || severity == model.SeverityUnchanged {
+				return fmt.Errorf("Invalid severity of rule %d, expected LOW, MEDIUM, HIGH or %s", i+1, Ignore)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a hazard.
+func (r Rule) matches(hazardType, description string) bool {
+	if r.Category != "" {
+		if category, ok := model.CategoryOf(hazardType); !ok || category != r.Category {
+			return false
+		}
+	}
+	// "stairs" also matches "stair steps"
+	match := strings.ToLower(r.Match)
+	stem := strings.TrimSuffix(match, "s")
+	text := strings.ToLower(hazardType + " " + description)
+	return strings.Contains(text, match) || (stem != "" && strings.Contains(text, stem))
+}
+
+// Apply returns the severity a hazard is given, and false when it is
+// ignored. HIGH hazards stay HIGH.
+func (p Profile) Apply(hazardType, description string, severity model.Severity) (model.Severity, bool) {
+	if severity == model.SeverityHigh {
+		return severity, true
+	}
+	for _, rule := range p.Rules {
+		if !rule.matches(hazardType, description) {
+			continue
+		}
+		if rule.Severity == Ignore {
+			return severity, false
+		}
+		return model.Severity(rule.Severity), true
+	}
+	return severity, true
+}
+
+type cached struct {
+	profile   Profile
+	expiresAt time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]cached{}
+)
+
+// Get returns the calibration of userID, none for a request without a
+// user.
+func Get(ctx context.Context, userID string) (Profile, error) {
+	if userID == "" {
+		return Profile{}, nil
+	}
+
+	mu.Lock()
+	c, ok := cache[userID]
+	mu.Unlock()
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.profile, nil
+	}
+
+	profile, err := load(ctx, userID)
+	if err != nil {
+		return Profile{}, err
+	}
+	remember(userID, profile)
+	return profile, nil
+}
+
+// Save replaces the calibration of userID with profile, which must be
+// valid, and returns it as stored.
+func Save(ctx context.Context, userID string, profile Profile) (Profile, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	rules := make([]*firestore.Value, 0, len(profile.Rules))
+	for _, rule := range profile.Rules {
+		fields := map[string]firestore.Value{
+			"match":    {StringValue: rule.Match},
+			"severity": {StringValue: rule.Severity},
+		}
+		if rule.Category != "" {
+			fields["category"] = firestore.Value{StringValue: string(rule.Category)}
+		}
+		rules = append(rules, &firestore.Value{MapValue: &firestore.MapValue{Fields: fields}})
+	}
+	doc := &firestore.Document{Fields: map[string]firestore.Value{
+		"calibration":          {ArrayValue: &firestore.ArrayValue{Values: rules}},
+		"calibrationUpdatedAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}}
+
+	saved, err := fs.Projects.Databases.Documents.Patch(document(userID), doc).
+		UpdateMaskFieldPaths("calibration", "calibrationUpdatedAt").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	profile = fromDocument(saved)
+	remember(userID, profile)
+	return profile, nil
+}
+
+func load(ctx context.Context, userID string) (Profile, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(userID)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Profile{}, nil
+		}
+		return Profile{}, err
+	}
+	return fromDocument(doc), nil
+}
+
+func fromDocument(doc *firestore.Document) Profile {
+	profile := Profile{Rules: []Rule{}}
+	if v, ok := doc.Fields["calibration"]; ok && v.ArrayValue != nil {
+		for _, value := range v.ArrayValue.Values {
+			if value.MapValue == nil {
+				continue
+			}
+			field := func(name string) string {
+				return value.MapValue.Fields[name].StringValue
+			}
+			profile.Rules = append(profile.Rules, Rule{
+				Match:    field("match"),
+				Category: model.Category(field("category")),
+				Severity: field("severity"),
+			})
+		}
+	}
+	if v, ok := doc.Fields["calibrationUpdatedAt"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v.TimestampValue); err == nil {
+			profile.UpdatedAt = &t
+		}
+	}
+	return profile
+}
+
+func remember(userID string, profile Profile) {
+	mu.Lock()
+	cache[userID] = cached{profile: profile, expiresAt: time.Now().Add(cacheTTL)}
+	mu.Unlock()
+}
+
+func document(userID string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/users/%s", config.Get().ProjectID, userID)
+}
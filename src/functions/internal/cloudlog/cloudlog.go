@@ -0,0 +1,61 @@
+// Package cloudlog creates the loggers used by the functions.
+package cloudlog
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/logging"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+var (
+	mu sync.Mutex
+	// open are the loggers of requests still running, flushed by Flush.
+	open = map[*logging.Logger]bool{}
+)
+
+// New returns a standard logger writing to the named Cloud Logging log and a
+// function that flushes and closes it. In MOCK_MODEL and MODEL_REPLAY modes
+// it logs to stderr instead, so no Google Cloud credentials are needed.
+func New(ctx context.Context, projectID, logName string) (*log.Logger, func() error, error) {
+	if cfg := config.Get(); cfg.MockModel || cfg.ModelReplay != "" {
+		return log.New(os.Stderr, logName+": ", log.LstdFlags), func() error { return nil }, nil
+	}
+
+	logClient, err := logging.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := logClient.Logger(logName)
+	mu.Lock()
+	open[logger] = true
+	mu.Unlock()
+
+	closeLog := func() error {
+		mu.Lock()
+		delete(open, logger)
+		mu.Unlock()
+		return logClient.Close()
+	}
+	return logger.StandardLogger(logging.Info), closeLog, nil
+}
+
+// Flush sends the buffered entries of every open logger. It is meant for
+// shutdown, when requests that didn't finish in time won't close theirs.
+func Flush() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var firstErr error
+	for logger := range open {
+		if err := logger.Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
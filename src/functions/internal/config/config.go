@@ -0,0 +1,625 @@
+// Package config reads and validates the environment configuration of the
+// functions once, so a bad deployment fails at startup with the full list of
+// problems instead of on the first real request.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the environment configuration. Fields are named after their
+// environment variables.
+type Config struct {
+	ProjectID      string
+	VertexAIAPIKey string
+	ModelName      string
+	// FallbackModels are tried in order when ModelName is rate limited or
+	// failing, e.g. MODEL_FALLBACKS=gemini-1.5-pro.
+	FallbackModels []string
+	// ModelAllowlist are the models clients may ask for per request.
+	ModelAllowlist []string
+	// HedgeModel is a fast model detect-hazards calls alongside the primary
+	// one, keeping the first acceptable answer, see provider.Hedge.
+	HedgeModel string
+	// ConsensusSamples is how many answers detect-hazards asks for per
+	// frame, acting on the most severe one, see package consensus.
+	ConsensusSamples int
+	// BreakerCooldown is how long a model whose circuit opened is skipped
+	// before it is probed again, see package provider. 0 disables the
+	// circuit breakers.
+	BreakerCooldown time.Duration
+	// ModelTimeout bounds the streamed model calls of object-reader, whose
+	// answer is then cut to its complete sentences. 0 leaves them to the
+	// request timeout of the platform.
+	ModelTimeout    time.Duration
+	SignalModelName string
+	// ModelProvider is one of the Provider constants. VertexLocation is the
+	// Vertex AI region, e.g. us-central1, or "global".
+	ModelProvider   string
+	VertexLocation  string
+	OpenAIAPIKey    string
+	AnthropicAPIKey string
+	// SafetyThreshold is the Gemini safety filter threshold for all harm
+	// categories, one of the Safety constants.
+	SafetyThreshold string
+	// APIKey is the key clients must send in X-API-Key. When empty, any
+	// key is accepted.
+	APIKey string
+
+	FacesBucket    string
+	CaregiverTopic string
+	// DebugBucket keeps frames of requests asking for debug archival, see
+	// package archive. When empty, nothing is archived. FrameRetention is
+	// how long they are kept.
+	DebugBucket    string
+	FrameRetention time.Duration
+	OverpassURL    string
+	// WeatherURL is the Open-Meteo forecast API detect-hazards looks up the
+	// weather at the user with, unless WeatherDisabled is set.
+	WeatherURL      string
+	WeatherDisabled bool
+	// CurrencyRatesURL is the Frankfurter API object-reader converts prices
+	// into the user's home currency with, unless CurrencyDisabled is set,
+	// see package currency.
+	CurrencyRatesURL string
+	CurrencyDisabled bool
+	// PlacesAPIKey enables the Google Places lookup answering "where am I"
+	// in object-reader, see package places.
+	PlacesAPIKey string
+	PlacesURL    string
+	// ProductLookup lets the model look up packaged products by barcode
+	// or name, in the products catalog and on Open Food Facts at
+	// ProductsURL, see package products.
+	ProductLookup bool
+	ProductsURL   string
+	// VisionOCR answers read-text commands with Cloud Vision OCR, see
+	// package ocr.
+	VisionOCR bool
+	// CloudTranslation translates answers with the Cloud Translation API
+	// rather than the model, see package translate.
+	CloudTranslation bool
+
+	MockModel    bool
+	MockModelDir string
+	ModelReplay  string
+	ModelRecord  string
+
+	PromptsBucket            string
+	PromptsCacheTTL          time.Duration
+	PromptVersion            string
+	AllowPromptVersionHeader bool
+	// Experiment is the raw JSON experiment definition, see package
+	// experiments.
+	Experiment string
+	// RuntimeSettings reads prompts and tunables managed through the admin
+	// function from Firestore, cached for SettingsCacheTTL, see package
+	// settings. AdminAPIKey is the key of the admin function, sent in
+	// X-Admin-Key; the admin function is off without one. AdminKeys are
+	// the keys of named admins, "name:key", so the audit log tells who
+	// acted, see package audit.
+	RuntimeSettings  bool
+	SettingsCacheTTL time.Duration
+	AdminAPIKey      string
+	AdminKeys        []string
+
+	// PersonaName and PersonaTone are the assistant's name and tone, see
+	// package persona.
+	PersonaName    string
+	PersonaTone    string
+	PromptLanguage string
+	Units          string
+	// Verbosity is the default level of package verbosity.
+	Verbosity string
+
+	// UsageTable is the BigQuery table usage records are exported to,
+	// "dataset.table" or "project.dataset.table". ModelPrices is a JSON
+	// price override, see package usage.
+	UsageTable  string
+	ModelPrices string
+	// AnalyticsDataset is the BigQuery dataset of the guidance quality
+	// tables, "dataset" or "project.dataset", see package analytics.
+	AnalyticsDataset string
+
+	// DailyBudgetUSD limits the estimated model spend per UTC day, see
+	// package budget. 0 means no limit. BudgetMinInterval is the frame
+	// interval suggested in interval mode.
+	DailyBudgetUSD    float64
+	BudgetMode        string
+	BudgetModel       string
+	BudgetMinInterval time.Duration
+
+	// IdempotencyTTL is how long responses are kept for retries with the
+	// same Idempotency-Key, see package idempotency. 0 disables it.
+	IdempotencyTTL time.Duration
+
+	// FrameCacheTTL is how long a hazard analysis is reused for
+	// near-identical frames, see package framecache, and how long after
+	// its analysis a frame of a session may be answered UNCHANGED. 0
+	// disables both.
+	FrameCacheTTL time.Duration
+
+	// ConversationTTL is how long object-reader keeps an image and the
+	// questions about it in memory, for follow-up questions. 0 disables
+	// follow-ups.
+	ConversationTTL time.Duration
+
+	// JobsTopic is the Pub/Sub topic of asynchronous requests, see package
+	// jobs; they are served synchronously when it is empty. CallbackHosts
+	// are the webhook hosts allowed, none when it is empty, and
+	// JobsWebhookSecret signs the calls.
+	JobsTopic         string
+	CallbackHosts     []string
+	JobsWebhookSecret string
+	// JobsQueue is the Cloud Tasks queue jobs failing transiently are
+	// retried on, calling JobsWorkerURL (ProcessJob) as JobsServiceAccount.
+	// Such jobs fail at once when it is empty. With JobsServiceAccount,
+	// ProcessJob only serves OIDC tokens of that account for JobsWorkerURL,
+	// so the push subscription must authenticate as it too.
+	JobsQueue          string
+	JobsWorkerURL      string
+	JobsServiceAccount string
+
+	HealthzSecrets  []string
+	HealthzProbeTTL time.Duration
+
+	// ShutdownTimeout is how long requests in flight get to finish on
+	// SIGTERM, see package shutdown.
+	ShutdownTimeout time.Duration
+
+	// FrameInterval is the shortest interval between frames suggested to
+	// clients, see package pacing.
+	FrameInterval time.Duration
+
+	// AppCheck is one of the AppCheck constants, see package appcheck.
+	// AppCheckProject is the Firebase project number tokens are issued
+	// for, and AppCheckAppIDs the app IDs accepted, any when empty.
+	AppCheck        string
+	AppCheckProject string
+	AppCheckAppIDs  []string
+
+	// DeviceTokenKeys sign the access tokens of register-device, "kid:key"
+	// pairs, the first signing and all verifying; see package devicetoken.
+	// Tokens last DeviceTokenTTL and carry DeviceScopes, the entry points
+	// they may call, any when empty, and DeviceRateLimit, requests per
+	// minute or 0 for none. With DeviceTokenRequired the static API key
+	// alone is refused.
+	DeviceTokenKeys     []string
+	DeviceTokenTTL      time.Duration
+	DeviceScopes        []string
+	DeviceRateLimit     int
+	DeviceTokenRequired bool
+
+	// MaxRequestBytes bounds request bodies. AbuseThrottle and
+	// AbuseQuarantine are the rejected requests, such as undecodable
+	// images, within ten minutes that throttle a client or quarantine it
+	// for AbuseQuarantineTTL, 0 disabling either; quarantines are
+	// announced on AbuseTopic. See package abuse.
+	MaxRequestBytes    int
+	AbuseThrottle      int
+	AbuseQuarantine    int
+	AbuseQuarantineTTL time.Duration
+	AbuseTopic         string
+
+	GitSHA    string
+	BuildTime string
+}
+
+// Model providers, see packages gemini and provider.
+const (
+	ProviderAIStudio  = "aistudio"
+	ProviderVertex    = "vertex"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+)
+
+// Safety filter thresholds, from least to most blocking. The API default,
+// medium and above, blocks some street scenes with people in them, so the
+// default here is only high.
+const (
+	SafetyNone           = "none"
+	SafetyOnlyHigh       = "only_high"
+	SafetyMediumAndAbove = "medium_and_above"
+	SafetyLowAndAbove    = "low_and_above"
+)
+
+// Persona tones, see package persona.
+const (
+	TonePlayful  = "playful"
+	ToneFriendly = "friendly"
+	ToneNeutral  = "neutral"
+)
+
+// App Check modes: off, logging requests without a valid token but serving
+// them, or refusing them.
+const (
+	AppCheckOff     = "off"
+	AppCheckGrace   = "grace"
+	AppCheckEnforce = "enforce"
+)
+
+// Budget modes, see package budget.
+const (
+	BudgetCheaper  = "cheaper"
+	BudgetReject   = "reject"
+	BudgetInterval = "interval"
+)
+
+const (
+	defaultOverpassURL = "https://overpass-api.de/api/interpreter"
+	defaultWeatherURL  = "https://api.open-meteo.com/v1/forecast"
+	defaultPlacesURL   = "https://places.googleapis.com/v1/places:searchNearby"
+	defaultProductsURL = "https://world.openfoodfacts.org"
+	defaultRatesURL    = "https://api.frankfurter.app/latest"
+)
+
+// maxConsensusSamples bounds CONSENSUS_SAMPLES, as every sample is a model
+// call.
+const maxConsensusSamples = 5
+
+// modelless are the entry points that never call the model.
+var modelless = map[string]bool{
+	"CheckLighting":    true,
+	"SubmitFeedback":   true,
+	"AggregateQuality": true,
+	"Admin":            true,
+	"QualitySummary":   true,
+	"DeleteMyData":     true,
+	"ExportMyData":     true,
+	"MyConsent":        true,
+	"MyCalibration":    true,
+	"MyAllergens":      true,
+	"ReapExpired":      true,
+	"RegisterDevice":   true,
+}
+
+var (
+	versionPattern  = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+	locationPattern = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	tablePattern    = regexp.MustCompile(`^([a-z][a-z0-9-]{4,61}[a-z0-9]\.)?\w+\.\w+$`)
+	datasetPattern  = regexp.MustCompile(`^([a-z][a-z0-9-]{4,61}[a-z0-9]\.)?\w+$`)
+	queuePattern    = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/queues/[^/]+$`)
+	httpsPattern    = regexp.MustCompile(`^https://\S+$`)
+
+	projectNumberPattern = regexp.MustCompile(`^[0-9]{1,20}$`)
+)
+
+var (
+	mu      sync.Mutex
+	current *Config
+)
+
+// Get returns the configuration, loading it on first use. An invalid
+// configuration is fatal.
+func Get() *Config {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if current == nil {
+		cfg, err := Load()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cfg.APIKey == "" {
+			log.Println("Warning: API_KEY environment variable not set")
+		}
+		current = cfg
+	}
+	return current
+}
+
+// Reload reads the environment again, e.g. after a test changed it.
+func Reload() error {
+	cfg, err := Load()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = cfg
+	mu.Unlock()
+	return nil
+}
+
+// Load reads and validates the environment. The error lists every missing
+// or invalid variable. Which variables are required depends on
+// FUNCTION_TARGET, the entry point set by the Cloud Functions runtime; when
+// it is empty (e.g. the local server) all functions are assumed to run.
+func Load() (*Config, error) {
+	r := &reader{}
+
+	cfg := &Config{
+		ProjectID:        r.str("PROJECT_ID", ""),
+		VertexAIAPIKey:   r.str("VERTEX_AI_API_KEY", ""),
+		ModelName:        r.str("MODEL_NAME", ""),
+		FallbackModels:   r.list("MODEL_FALLBACKS"),
+		ModelAllowlist:   r.list("MODEL_ALLOWLIST"),
+		HedgeModel:       r.str("HEDGE_MODEL", ""),
+		ConsensusSamples: r.integer("CONSENSUS_SAMPLES", 1, 1, maxConsensusSamples),
+		BreakerCooldown:  r.duration("BREAKER_COOLDOWN", 30*time.Second),
+		ModelTimeout:     r.duration("MODEL_TIMEOUT", 0),
+		SignalModelName:  r.str("SIGNAL_MODEL_NAME", ""),
+		ModelProvider:    r.oneOf("MODEL_PROVIDER", ProviderAIStudio, ProviderAIStudio, ProviderVertex, ProviderOpenAI, ProviderAnthropic),
+		VertexLocation:   r.pattern("VERTEX_LOCATION", locationPattern, "us-central1"),
+		OpenAIAPIKey:     r.str("OPENAI_API_KEY", ""),
+		AnthropicAPIKey:  r.str("ANTHROPIC_API_KEY", ""),
+		SafetyThreshold:  r.oneOf("SAFETY_THRESHOLD", SafetyOnlyHigh, SafetyNone, SafetyOnlyHigh, SafetyMediumAndAbove, SafetyLowAndAbove),
+		APIKey:           r.str("API_KEY", ""),
+
+		FacesBucket:      r.str("FACES_BUCKET", ""),
+		CaregiverTopic:   r.str("CAREGIVER_TOPIC", ""),
+		DebugBucket:      r.str("DEBUG_BUCKET", ""),
+		FrameRetention:   r.duration("FRAME_RETENTION", 72*time.Hour),
+		OverpassURL:      r.url("OVERPASS_URL", defaultOverpassURL),
+		WeatherURL:       r.url("WEATHER_URL", defaultWeatherURL),
+		WeatherDisabled:  r.boolean("WEATHER_DISABLED"),
+		CurrencyRatesURL: r.url("CURRENCY_RATES_URL", defaultRatesURL),
+		CurrencyDisabled: r.boolean("CURRENCY_DISABLED"),
+		PlacesAPIKey:     r.str("PLACES_API_KEY", ""),
+		PlacesURL:        r.url("PLACES_URL", defaultPlacesURL),
+		ProductLookup:    r.boolean("PRODUCT_LOOKUP"),
+		ProductsURL:      r.url("PRODUCTS_URL", defaultProductsURL),
+		VisionOCR:        r.boolean("VISION_OCR"),
+		CloudTranslation: r.boolean("CLOUD_TRANSLATION"),
+
+		MockModel:    r.boolean("MOCK_MODEL"),
+		MockModelDir: r.str("MOCK_MODEL_DIR", ""),
+		ModelReplay:  r.str("MODEL_REPLAY", ""),
+		ModelRecord:  r.str("MODEL_RECORD", ""),
+
+		PromptsBucket:            r.str("PROMPTS_BUCKET", ""),
+		PromptsCacheTTL:          r.duration("PROMPTS_CACHE_TTL", 5*time.Minute),
+		PromptVersion:            r.pattern("PROMPT_VERSION", versionPattern, ""),
+		AllowPromptVersionHeader: r.boolean("ALLOW_PROMPT_VERSION_HEADER"),
+		Experiment:               r.json("EXPERIMENT"),
+		RuntimeSettings:          r.boolean("RUNTIME_SETTINGS"),
+		SettingsCacheTTL:         r.duration("SETTINGS_CACHE_TTL", time.Minute),
+		AdminAPIKey:              r.str("ADMIN_API_KEY", ""),
+		AdminKeys:                r.list("ADMIN_KEYS"),
+
+		PersonaName:    r.str("PERSONA_NAME", "Buddy"),
+		PersonaTone:    r.oneOf("PERSONA_TONE", TonePlayful, TonePlayful, ToneFriendly, ToneNeutral),
+		PromptLanguage: r.str("PROMPT_LANGUAGE", "English"),
+		Units:          r.oneOf("UNITS", "metric", "metric", "imperial"),
+		Verbosity:      r.oneOf("VERBOSITY", "normal", "terse", "normal", "detailed"),
+
+		UsageTable:  r.pattern("USAGE_TABLE", tablePattern, ""),
+		ModelPrices: r.json("MODEL_PRICES"),
+
+		AnalyticsDataset: r.pattern("ANALYTICS_DATASET", datasetPattern, ""),
+
+		DailyBudgetUSD:    r.float("DAILY_BUDGET_USD"),
+		BudgetMode:        r.oneOf("BUDGET_MODE", BudgetCheaper, BudgetCheaper, BudgetReject, BudgetInterval),
+		BudgetModel:       r.str("BUDGET_MODEL", "gemini-1.5-flash-8b"),
+		BudgetMinInterval: r.duration("BUDGET_MIN_INTERVAL", 5*time.Second),
+
+		IdempotencyTTL: r.duration("IDEMPOTENCY_TTL", 5*time.Minute),
+
+		FrameCacheTTL: r.duration("FRAME_CACHE_TTL", 3*time.Second),
+
+		ConversationTTL: r.duration("CONVERSATION_TTL", 10*time.Minute),
+
+		JobsTopic:         r.str("JOBS_TOPIC", ""),
+		CallbackHosts:     r.list("CALLBACK_HOSTS"),
+		JobsWebhookSecret: r.str("JOBS_WEBHOOK_SECRET", ""),
+
+		JobsQueue:          r.pattern("JOBS_QUEUE", queuePattern, ""),
+		JobsWorkerURL:      r.pattern("JOBS_WORKER_URL", httpsPattern, ""),
+		JobsServiceAccount: r.str("JOBS_SERVICE_ACCOUNT", ""),
+
+		HealthzSecrets:  r.list("HEALTHZ_SECRETS"),
+		HealthzProbeTTL: r.duration("HEALTHZ_PROBE_TTL", 5*time.Minute),
+
+		ShutdownTimeout: r.duration("SHUTDOWN_TIMEOUT", 8*time.Second),
+
+		FrameInterval: r.duration("FRAME_INTERVAL", time.Second),
+
+		AppCheck:        r.oneOf("APP_CHECK", AppCheckOff, AppCheckOff, AppCheckGrace, AppCheckEnforce),
+		AppCheckProject: r.pattern("APP_CHECK_PROJECT", projectNumberPattern, ""),
+		AppCheckAppIDs:  r.list("APP_CHECK_APP_IDS"),
+
+		DeviceTokenKeys:     r.list("DEVICE_TOKEN_KEYS"),
+		DeviceTokenTTL:      r.duration("DEVICE_TOKEN_TTL", time.Hour),
+		DeviceScopes:        r.list("DEVICE_SCOPES"),
+		DeviceRateLimit:     r.integer("DEVICE_RATE_LIMIT", 60, 0, 10000),
+		DeviceTokenRequired: r.boolean("DEVICE_TOKEN_REQUIRED"),
+
+		MaxRequestBytes:    r.integer("MAX_REQUEST_BYTES", 10<<20, 1<<10, 32<<20),
+		AbuseThrottle:      r.integer("ABUSE_THROTTLE", 20, 0, 100000),
+		AbuseQuarantine:    r.integer("ABUSE_QUARANTINE", 100, 0, 100000),
+		AbuseQuarantineTTL: r.duration("ABUSE_QUARANTINE_TTL", 24*time.Hour),
+		AbuseTopic:         r.str("ABUSE_TOPIC", ""),
+
+		GitSHA:    r.str("GIT_SHA", ""),
+		BuildTime: r.str("BUILD_TIME", ""),
+	}
+
+	target := os.Getenv("FUNCTION_TARGET")
+	offline := cfg.MockModel || cfg.ModelReplay != ""
+
+	if !offline {
+		r.require("PROJECT_ID", cfg.ProjectID)
+	}
+	if !offline && !modelless[target] {
+		switch cfg.ModelProvider {
+		case ProviderAIStudio:
+			r.require("VERTEX_AI_API_KEY", cfg.VertexAIAPIKey)
+		case ProviderOpenAI:
+			r.require("OPENAI_API_KEY", cfg.OpenAIAPIKey)
+		case ProviderAnthropic:
+			r.require("ANTHROPIC_API_KEY", cfg.AnthropicAPIKey)
+		}
+		if target != "CheckSignal" {
+			r.require("MODEL_NAME", cfg.ModelName)
+		}
+	}
+	if target == "RecognizePerson" {
+		r.require("FACES_BUCKET", cfg.FacesBucket)
+	}
+	if !offline && cfg.AppCheck != AppCheckOff {
+		r.require("APP_CHECK_PROJECT", cfg.AppCheckProject)
+	}
+	if cfg.JobsQueue != "" || cfg.JobsServiceAccount != "" {
+		r.require("JOBS_WORKER_URL", cfg.JobsWorkerURL)
+	}
+	if cfg.MockModel && cfg.ModelRecord != "" {
+		r.problems = append(r.problems, "MOCK_MODEL and MODEL_RECORD can't be used together")
+	}
+	if cfg.ModelRecord != "" && cfg.ModelProvider == ProviderVertex {
+		r.problems = append(r.problems, "MODEL_RECORD records the Gemini API, use MODEL_PROVIDER=aistudio")
+	}
+	for _, key := range cfg.AdminKeys {
+		if name, secret, _ := strings.Cut(key, ":"); name == "" || secret == "" {
+			r.problems = append(r.problems, "ADMIN_KEYS: expected name:key pairs")
+			break
+		}
+	}
+	for _, key := range cfg.DeviceTokenKeys {
+		if kid, secret, _ := strings.Cut(key, ":"); kid == "" || len(secret) < 32 {
+			r.problems = append(r.problems, "DEVICE_TOKEN_KEYS: expected kid:key pairs with keys of at least 32 characters")
+			break
+		}
+	}
+	if cfg.DeviceTokenRequired && len(cfg.DeviceTokenKeys) == 0 {
+		r.require("DEVICE_TOKEN_KEYS", "")
+	}
+	for _, name := range cfg.HealthzSecrets {
+		if !strings.HasPrefix(name, "projects/") {
+			r.problems = append(r.problems, fmt.Sprintf("HEALTHZ_SECRETS: %q is not a secret version resource name", name))
+		}
+	}
+
+	if len(r.problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  - %s", strings.Join(r.problems, "\n  - "))
+	}
+
+	return cfg, nil
+}
+
+// reader reads environment variables, collecting problems instead of
+// stopping at the first one.
+type reader struct {
+	problems []string
+}
+
+func (r *reader) invalid(name, value, expected string) {
+	r.problems = append(r.problems, fmt.Sprintf("%s: invalid value %q, expected %s", name, value, expected))
+}
+
+func (r *reader) require(name, value string) {
+	if value == "" {
+		r.problems = append(r.problems, name+" is required")
+	}
+}
+
+func (r *reader) str(name, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (r *reader) boolean(name string) bool {
+	v := r.str(name, "")
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		r.invalid(name, v, "true or false")
+	}
+	return b
+}
+
+func (r *reader) float(name string) float64 {
+	v := r.str(name, "")
+	if v == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		r.invalid(name, v, "a non-negative number")
+		return 0
+	}
+	return f
+}
+
+func (r *reader) integer(name string, fallback, lowest, highest int) int {
+	v := r.str(name, "")
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lowest || n > highest {
+		r.invalid(name, v, fmt.Sprintf("an integer from %d to %d", lowest, highest))
+		return fallback
+	}
+	return n
+}
+
+func (r *reader) duration(name string, fallback time.Duration) time.Duration {
+	v := r.str(name, "")
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		r.invalid(name, v, "a duration such as 5m")
+		return fallback
+	}
+	return d
+}
+
+func (r *reader) url(name, fallback string) string {
+	v := r.str(name, fallback)
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		r.invalid(name, v, "an absolute URL")
+	}
+	return v
+}
+
+func (r *reader) pattern(name string, pattern *regexp.Regexp, fallback string) string {
+	v := r.str(name, fallback)
+	if v != "" && !pattern.MatchString(v) {
+		r.invalid(name, v, "a value matching "+pattern.String())
+	}
+	return v
+}
+
+func (r *reader) oneOf(name, fallback string, allowed ...string) string {
+	v := r.str(name, fallback)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	r.invalid(name, v, "one of "+strings.Join(allowed, ", "))
+	return fallback
+}
+
+func (r *reader) json(name string) string {
+	v := r.str(name, "")
+	if v != "" && !json.Valid([]byte(v)) {
+		r.invalid(name, v, "JSON")
+	}
+	return v
+}
+
+func (r *reader) list(name string) []string {
+	var items []string
+	for _, item := range strings.Split(r.str(name, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
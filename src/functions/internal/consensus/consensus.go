@@ -0,0 +1,69 @@
+// Package consensus asks a model the same question several times and
+// reconciles the answers, as the severity of a single answer is too noisy
+// to act on. CONSENSUS_SAMPLES sets the number of answers; with 1, the
+// default, there is a single answer and nothing to reconcile.
+//
+// Reconciling is conservative: the most severe answer wins, and answers
+// more than one severity level apart (HIGH and LOW) are a disagreement the
+// caller should flag as low confidence.
+package consensus
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Sample sends parts to every model at once, one answer each. Models must
+// not be shared, as a VisionModel isn't safe for concurrent use. Failed
+// calls are left out; Sample only fails when every call did, with the
+// error of the first model.
+func Sample(ctx context.Context, models []provider.VisionModel, parts ...provider.Part) ([]string, error) {
+	if len(models) == 0 {
+		return nil, errors.New("no model to sample")
+	}
+
+	texts := make([]string, len(models))
+	errs := make([]error, len(models))
+	var wg sync.WaitGroup
+	for i, m := range models {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			texts[i], errs[i] = m.Generate(ctx, parts...)
+		}()
+	}
+	wg.Wait()
+
+	var answers []string
+	for i, text := range texts {
+		if errs[i] == nil {
+			answers = append(answers, text)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, errs[0]
+	}
+	return answers, nil
+}
+
+// Decide returns the index of the candidate severity to act on, the most
+// severe one, and whether the candidates agree: they are at most one level
+// apart. With no candidates it returns -1.
+func Decide(severities []model.Severity) (index int, agreed bool) {
+	if len(severities) == 0 {
+		return -1, true
+	}
+
+	lowest := severities[0].Rank()
+	for i, s := range severities {
+		if s.Rank() > severities[index].Rank() {
+			index = i
+		}
+		lowest = min(lowest, s.Rank())
+	}
+	return index, severities[index].Rank()-lowest <= 1
+}
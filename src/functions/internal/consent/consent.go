@@ -0,0 +1,215 @@
+// Package consent holds what users agreed to be kept about them, in their
+// Firestore profile, users/{uid}:
+//
+//	imageRetention: frames and the records of their answers may be
+//	  archived, see package archive
+//	analytics: what was seen in their frames may go into logs and
+//	  analytics
+//	consentUpdatedAt: when they last answered
+//
+// debugArchive, the flag package archive read before, counts as
+// imageRetention. Both are opt-in: users who never answered consent to
+// neither. Requests without a user aren't tied to anyone, so their
+// analytics are recorded, but their frames are archived only when they ask
+// with "debug": true.
+//
+// Functions check consent before archiving a frame or logging what it
+// showed, for the user of the ID token, see auth.Caller: the X-User-ID
+// header would let anyone pass as a user who consented. The reap-expired
+// function deletes what outlived its retention or its consent.
+package consent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// cacheTTL is how long a user's consent is cached, sparing a profile read
+// per frame. A withdrawal takes up to this long to reach all instances.
+const cacheTTL = 5 * time.Minute
+
+// Record is a user's consent. A nil field was never answered.
+type Record struct {
+	ImageRetention *bool      `json:"imageRetention"`
+	Analytics      *bool      `json:"analytics"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+}
+
+type cached struct {
+	record    Record
+	expiresAt time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]cached{}
+)
+
+// anonymous is the consent of requests without a user.
+var anonymous = Record{Analytics: func(b bool) *bool { return &b }(true)}
+
+// KeepFrames reports whether frames may be archived. debug is set when the
+// request asked for it, which is enough unless the user refused.
+func (c Record) KeepFrames(debug bool) bool {
+	if c.ImageRetention != nil {
+		return *c.ImageRetention
+	}
+	return debug
+}
+
+// Refused reports whether the user refused frames to be kept, so those
+// already kept must go.
+func (c Record) Refused() bool {
+	return c.ImageRetention != nil && !*c.ImageRetention
+}
+
+// AllowsAnalytics reports whether what was seen may be logged and analyzed.
+func (c Record) AllowsAnalytics() bool {
+	return c.Analytics != nil && *c.Analytics
+}
+
+// Get returns the consent of userID, "" for a request without a user.
+func Get(ctx context.Context, userID string) (Record, error) {
+	if userID == "" {
+		return anonymous, nil
+	}
+
+	mu.Lock()
+	c, ok := cache[userID]
+	mu.Unlock()
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.record, nil
+	}
+
+	record, err := load(ctx, userID)
+	if err != nil {
+		return Record{}, err
+	}
+	remember(userID, record)
+	return record, nil
+}
+
+// Frames reports whether the frames of a request may be archived. Without
+// a readable consent they are not.
+func Frames(ctx context.Context, debug bool, userID string) bool {
+	c, err := Get(ctx, userID)
+	if err != nil {
+		log.Printf("Error reading consent of %s: %v", userID, err)
+		return false
+	}
+	return c.KeepFrames(debug)
+}
+
+// Analytics reports whether what the frames of userID showed may be
+// logged and analyzed. Without a readable consent it may not.
+func Analytics(ctx context.Context, userID string) bool {
+	c, err := Get(ctx, userID)
+	if err != nil {
+		log.Printf("Error reading consent of %s: %v", userID, err)
+		return false
+	}
+	return c.AllowsAnalytics()
+}
+
+// Logger returns logger if userID allows analytics, else a logger
+// discarding everything. Image-derived content is logged through it.
+func Logger(ctx context.Context, userID string, logger *log.Logger) *log.Logger {
+	if Analytics(ctx, userID) {
+		return logger
+	}
+	return log.New(io.Discard, "", 0)
+}
+
+// Save stores the answered fields of record as the consent of userID,
+// keeping the others, and returns the whole consent.
+func Save(ctx context.Context, userID string, record Record) (Record, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Record{}, err
+	}
+
+	doc := &firestore.Document{Fields: map[string]firestore.Value{
+		"consentUpdatedAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}}
+	mask := []string{"consentUpdatedAt"}
+	answers := map[string]*bool{"imageRetention": record.ImageRetention, "analytics": record.Analytics}
+	for field, answer := range answers {
+		if answer != nil {
+			doc.Fields[field] = firestore.Value{BooleanValue: *answer, ForceSendFields: []string{"BooleanValue"}}
+			mask = append(mask, field)
+		}
+	}
+
+	saved, err := fs.Projects.Databases.Documents.Patch(document(userID), doc).
+		UpdateMaskFieldPaths(mask...).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return Record{}, err
+	}
+
+	record = fromDocument(saved)
+	remember(userID, record)
+	return record, nil
+}
+
+func load(ctx context.Context, userID string) (Record, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Record{}, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(userID)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Record{}, nil
+		}
+		return Record{}, err
+	}
+	return fromDocument(doc), nil
+}
+
+func fromDocument(doc *firestore.Document) Record {
+	answer := func(field string) *bool {
+		v, ok := doc.Fields[field]
+		if !ok {
+			return nil
+		}
+		return &v.BooleanValue
+	}
+
+	var record Record
+	record.ImageRetention = answer("imageRetention")
+	if record.ImageRetention == nil {
+		record.ImageRetention = answer("debugArchive")
+	}
+	record.Analytics = answer("analytics")
+	if v, ok := doc.Fields["consentUpdatedAt"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v.TimestampValue); err == nil {
+			record.UpdatedAt = &t
+		}
+	}
+	return record
+}
+
+func remember(userID string, record Record) {
+	mu.Lock()
+	cache[userID] = cached{record: record, expiresAt: time.Now().Add(cacheTTL)}
+	mu.Unlock()
+}
+
+func document(userID string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/users/%s", config.Get().ProjectID, userID)
+}
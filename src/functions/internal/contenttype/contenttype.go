@@ -0,0 +1,38 @@
+// Package contenttype refuses request bodies that aren't JSON with 415, so
+// a client sending a form or a raw image learns so at once instead of
+// getting "Invalid request body". The only charset accepted is UTF-8,
+// which JSON requires anyway.
+package contenttype
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// JSON is the media type of request bodies.
+const JSON = "application/json"
+
+// Handle passes requests to next when they have no body, or a JSON one.
+func Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+			next(w, r)
+			return
+		}
+
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != JSON {
+			w.Header().Set("Accept-Post", JSON)
+			apierror.Write(w, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType, "Content-Type must be "+JSON))
+			return
+		}
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+			apierror.Write(w, apierror.New(http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType, "Charset must be utf-8"))
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,344 @@
+// Package currency converts the prices in an answer into the user's home
+// currency, for travelers, e.g. "1,200 yen, about 8 US dollars". Rates come
+// from the Frankfurter API at CURRENCY_RATES_URL and are cached for an
+// hour. The home currency is given by the request or by the homeCurrency
+// field of the user's profile, users/{uid}, e.g. "USD". Conversion is off
+// with CURRENCY_DISABLED and in the offline modes.
+package currency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/model"
+)
+
+const (
+	// timeout bounds a rate lookup; prices are read unconverted rather
+	// than late.
+	timeout = 2 * time.Second
+	// ratesTTL is how long the rates of a currency are reused.
+	ratesTTL = time.Hour
+	// profileTTL is how long a user's home currency is cached.
+	profileTTL = 5 * time.Minute
+	// maxConversions bounds the prices converted in one answer.
+	maxConversions = 5
+)
+
+// codePattern matches ISO 4217 currency codes.
+var codePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// names are the spoken names of the currencies, singular and plural.
+var names = map[string][2]string{
+	"USD": {"US dollar", "US dollars"},
+	"EUR": {"euro", "euros"},
+	"GBP": {"British pound", "British pounds"},
+	"JPY": {"yen", "yen"},
+	"CNY": {"yuan", "yuan"},
+	"KRW": {"won", "won"},
+	"THB": {"baht", "baht"},
+	"INR": {"Indian rupee", "Indian rupees"},
+	"AUD": {"Australian dollar", "Australian dollars"},
+	"CAD": {"Canadian dollar", "Canadian dollars"},
+	"NZD": {"New Zealand dollar", "New Zealand dollars"},
+	"SGD": {"Singapore dollar", "Singapore dollars"},
+	"HKD": {"Hong Kong dollar", "Hong Kong dollars"},
+	"CHF": {"Swiss franc", "Swiss francs"},
+	"SEK": {"Swedish krona", "Swedish kronor"},
+	"NOK": {"Norwegian krone", "Norwegian kroner"},
+	"DKK": {"Danish krone", "Danish kroner"},
+	"MYR": {"ringgit", "ringgit"},
+	"IDR": {"rupiah", "rupiah"},
+	"PHP": {"Philippine peso", "Philippine pesos"},
+	"MXN": {"Mexican peso", "Mexican pesos"},
+	"BRL": {"real", "reais"},
+	"TRY": {"lira", "lira"},
+	"PLN": {"zloty", "zloty"},
+}
+
+// symbols are the currencies of price symbols and words. "$" is taken for
+// US dollars. Pounds are only read from "£" and "GBP", as "2 pounds" is
+// more often a weight.
+var symbols = map[string]string{
+	"$": "USD", "€": "EUR", "£": "GBP", "¥": "JPY", "円": "JPY", "元": "CNY",
+	"₩": "KRW", "฿": "THB", "₹": "INR", "₱": "PHP", "₺": "TRY",
+	"dollar": "USD", "dollars": "USD", "euro": "EUR", "euros": "EUR",
+	"yen": "JPY", "yuan": "CNY",
+	"won": "KRW", "baht": "THB", "rupee": "INR", "rupees": "INR",
+	"ringgit": "MYR", "rupiah": "IDR", "franc": "CHF", "francs": "CHF",
+}
+
+const amount = `(\d{1,3}(?:,\d{3})+|\d+)(\.\d{1,2})?`
+
+var (
+	// prefixPattern matches prices with the currency first, e.g. "¥1,200"
+	// or "THB 45".
+	prefixPattern = regexp.MustCompile(`([$€£¥₩฿₹₱₺]|\b[A-Z]{3}\b)\s?` + amount + `\b`)
+	// suffixPattern matches prices with the currency last, e.g. "1,200
+	// yen", "45 THB" or "1200円".
+	suffixPattern = regexp.MustCompile(`\b` + amount + `\s?([円元]|[A-Z]{3}\b|(?i:dollars?|euros?|yen|yuan|won|baht|rupees?|ringgit|rupiah|francs?)\b)`)
+)
+
+// ErrDisabled is returned by Convert when conversion is off.
+var ErrDisabled = errors.New("currency conversion disabled")
+
+// Enabled reports whether conversion is on.
+func Enabled() bool {
+	cfg := config.Get()
+	return !cfg.CurrencyDisabled && !cfg.MockModel && cfg.ModelReplay == ""
+}
+
+// ValidCode reports whether code is a currency that can be converted to,
+// in upper case.
+func ValidCode(code string) bool {
+	_, ok := names[code]
+	return codePattern.MatchString(code) && ok
+}
+
+// HasPrice reports whether text has a price in a known currency.
+func HasPrice(text string) bool {
+	return len(prices(text)) > 0
+}
+
+// price is a price found in a text, at [start, end).
+type price struct {
+	start, end int
+	amount     float64
+	currency   string
+}
+
+// prices returns the prices in text, in order, skipping the ones in an
+// unknown currency.
+func prices(text string) []price {
+	var found []price
+	add := func(match []int, number, fraction, unit int) {
+		code, ok := symbols[strings.ToLower(text[match[unit]:match[unit+1]])]
+		if !ok {
+			code = text[match[unit]:match[unit+1]]
+		}
+		if _, ok := names[code]; !ok {
+			return
+		}
+		digits := strings.ReplaceAll(text[match[number]:match[number+1]], ",", "")
+		if match[fraction] >= 0 {
+			digits += text[match[fraction]:match[fraction+1]]
+		}
+		value, err := strconv.ParseFloat(digits, 64)
+		if err != nil || value == 0 {
+			return
+		}
+		for _, p := range found {
+			if match[0] < p.end && p.start < match[1] {
+				return
+			}
+		}
+		found = append(found, price{start: match[0], end: match[1], amount: value, currency: code})
+	}
+	for _, match := range prefixPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(match, 4, 6, 2)
+	}
+	for _, match := range suffixPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(match, 2, 4, 6)
+	}
+
+	// In order of the text, for the insertions of Convert
+	for i := 1; i < len(found); i++ {
+		for j := i; j > 0 && found[j].start < found[j-1].start; j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+		}
+	}
+	return found
+}
+
+// Convert appends the amount in the home currency to each price of text in
+// another currency, e.g. "1,200 yen" becomes "1,200 yen, about 8 US
+// dollars", and returns the conversions, to the cent. Text is returned as
+// is when it has no such price.
+func Convert(ctx context.Context, text, home string) (string, []model.Conversion, error) {
+	if !Enabled() {
+		return text, nil, ErrDisabled
+	}
+
+	var conversions []model.Conversion
+	var converted strings.Builder
+	last := 0
+	for _, p := range prices(text) {
+		if p.currency == home || len(conversions) == maxConversions {
+			continue
+		}
+		rate, err := rate(ctx, p.currency, home)
+		if err != nil {
+			return text, nil, err
+		}
+		value := p.amount * rate
+
+		converted.WriteString(text[last:p.end])
+		fmt.Fprintf(&converted, ", about %s", spoken(value, home))
+		last = p.end
+		conversions = append(conversions, model.Conversion{
+			Price:        text[p.start:p.end],
+			Amount:       p.amount,
+			Currency:     p.currency,
+			Converted:    math.Round(value*100) / 100,
+			HomeCurrency: home,
+		})
+	}
+	if len(conversions) == 0 {
+		return text, nil, nil
+	}
+	converted.WriteString(text[last:])
+	return converted.String(), conversions, nil
+}
+
+// spoken is an amount as read out, rounded as fits an estimate, e.g. "8
+// US dollars", "2.50 euros" or "0.35 British pounds": whole units from 5
+// up, half units from 1 up, else cents.
+func spoken(value float64, code string) string {
+	switch {
+	case value >= 5:
+		value = math.Round(value)
+	case value >= 1:
+		value = math.Round(value*2) / 2
+	}
+
+	var number string
+	if value == math.Trunc(value) {
+		number = strconv.FormatFloat(value, 'f', 0, 64)
+		// Thousands separators, as in "1,200"
+		for i := len(number) - 3; i > 0; i -= 3 {
+			number = number[:i] + "," + number[i:]
+		}
+	} else {
+		number = strconv.FormatFloat(value, 'f', 2, 64)
+	}
+	name := names[code][1]
+	if number == "1" {
+		name = names[code][0]
+	}
+	return number + " " + name
+}
+
+type cachedRates struct {
+	rates     map[string]float64
+	fetchedAt time.Time
+}
+
+var (
+	ratesMu    sync.Mutex
+	ratesCache = map[string]cachedRates{}
+)
+
+// rate returns the rate from one currency to another, from the cached
+// rates of from.
+func rate(ctx context.Context, from, to string) (float64, error) {
+	ratesMu.Lock()
+	entry, ok := ratesCache[from]
+	ratesMu.Unlock()
+	if !ok || time.Since(entry.fetchedAt) >= ratesTTL {
+		rates, err := fetchRates(ctx, from)
+		if err != nil {
+			return 0, err
+		}
+		entry = cachedRates{rates: rates, fetchedAt: time.Now()}
+		ratesMu.Lock()
+		ratesCache[from] = entry
+		ratesMu.Unlock()
+	}
+
+	rate, ok := entry.rates[to]
+	if !ok {
+		return 0, fmt.Errorf("no rate from %s to %s", from, to)
+	}
+	return rate, nil
+}
+
+func fetchRates(ctx context.Context, from string) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := url.Values{"from": {from}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.Get().CurrencyRatesURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rates API returned %s", resp.Status)
+	}
+
+	var result struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Rates, nil
+}
+
+type cachedHome struct {
+	code      string
+	expiresAt time.Time
+}
+
+var (
+	homeMu    sync.Mutex
+	homeCache = map[string]cachedHome{}
+)
+
+// Home returns the home currency of userID's profile, "" when it has none
+// or for a request without a user.
+func Home(ctx context.Context, userID string) (string, error) {
+	if userID == "" {
+		return "", nil
+	}
+
+	homeMu.Lock()
+	c, ok := homeCache[userID]
+	homeMu.Unlock()
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.code, nil
+	}
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("projects/%s/databases/(default)/documents/users/%s", config.Get().ProjectID, userID)
+	doc, err := fs.Projects.Databases.Documents.Get(name).Context(ctx).Do()
+	var code string
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+	case err != nil:
+		return "", err
+	default:
+		if code = strings.ToUpper(doc.Fields["homeCurrency"].StringValue); !ValidCode(code) {
+			code = ""
+		}
+	}
+
+	homeMu.Lock()
+	homeCache[userID] = cachedHome{code: code, expiresAt: time.Now().Add(profileTTL)}
+	homeMu.Unlock()
+	return code, nil
+}
@@ -0,0 +1,126 @@
+// Package depth measures distances in the depth maps of LiDAR and ToF
+// equipped phones, which clients may send along with a camera frame. A
+// model guesses distances from a single image, often by several steps; the
+// depth map measures them.
+//
+// A depth map is a grid of distances in the orientation of the camera
+// frame, base64 encoded row by row from the top left:
+//
+//   - "float32": little-endian float32 meters, as ARKit's sceneDepth
+//   - "uint16": little-endian uint16 millimeters, as ARCore's
+//     acquireDepthImage16Bits
+//
+// Zero, negative and non-finite samples are treated as missing.
+package depth
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Encodings of depth samples.
+const (
+	EncodingFloat32 = "float32"
+	EncodingUint16  = "uint16"
+)
+
+// maxSide bounds the width and height of a depth map. Phone depth sensors
+// produce 256x192 or so.
+const maxSide = 1024
+
+// maxRange is the farthest distance, in meters, trusted from a phone depth
+// sensor.
+const maxRange = 8.0
+
+// minCoverage is the fraction of a region that must have valid samples for
+// a distance to be measured.
+const minCoverage = 0.1
+
+// nearPercentile picks the distance of a region among its samples: near
+// the closest, the safer estimate, while ignoring stray samples.
+const nearPercentile = 0.1
+
+// Map is a depth map as sent by clients.
+type Map struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Encoding string `json:"encoding,omitempty"`
+	Data     string `json:"data"`
+}
+
+// Samples is a decoded depth map, in meters.
+type Samples struct {
+	width, height int
+	meters        []float32
+}
+
+// Decode validates m and decodes its samples. The encoding defaults to
+// float32.
+func (m Map) Decode() (*Samples, error) {
+	if m.Width <= 0 || m.Height <= 0 || m.Width > maxSide || m.Height > maxSide {
+		return nil, fmt.Errorf("depth map size %dx%d out of range", m.Width, m.Height)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(m.Data)
+	if err != nil {
+		return nil, fmt.Errorf("depth map is not valid base64: %v", err)
+	}
+
+	n := m.Width * m.Height
+	s := &Samples{width: m.Width, height: m.Height, meters: make([]float32, n)}
+	switch m.Encoding {
+	case "", EncodingFloat32:
+		if len(data) != 4*n {
+			return nil, fmt.Errorf("depth map has %d bytes, expected %d", len(data), 4*n)
+		}
+		for i := range s.meters {
+			s.meters[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+		}
+	case EncodingUint16:
+		if len(data) != 2*n {
+			return nil, fmt.Errorf("depth map has %d bytes, expected %d", len(data), 2*n)
+		}
+		for i := range s.meters {
+			s.meters[i] = float32(binary.LittleEndian.Uint16(data[2*i:])) / 1000
+		}
+	default:
+		return nil, errors.New("unknown depth map encoding " + m.Encoding)
+	}
+	return s, nil
+}
+
+// Distance returns the distance in meters of what is nearest in a region,
+// and false when too few of its samples are valid to tell.
+func (s *Samples) Distance(region model.Region) (float64, bool) {
+	x0 := clamp(int(region.X*float64(s.width)), 0, s.width)
+	y0 := clamp(int(region.Y*float64(s.height)), 0, s.height)
+	x1 := clamp(int(math.Ceil((region.X+region.W)*float64(s.width))), x0, s.width)
+	y1 := clamp(int(math.Ceil((region.Y+region.H)*float64(s.height))), y0, s.height)
+
+	var valid []float64
+	for y := y0; y < y1; y++ {
+		for _, d := range s.meters[y*s.width+x0 : y*s.width+x1] {
+			if d > 0 && d <= maxRange {
+				valid = append(valid, float64(d))
+			}
+		}
+	}
+
+	total := (x1 - x0) * (y1 - y0)
+	if total == 0 || float64(len(valid)) < minCoverage*float64(total) {
+		return 0, false
+	}
+
+	sort.Float64s(valid)
+	return valid[int(nearPercentile*float64(len(valid)-1))], true
+}
+
+func clamp(v, lo, hi int) int {
+	return min(max(v, lo), hi)
+}
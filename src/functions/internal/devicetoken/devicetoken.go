@@ -0,0 +1,281 @@
+// Package devicetoken issues and checks the short-lived access tokens of
+// registered devices, see the register-device function. A token is a JWT
+// signed with HS256 by a key of DEVICE_TOKEN_KEYS, naming the device, the
+// user when known, the entry points it may call and its rate limit, so
+// every function checks it locally, without a round trip.
+//
+// Tokens are sent as "Authorization: Bearer <token>" and replace the
+// static API key and the App Check token. Firebase ID tokens, signed with
+// RS256, are left to package auth.
+package devicetoken
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+const (
+	// issuer names the tokens of this service.
+	issuer = "buddy-paws"
+	// leeway allows for clock skew between instances.
+	leeway = time.Minute
+	// window is the period of the rate limit.
+	window = time.Minute
+	// maxTracked bounds the rate limit windows kept; expired ones are
+	// dropped beyond it.
+	maxTracked = 10000
+)
+
+// ErrInvalid is returned by Verify for tokens that aren't valid device
+// tokens.
+var ErrInvalid = errors.New("invalid device token")
+
+// Claims are the claims of a device token.
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Audience  string   `json:"aud"`
+	DeviceID  string   `json:"sub"`
+	UserID    string   `json:"uid,omitempty"`
+	AppID     string   `json:"app,omitempty"`
+	Scopes    []string `json:"scope"`
+	RateLimit int      `json:"rpm,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	Expires   int64    `json:"exp"`
+	ID        string   `json:"jti"`
+}
+
+// Allows reports whether the token may call function.
+func (c Claims) Allows(function string) bool {
+	return slices.Contains(c.Scopes, "*") || slices.Contains(c.Scopes, function)
+}
+
+type contextKey struct{}
+
+// FromContext returns the claims of the device token of the request ctx
+// belongs to, if it carried one.
+func FromContext(ctx context.Context) (Claims, bool) {
+	c, ok := ctx.Value(contextKey{}).(Claims)
+	return c, ok
+}
+
+// NewContext returns a copy of ctx carrying the claims c, as if its request
+// had carried the token.
+func NewContext(ctx context.Context, c Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// Enabled reports whether device tokens can be issued.
+func Enabled() bool {
+	return len(config.Get().DeviceTokenKeys) > 0
+}
+
+// Issue returns a token for a device, and user and app when known, with
+// the configured scopes, rate limit and lifetime.
+func Issue(deviceID, userID, appID string) (string, Claims, error) {
+	cfg := config.Get()
+	if len(cfg.DeviceTokenKeys) == 0 {
+		return "", Claims{}, errors.New("DEVICE_TOKEN_KEYS not set")
+	}
+	kid, key, _ := strings.Cut(cfg.DeviceTokenKeys[0], ":")
+
+	scopes := cfg.DeviceScopes
+	if len(scopes) == 0 {
+		scopes = []string{"*"}
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	now := time.Now()
+	c := Claims{
+		Issuer:    issuer,
+		Audience:  cfg.ProjectID,
+		DeviceID:  deviceID,
+		UserID:    userID,
+		AppID:     appID,
+		Scopes:    scopes,
+		RateLimit: cfg.DeviceRateLimit,
+		IssuedAt:  now.Unix(),
+		Expires:   now.Add(cfg.DeviceTokenTTL).Unix(),
+		ID:        hex.EncodeToString(id),
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid})
+	if err != nil {
+		return "", Claims{}, err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", Claims{}, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(key, signed)), c, nil
+}
+
+// Verify checks a device token and returns its claims. Tokens that aren't
+// device tokens, such as Firebase ID tokens, are reported with ok false.
+func Verify(token string) (c Claims, ok bool, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, false, nil
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Claims{}, false, nil
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if json.Unmarshal(rawHeader, &header) != nil || header.Algorithm != "HS256" {
+		return Claims{}, false, nil
+	}
+
+	key := ""
+	for _, k := range config.Get().DeviceTokenKeys {
+		if kid, secret, _ := strings.Cut(k, ":"); kid == header.KeyID {
+			key = secret
+		}
+	}
+	if key == "" {
+		return Claims{}, true, fmt.Errorf("%w: unknown key %q", ErrInvalid, header.KeyID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return Claims{}, true, fmt.Errorf("%w: invalid signature", ErrInvalid)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return Claims{}, true, fmt.Errorf("%w: malformed payload", ErrInvalid)
+	}
+
+	now := time.Now()
+	switch {
+	case c.Issuer != issuer || c.Audience != config.Get().ProjectID:
+		return Claims{}, true, fmt.Errorf("%w: token of another service", ErrInvalid)
+	case now.After(time.Unix(c.Expires, 0).Add(leeway)):
+		return Claims{}, true, fmt.Errorf("%w: token expired", ErrInvalid)
+	case time.Unix(c.IssuedAt, 0).After(now.Add(leeway)):
+		return Claims{}, true, fmt.Errorf("%w: token issued in the future", ErrInvalid)
+	}
+	return c, true, nil
+}
+
+// Handle checks the device token of requests to function. Requests with a
+// valid token within its scopes and rate limit are passed to next as if
+// they carried the API key; requests without one only unless
+// DEVICE_TOKEN_REQUIRED is set. Responses carry the rate limit in
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset, the
+// seconds until the window resets.
+func Handle(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.Get()
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.Method == http.MethodOptions || !Enabled() {
+			next(w, r)
+			return
+		}
+
+		c, ok, err := Verify(token)
+		switch {
+		case !ok && cfg.DeviceTokenRequired:
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Access token required, see register-device"))
+			return
+		case !ok:
+			next(w, r)
+			return
+		case err != nil:
+			log.Printf("Device token refused for %s: %v", function, err)
+			apierror.Write(w, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid access token"))
+			return
+		case !c.Allows(function):
+			apierror.Write(w, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Access token not valid for this function"))
+			return
+		}
+
+		// The limit is announced so clients can pace themselves
+		remaining, reset := limit(c)
+		if c.RateLimit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(c.RateLimit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(remaining, 0)))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(reset.Seconds()+1)))
+		}
+		if remaining < 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Seconds()+1)))
+			apierror.Write(w, apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests, please slow down"))
+			return
+		}
+
+		// The functions check the static key; the token stands in for it
+		apiKey := cfg.APIKey
+		if apiKey == "" {
+			apiKey = "device"
+		}
+		r.Header.Set("X-API-Key", apiKey)
+		next(w, r.WithContext(NewContext(r.Context(), c)))
+	}
+}
+
+type counter struct {
+	start time.Time
+	count int
+}
+
+var (
+	limitsMu sync.Mutex
+	limits   = map[string]*counter{}
+)
+
+// limit counts a request of the device of c and returns the requests left
+// in the window, negative when over its rate limit, and the time until the
+// window resets. Limits are kept per instance, so a device spread over
+// instances gets more.
+func limit(c Claims) (int, time.Duration) {
+	if c.RateLimit <= 0 {
+		return 0, 0
+	}
+
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+
+	now := time.Now()
+	if len(limits) > maxTracked {
+		for id, l := range limits {
+			if now.Sub(l.start) > window {
+				delete(limits, id)
+			}
+		}
+	}
+
+	l, ok := limits[c.DeviceID]
+	if !ok || now.Sub(l.start) > window {
+		l = &counter{start: now}
+		limits[c.DeviceID] = l
+	}
+	l.count++
+	return c.RateLimit - l.count, l.start.Add(window).Sub(now)
+}
+
+func sign(key, data string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,122 @@
+// Package experiments assigns requests to A/B experiment variants.
+//
+// An experiment is configured per deployment with the EXPERIMENT environment
+// variable, as JSON:
+//
+//	{
+//	  "name": "stop-precision",
+//	  "variants": [
+//	    {"name": "control", "weight": 50},
+//	    {"name": "prompt-v5", "weight": 50, "promptVersion": "v5", "temperature": 0.2}
+//	  ]
+//	}
+//
+// A variant overrides the prompt version, model and temperature it sets and
+// keeps the function defaults for the rest.
+package experiments
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+type Experiment struct {
+	Name     string    `json:"name"`
+	Variants []Variant `json:"variants"`
+}
+
+type Variant struct {
+	Name          string   `json:"name"`
+	Weight        int      `json:"weight"`
+	PromptVersion string   `json:"promptVersion,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+}
+
+// Assignment is the variant a request was assigned to. It is the zero value
+// when no experiment is running or the request has no key.
+type Assignment struct {
+	Experiment string
+	Variant
+}
+
+// Label identifies the assignment in logs and response headers, e.g.
+// "stop-precision/prompt-v5".
+func (a Assignment) Label() string {
+	if a.Experiment == "" {
+		return ""
+	}
+	return a.Experiment + "/" + a.Name
+}
+
+var (
+	loadOnce sync.Once
+	current  *Experiment
+)
+
+// Assign picks the variant for key, a user or session ID. The same key
+// always gets the same variant, so a user sees one configuration for a
+// whole session.
+func Assign(key string) Assignment {
+	loadOnce.Do(func() {
+		exp, err := parse(config.Get().Experiment)
+		if err != nil {
+			log.Printf("Ignoring EXPERIMENT: %v", err)
+			return
+		}
+		current = exp
+	})
+
+	if current == nil || key == "" {
+		return Assignment{}
+	}
+
+	total := 0
+	for _, v := range current.Variants {
+		total += v.Weight
+	}
+
+	sum := sha256.Sum256([]byte(current.Name + ":" + key))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range current.Variants {
+		if bucket < v.Weight {
+			return Assignment{Experiment: current.Name, Variant: v}
+		}
+		bucket -= v.Weight
+	}
+
+	return Assignment{}
+}
+
+func parse(config string) (*Experiment, error) {
+	if config == "" {
+		return nil, nil
+	}
+
+	var exp Experiment
+	if err := json.Unmarshal([]byte(config), &exp); err != nil {
+		return nil, err
+	}
+	if exp.Name == "" {
+		return nil, errors.New("experiment has no name")
+	}
+
+	total := 0
+	for _, v := range exp.Variants {
+		if v.Name == "" || v.Weight < 0 {
+			return nil, errors.New("every variant needs a name and a non-negative weight")
+		}
+		total += v.Weight
+	}
+	if total == 0 {
+		return nil, errors.New("experiment has no weighted variants")
+	}
+
+	return &exp, nil
+}
@@ -0,0 +1,153 @@
+// Package framecache reuses the analysis of a camera frame for the frames
+// that follow it while the user stands still.
+//
+// Frames are compared by a perceptual hash (dHash) of the downscaled
+// grayscale image, so frames differing only by sensor noise or compression
+// still match. Entries live in an in-memory LRU of each instance for
+// FRAME_CACHE_TTL, which should stay short: a hazard may walk into view at
+// any time. FRAME_CACHE_TTL=0 disables the cache.
+package framecache
+
+import (
+	"container/list"
+	"image"
+	"math/bits"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+)
+
+// maxDistance is the number of hash bits two frames may differ by and still
+// count as the same view.
+const maxDistance = 4
+
+// hashWidth and hashHeight are the size of the downscaled image. Each row
+// compares hashWidth neighbouring pixels, giving 64 bits.
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// maxSamples bounds the pixels averaged per cell of the downscaled image, so
+// hashing a large photo stays cheap.
+const maxSamples = 16
+
+// Hash returns the perceptual hash of an encoded JPEG, PNG or GIF image. Its
+// pixels are decoded by imagedata.DecodeImage, which rejects images too
+// large to decode.
+func Hash(data []byte) (uint64, error) {
+	img, err := imagedata.DecodeImage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	var cells [hashHeight][hashWidth]float64
+	b := img.Bounds()
+	for y := 0; y < hashHeight; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/hashHeight, b.Min.Y+(y+1)*b.Dy()/hashHeight
+		for x := 0; x < hashWidth; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/hashWidth, b.Min.X+(x+1)*b.Dx()/hashWidth
+			cells[y][x] = luminance(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+			if cells[y][x] < cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// Distance is the number of bits two hashes differ by; 0 for identical
+// frames, around 32 for unrelated ones.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// luminance is the mean brightness of a sample of the pixels in the
+// rectangle.
+func luminance(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := max((x1-x0)/maxSamples, 1)
+	stepY := max((y1-y0)/maxSamples, 1)
+
+	sum, n := 0.0, 0
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+type entry[V any] struct {
+	key      string
+	hash     uint64
+	value    V
+	storedAt time.Time
+}
+
+// Cache maps a frame and the text of its request to a value, evicting the
+// least recently used entries beyond its size.
+type Cache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+}
+
+// New returns a cache holding up to size entries.
+func New[V any](size int) *Cache[V] {
+	return &Cache[V]{size: size, entries: list.New()}
+}
+
+// Get returns the value stored for key and a frame looking like hash.
+func (c *Cache[V]) Get(key string, hash uint64) (V, bool) {
+	var zero V
+	ttl := config.Get().FrameCacheTTL
+	if ttl <= 0 {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.entries.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*entry[V])
+		switch {
+		case time.Since(e.storedAt) > ttl:
+			c.entries.Remove(el)
+		case e.key == key && Distance(e.hash, hash) <= maxDistance:
+			c.entries.MoveToFront(el)
+			return e.value, true
+		}
+		el = next
+	}
+	return zero, false
+}
+
+// Put stores value for key and the frame with hash.
+func (c *Cache[V]) Put(key string, hash uint64, value V) {
+	if config.Get().FrameCacheTTL <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.PushFront(&entry[V]{key: key, hash: hash, value: value, storedAt: time.Now()})
+	for c.entries.Len() > c.size {
+		c.entries.Remove(c.entries.Back())
+	}
+}
@@ -0,0 +1,222 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Cassette is a recording of Gemini API exchanges, stored as JSON. Cassettes
+// are meant to be checked in as testdata: replaying one runs a handler's full
+// post-processing against a realistic model output, without network access
+// or an API key.
+//
+//	MODEL_RECORD=detect-hazards/testdata/crosswalk.json go run ./cmd/localserver
+//	# send the request once, then in a handler test:
+//	t.Setenv("MODEL_REPLAY", "testdata/crosswalk.json")
+//	config.Reload()
+//
+// See package replaytest, and the replay tests of detect-hazards and
+// object-reader.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one API call. Prompt holds the text parts of the request,
+// so reviewers can see what a recording was made with; Response is the raw
+// response body.
+type Interaction struct {
+	Method   string          `json:"method"`
+	Prompt   string          `json:"prompt,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// cassetteMu serializes writes to cassettes, as concurrent requests may
+// record to the same file.
+var cassetteMu sync.Mutex
+
+func loadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("decoding cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// apiMethod is the last path element of a REST call, e.g.
+// "gemini-1.5-flash:generateContent" becomes "generateContent".
+func apiMethod(req *http.Request) string {
+	path := req.URL.Path
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		return path[i+1:]
+	}
+	return "get"
+}
+
+// replayTransport serves responses from a cassette, in recorded order for
+// each API method. A client is created per request, so every handler call
+// replays the cassette from the start.
+type replayTransport struct {
+	path string
+
+	mu   sync.Mutex
+	used map[string]int
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	cassette, err := loadCassette(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.used == nil {
+		t.used = map[string]int{}
+	}
+
+	method := apiMethod(req)
+	skip := t.used[method]
+	for _, in := range cassette.Interactions {
+		if in.Method != method {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		t.used[method]++
+		return &http.Response{
+			StatusCode: in.Status,
+			Status:     fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(in.Response)),
+			Request:    req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("replay: no more %s interactions in %s", method, t.path)
+}
+
+// recordTransport calls the real API and appends each exchange to the
+// cassette at path.
+type recordTransport struct {
+	path   string
+	apiKey string
+	next   http.RoundTripper
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.Header.Set("x-goog-api-key", t.apiKey)
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	if err := t.save(Interaction{
+		Method:   apiMethod(req),
+		Prompt:   promptText(body),
+		Status:   resp.StatusCode,
+		Response: compactJSON(data),
+	}); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+
+	return resp, nil
+}
+
+func (t *recordTransport) save(in Interaction) error {
+	cassetteMu.Lock()
+	defer cassetteMu.Unlock()
+
+	cassette, err := loadCassette(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		cassette, err = &Cassette{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	cassette.Interactions = append(cassette.Interactions, in)
+
+	data, err := json.MarshalIndent(cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, append(data, '\n'), 0o644)
+}
+
+// promptText joins the text parts of a generateContent request body.
+func promptText(body []byte) string {
+	var request struct {
+		Contents []struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"contents"`
+	}
+	if json.Unmarshal(body, &request) != nil {
+		return ""
+	}
+
+	var texts []string
+	for _, c := range request.Contents {
+		for _, p := range c.Parts {
+			if p.Text != "" {
+				texts = append(texts, p.Text)
+			}
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// compactJSON keeps cassettes small and stable; a body that isn't JSON is
+// stored as a JSON string.
+func compactJSON(data []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		quoted, _ := json.Marshal(string(data))
+		return quoted
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,62 @@
+// Package gemini creates the Gemini clients used by the functions.
+//
+// The transport behind a client is chosen by environment variables:
+//
+//   - MOCK_MODEL=true answers every request with a canned response.
+//   - MODEL_REPLAY=<file> answers requests from a cassette recorded earlier.
+//   - MODEL_RECORD=<file> calls the real API and appends every exchange to
+//     a cassette.
+//
+// Otherwise the client calls the Gemini API with the given key. Vertex AI,
+// MODEL_PROVIDER=vertex, is served by the Vertex AI SDK instead, see package
+// provider, and only the offline modes go through this package then.
+package gemini
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// Mock reports whether MOCK_MODEL mode is on. In mock mode no request
+// leaves the process: the model returns canned responses and no API key is
+// needed.
+func Mock() bool {
+	return config.Get().MockModel
+}
+
+// NeedsAPIKey reports whether NewClient needs an API key, which is only the
+// case when it calls the Gemini API directly.
+func NeedsAPIKey() bool {
+	cfg := config.Get()
+	return !cfg.MockModel && cfg.ModelReplay == "" && cfg.ModelProvider == config.ProviderAIStudio
+}
+
+// NewClient returns a Gemini API client authenticated with apiKey, or a
+// client backed by the mock, replay or recording transport.
+func NewClient(ctx context.Context, apiKey string) (*genai.Client, error) {
+	cfg := config.Get()
+
+	var transport http.RoundTripper
+	switch {
+	case Mock():
+		transport = &mockTransport{dir: cfg.MockModelDir}
+	case cfg.ModelReplay != "":
+		transport = &replayTransport{path: cfg.ModelReplay}
+	case cfg.ModelRecord != "":
+		transport = &recordTransport{path: cfg.ModelRecord, apiKey: apiKey, next: http.DefaultTransport}
+	default:
+		return genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	}
+
+	// The API key option is only there to satisfy genai; a custom HTTP
+	// client takes precedence over it.
+	return genai.NewClient(ctx,
+		option.WithAPIKey("unused"),
+		option.WithHTTPClient(&http.Client{Transport: transport}),
+	)
+}
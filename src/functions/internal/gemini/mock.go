@@ -0,0 +1,159 @@
+package gemini
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed mockdata/defaults.json
+var defaultsJSON []byte
+
+// mockDefault is a canned JSON response, used for every request whose prompt
+// contains Match.
+type mockDefault struct {
+	Match    string          `json:"match"`
+	Response json.RawMessage `json:"response"`
+}
+
+var mockDefaults []mockDefault
+
+func init() {
+	if err := json.Unmarshal(defaultsJSON, &mockDefaults); err != nil {
+		panic(fmt.Sprintf("gemini: invalid mockdata/defaults.json: %v", err))
+	}
+}
+
+const mockText = "This is a mock response. Buddy is running without a model."
+
+// mockTransport answers Gemini REST calls locally. A generateContent or
+// streamGenerateContent request is answered with the file <hash>.txt from
+// dir, where hash identifies the request body (prompt, images and
+// settings), so a response can be pinned for a specific request. Without
+// such a file it falls back to the canned response matching the prompt.
+type mockTransport struct {
+	dir string
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var payload interface{}
+	switch {
+	case strings.HasSuffix(req.URL.Path, ":generateContent"):
+		text, err := t.generate(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = mockResponse(text)
+	case strings.HasSuffix(req.URL.Path, ":streamGenerateContent"):
+		// A stream is an array of responses; the answer comes in one
+		text, err := t.generate(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = []interface{}{mockResponse(text)}
+	case strings.HasSuffix(req.URL.Path, ":countTokens"):
+		payload = map[string]int{"totalTokens": 0}
+	default:
+		// Model metadata, as used by health checks.
+		name := req.URL.Path[strings.LastIndex(req.URL.Path, "/models/")+1:]
+		payload = map[string]interface{}{
+			"name":        name,
+			"displayName": "Mock model",
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(data)),
+		Request:    req,
+	}, nil
+}
+
+func mockResponse(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"candidates": []interface{}{
+			map[string]interface{}{
+				"content": map[string]interface{}{
+					"role":  "model",
+					"parts": []interface{}{map[string]string{"text": text}},
+				},
+				"finishReason": "STOP",
+			},
+		},
+	}
+}
+
+func (t *mockTransport) generate(body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:8])
+
+	if t.dir != "" {
+		data, err := os.ReadFile(filepath.Join(t.dir, hash+".txt"))
+		if err == nil {
+			log.Printf("Mock model: request %s answered from %s", hash, t.dir)
+			return string(data), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	log.Printf("Mock model: request %s answered with a canned response", hash)
+
+	var request struct {
+		Contents []struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"contents"`
+		GenerationConfig struct {
+			ResponseMimeType string `json:"responseMimeType"`
+		} `json:"generationConfig"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", fmt.Errorf("mock model: decoding request: %w", err)
+	}
+
+	if request.GenerationConfig.ResponseMimeType != "application/json" {
+		return mockText, nil
+	}
+
+	var prompt strings.Builder
+	for _, c := range request.Contents {
+		for _, p := range c.Parts {
+			prompt.WriteString(p.Text)
+		}
+	}
+	for _, d := range mockDefaults {
+		if strings.Contains(prompt.String(), d.Match) {
+			return string(d.Response), nil
+		}
+	}
+
+	return "{}", nil
+}
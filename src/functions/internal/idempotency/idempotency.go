@@ -0,0 +1,233 @@
+// Package idempotency lets clients retry a POST safely. A request with an
+// Idempotency-Key header is answered once; a retry with the same key within
+// IDEMPOTENCY_TTL gets the recorded response, marked with an
+// Idempotent-Replayed header, instead of another model call. A retry that
+// arrives while the first attempt is still running waits for it.
+//
+// Keys are scoped to the caller: the device of its device token, see
+// package devicetoken, else the user of its ID token, see package auth.
+// The API key is shared by every install, so requests with neither aren't
+// deduplicated, lest one install be answered with another's response.
+//
+// Responses are kept in memory, so only retries reaching the same instance
+// are deduplicated. Server errors (5xx) and 429s are not recorded: a retry
+// should try again.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// Header is the request header carrying the key.
+const Header = "Idempotency-Key"
+
+// maxEntries bounds the memory held by recorded responses.
+const maxEntries = 500
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// entry is a recorded response. done is closed once it is complete;
+// recorded is false if the response was not worth keeping.
+type entry struct {
+	done      chan struct{}
+	bodyHash  string
+	recorded  bool
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+var (
+	mu      sync.Mutex
+	entries = map[string]*entry{}
+)
+
+// Handle serves POST requests carrying an Idempotency-Key at most once per
+// key. Other requests go straight to next.
+func Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		ttl := config.Get().IdempotencyTTL
+		if r.Method != http.MethodPost || key == "" || ttl <= 0 {
+			next(w, r)
+			return
+		}
+		if !keyPattern.MatchString(key) {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid Idempotency-Key")
+			return
+		}
+
+		from := caller(r)
+		if from == "" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the caller and the function
+		id := hash(from, r.URL.Path, key)
+		bodyHash := hash(string(body))
+
+		for {
+			e, owner := claim(id, bodyHash, ttl)
+			if owner {
+				record(w, r, next, id, e)
+				return
+			}
+
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+
+			if e.bodyHash != bodyHash {
+				respondWithError(w, http.StatusUnprocessableEntity, apierror.CodeIdempotencyKeyReused, "Idempotency-Key reused for a different request")
+				return
+			}
+			if e.recorded {
+				replay(w, e)
+				return
+			}
+			// The first attempt failed; this retry runs on its own
+		}
+	}
+}
+
+// caller returns who a request is from, "" when it isn't authenticated.
+func caller(r *http.Request) string {
+	if c, ok := devicetoken.FromContext(r.Context()); ok {
+		return "device:" + c.DeviceID
+	}
+	if uid := auth.Caller(r.Context(), r); uid != "" {
+		return "user:" + uid
+	}
+	return ""
+}
+
+// claim returns the entry for id, creating it if there is none. owner is
+// true when the caller created it and must run the request.
+func claim(id, bodyHash string, ttl time.Duration) (e *entry, owner bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	if e, ok := entries[id]; ok && (!isDone(e) || now.Before(e.expiresAt)) {
+		return e, false
+	}
+
+	if len(entries) >= maxEntries {
+		evict(now)
+	}
+
+	e = &entry{done: make(chan struct{}), bodyHash: bodyHash, expiresAt: now.Add(ttl)}
+	entries[id] = e
+	return e, true
+}
+
+// record runs the request and keeps its response in e.
+func record(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, id string, e *entry) {
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		mu.Lock()
+		e.recorded = rec.status < http.StatusInternalServerError && rec.status != http.StatusTooManyRequests
+		if e.recorded {
+			e.status, e.header, e.body = rec.status, w.Header().Clone(), rec.body.Bytes()
+		} else {
+			delete(entries, id)
+		}
+		close(e.done)
+		mu.Unlock()
+	}()
+
+	next(rec, r)
+}
+
+func replay(w http.ResponseWriter, e *entry) {
+	for name, values := range e.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// evict drops expired entries and, if that isn't enough, the oldest ones.
+// It is called with mu held.
+func evict(now time.Time) {
+	var oldest string
+	for id, e := range entries {
+		if !isDone(e) {
+			continue
+		}
+		if now.After(e.expiresAt) {
+			delete(entries, id)
+			continue
+		}
+		if oldest == "" || e.expiresAt.Before(entries[oldest].expiresAt) {
+			oldest = id
+		}
+	}
+	if len(entries) >= maxEntries && oldest != "" {
+		delete(entries, oldest)
+	}
+}
+
+func isDone(e *entry) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func hash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder copies the response as it is written.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	apierror.Write(w, apierror.New(status, code, message))
+}
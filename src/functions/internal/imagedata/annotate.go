@@ -0,0 +1,126 @@
+package imagedata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// ErrAnnotateUnsupported is returned by Annotate for formats the standard
+// library can't decode, WebP and HEIC.
+var ErrAnnotateUnsupported = errors.New("annotating is only supported for JPEG and PNG images")
+
+// Annotation is a box to draw on an image, with a label above it.
+type Annotation struct {
+	Region model.Region
+	Label  string
+	Color  color.Color
+}
+
+// labelPadding is the margin around label text, in font pixels.
+const labelPadding = 1
+
+// Annotate returns an image decoded by Decode with the annotations drawn
+// on it, in the same format. Lines and text are scaled to the image, so
+// they stay legible on a phone screen whatever its resolution.
+func Annotate(data []byte, format string, annotations []Annotation) ([]byte, error) {
+	if format != FormatJPEG && format != FormatPNG {
+		return nil, ErrAnnotateUnsupported
+	}
+
+	img, err := DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %v", format, err)
+	}
+
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	// Lines of about 1/160 of the shorter side, and labels a thirtieth of
+	// it high, large enough for low vision
+	side := min(b.Dx(), b.Dy())
+	thickness := max(side/160, 2)
+	scale := max(side/(30*glyphHeight), 1)
+
+	w, h := float64(b.Dx()), float64(b.Dy())
+	for _, a := range annotations {
+		rect := image.Rect(
+			b.Min.X+int(a.Region.X*w),
+			b.Min.Y+int(a.Region.Y*h),
+			b.Min.X+int((a.Region.X+a.Region.W)*w+0.5),
+			b.Min.Y+int((a.Region.Y+a.Region.H)*h+0.5),
+		).Intersect(b)
+		if rect.Empty() {
+			continue
+		}
+		outline(out, rect, a.Color, thickness)
+		if a.Label != "" {
+			label(out, rect, a.Label, a.Color, scale)
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == FormatPNG {
+		err = png.Encode(&buf, out)
+	} else {
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// outline draws the border of rect, thickness pixels wide on its inside.
+func outline(img *image.RGBA, rect image.Rectangle, c color.Color, thickness int) {
+	fill := &image.Uniform{c}
+	t := min(thickness, rect.Dx()/2, rect.Dy()/2)
+	t = max(t, 1)
+	for _, edge := range []image.Rectangle{
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+t),
+		image.Rect(rect.Min.X, rect.Max.Y-t, rect.Max.X, rect.Max.Y),
+		image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+t, rect.Max.Y),
+		image.Rect(rect.Max.X-t, rect.Min.Y, rect.Max.X, rect.Max.Y),
+	} {
+		draw.Draw(img, edge, fill, image.Point{}, draw.Src)
+	}
+}
+
+// label draws text in a filled tab above the top left corner of rect, or
+// inside the top of rect when there is no room above it, kept within the
+// image.
+func label(img *image.RGBA, rect image.Rectangle, text string, c color.Color, scale int) {
+	pad := labelPadding * scale
+	tab := image.Rect(0, 0, textWidth(text, scale)+2*pad, glyphHeight*scale+2*pad)
+
+	b := img.Bounds()
+	origin := image.Pt(rect.Min.X, rect.Min.Y-tab.Dy())
+	if origin.Y < b.Min.Y {
+		origin.Y = rect.Min.Y
+	}
+	if over := origin.X + tab.Dx() - b.Max.X; over > 0 {
+		origin.X = max(origin.X-over, b.Min.X)
+	}
+	tab = tab.Add(origin).Intersect(b)
+
+	draw.Draw(img, tab, &image.Uniform{c}, image.Point{}, draw.Src)
+	drawText(img, tab.Min.Add(image.Pt(pad, pad)), text, contrasting(c), scale)
+}
+
+// contrasting returns black or white, whichever is more legible on c.
+func contrasting(c color.Color) color.Color {
+	r, g, b, _ := c.RGBA()
+	// Rec. 601 luma, on 16-bit channels
+	if 299*r+587*g+114*b > 1000*0x8000 {
+		return color.Black
+	}
+	return color.White
+}
@@ -0,0 +1,30 @@
+package imagedata
+
+// brightnessSamples bounds the pixels sampled per side by Brightness.
+const brightnessSamples = 64
+
+// Brightness returns the mean luminance of a JPEG or PNG image, from 0 for
+// black to 1 for white.
+func Brightness(data []byte) (float64, error) {
+	img, err := DecodeImage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	stepX := max(bounds.Dx()/brightnessSamples, 1)
+	stepY := max(bounds.Dy()/brightnessSamples, 1)
+
+	sum, n := 0.0, 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return sum / float64(n) / 0xffff, nil
+}
@@ -0,0 +1,70 @@
+package imagedata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// ErrCropUnsupported is returned by Crop for formats the standard library
+// can't decode, WebP and HEIC.
+var ErrCropUnsupported = errors.New("cropping is only supported for JPEG and PNG images")
+
+// minCropSize is the smallest crop, in pixels, worth sending to a model.
+const minCropSize = 16
+
+// Crop returns the region of an image decoded by Decode, in the same
+// format. The region is clamped to the image and widened to minCropSize.
+func Crop(data []byte, format string, region model.Region) ([]byte, error) {
+	if format != FormatJPEG && format != FormatPNG {
+		return nil, ErrCropUnsupported
+	}
+
+	img, err := DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %v", format, err)
+	}
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	rect := image.Rect(
+		b.Min.X+int(region.X*w),
+		b.Min.Y+int(region.Y*h),
+		b.Min.X+int((region.X+region.W)*w+0.5),
+		b.Min.Y+int((region.Y+region.H)*h+0.5),
+	)
+	if rect.Dx() < minCropSize {
+		rect.Max.X = rect.Min.X + minCropSize
+	}
+	if rect.Dy() < minCropSize {
+		rect.Max.Y = rect.Min.Y + minCropSize
+	}
+	rect = rect.Intersect(b)
+	if rect.Empty() {
+		return nil, errors.New("region outside the image")
+	}
+
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, ErrCropUnsupported
+	}
+	cropped := sub.SubImage(rect)
+
+	var buf bytes.Buffer
+	if format == FormatPNG {
+		err = png.Encode(&buf, cropped)
+	} else {
+		err = jpeg.Encode(&buf, cropped, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,196 @@
+package imagedata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Phones often store a JPEG as captured by the sensor, with the way to hold
+// it in the EXIF orientation tag. Models ignore the tag, so a rotated frame
+// reads with LEFT and RIGHT swapped. normalizeJPEG applies the orientation
+// to the pixels instead, and drops the EXIF and IPTC metadata, which may
+// hold the location, on the way.
+
+// jpegQuality is the quality of re-encoded JPEG images.
+const jpegQuality = 90
+
+const (
+	markerSOI   = 0xd8
+	markerSOS   = 0xda
+	markerAPP1  = 0xe1
+	markerAPP13 = 0xed
+
+	tagOrientation = 0x0112
+)
+
+// normalizeJPEG returns data upright and without metadata. Data that can't
+// be parsed is returned as is, for the model to make what it can of it.
+func normalizeJPEG(data []byte) []byte {
+	segments, ok := jpegSegments(data)
+	if !ok {
+		return data
+	}
+
+	orientation := 1
+	for _, seg := range segments {
+		if seg.marker == markerAPP1 {
+			if o, ok := exifOrientation(seg.payload); ok {
+				orientation = o
+			}
+		}
+	}
+
+	if orientation < 2 || orientation > 8 {
+		return stripMetadata(data, segments)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(img, orientation), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// segment is a JPEG marker segment before the image data. start and end are
+// its offsets in the file, marker included.
+type segment struct {
+	marker     byte
+	start, end int
+	payload    []byte
+}
+
+// jpegSegments returns the marker segments up to the start of scan.
+func jpegSegments(data []byte) ([]segment, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, false
+	}
+
+	var segments []segment
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil, false
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == markerSOS {
+			return segments, true
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, false
+		}
+		segments = append(segments, segment{
+			marker:  marker,
+			start:   i,
+			end:     i + 2 + length,
+			payload: data[i+4 : i+2+length],
+		})
+		i += 2 + length
+	}
+	return nil, false
+}
+
+// exifOrientation reads the orientation tag of an APP1 payload.
+func exifOrientation(payload []byte) (int, bool) {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == tagOrientation {
+			return int(order.Uint16(tiff[entry+8:])), true
+		}
+	}
+	return 0, false
+}
+
+// stripMetadata removes the EXIF and IPTC segments of data.
+func stripMetadata(data []byte, segments []segment) []byte {
+	var out []byte
+	last := 0
+	for _, seg := range segments {
+		if seg.marker != markerAPP1 && seg.marker != markerAPP13 {
+			continue
+		}
+		if out == nil {
+			out = make([]byte, 0, len(data))
+		}
+		out = append(out, data[last:seg.start]...)
+		last = seg.end
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, data[last:]...)
+}
+
+// orient applies an EXIF orientation, 2 to 8, to img.
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Rotated a quarter turn
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Upside down, mirrored
+				sx, sy = x, h-1-y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Rotated 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // Transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotated 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):][:4], src.Pix[src.PixOffset(sx, sy):][:4])
+		}
+	}
+	return dst
+}
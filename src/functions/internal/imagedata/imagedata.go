@@ -0,0 +1,177 @@
+// Package imagedata decodes the images sent to the functions, as base64
+// data or data URIs. Base64 is accepted in either alphabet, wrapped or
+// padded or not, as clients produce all of these. The format is sniffed
+// from the decoded bytes rather than taken from the data URI, which clients
+// often get wrong, so the model is told the actual format. Bytes that aren't
+// an image of a supported format are rejected, as are images over
+// MaxPixels, before anything decodes their pixels.
+//
+// JPEG images are turned upright by their EXIF orientation, and their
+// metadata dropped, before they reach a model.
+package imagedata
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Formats supported by every model provider, as image subtypes.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+	FormatHEIC = "heic"
+	FormatHEIF = "heif"
+)
+
+// ErrNotImage is returned for data that isn't an image of a supported
+// format.
+var ErrNotImage = errors.New("not a supported image, expected JPEG, PNG, WebP, HEIC or GIF")
+
+// MaxPixels bounds the width times height of the images decoded. A small,
+// highly compressed image may claim a size whose pixels don't fit in the
+// memory of an instance, so the size is read from the header first.
+const MaxPixels = 36_000_000
+
+// ErrTooLarge is returned for images over MaxPixels.
+var ErrTooLarge = fmt.Errorf("image is larger than %d megapixels", MaxPixels/1_000_000)
+
+// heicBrands are the ftyp major brands of HEIC and HEIF images, which
+// http.DetectContentType doesn't know.
+var heicBrands = map[string]string{
+	"heic": FormatHEIC,
+	"heix": FormatHEIC,
+	"hevc": FormatHEIC,
+	"heim": FormatHEIC,
+	"heis": FormatHEIC,
+	"mif1": FormatHEIF,
+	"msf1": FormatHEIF,
+	"heif": FormatHEIF,
+}
+
+// Decode returns the image of a base64 string or data URI, and its format.
+// GIF images, which Gemini doesn't accept, are converted to PNG, and JPEG
+// images normalized, see normalizeJPEG.
+func Decode(s string) ([]byte, string, error) {
+	b64Data := s
+	if meta, data, ok := strings.Cut(s, ","); ok {
+		// Data URI scheme present
+		if !strings.HasPrefix(meta, "data:image/") || !strings.HasSuffix(meta, ";base64") {
+			return nil, "", errors.New("invalid image format in data URI")
+		}
+		b64Data = data
+	}
+
+	data, err := decodeBase64(b64Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("image is not valid base64: %v", err)
+	}
+
+	format, err := Sniff(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkSize(data); err != nil {
+		return nil, "", err
+	}
+	if format == "gif" {
+		data, err = gifToPNG(data)
+		if err != nil {
+			return nil, "", err
+		}
+		format = FormatPNG
+	}
+	if format == FormatJPEG {
+		data = normalizeJPEG(data)
+	}
+	return data, format, nil
+}
+
+// DecodeImage decodes the pixels of a JPEG, PNG or GIF image, rejecting
+// images over MaxPixels before allocating them.
+func DecodeImage(data []byte) (image.Image, error) {
+	if err := checkSize(data); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// checkSize returns ErrTooLarge for images over MaxPixels, from their
+// header. Formats the standard library can't decode, WebP and HEIC, are
+// only passed on to the model and aren't checked.
+func checkSize(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read image header: %v", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// decodeBase64 decodes base64 the way clients produce it: line-wrapped or
+// not, in the standard or URL-safe alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.TrimRight(s, "=")
+
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Sniff returns the format of an image from its magic bytes: one of the
+// Format constants, or "gif".
+func Sniff(data []byte) (string, error) {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return FormatJPEG, nil
+	case "image/png":
+		return FormatPNG, nil
+	case "image/webp":
+		return FormatWebP, nil
+	case "image/gif":
+		return "gif", nil
+	}
+
+	// ISO base media file: size, "ftyp", then the major brand
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		if format, ok := heicBrands[string(data[8:12])]; ok {
+			return format, nil
+		}
+	}
+	return "", ErrNotImage
+}
+
+// gifToPNG converts the first frame of a GIF image.
+func gifToPNG(data []byte) ([]byte, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode GIF image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package imagedata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// ErrPixelateUnsupported is returned by Pixelate for formats the standard
+// library can't decode, WebP and HEIC.
+var ErrPixelateUnsupported = errors.New("pixelating is only supported for JPEG and PNG images")
+
+const (
+	// pixelBlocks is how many blocks a pixelated region is across, too few
+	// to recognize a face or read a plate.
+	pixelBlocks = 8
+	// pixelMargin widens regions by this fraction of their size on each
+	// side, as detected boxes are often tight.
+	pixelMargin = 0.1
+)
+
+// Pixelate returns an image decoded by Decode with the regions pixelated,
+// in the same format.
+func Pixelate(data []byte, format string, regions []model.Region) ([]byte, error) {
+	if format != FormatJPEG && format != FormatPNG {
+		return nil, ErrPixelateUnsupported
+	}
+
+	img, err := DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %v", format, err)
+	}
+
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, img, b.Min, draw.Src)
+
+	w, h := float64(b.Dx()), float64(b.Dy())
+	for _, region := range regions {
+		mx, my := region.W*pixelMargin, region.H*pixelMargin
+		rect := image.Rect(
+			b.Min.X+int((region.X-mx)*w),
+			b.Min.Y+int((region.Y-my)*h),
+			b.Min.X+int((region.X+region.W+mx)*w+0.5),
+			b.Min.Y+int((region.Y+region.H+my)*h+0.5),
+		).Intersect(b)
+		if !rect.Empty() {
+			pixelate(out, rect)
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == FormatPNG {
+		err = png.Encode(&buf, out)
+	} else {
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: jpegQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pixelate fills rect with blocks of their average color.
+func pixelate(img *image.RGBA, rect image.Rectangle) {
+	size := rect.Dx()
+	if rect.Dy() > size {
+		size = rect.Dy()
+	}
+	size /= pixelBlocks
+	if size < 1 {
+		size = 1
+	}
+
+	for y := rect.Min.Y; y < rect.Max.Y; y += size {
+		for x := rect.Min.X; x < rect.Max.X; x += size {
+			block := image.Rect(x, y, x+size, y+size).Intersect(rect)
+
+			var r, g, bl, a, n uint32
+			for py := block.Min.Y; py < block.Max.Y; py++ {
+				for px := block.Min.X; px < block.Max.X; px++ {
+					c := img.RGBAAt(px, py)
+					r, g, bl, a = r+uint32(c.R), g+uint32(c.G), bl+uint32(c.B), a+uint32(c.A)
+					n++
+				}
+			}
+			avg := color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)}
+			draw.Draw(img, block, &image.Uniform{avg}, image.Point{}, draw.Src)
+		}
+	}
+}
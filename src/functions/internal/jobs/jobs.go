@@ -0,0 +1,434 @@
+// Package jobs runs heavyweight requests, such as multi-page documents,
+// asynchronously. A POST with the header "Prefer: respond-async" is queued on
+// JOBS_TOPIC and answered at once with 202 and a job ID. The ProcessJob
+// function, subscribed to the topic with a push subscription, runs the
+// request through the same function and stores the result. The client polls
+// for it with GET .../get-job/{id}, or receives it on the HTTPS webhook given
+// in X-Callback-URL.
+//
+// A job whose function fails transiently (5xx or 429) is retried with
+// exponential backoff on the JOBS_QUEUE Cloud Tasks queue, see retry.go.
+//
+// A job belongs to its caller, the device or signed-in user, whose verified
+// identity it carries to its run instead of the token, which may have
+// expired by then. Anonymous requests are served synchronously.
+//
+// Job state is kept in Firestore under jobs/{id}; expiresAt is meant for a
+// TTL policy. ProcessJob must only be reachable by the push subscription
+// (deploy it without unauthenticated access); with JOBS_SERVICE_ACCOUNT it
+// also checks the OIDC token of the push, see verifyPush. A job only runs
+// as the caller whose hash was stored when it was queued, and its webhook
+// is checked against CALLBACK_HOSTS again before it is called.
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/internal/requestid"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+const (
+	// maxBody keeps a job within the 10 MB Pub/Sub message limit after
+	// base64 encoding.
+	maxBody = 7 << 20
+	// retention is how long a job and its result are kept.
+	retention = 24 * time.Hour
+)
+
+// Job statuses. A job is pending until it runs, including between retries,
+// and ends done when the function succeeded or failed otherwise.
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+)
+
+// forwardedHeaders are the request headers a job keeps for its run. The
+// caller's identity is kept verified instead, see message.
+var forwardedHeaders = []string{"X-Prompt-Version", requestid.Header}
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// message is the Pub/Sub payload of a job. Device holds the claims of the
+// device token the job was queued with, and UserID the signed-in user
+// otherwise.
+type message struct {
+	ID          string              `json:"id"`
+	Function    string              `json:"function"`
+	Path        string              `json:"path"`
+	Header      map[string]string   `json:"header"`
+	Body        []byte              `json:"body"`
+	CallbackURL string              `json:"callbackUrl,omitempty"`
+	Device      *devicetoken.Claims `json:"device,omitempty"`
+	UserID      string              `json:"userId,omitempty"`
+}
+
+// Status is the response of the poll endpoint and the webhook. Result is the
+// function's response body once the job is done or failed, with its HTTP
+// status. Attempts counts the runs so far; NextAttemptAt is set while a
+// retry is scheduled.
+type Status struct {
+	JobID         string          `json:"jobId"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts,omitempty"`
+	NextAttemptAt string          `json:"nextAttemptAt,omitempty"`
+	HTTPStatus    int             `json:"httpStatus,omitempty"`
+	Result        json.RawMessage `json:"result,omitempty"`
+}
+
+// final reports whether the job has ended.
+func (s Status) final() bool {
+	return s.Status == StatusDone || s.Status == StatusFailed
+}
+
+var (
+	mu       sync.Mutex
+	handlers = map[string]http.HandlerFunc{}
+)
+
+// Register makes a function available to ProcessJob under its entry point
+// name.
+func Register(name string, handler http.HandlerFunc) {
+	mu.Lock()
+	handlers[name] = handler
+	mu.Unlock()
+}
+
+func handler(name string) (http.HandlerFunc, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	h, ok := handlers[name]
+	return h, ok
+}
+
+// Async queues requests asking for asynchronous processing and passes the
+// others to next. function is the entry point name of next.
+func Async(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.Contains(strings.ToLower(r.Header.Get("Prefer")), "respond-async") {
+			next(w, r)
+			return
+		}
+
+		cfg := config.Get()
+		if cfg.JobsTopic == "" {
+			// Without a queue the request is simply served synchronously
+			next(w, r)
+			return
+		}
+
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" || (cfg.APIKey != "" && apiKey != cfg.APIKey) {
+			respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+			return
+		}
+
+		job := message{
+			ID:       newID(),
+			Function: function,
+			Path:     r.URL.Path,
+			Header:   map[string]string{},
+		}
+		if c, ok := devicetoken.FromContext(r.Context()); ok {
+			job.Device = &c
+		} else {
+			job.UserID = auth.Caller(r.Context(), r)
+		}
+		caller := owner(job.Device, job.UserID)
+		if caller == "" {
+			// Nobody could poll for the result
+			next(w, r)
+			return
+		}
+
+		callbackURL := r.Header.Get("X-Callback-URL")
+		if callbackURL != "" && !validCallback(callbackURL, cfg.CallbackHosts) {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid X-Callback-URL")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+			return
+		}
+		if len(body) > maxBody {
+			respondWithError(w, http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request too large")
+			return
+		}
+
+		job.Body = body
+		job.CallbackURL = callbackURL
+		for _, name := range forwardedHeaders {
+			if v := r.Header.Get(name); v != "" {
+				job.Header[name] = v
+			}
+		}
+
+		if err := enqueue(r.Context(), job, ownerHash(caller)); err != nil {
+			log.Printf("Error queuing job: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error queuing job")
+			return
+		}
+
+		respondWithJSON(w, http.StatusAccepted, Status{JobID: job.ID, Status: StatusPending})
+	}
+}
+
+// enqueue records the job as pending, owned by the caller ownerHash
+// identifies, and publishes it.
+func enqueue(ctx context.Context, job message, ownerHash string) error {
+	cfg := config.Get()
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = fs.Projects.Databases.Documents.Patch(document(cfg.ProjectID, job.ID), &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"function":  {StringValue: job.Function},
+			"status":    {StringValue: StatusPending},
+			"ownerHash": {StringValue: ownerHash},
+			"createdAt": {TimestampValue: now.Format(time.RFC3339Nano)},
+			"expiresAt": {TimestampValue: now.Add(retention).Format(time.RFC3339Nano)},
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("saving job: %w", err)
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	ps, err := pubsub.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = ps.Projects.Topics.Publish(fmt.Sprintf("projects/%s/topics/%s", cfg.ProjectID, cfg.JobsTopic), &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"jobId": job.ID, "function": job.Function},
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("publishing job: %w", err)
+	}
+	return nil
+}
+
+// GetJob is the poll endpoint: GET {GetJob URL}/{id} returns the Status of a
+// job created by the same device or user.
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	cfg := config.Get()
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" || (cfg.APIKey != "" && apiKey != cfg.APIKey) {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if !idPattern.MatchString(id) {
+		respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Job not found")
+		return
+	}
+
+	var device *devicetoken.Claims
+	if c, ok := devicetoken.FromContext(r.Context()); ok {
+		device = &c
+	}
+	caller := owner(device, auth.Caller(r.Context(), r))
+
+	status, hash, err := load(r.Context(), id)
+	if errors.Is(err, errNotFound) || (err == nil && (caller == "" || hash != ownerHash(caller))) {
+		respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Job not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading job %s: %v", id, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading job")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+var errNotFound = errors.New("job not found")
+
+// load returns the status of a job and the hash of its owner.
+func load(ctx context.Context, id string) (Status, string, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Status{}, "", err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(config.Get().ProjectID, id)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Status{}, "", errNotFound
+		}
+		return Status{}, "", err
+	}
+
+	status := Status{
+		JobID:         id,
+		Status:        doc.Fields["status"].StringValue,
+		Attempts:      int(doc.Fields["attempts"].IntegerValue),
+		NextAttemptAt: doc.Fields["nextAttemptAt"].TimestampValue,
+		HTTPStatus:    int(doc.Fields["httpStatus"].IntegerValue),
+	}
+	if result := doc.Fields["result"].StringValue; result != "" {
+		status.Result = json.RawMessage(result)
+	}
+	return status, doc.Fields["ownerHash"].StringValue, nil
+}
+
+// update sets fields of a job.
+func update(ctx context.Context, id string, fields map[string]firestore.Value) error {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(fields))
+	for name := range fields {
+		paths = append(paths, name)
+	}
+	_, err = fs.Projects.Databases.Documents.Patch(document(config.Get().ProjectID, id), &firestore.Document{Fields: fields}).
+		UpdateMaskFieldPaths(paths...).
+		Context(ctx).
+		Do()
+	return err
+}
+
+// validCallback accepts HTTPS URLs on one of hosts. Without hosts there
+// are no webhooks, which would otherwise let anyone make us call any URL.
+func validCallback(raw string, hosts []string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return false
+	}
+	for _, host := range hosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func document(projectID, id string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/jobs/%s", projectID, id)
+}
+
+// owner returns who a job is for, the device when there is one, or the
+// user, and "" for anonymous requests. Every device sends the same API key,
+// so it can't tell jobs apart.
+func owner(device *devicetoken.Claims, uid string) string {
+	switch {
+	case device != nil:
+		return "device:" + device.DeviceID
+	case uid != "":
+		return "user:" + uid
+	}
+	return ""
+}
+
+// ownerHash identifies the owner of a job without storing it.
+func ownerHash(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// postJSON sends payload to url, signed with secret when there is one.
+func postJSON(ctx context.Context, url, secret string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("X-Buddy-Signature", sign(secret, data))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
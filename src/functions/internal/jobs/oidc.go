@@ -0,0 +1,139 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/auth"
+)
+
+const (
+	// googleCertsURL publishes the keys Google signs the OIDC tokens of
+	// service accounts with, such as those of Pub/Sub pushes and Cloud
+	// Tasks.
+	googleCertsURL = "https://www.googleapis.com/oauth2/v1/certs"
+
+	fetchTimeout = 2 * time.Second
+	// keysTTL is how long keys are cached; Google rotates them over days.
+	keysTTL = time.Hour
+	// leeway allows for clock skew.
+	leeway = time.Minute
+)
+
+// googleIssuers are the issuers of Google-signed OIDC tokens.
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+var (
+	keysMu        sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysExpiresAt time.Time
+)
+
+type oidcClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Expires       int64  `json:"exp"`
+}
+
+// verifyPush checks that a request to ProcessJob carries an OIDC token of
+// the service account for audience, as Pub/Sub push subscriptions and
+// Cloud Tasks configured with it send. Invalid tokens are reported with
+// auth.ErrUnauthenticated.
+func verifyPush(ctx context.Context, r *http.Request, serviceAccount, audience string) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return fmt.Errorf("%w: no token", auth.ErrUnauthenticated)
+	}
+
+	keys, err := publicKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("loading Google keys: %w", err)
+	}
+
+	payload, err := auth.VerifyRS256(token, keys)
+	if err != nil {
+		return fmt.Errorf("%w: %v", auth.ErrUnauthenticated, err)
+	}
+
+	var c oidcClaims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return fmt.Errorf("%w: %v", auth.ErrUnauthenticated, err)
+	}
+
+	switch {
+	case !slices.Contains(googleIssuers, c.Issuer):
+		return fmt.Errorf("%w: token not issued by Google", auth.ErrUnauthenticated)
+	case c.Audience != audience:
+		return fmt.Errorf("%w: token for another audience", auth.ErrUnauthenticated)
+	case time.Now().After(time.Unix(c.Expires, 0).Add(leeway)):
+		return fmt.Errorf("%w: token expired", auth.ErrUnauthenticated)
+	case !c.EmailVerified || !strings.EqualFold(c.Email, serviceAccount):
+		return fmt.Errorf("%w: token of %q", auth.ErrUnauthenticated, c.Email)
+	}
+	return nil
+}
+
+// publicKeys returns the keys Google OIDC tokens are signed with, by key
+// ID.
+func publicKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if keys != nil && time.Now().Before(keysExpiresAt) {
+		return keys, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, googleCertsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("keys endpoint returned %s", resp.Status)
+	}
+
+	var certs map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&certs); err != nil {
+		return nil, err
+	}
+
+	fetched := map[string]*rsa.PublicKey{}
+	for id, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			fetched[id] = key
+		}
+	}
+	if len(fetched) == 0 {
+		return nil, errors.New("no keys published")
+	}
+
+	keys, keysExpiresAt = fetched, time.Now().Add(keysTTL)
+	return keys, nil
+}
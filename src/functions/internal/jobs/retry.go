@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/cloudtasks/v2"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+const (
+	// maxAttempts bounds the runs of a job, the first one included.
+	maxAttempts = 5
+	// firstBackoff is the delay before the first retry, doubled for each
+	// further one up to maxBackoff.
+	firstBackoff = 15 * time.Second
+	maxBackoff   = 10 * time.Minute
+)
+
+// transient reports whether a function response is worth retrying later:
+// the model was rate limited or failing.
+func transient(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff is the delay before the retry following the given attempt.
+func backoff(attempt int) time.Duration {
+	d := firstBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// retry schedules a Cloud Task running job again at the given time.
+func retry(ctx context.Context, job message, at time.Time) error {
+	cfg := config.Get()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	var envelope pushEnvelope
+	envelope.Message.Data = data
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	req := &cloudtasks.HttpRequest{
+		Url:        cfg.JobsWorkerURL,
+		HttpMethod: http.MethodPost,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       base64.StdEncoding.EncodeToString(body),
+	}
+	if cfg.JobsServiceAccount != "" {
+		req.OidcToken = &cloudtasks.OidcToken{ServiceAccountEmail: cfg.JobsServiceAccount}
+	}
+
+	service, err := cloudtasks.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = service.Projects.Locations.Queues.Tasks.Create(cfg.JobsQueue, &cloudtasks.CreateTaskRequest{
+		Task: &cloudtasks.Task{
+			HttpRequest:  req,
+			ScheduleTime: at.UTC().Format(time.RFC3339Nano),
+		},
+	}).Context(ctx).Do()
+	return err
+}
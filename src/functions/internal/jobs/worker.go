@@ -0,0 +1,198 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// callbackTimeout bounds the webhook call; the result can still be polled.
+const callbackTimeout = 10 * time.Second
+
+// pushEnvelope is the body of a Pub/Sub push request, and of the Cloud Tasks
+// retrying a job.
+type pushEnvelope struct {
+	Message struct {
+		Data []byte `json:"data"`
+	} `json:"message"`
+}
+
+// ProcessJob is the push endpoint of the JOBS_TOPIC subscription and the
+// target of retry tasks. It runs a pending request and stores its result.
+// Errors that a redelivery could fix are answered with 500 so Pub/Sub
+// retries; anything else is acknowledged. With JOBS_SERVICE_ACCOUNT, only
+// requests with an OIDC token of that account are served, see verifyPush.
+func ProcessJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	cfg := config.Get()
+	if cfg.JobsServiceAccount != "" {
+		err := verifyPush(ctx, r, cfg.JobsServiceAccount, cfg.JobsWorkerURL)
+		switch {
+		case errors.Is(err, auth.ErrUnauthenticated):
+			log.Printf("Refusing job push: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Error verifying job push: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var envelope pushEnvelope
+	var job message
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil || json.Unmarshal(envelope.Message.Data, &job) != nil {
+		log.Printf("Dropping malformed job message: %v", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	status, hash, err := load(ctx, job.ID)
+	if errors.Is(err, errNotFound) {
+		log.Printf("Dropping unknown job %s", job.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading job %s: %v", job.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The job runs as the caller it was queued by, never as another one
+	// named in a forged message
+	if caller := owner(job.Device, job.UserID); caller == "" || ownerHash(caller) != hash {
+		log.Printf("Dropping job %s not matching the caller it was queued by", job.ID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if status.final() {
+		// A redelivery of a job that already ran
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	handle, ok := handler(job.Function)
+	if !ok {
+		log.Printf("Dropping job %s for unknown function %q", job.ID, job.Function)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	attempts := status.Attempts + 1
+	err = update(ctx, job.ID, map[string]firestore.Value{
+		"status":        {StringValue: StatusProcessing},
+		"attempts":      {IntegerValue: int64(attempts)},
+		"nextAttemptAt": {NullValue: "NULL_VALUE"},
+	})
+	if err != nil {
+		log.Printf("Error updating job %s: %v", job.ID, err)
+	}
+
+	// Replay the request against the function, as the server itself, for
+	// the caller verified when the job was queued
+	callerCtx := ctx
+	switch {
+	case job.Device != nil:
+		callerCtx = devicetoken.NewContext(ctx, *job.Device)
+	case job.UserID != "":
+		callerCtx = auth.NewContext(ctx, job.UserID)
+	}
+	req := httptest.NewRequest(http.MethodPost, job.Path, bytes.NewReader(job.Body)).WithContext(callerCtx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKeyFor())
+	for name, value := range job.Header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handle(rec, req)
+
+	result := rec.Body.Bytes()
+	if !json.Valid(result) {
+		result, _ = json.Marshal(apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Invalid function response"))
+	}
+
+	if transient(rec.Code) && attempts < maxAttempts && cfg.JobsQueue != "" {
+		at := time.Now().Add(backoff(attempts))
+		err := retry(ctx, job, at)
+		if err == nil {
+			log.Printf("Job %s failed with %d on attempt %d, retrying at %s", job.ID, rec.Code, attempts, at.Format(time.RFC3339))
+			err = update(ctx, job.ID, map[string]firestore.Value{
+				"status":        {StringValue: StatusPending},
+				"httpStatus":    {IntegerValue: int64(rec.Code)},
+				"nextAttemptAt": {TimestampValue: at.UTC().Format(time.RFC3339Nano)},
+			})
+			if err != nil {
+				log.Printf("Error updating job %s: %v", job.ID, err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Without a retry the job fails now rather than never
+		log.Printf("Error scheduling a retry of job %s: %v", job.ID, err)
+	}
+
+	final := StatusDone
+	if rec.Code < 200 || rec.Code > 299 {
+		final = StatusFailed
+	}
+	err = update(ctx, job.ID, map[string]firestore.Value{
+		"status":     {StringValue: final},
+		"httpStatus": {IntegerValue: int64(rec.Code)},
+		"result":     {StringValue: string(result)},
+	})
+	if err != nil {
+		log.Printf("Error saving job %s: %v", job.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The webhook is checked again, as the allowlist may have changed
+	// since the job was queued
+	if job.CallbackURL != "" && !validCallback(job.CallbackURL, cfg.CallbackHosts) {
+		log.Printf("Not calling back for job %s, its callback host is no longer allowed", job.ID)
+	} else if job.CallbackURL != "" {
+		ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+		defer cancel()
+
+		done := Status{JobID: job.ID, Status: final, Attempts: attempts, HTTPStatus: rec.Code, Result: result}
+		if err := postJSON(ctx, job.CallbackURL, cfg.JobsWebhookSecret, done); err != nil {
+			// The result stays available to polling
+			log.Printf("Error calling back for job %s: %v", job.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiKeyFor is the key the replayed request authenticates with: the
+// server's own, as the client's key isn't stored.
+func apiKeyFor() string {
+	if key := config.Get().APIKey; key != "" {
+		return key
+	}
+	return "internal"
+}
+
+// sign is the hex HMAC-SHA256 of the webhook body, so the receiver can check
+// the call came from us.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,96 @@
+// Package ocr reads the text in an image with the Cloud Vision API, which
+// answers well under a second, for commands that only need the text read
+// out. It is enabled with VISION_OCR and never used in the offline modes.
+package ocr
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/vision/v1"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// timeout bounds the Vision call, so a slow answer costs less than the
+// model call it was meant to save.
+const timeout = 1500 * time.Millisecond
+
+// readTextPattern matches commands that only ask for the text to be read
+// out, e.g. "read this", "what does it say" or "read the label aloud".
+// Anything more, like "read this and tell me if it's expired", needs the
+// model.
+var readTextPattern = regexp.MustCompile(`(?i)^\s*(please\s+)?(read(\s+(it|this|that|the\s+\w+))?(\s+(out|aloud|for\s+me))?|what\s+does\s+(it|this|that)\s+say|what('s|\s+is)\s+written(\s+(here|on\s+(it|this|that)))?)\s*[.?!]*\s*$`)
+
+// ErrDisabled is returned by DetectText when the fast path is off.
+var ErrDisabled = errors.New("vision OCR disabled")
+
+// Enabled reports whether the fast path is on.
+func Enabled() bool {
+	cfg := config.Get()
+	return cfg.VisionOCR && !cfg.MockModel && cfg.ModelReplay == ""
+}
+
+// IsReadText reports whether a command only asks for the text to be read.
+func IsReadText(command string) bool {
+	return readTextPattern.MatchString(command)
+}
+
+// DetectText returns the text in the image, one line per line of text, or ""
+// when there is none.
+func DetectText(ctx context.Context, image []byte) (string, error) {
+	if !Enabled() {
+		return "", ErrDisabled
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	svc, err := vision.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := svc.Images.Annotate(&vision.BatchAnnotateImagesRequest{
+		Requests: []*vision.AnnotateImageRequest{{
+			Image:    &vision.Image{Content: base64.StdEncoding.EncodeToString(image)},
+			Features: []*vision.Feature{{Type: "TEXT_DETECTION"}},
+		}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Responses) == 0 {
+		return "", nil
+	}
+
+	result := resp.Responses[0]
+	if result.Error != nil {
+		return "", errors.New(result.Error.Message)
+	}
+	if result.FullTextAnnotation == nil {
+		return "", nil
+	}
+	return strings.TrimSpace(result.FullTextAnnotation.Text), nil
+}
+
+// Speech turns detected text into sentences for text to speech, so each
+// line is read with a pause.
+func Speech(text string) string {
+	var sentences []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.ContainsAny(line[len(line)-1:], ".!?:") {
+			line += "."
+		}
+		sentences = append(sentences, line)
+	}
+	return strings.Join(sentences, " ")
+}
@@ -0,0 +1,137 @@
+package ocr
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Segment is a run of text in one script, e.g. the Thai and the English
+// half of a bilingual sign, for a TTS voice per language. Language is the
+// BCP 47 code of the script, when only one language uses it.
+type Segment struct {
+	Text     string `json:"text"`
+	Script   string `json:"script"`
+	Language string `json:"language,omitempty"`
+}
+
+// script is a writing system recognized in text.
+type script struct {
+	name     string
+	table    *unicode.RangeTable
+	language string
+}
+
+// scripts are the writing systems recognized, in order of precedence for
+// characters in several of them.
+var scripts = []script{
+	{"Latin", unicode.Latin, ""},
+	{"Thai", unicode.Thai, "th"},
+	{"Lao", unicode.Lao, "lo"},
+	{"Khmer", unicode.Khmer, "km"},
+	{"Myanmar", unicode.Myanmar, "my"},
+	{"Hangul", unicode.Hangul, "ko"},
+	{"Kana", unicode.Hiragana, "ja"},
+	{"Kana", unicode.Katakana, "ja"},
+	{"Han", unicode.Han, ""},
+	{"Cyrillic", unicode.Cyrillic, ""},
+	{"Greek", unicode.Greek, "el"},
+	{"Hebrew", unicode.Hebrew, "he"},
+	{"Arabic", unicode.Arabic, ""},
+	{"Devanagari", unicode.Devanagari, ""},
+}
+
+// languageScripts are the scripts the prompt languages are written in.
+// Languages not listed are assumed to use the Latin script.
+var languageScripts = map[string][]string{
+	"thai":      {"Thai"},
+	"lao":       {"Lao"},
+	"khmer":     {"Khmer"},
+	"burmese":   {"Myanmar"},
+	"korean":    {"Hangul", "Han"},
+	"japanese":  {"Kana", "Han"},
+	"chinese":   {"Han"},
+	"russian":   {"Cyrillic"},
+	"ukrainian": {"Cyrillic"},
+	"greek":     {"Greek"},
+	"hebrew":    {"Hebrew"},
+	"arabic":    {"Arabic"},
+	"hindi":     {"Devanagari"},
+}
+
+// scriptOf returns the script of r, or nil for characters common to all
+// scripts, such as digits, punctuation and spaces.
+func scriptOf(r rune) *script {
+	for i := range scripts {
+		if unicode.Is(scripts[i].table, r) {
+			return &scripts[i]
+		}
+	}
+	return nil
+}
+
+// Segments splits text into runs of one script. Characters common to all
+// scripts join the run they are in; leading ones join the first run.
+func Segments(text string) []Segment {
+	var segments []Segment
+	var current strings.Builder
+	var currentScript *script
+
+	flush := func() {
+		if currentScript != nil && strings.TrimSpace(current.String()) != "" {
+			segments = append(segments, Segment{
+				Text:     strings.TrimSpace(current.String()),
+				Script:   currentScript.name,
+				Language: currentScript.language,
+			})
+		}
+		current.Reset()
+	}
+
+	for _, r := range text {
+		s := scriptOf(r)
+		if s != nil && currentScript != nil && s.name != currentScript.name {
+			flush()
+		}
+		if s != nil {
+			currentScript = s
+		}
+		current.WriteRune(r)
+	}
+	flush()
+
+	return segments
+}
+
+// Scripts returns the scripts of text, in order of appearance.
+func Scripts(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, segment := range Segments(text) {
+		if !seen[segment.Script] {
+			seen[segment.Script] = true
+			names = append(names, segment.Script)
+		}
+	}
+	return names
+}
+
+// ForeignScripts returns the scripts of text that language, a prompt
+// language such as "English" or "Thai", isn't written in.
+func ForeignScripts(text, language string) []string {
+	own, ok := languageScripts[strings.ToLower(strings.TrimSpace(language))]
+	if !ok {
+		own = []string{"Latin"}
+	}
+
+	var foreign []string
+	for _, name := range Scripts(text) {
+		isOwn := false
+		for _, o := range own {
+			isOwn = isOwn || o == name
+		}
+		if !isOwn {
+			foreign = append(foreign, name)
+		}
+	}
+	return foreign
+}
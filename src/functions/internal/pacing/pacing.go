@@ -0,0 +1,58 @@
+// Package pacing suggests how often a client should send camera frames, so
+// the app slows its cadence when the backend is loaded instead of piling up
+// requests it will drop anyway. The suggestion is the longest of
+// FRAME_INTERVAL, the time the instance recently took to answer, and the
+// spacing the rate limit of the device's access token allows, see package
+// devicetoken. Once the daily budget is used up in interval mode, it is at
+// least BUDGET_MIN_INTERVAL, see package budget.
+package pacing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+)
+
+// smoothing is the weight of the latest response time in the average.
+const smoothing = 0.2
+
+// maxInterval bounds the suggestion, so a few slow answers don't stall the
+// guidance.
+const maxInterval = 10 * time.Second
+
+var (
+	mu sync.Mutex
+	// average is the moving average of the response times observed.
+	average time.Duration
+)
+
+// Observe records the time a response took.
+func Observe(took time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if average == 0 {
+		average = took
+		return
+	}
+	average += time.Duration(smoothing * float64(took-average))
+}
+
+// Suggest returns the interval the client of ctx should leave between
+// frames.
+func Suggest(ctx context.Context) time.Duration {
+	interval := config.Get().FrameInterval
+
+	mu.Lock()
+	interval = max(interval, average)
+	mu.Unlock()
+
+	if c, ok := devicetoken.FromContext(ctx); ok && c.RateLimit > 0 {
+		interval = max(interval, time.Minute/time.Duration(c.RateLimit))
+	}
+	return max(min(interval, maxInterval), budget.MinInterval(ctx))
+}
@@ -0,0 +1,67 @@
+// Package persona is the assistant as users hear it: its name,
+// PERSONA_NAME (default "Buddy"), and its tone, PERSONA_TONE:
+//
+//   - playful, the default, is Buddy the Golden Retriever, with the odd
+//     "Oops!" and talk of its ears.
+//   - friendly is warm but plain, without the dog.
+//   - neutral is a professional voice, for partner organizations that want
+//     one.
+//
+// The prompts are written for the playful persona; Context tells the model
+// about another tone. The fixed speech of the functions goes through Speech.
+package persona
+
+import (
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// defaultName is the name the prompts and fixed speech are written with.
+const defaultName = "Buddy"
+
+// interjectionPattern matches the playful interjections of the fixed speech.
+var interjectionPattern = regexp.MustCompile(`\b(Oops|Woof)! `)
+
+// Name returns the assistant's name.
+func Name() string {
+	return config.Get().PersonaName
+}
+
+// Tone returns the assistant's tone, one of the config Tone constants.
+func Tone() string {
+	return config.Get().PersonaTone
+}
+
+// Context renders the tone as extra prompt text. The playful tone is the
+// prompts' own and renders as nothing.
+func Context() string {
+	var line string
+	switch Tone() {
+	case config.ToneFriendly:
+		line = "Speak warmly but plainly. You are an assistant, not a dog: never mention ears, paws or barking, and leave out playful exclamations such as \"Oops!\". Rephrase the example responses accordingly."
+	case config.ToneNeutral:
+		line = "Speak in a neutral, professional voice, like a trained sighted guide. You are an assistant, not a dog: never mention ears, paws or barking, and leave out jokes, exclamations such as \"Oops!\" and expressions of feeling. Rephrase the example responses accordingly."
+	default:
+		return ""
+	}
+
+	return strings.Join([]string{
+		"# Persona:",
+		"Your name is \"" + Name() + "\". " + line,
+	}, "\n")
+}
+
+// Speech adapts fixed speech written for Buddy to the persona: the name is
+// replaced, and playful interjections are dropped unless the tone is
+// playful.
+func Speech(text string) string {
+	if name := Name(); name != defaultName {
+		text = strings.ReplaceAll(text, defaultName, name)
+	}
+	if Tone() != config.TonePlayful {
+		text = interjectionPattern.ReplaceAllString(text, "")
+	}
+	return text
+}
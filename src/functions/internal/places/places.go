@@ -0,0 +1,205 @@
+// Package places looks up the named places around the user with the Google
+// Places API, for "where am I" questions: the model tells the user which of
+// them it sees, e.g. "You are near the entrance of Central Station". It is
+// enabled with PLACES_API_KEY and never used in the offline modes.
+package places
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+const (
+	// timeout bounds the lookup; the question is answered without places
+	// rather than late.
+	timeout = 2 * time.Second
+	// radius is the search radius around the user, in meters.
+	radius = 100
+	// maxPlaces is the number of places looked up, nearest first.
+	maxPlaces = 5
+
+	fieldMask   = "places.displayName,places.location,places.primaryTypeDisplayName"
+	earthRadius = 6371000.0
+)
+
+// whereAmIPattern matches questions about where the user is, e.g. "where am
+// I", "what is this place" or "what's around me".
+var whereAmIPattern = regexp.MustCompile(`(?i)\b(where\s+am\s+i|where\s+are\s+we|what(\s+is|'s)?\s+this\s+place|what\s+place\s+is\s+this|what('s|\s+is)\s+(around|near)\s+(me|here))\b`)
+
+// ErrDisabled is returned by Nearby when the lookup is off.
+var ErrDisabled = errors.New("places lookup disabled")
+
+// Place is a named place near the user. Distance is in meters, and Bearing
+// in degrees clockwise from north.
+type Place struct {
+	Name     string
+	Type     string
+	Distance float64
+	Bearing  float64
+}
+
+type searchNearbyRequest struct {
+	MaxResultCount      int    `json:"maxResultCount"`
+	RankPreference      string `json:"rankPreference"`
+	LocationRestriction struct {
+		Circle struct {
+			Center latLng  `json:"center"`
+			Radius float64 `json:"radius"`
+		} `json:"circle"`
+	} `json:"locationRestriction"`
+}
+
+type latLng struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type localizedText struct {
+	Text string `json:"text"`
+}
+
+type searchNearbyResponse struct {
+	Places []struct {
+		DisplayName            localizedText `json:"displayName"`
+		Location               latLng        `json:"location"`
+		PrimaryTypeDisplayName localizedText `json:"primaryTypeDisplayName"`
+	} `json:"places"`
+}
+
+// Enabled reports whether the lookup is on.
+func Enabled() bool {
+	cfg := config.Get()
+	return cfg.PlacesAPIKey != "" && !cfg.MockModel && cfg.ModelReplay == ""
+}
+
+// IsWhereAmI reports whether a question asks where the user is.
+func IsWhereAmI(question string) bool {
+	return whereAmIPattern.MatchString(question)
+}
+
+// Nearby returns the places around lat, lng, nearest first.
+func Nearby(ctx context.Context, lat, lng float64) ([]Place, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	cfg := config.Get()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var search searchNearbyRequest
+	search.MaxResultCount = maxPlaces
+	search.RankPreference = "DISTANCE"
+	search.LocationRestriction.Circle.Center = latLng{Latitude: lat, Longitude: lng}
+	search.LocationRestriction.Circle.Radius = radius
+
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.PlacesURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", cfg.PlacesAPIKey)
+	req.Header.Set("X-Goog-FieldMask", fieldMask)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("places API returned %s", resp.Status)
+	}
+
+	var result searchNearbyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	var places []Place
+	for _, p := range result.Places {
+		if p.DisplayName.Text == "" {
+			continue
+		}
+		places = append(places, Place{
+			Name:     p.DisplayName.Text,
+			Type:     p.PrimaryTypeDisplayName.Text,
+			Distance: distanceMeters(lat, lng, p.Location.Latitude, p.Location.Longitude),
+			Bearing:  bearingDegrees(lat, lng, p.Location.Latitude, p.Location.Longitude),
+		})
+	}
+	return places, nil
+}
+
+// Context renders places as extra prompt text. With the heading of the
+// camera, places are placed relative to the user, else by compass point.
+func Context(places []Place, heading *float64) string {
+	lines := []string{"# Place Context:"}
+	if len(places) == 0 {
+		lines = append(lines, "Map data shows no named places nearby.")
+	} else {
+		lines = append(lines, "Map data shows the user is near:")
+		for _, p := range places {
+			kind := ""
+			if p.Type != "" {
+				kind = fmt.Sprintf(" (%s)", strings.ToLower(p.Type))
+			}
+			lines = append(lines, fmt.Sprintf("- %s%s, about %.0f meters %s", p.Name, kind, p.Distance, direction(p.Bearing, heading)))
+		}
+	}
+	lines = append(lines, `The user asks where they are. Combine the map data with what is visible, e.g. "You are near the entrance of Central Station". Name only places from the map data or visible in the image, and say which are in view.`)
+	return strings.Join(lines, "\n")
+}
+
+var compassPoints = []string{"north", "north-east", "east", "south-east", "south", "south-west", "west", "north-west"}
+
+// direction describes a bearing relative to heading if known, else as a
+// compass point.
+func direction(bearing float64, heading *float64) string {
+	if heading == nil {
+		return "to the " + compassPoints[int(math.Round(bearing/45))%len(compassPoints)]
+	}
+	angle := math.Mod(math.Mod(bearing-*heading, 360)+360, 360)
+	switch {
+	case angle < 30 || angle >= 330:
+		return "ahead"
+	case angle < 150:
+		return "to the right"
+	case angle < 210:
+		return "behind"
+	default:
+		return "to the left"
+	}
+}
+
+func distanceMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+func bearingDegrees(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLambda := (lng2 - lng1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
@@ -0,0 +1,258 @@
+// Package products looks up packaged products by barcode or name, so the
+// model reads out verified nutrition and allergen data instead of guessing
+// what a label it can only partly see says. The internal catalog, the
+// Firestore collection products keyed by barcode, is looked in first:
+//
+//	name, brand, ingredients: strings
+//	allergens: array of strings, e.g. ["milk", "soy"]
+//	nutrition: map of nutrient to amount per 100 g, e.g. {"sugars": "12 g"}
+//
+// Other products are looked up on Open Food Facts. It is enabled with
+// PRODUCT_LOOKUP and never used in the offline modes.
+package products
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// timeout bounds a lookup; the model answers from the label rather than
+// late.
+const timeout = 3 * time.Second
+
+// Sources of a Product.
+const (
+	SourceCatalog       = "catalog"
+	SourceOpenFoodFacts = "openfoodfacts"
+)
+
+// userAgent identifies the lookups, as Open Food Facts asks of API clients.
+const userAgent = "BuddyPaws/1.0 (accessibility assistant)"
+
+// barcodePattern matches EAN-8, UPC-A, EAN-13 and GTIN-14 barcodes.
+var barcodePattern = regexp.MustCompile(`^[0-9]{8,14}$`)
+
+// ErrDisabled is returned by Lookup when the lookup is off.
+var ErrDisabled = errors.New("product lookup disabled")
+
+// ErrNotFound is returned by Lookup for an unknown product.
+var ErrNotFound = errors.New("product not found")
+
+// Product is the verified data of a packaged product. Nutrition is per
+// 100 g or 100 ml, by nutrient, e.g. "sugars": "12 g".
+type Product struct {
+	Barcode     string            `json:"barcode,omitempty"`
+	Name        string            `json:"name"`
+	Brand       string            `json:"brand,omitempty"`
+	Ingredients string            `json:"ingredients,omitempty"`
+	Allergens   []string          `json:"allergens"`
+	Nutrition   map[string]string `json:"nutritionPer100g,omitempty"`
+	Source      string            `json:"source"`
+}
+
+// Enabled reports whether the lookup is on.
+func Enabled() bool {
+	cfg := config.Get()
+	return cfg.ProductLookup && !cfg.MockModel && cfg.ModelReplay == ""
+}
+
+// Lookup returns the product with barcode, or else the best match for
+// name on Open Food Facts.
+func Lookup(ctx context.Context, barcode, name string) (*Product, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	barcode = strings.Join(strings.Fields(barcode), "")
+	name = strings.TrimSpace(name)
+	switch {
+	case barcode != "" && !barcodePattern.MatchString(barcode):
+		return nil, fmt.Errorf("invalid barcode %q, expected 8 to 14 digits", barcode)
+	case barcode == "" && name == "":
+		return nil, errors.New("expected a barcode or a name")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if barcode != "" {
+		product, err := fromCatalog(ctx, barcode)
+		if !errors.Is(err, ErrNotFound) {
+			return product, err
+		}
+		product, err = byBarcode(ctx, barcode)
+		if !errors.Is(err, ErrNotFound) || name == "" {
+			return product, err
+		}
+	}
+	return byName(ctx, name)
+}
+
+func fromCatalog(ctx context.Context, barcode string) (*Product, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(barcode)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return fromDocument(barcode, doc), nil
+}
+
+func fromDocument(barcode string, doc *firestore.Document) *Product {
+	product := &Product{
+		Barcode:     barcode,
+		Name:        doc.Fields["name"].StringValue,
+		Brand:       doc.Fields["brand"].StringValue,
+		Ingredients: doc.Fields["ingredients"].StringValue,
+		Allergens:   []string{},
+		Source:      SourceCatalog,
+	}
+	if v, ok := doc.Fields["allergens"]; ok && v.ArrayValue != nil {
+		for _, value := range v.ArrayValue.Values {
+			if value.StringValue != "" {
+				product.Allergens = append(product.Allergens, value.StringValue)
+			}
+		}
+	}
+	if v, ok := doc.Fields["nutrition"]; ok && v.MapValue != nil {
+		product.Nutrition = map[string]string{}
+		for nutrient, amount := range v.MapValue.Fields {
+			product.Nutrition[nutrient] = amount.StringValue
+		}
+	}
+	return product
+}
+
+func document(barcode string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/products/%s", config.Get().ProjectID, barcode)
+}
+
+// offFields are the Open Food Facts fields of a Product.
+const offFields = "code,product_name,brands,ingredients_text,allergens_tags,nutriments"
+
+// offProduct is a product of the Open Food Facts API.
+type offProduct struct {
+	Code        string                 `json:"code"`
+	Name        string                 `json:"product_name"`
+	Brands      string                 `json:"brands"`
+	Ingredients string                 `json:"ingredients_text"`
+	Allergens   []string               `json:"allergens_tags"`
+	Nutriments  map[string]interface{} `json:"nutriments"`
+}
+
+// offNutrients are the nutrients read out, with their unit.
+var offNutrients = map[string]string{
+	"energy-kcal":   "kcal",
+	"fat":           "g",
+	"saturated-fat": "g",
+	"carbohydrates": "g",
+	"sugars":        "g",
+	"fiber":         "g",
+	"proteins":      "g",
+	"salt":          "g",
+}
+
+func byBarcode(ctx context.Context, barcode string) (*Product, error) {
+	var result struct {
+		Status  int        `json:"status"`
+		Product offProduct `json:"product"`
+	}
+	u := fmt.Sprintf("%s/api/v2/product/%s.json?fields=%s", config.Get().ProductsURL, barcode, offFields)
+	if err := get(ctx, u, &result); err != nil {
+		return nil, err
+	}
+	if result.Status != 1 || result.Product.Name == "" {
+		return nil, ErrNotFound
+	}
+	return result.Product.product(), nil
+}
+
+func byName(ctx context.Context, name string) (*Product, error) {
+	var result struct {
+		Products []offProduct `json:"products"`
+	}
+	query := url.Values{
+		"search_terms":  {name},
+		"search_simple": {"1"},
+		"json":          {"1"},
+		"page_size":     {"1"},
+		"fields":        {offFields},
+	}
+	if err := get(ctx, config.Get().ProductsURL+"/cgi/search.pl?"+query.Encode(), &result); err != nil {
+		return nil, err
+	}
+	if len(result.Products) == 0 || result.Products[0].Name == "" {
+		return nil, ErrNotFound
+	}
+	return result.Products[0].product(), nil
+}
+
+func get(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("open food facts returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p offProduct) product() *Product {
+	product := &Product{
+		Barcode:     p.Code,
+		Name:        p.Name,
+		Brand:       p.Brands,
+		Ingredients: p.Ingredients,
+		Allergens:   []string{},
+		Source:      SourceOpenFoodFacts,
+	}
+	// Tags are in a language prefix, e.g. "en:milk"
+	for _, tag := range p.Allergens {
+		if _, allergen, ok := strings.Cut(tag, ":"); ok {
+			tag = allergen
+		}
+		product.Allergens = append(product.Allergens, strings.ReplaceAll(tag, "-", " "))
+	}
+	sort.Strings(product.Allergens)
+
+	for nutrient, unit := range offNutrients {
+		if amount, ok := p.Nutriments[nutrient+"_100g"].(float64); ok {
+			if product.Nutrition == nil {
+				product.Nutrition = map[string]string{}
+			}
+			product.Nutrition[nutrient] = fmt.Sprintf("%g %s", amount, unit)
+		}
+	}
+	return product
+}
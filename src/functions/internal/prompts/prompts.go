@@ -0,0 +1,215 @@
+// Package prompts loads the model prompts of the functions.
+//
+// Prompts are text files under templates/<name>/<version>.txt, embedded in
+// the binary. When PROMPTS_BUCKET is set, a file at
+// gs://PROMPTS_BUCKET/prompts/<name>/<version>.txt takes precedence, so a
+// prompt can be tweaked without a redeploy. Overrides are cached for
+// PROMPTS_CACHE_TTL (a Go duration, default 5m).
+//
+// Add a new version rather than editing a released one, so regression
+// reports, see package buildinfo, can be matched to the prompt that produced
+// them.
+//
+// Each function has a default prompt version. PROMPT_VERSION selects another
+// one for a deployment, a version activated through the admin function (see
+// package settings) overrides it at runtime, and when
+// ALLOW_PROMPT_VERSION_HEADER is true (e.g. on staging) the X-Prompt-Version
+// request header selects one per request. Versions can also be uploaded at
+// runtime, see runtime.go.
+//
+// Prompts are text/template templates, rendered with Vars or a struct
+// embedding it, e.g. "Answer in {{.Language}}. User speech: {{.Text}}".
+package prompts
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/settings"
+)
+
+//go:embed templates
+var templates embed.FS
+
+const (
+	overridePrefix = "prompts"
+	fetchTimeout   = 2 * time.Second
+)
+
+type cached struct {
+	text      string
+	found     bool
+	fetchedAt time.Time
+}
+
+// versionPattern keeps versions from reaching outside the prompt's
+// directory.
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+var (
+	cacheMu sync.Mutex
+	cache   = map[string]cached{}
+)
+
+// Vars are the variables available to every prompt template.
+type Vars struct {
+	// Persona is the assistant's name, e.g. "Buddy".
+	Persona string
+	// Language is the language the answer should be in, e.g. "English".
+	Language string
+	// Units is "metric" or "imperial".
+	Units string
+	// Verbosity is "terse", "normal" or "detailed", see package verbosity.
+	Verbosity string
+	// Text is the user's speech or note, if any.
+	Text string
+}
+
+// DefaultVars returns the variables configured for the deployment through
+// PERSONA_NAME, PROMPT_LANGUAGE, UNITS and VERBOSITY.
+func DefaultVars() Vars {
+	cfg := config.Get()
+	return Vars{
+		Persona:   cfg.PersonaName,
+		Language:  cfg.PromptLanguage,
+		Units:     cfg.Units,
+		Verbosity: cfg.Verbosity,
+	}
+}
+
+// Render loads a prompt like Load and executes it as a template with data.
+// Referencing a variable that data doesn't have is an error.
+func Render(ctx context.Context, name, version string, data interface{}) (string, error) {
+	text, err := Load(ctx, name, version)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("prompt %s %s: %w", name, version, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("prompt %s %s: %w", name, version, err)
+	}
+	return b.String(), nil
+}
+
+// Select returns the prompt version to use for the request to function: the
+// X-Prompt-Version header if allowed, else the version activated in the
+// function's settings, else PROMPT_VERSION, else defaultVersion. A selected
+// version that doesn't exist makes Load fail rather than silently falling
+// back, so version comparisons stay clean.
+func Select(r *http.Request, function, defaultVersion string) string {
+	cfg := config.Get()
+	if cfg.AllowPromptVersionHeader {
+		if v := strings.TrimSpace(r.Header.Get("X-Prompt-Version")); v != "" {
+			return v
+		}
+	}
+	if v := settings.Get(r.Context(), function).PromptVersion; v != "" {
+		return v
+	}
+	if cfg.PromptVersion != "" {
+		return cfg.PromptVersion
+	}
+	return defaultVersion
+}
+
+// Load returns the prompt name (e.g. "detect-hazards") at version (e.g.
+// "v4").
+func Load(ctx context.Context, name, version string) (string, error) {
+	if !versionPattern.MatchString(version) {
+		return "", fmt.Errorf("prompt %s: invalid version %q", name, version)
+	}
+
+	file := path.Join(name, version+".txt")
+
+	if config.Get().RuntimeSettings {
+		if text, ok := uploaded(ctx, name, version); ok {
+			return text, nil
+		}
+	}
+
+	if bucket := config.Get().PromptsBucket; bucket != "" {
+		if text, ok := override(ctx, bucket, file); ok {
+			return text, nil
+		}
+	}
+
+	data, err := templates.ReadFile(path.Join("templates", file))
+	if err != nil {
+		return "", fmt.Errorf("prompt %s %s: %w", name, version, err)
+	}
+	return string(data), nil
+}
+
+// override returns the prompt from the bucket, if there is one. Failures are
+// logged and fall back to the last fetched copy or the embedded prompt.
+func override(ctx context.Context, bucket, file string) (string, bool) {
+	ttl := config.Get().PromptsCacheTTL
+
+	key := bucket + "/" + file
+
+	cacheMu.Lock()
+	entry, ok := cache[key]
+	cacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < ttl {
+		return entry.text, entry.found
+	}
+
+	text, found, err := fetch(ctx, bucket, path.Join(overridePrefix, file))
+	if err != nil {
+		log.Printf("Error loading prompt override gs://%s/%s/%s: %v", bucket, overridePrefix, file, err)
+		return entry.text, entry.found
+	}
+
+	cacheMu.Lock()
+	cache[key] = cached{text: text, found: found, fetchedAt: time.Now()}
+	cacheMu.Unlock()
+
+	return text, found
+}
+
+func fetch(ctx context.Context, bucket, object string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	svc, err := storage.NewService(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	resp, err := svc.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
@@ -0,0 +1,245 @@
+package prompts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// Prompts uploaded through the admin function are Firestore documents
+// prompts/{name}/versions/{version}, with "/" in the name written as ":".
+// They are only read when RUNTIME_SETTINGS is true, and take precedence
+// over the bucket and the embedded prompts. An uploaded version can't
+// replace an embedded one, so a released version always means the same
+// text.
+
+// maxPromptSize bounds an uploaded prompt.
+const maxPromptSize = 32 << 10
+
+var namePattern = regexp.MustCompile(`^[a-z0-9-]+(/[a-z0-9-]+)?$`)
+
+// ErrExists is returned when uploading a version that is embedded.
+var ErrExists = errors.New("prompt version is embedded and can't be replaced")
+
+// Version describes a prompt version. Uploaded is false for embedded ones.
+type Version struct {
+	Version    string    `json:"version"`
+	Uploaded   bool      `json:"uploaded"`
+	UploadedAt time.Time `json:"uploadedAt,omitempty"`
+}
+
+// ValidName reports whether name can be a prompt name, e.g.
+// "identify-color/shades".
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// ValidVersion reports whether version can be a prompt version, e.g. "v6".
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+// Validate checks that text is a template that renders with the default
+// variables. Prompts of a name whose embedded versions need more variables
+// (e.g. recognize-person) are only checked to parse.
+func Validate(name, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("prompt is empty")
+	}
+	if len(text) > maxPromptSize {
+		return fmt.Errorf("prompt is larger than %d bytes", maxPromptSize)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return err
+	}
+
+	if !rendersWithDefaults(name) {
+		return nil
+	}
+	var b strings.Builder
+	return tmpl.Execute(&b, DefaultVars())
+}
+
+// rendersWithDefaults reports whether the embedded versions of name render
+// with the default variables alone.
+func rendersWithDefaults(name string) bool {
+	versions := embedded(name)
+	if len(versions) == 0 {
+		return true
+	}
+	_, err := Render(context.Background(), name, versions[len(versions)-1], DefaultVars())
+	return err == nil
+}
+
+// embedded returns the embedded versions of name, sorted.
+func embedded(name string) []string {
+	entries, err := fs.ReadDir(templates, path.Join("templates", name))
+	if err != nil {
+		return nil
+	}
+	var versions []string
+	for _, e := range entries {
+		if v, ok := strings.CutSuffix(e.Name(), ".txt"); ok && !e.IsDir() {
+			versions = append(versions, v)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Names returns the embedded prompt names of a function: its own name,
+// and names below it such as "identify-color/shades".
+func Names(function string) []string {
+	entries, err := fs.ReadDir(templates, path.Join("templates", function))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	own := false
+	for _, e := range entries {
+		switch {
+		case e.IsDir():
+			names = append(names, function+"/"+e.Name())
+		case !own:
+			names = append(names, function)
+			own = true
+		}
+	}
+	return names
+}
+
+// Versions lists the embedded and uploaded versions of name.
+func Versions(ctx context.Context, name string) ([]Version, error) {
+	versions := []Version{}
+	for _, v := range embedded(name) {
+		versions = append(versions, Version{Version: v})
+	}
+
+	svc, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.Databases.Documents.List(versionsParent(name), "versions").
+		MaskFieldPaths("uploadedAt").
+		PageSize(300).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range resp.Documents {
+		v := Version{Version: path.Base(doc.Name), Uploaded: true}
+		v.UploadedAt, _ = time.Parse(time.RFC3339Nano, doc.Fields["uploadedAt"].TimestampValue)
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// Exists reports whether version of name can be loaded.
+func Exists(ctx context.Context, name, version string) bool {
+	_, err := Load(ctx, name, version)
+	return err == nil
+}
+
+// Upload validates and stores a new version of name.
+func Upload(ctx context.Context, name, version, text string) error {
+	if !ValidName(name) || !ValidVersion(version) {
+		return fmt.Errorf("invalid prompt %s %s", name, version)
+	}
+	if _, err := templates.ReadFile(path.Join("templates", name, version+".txt")); err == nil {
+		return ErrExists
+	}
+	if err := Validate(name, text); err != nil {
+		return err
+	}
+
+	svc, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = svc.Projects.Databases.Documents.Patch(versionsParent(name)+"/versions/"+version, &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"text":       {StringValue: text},
+			"uploadedAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	}).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	cacheMu.Lock()
+	delete(cache, uploadKey(name, version))
+	cacheMu.Unlock()
+	return nil
+}
+
+// uploaded returns the uploaded version of a prompt, if there is one. It is
+// cached like the bucket overrides, and failures fall back the same way.
+func uploaded(ctx context.Context, name, version string) (string, bool) {
+	cfg := config.Get()
+	key := uploadKey(name, version)
+
+	cacheMu.Lock()
+	entry, ok := cache[key]
+	cacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < cfg.PromptsCacheTTL {
+		return entry.text, entry.found
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	text, found, err := fetchUploaded(ctx, name, version)
+	if err != nil {
+		log.Printf("Error loading uploaded prompt %s %s: %v", name, version, err)
+		return entry.text, entry.found
+	}
+
+	cacheMu.Lock()
+	cache[key] = cached{text: text, found: found, fetchedAt: time.Now()}
+	cacheMu.Unlock()
+
+	return text, found
+}
+
+func fetchUploaded(ctx context.Context, name, version string) (string, bool, error) {
+	svc, err := firestore.NewService(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	doc, err := svc.Projects.Databases.Documents.Get(versionsParent(name) + "/versions/" + version).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return doc.Fields["text"].StringValue, true, nil
+}
+
+func versionsParent(name string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/prompts/%s",
+		config.Get().ProjectID, strings.ReplaceAll(name, "/", ":"))
+}
+
+func uploadKey(name, version string) string {
+	return "firestore:" + name + "/" + version
+}
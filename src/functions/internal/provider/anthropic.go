@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// anthropicURL is a variable so tests can serve the API.
+var anthropicURL = "https://api.anthropic.com/v1/messages"
+
+const (
+	anthropicVersion = "2023-06-01"
+	// anthropicMaxTokens is used when Options has no limit; the Messages
+	// API requires one.
+	anthropicMaxTokens = 1024
+)
+
+// anthropicModel uses the Anthropic Messages API, e.g. with
+// claude-3-5-sonnet-latest.
+type anthropicModel struct {
+	apiKey string
+	name   string
+	opts   Options
+	usage  Usage
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature float32            `json:"temperature"`
+	MaxTokens   int32              `json:"max_tokens"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+type anthropicContent struct {
+	Type   string           `json:"type"`
+	Text   string           `json:"text,omitempty"`
+	Source *anthropicSource `json:"source,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int64 `json:"input_tokens"`
+		OutputTokens int64 `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func newAnthropic(apiKey, name string, opts Options) *anthropicModel {
+	return &anthropicModel{apiKey: apiKey, name: name, opts: opts}
+}
+
+func (m *anthropicModel) Generate(ctx context.Context, parts ...Part) (string, error) {
+	message := anthropicMessage{Role: "user"}
+	for _, p := range parts {
+		switch p := p.(type) {
+		case Text:
+			message.Content = append(message.Content, anthropicContent{Type: "text", Text: string(p)})
+		case Image:
+			message.Content = append(message.Content, anthropicContent{
+				Type: "image",
+				Source: &anthropicSource{
+					Type:      "base64",
+					MediaType: mediaType(p),
+					Data:      base64.StdEncoding.EncodeToString(p.Data),
+				},
+			})
+		}
+	}
+
+	req := anthropicRequest{
+		Model:    m.name,
+		Messages: []anthropicMessage{message},
+		// The Messages API takes temperatures up to 1 only.
+		Temperature: min(m.opts.Temperature, 1),
+		MaxTokens:   m.opts.MaxOutputTokens,
+	}
+	if req.MaxTokens <= 0 {
+		req.MaxTokens = anthropicMaxTokens
+	}
+
+	// There is no JSON mode; prefilling the answer with "{" keeps the model
+	// from wrapping the JSON in prose.
+	prefill := ""
+	if m.opts.JSON {
+		prefill = "{"
+		req.Messages = append(req.Messages, anthropicMessage{
+			Role:    "assistant",
+			Content: []anthropicContent{{Type: "text", Text: prefill}},
+		})
+	}
+
+	header := http.Header{}
+	header.Set("x-api-key", m.apiKey)
+	header.Set("anthropic-version", anthropicVersion)
+
+	var resp anthropicResponse
+	if err := postJSON(ctx, "anthropic", anthropicURL, header, req, &resp); err != nil {
+		return "", err
+	}
+	m.usage.add(m.name, resp.Usage.InputTokens, resp.Usage.OutputTokens)
+
+	if resp.StopReason == "max_tokens" {
+		return "", ErrTruncated
+	}
+
+	var b strings.Builder
+	for _, c := range resp.Content {
+		if c.Type == "text" {
+			b.WriteString(c.Text)
+		}
+	}
+	if b.Len() == 0 {
+		return "", ErrNoResponse
+	}
+	return prefill + b.String(), nil
+}
+
+func (m *anthropicModel) Usage() Usage {
+	return m.usage
+}
+
+func (m *anthropicModel) Close() error {
+	return nil
+}
@@ -0,0 +1,168 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// A circuit breaker guards every model, so that during a vendor outage
+// requests fail at once, and the functions answer with their degraded
+// responses, instead of each waiting for the vendor to time out.
+//
+// Breakers are per model name and per instance. A breaker opens when at
+// least breakerMinCalls calls within breakerWindow were made and
+// breakerErrorRate of them failed with an outage error. After
+// BREAKER_COOLDOWN it lets a single probe call through (half-open): the
+// breaker closes when the probe succeeds and opens again when it fails.
+
+const (
+	breakerErrorRate = 0.5
+	breakerMinCalls  = 10
+	breakerWindow    = time.Minute
+)
+
+// ErrCircuitOpen is returned by Generate while the breaker of the model is
+// open. It is Retryable, so a Fallback moves on to the next model.
+var ErrCircuitOpen = errors.New("circuit open, model unavailable")
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+type breaker struct {
+	name string
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+}
+
+var breakers = struct {
+	sync.Mutex
+	byName map[string]*breaker
+}{byName: map[string]*breaker{}}
+
+func breakerFor(name string) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b, ok := breakers.byName[name]
+	if !ok {
+		b = &breaker{name: name}
+		breakers.byName[name] = b
+	}
+	return b
+}
+
+// allow reports whether a call may be made now.
+func (b *breaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = halfOpen
+		return true
+	case halfOpen:
+		// The probe is still running
+		return false
+	default:
+		return true
+	}
+}
+
+// record counts the outcome of a call that allow let through.
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == halfOpen {
+		if failed {
+			b.state, b.openedAt = open, now
+			log.Printf("Circuit of %s still open after probe", b.name)
+		} else {
+			b.state = closed
+			b.windowStart, b.calls, b.failures = now, 0, 0
+			log.Printf("Circuit of %s closed", b.name)
+		}
+		return
+	}
+
+	if now.Sub(b.windowStart) > breakerWindow {
+		b.windowStart, b.calls, b.failures = now, 0, 0
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if b.calls >= breakerMinCalls && float64(b.failures) >= breakerErrorRate*float64(b.calls) {
+		b.state, b.openedAt = open, now
+		log.Printf("Circuit of %s open: %d of %d calls failed", b.name, b.failures, b.calls)
+	}
+}
+
+// release gives back a call that allow let through without an outcome. A
+// probe is made again by the next call.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == halfOpen {
+		b.state = open
+	}
+}
+
+// outage reports whether err means the model is unavailable, rather than
+// the request or the scene being the problem.
+func outage(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return Retryable(err) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr)
+}
+
+// guarded is a VisionModel behind the breaker of its name.
+type guarded struct {
+	VisionModel
+	breaker *breaker
+}
+
+func guard(name string, model VisionModel) VisionModel {
+	if config.Get().BreakerCooldown == 0 {
+		return model
+	}
+	return &guarded{VisionModel: model, breaker: breakerFor(name)}
+}
+
+func (g *guarded) Generate(ctx context.Context, parts ...Part) (string, error) {
+	if !g.breaker.allow(config.Get().BreakerCooldown) {
+		return "", ErrCircuitOpen
+	}
+
+	text, err := g.VisionModel.Generate(ctx, parts...)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// A cancelled call, e.g. the loser of a Hedge, says nothing either way
+		g.breaker.release()
+		return text, err
+	}
+	g.breaker.record(outage(err))
+	return text, err
+}
@@ -0,0 +1,303 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/gemini"
+)
+
+type geminiModel struct {
+	client *genai.Client
+	model  *genai.GenerativeModel
+	name   string
+	stream bool
+	tools  map[string]Tool
+	usage  Usage
+}
+
+func newGemini(ctx context.Context, name string, opts Options) (*geminiModel, error) {
+	client, err := gemini.NewClient(ctx, config.Get().VertexAIAPIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	model := client.GenerativeModel(name)
+	model.GenerationConfig = genai.GenerationConfig{
+		ResponseMIMEType: "text/plain",
+	}
+	if opts.JSON {
+		model.ResponseMIMEType = "application/json"
+	}
+	model.SetTemperature(opts.Temperature)
+	model.SetMaxOutputTokens(opts.MaxOutputTokens)
+	model.SafetySettings = safetySettings(config.Get().SafetyThreshold)
+
+	m := &geminiModel{client: client, model: model, name: name, stream: opts.Stream}
+	if len(opts.Tools) > 0 && !opts.JSON {
+		m.tools = map[string]Tool{}
+		var declarations []*genai.FunctionDeclaration
+		for _, tool := range opts.Tools {
+			m.tools[tool.Name] = tool
+			declarations = append(declarations, functionDeclaration(tool))
+		}
+		model.Tools = []*genai.Tool{{FunctionDeclarations: declarations}}
+		m.stream = false
+	}
+	return m, nil
+}
+
+// functionDeclaration declares tool to Gemini.
+func functionDeclaration(tool Tool) *genai.FunctionDeclaration {
+	params := &genai.Schema{Type: genai.TypeObject, Properties: map[string]*genai.Schema{}}
+	for name, description := range tool.Parameters {
+		params.Properties[name] = &genai.Schema{Type: genai.TypeString, Description: description}
+	}
+	return &genai.FunctionDeclaration{Name: tool.Name, Description: tool.Description, Parameters: params}
+}
+
+// safetyThresholds maps the SAFETY_THRESHOLD values to Gemini thresholds.
+var safetyThresholds = map[string]genai.HarmBlockThreshold{
+	config.SafetyNone:           genai.HarmBlockNone,
+	config.SafetyOnlyHigh:       genai.HarmBlockOnlyHigh,
+	config.SafetyMediumAndAbove: genai.HarmBlockMediumAndAbove,
+	config.SafetyLowAndAbove:    genai.HarmBlockLowAndAbove,
+}
+
+// safetySettings applies threshold to every harm category Gemini filters.
+func safetySettings(threshold string) []*genai.SafetySetting {
+	var settings []*genai.SafetySetting
+	for _, category := range []genai.HarmCategory{
+		genai.HarmCategoryHarassment,
+		genai.HarmCategoryHateSpeech,
+		genai.HarmCategorySexuallyExplicit,
+		genai.HarmCategoryDangerousContent,
+	} {
+		settings = append(settings, &genai.SafetySetting{Category: category, Threshold: safetyThresholds[threshold]})
+	}
+	return settings
+}
+
+func (m *geminiModel) Generate(ctx context.Context, parts ...Part) (string, error) {
+	var content []genai.Part
+	for _, p := range parts {
+		switch p := p.(type) {
+		case Text:
+			content = append(content, genai.Text(p))
+		case Image:
+			content = append(content, genai.ImageData(p.Format, p.Data))
+		}
+	}
+
+	if m.stream {
+		return m.generateStream(ctx, content)
+	}
+	if m.tools != nil {
+		return m.generateWithTools(ctx, content)
+	}
+
+	resp, err := m.model.GenerateContent(ctx, content...)
+	if err != nil {
+		return "", blockedError(err)
+	}
+	return m.answer(resp)
+}
+
+// generateStream is Generate with the answer streamed. An answer cut short
+// returns the text received with ErrPartial.
+func (m *geminiModel) generateStream(ctx context.Context, content []genai.Part) (string, error) {
+	iter := m.model.GenerateContentStream(ctx, content...)
+	var text strings.Builder
+	// finished is set by the last chunk, after which the stream may still
+	// fail to close cleanly
+	finished := false
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done || (err != nil && finished) {
+			break
+		}
+		if err != nil {
+			if merged := iter.MergedResponse(); merged != nil && merged.UsageMetadata != nil {
+				m.usage.add(m.name, int64(merged.UsageMetadata.PromptTokenCount), int64(merged.UsageMetadata.CandidatesTokenCount))
+			}
+			if text.Len() > 0 {
+				return text.String(), fmt.Errorf("%w: %w", ErrPartial, err)
+			}
+			return "", blockedError(err)
+		}
+		if len(resp.Candidates) == 0 {
+			continue
+		}
+		finished = resp.Candidates[0].FinishReason != genai.FinishReasonUnspecified
+		if resp.Candidates[0].Content == nil {
+			continue
+		}
+		for _, p := range resp.Candidates[0].Content.Parts {
+			if t, ok := p.(genai.Text); ok {
+				text.WriteString(string(t))
+			}
+		}
+	}
+
+	merged := iter.MergedResponse()
+	if merged == nil || len(merged.Candidates) == 0 {
+		return "", ErrNoResponse
+	}
+	if u := merged.UsageMetadata; u != nil {
+		m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+	}
+	if merged.Candidates[0].FinishReason == genai.FinishReasonMaxTokens {
+		return "", ErrTruncated
+	}
+	if text.Len() == 0 {
+		return "", ErrNoResponse
+	}
+	return text.String(), nil
+}
+
+// generateWithTools is Generate with the model calling tools: the calls of
+// each answer are run and their results sent back, until the model answers
+// in text or maxToolRounds is reached.
+func (m *geminiModel) generateWithTools(ctx context.Context, content []genai.Part) (string, error) {
+	chat := m.model.StartChat()
+	for round := 0; ; round++ {
+		resp, err := m.send(ctx, chat, content)
+		if err != nil {
+			return "", blockedError(err)
+		}
+		if len(resp.Candidates) == 0 || round == maxToolRounds {
+			return m.answer(resp)
+		}
+		calls := resp.Candidates[0].FunctionCalls()
+		if len(calls) == 0 {
+			return m.answer(resp)
+		}
+		if u := resp.UsageMetadata; u != nil {
+			m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+		}
+
+		content = make([]genai.Part, 0, len(calls))
+		for _, call := range calls {
+			content = append(content, genai.FunctionResponse{Name: call.Name, Response: m.call(ctx, call)})
+		}
+	}
+}
+
+// send sends content in chat and returns the whole answer. Like
+// generateStream, it tolerates a stream failing to close after its last
+// chunk, which leaves the answer out of the history; it is added then.
+func (m *geminiModel) send(ctx context.Context, chat *genai.ChatSession, content []genai.Part) (*genai.GenerateContentResponse, error) {
+	iter := chat.SendMessageStream(ctx, content...)
+	finished := false
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done || (err != nil && finished) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Candidates) > 0 {
+			finished = resp.Candidates[0].FinishReason != genai.FinishReasonUnspecified
+		}
+	}
+
+	merged := iter.MergedResponse()
+	if merged == nil {
+		return nil, ErrNoResponse
+	}
+	if last := chat.History[len(chat.History)-1]; last.Role == "user" && len(merged.Candidates) > 0 && merged.Candidates[0].Content != nil {
+		answer := *merged.Candidates[0].Content
+		answer.Role = "model"
+		chat.History = append(chat.History, &answer)
+	}
+	return merged, nil
+}
+
+// call runs the tool a function call names.
+func (m *geminiModel) call(ctx context.Context, call genai.FunctionCall) map[string]interface{} {
+	return runTool(ctx, m.tools, call.Name, call.Args)
+}
+
+// runTool runs the tool named name of tools, with the arguments the model
+// called it with. Failures are reported to the model, which can then
+// answer without the data.
+func runTool(ctx context.Context, tools map[string]Tool, name string, callArgs map[string]interface{}) map[string]interface{} {
+	tool, ok := tools[name]
+	if !ok {
+		return map[string]interface{}{"error": fmt.Sprintf("unknown function %q", name)}
+	}
+
+	args := map[string]string{}
+	for name, value := range callArgs {
+		if s, ok := value.(string); ok {
+			args[name] = s
+		} else {
+			args[name] = fmt.Sprint(value)
+		}
+	}
+	result, err := tool.Call(ctx, args)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	// The response is sent as a protobuf Struct, which only takes JSON
+	// values
+	data, err := json.Marshal(result)
+	var value interface{}
+	if err == nil {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return map[string]interface{}{"result": value}
+}
+
+// blockedError reports an answer blocked by the safety filters as
+// ErrBlocked.
+func blockedError(err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	return err
+}
+
+// answer returns the text of resp, counting its usage.
+func (m *geminiModel) answer(resp *genai.GenerateContentResponse) (string, error) {
+	if u := resp.UsageMetadata; u != nil {
+		m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+	}
+
+	if len(resp.Candidates) == 0 {
+		return "", ErrNoResponse
+	}
+	if resp.Candidates[0].FinishReason == genai.FinishReasonMaxTokens {
+		return "", ErrTruncated
+	}
+	if resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", ErrNoResponse
+	}
+
+	text, ok := resp.Candidates[0].Content.Parts[0].(genai.Text)
+	if !ok {
+		return "", ErrNoResponse
+	}
+	return string(text), nil
+}
+
+func (m *geminiModel) Usage() Usage {
+	return m.usage
+}
+
+func (m *geminiModel) Close() error {
+	return m.client.Close()
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"errors"
+)
+
+// Hedge is a VisionModel sending each prompt to a chain of models and,
+// when configured, to a fast model at the same time. The first acceptable
+// answer wins and the other call is cancelled, which trades the cost of a
+// second call for a shorter latency tail. Without a fast model it is the
+// chain alone.
+type Hedge struct {
+	primary  *Fallback
+	fast     VisionModel
+	fastName string
+	accept   func(text string) bool
+	// Answered is the name of the model that produced the last answer.
+	Answered string
+}
+
+// NewHedge returns a Hedge of primary by the named fast model, with opts.
+// accept tells whether an answer is usable, e.g. valid JSON; an empty
+// fastName disables hedging.
+func NewHedge(ctx context.Context, primary *Fallback, fastName string, opts Options, accept func(text string) bool) (*Hedge, error) {
+	h := &Hedge{primary: primary, fastName: fastName, accept: accept}
+	if fastName == "" {
+		return h, nil
+	}
+
+	fast, err := New(ctx, fastName, opts)
+	if err != nil {
+		return nil, err
+	}
+	h.fast = fast
+	return h, nil
+}
+
+type hedgeResult struct {
+	text string
+	err  error
+	fast bool
+}
+
+func (h *Hedge) Generate(ctx context.Context, parts ...Part) (string, error) {
+	if h.fast == nil {
+		text, err := h.primary.Generate(ctx, parts...)
+		h.Answered = h.primary.Answered
+		return text, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	go func() {
+		text, err := h.primary.Generate(ctx, parts...)
+		results <- hedgeResult{text: text, err: err}
+	}()
+	go func() {
+		text, err := h.fast.Generate(ctx, parts...)
+		results <- hedgeResult{text: text, err: err, fast: true}
+	}()
+
+	// Both calls are waited for, cancelled or not, so that their usage is
+	// complete when Generate returns
+	var winner, primary *hedgeResult
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if winner == nil && result.err == nil && h.accept(result.text) {
+			winner = &result
+			cancel()
+		}
+		if !result.fast {
+			primary = &result
+		}
+	}
+
+	// Neither answer is acceptable: the primary one is reported, as if the
+	// call wasn't hedged
+	if winner == nil {
+		winner = primary
+	}
+	if winner.err != nil {
+		return "", winner.err
+	}
+	h.Answered = h.primary.Answered
+	if winner.fast {
+		h.Answered = h.fastName
+	}
+	return winner.text, nil
+}
+
+func (h *Hedge) Usage() Usage {
+	total := h.primary.Usage()
+	if h.fast != nil {
+		u := h.fast.Usage()
+		total.PromptTokens += u.PromptTokens
+		total.OutputTokens += u.OutputTokens
+	}
+	if h.Answered != "" {
+		total.Model = h.Answered
+	}
+	return total
+}
+
+func (h *Hedge) Close() error {
+	errs := []error{h.primary.Close()}
+	if h.fast != nil {
+		errs = append(errs, h.fast.Close())
+	}
+	return errors.Join(errs...)
+}
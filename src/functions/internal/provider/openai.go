@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+)
+
+// openAIURL is a variable so tests can serve the API.
+var openAIURL = "https://api.openai.com/v1/chat/completions"
+
+// openAIModel uses the OpenAI Chat Completions API, e.g. with gpt-4o.
+type openAIModel struct {
+	apiKey string
+	name   string
+	opts   Options
+	usage  Usage
+}
+
+type openAIRequest struct {
+	Model          string          `json:"model"`
+	Messages       []openAIMessage `json:"messages"`
+	Temperature    float32         `json:"temperature"`
+	MaxTokens      int32           `json:"max_tokens,omitempty"`
+	ResponseFormat *openAIFormat   `json:"response_format,omitempty"`
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content []openAIContent `json:"content"`
+}
+
+type openAIContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIFormat struct {
+	Type string `json:"type"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func newOpenAI(apiKey, name string, opts Options) *openAIModel {
+	return &openAIModel{apiKey: apiKey, name: name, opts: opts}
+}
+
+func (m *openAIModel) Generate(ctx context.Context, parts ...Part) (string, error) {
+	message := openAIMessage{Role: "user"}
+	for _, p := range parts {
+		switch p := p.(type) {
+		case Text:
+			message.Content = append(message.Content, openAIContent{Type: "text", Text: string(p)})
+		case Image:
+			url := "data:" + mediaType(p) + ";base64," + base64.StdEncoding.EncodeToString(p.Data)
+			message.Content = append(message.Content, openAIContent{Type: "image_url", ImageURL: &openAIImageURL{URL: url}})
+		}
+	}
+
+	req := openAIRequest{
+		Model:       m.name,
+		Messages:    []openAIMessage{message},
+		Temperature: m.opts.Temperature,
+		MaxTokens:   m.opts.MaxOutputTokens,
+	}
+	if m.opts.JSON {
+		req.ResponseFormat = &openAIFormat{Type: "json_object"}
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+m.apiKey)
+
+	var resp openAIResponse
+	if err := postJSON(ctx, "openai", openAIURL, header, req, &resp); err != nil {
+		return "", err
+	}
+	m.usage.add(m.name, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+
+	if len(resp.Choices) == 0 {
+		return "", ErrNoResponse
+	}
+	switch resp.Choices[0].FinishReason {
+	case "length":
+		return "", ErrTruncated
+	case "content_filter":
+		return "", ErrBlocked
+	}
+	if resp.Choices[0].Message.Content == "" {
+		return "", ErrNoResponse
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+func (m *openAIModel) Usage() Usage {
+	return m.usage
+}
+
+func (m *openAIModel) Close() error {
+	return nil
+}
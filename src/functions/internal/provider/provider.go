@@ -0,0 +1,388 @@
+// Package provider puts the vision model behind an interface, so a
+// deployment can move between model vendors during an outage or a price
+// change without touching the functions. MODEL_PROVIDER selects the vendor:
+//
+//   - aistudio uses the Gemini API through package gemini, which also
+//     provides the mock, replay and recording modes.
+//   - vertex uses Gemini on Vertex AI through the Vertex AI SDK, with
+//     Application Default Credentials.
+//   - openai uses the Chat Completions API with OPENAI_API_KEY.
+//   - anthropic uses the Messages API with ANTHROPIC_API_KEY.
+//
+// MODEL_NAME must name a model of the selected vendor, e.g. gpt-4o or
+// claude-3-5-sonnet-latest.
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/gemini"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// VisionModel answers a prompt made of text and image parts, in order.
+// Usage is the token usage of all Generate calls so far.
+type VisionModel interface {
+	Generate(ctx context.Context, parts ...Part) (string, error)
+	Usage() Usage
+	Close() error
+}
+
+// Usage counts the tokens billed for a model. Model is the model that was
+// called last.
+type Usage struct {
+	Model        string
+	PromptTokens int64
+	OutputTokens int64
+}
+
+func (u *Usage) add(model string, prompt, output int64) {
+	u.Model = model
+	u.PromptTokens += prompt
+	u.OutputTokens += output
+}
+
+// Part is a Text or an Image.
+type Part interface {
+	part()
+}
+
+// Text is a text part of a prompt.
+type Text string
+
+// Image is an image part of a prompt. Format is the image subtype, e.g.
+// "jpeg".
+type Image struct {
+	Format string
+	Data   []byte
+}
+
+func (Text) part()  {}
+func (Image) part() {}
+
+// ImageData returns an image part, like genai.ImageData.
+func ImageData(format string, data []byte) Image {
+	return Image{Format: format, Data: data}
+}
+
+// Options are the generation settings of a model.
+type Options struct {
+	Temperature     float32
+	MaxOutputTokens int32
+	// JSON asks for a JSON answer. The prompt must still describe the
+	// expected JSON.
+	JSON bool
+	// Stream has the answer streamed, so an answer cut short, e.g. by a
+	// timeout, still yields the text received, see ErrPartial. Only Gemini
+	// streams; the other vendors ignore it.
+	Stream bool
+	// Tools are the functions the model can call while answering, see Tool.
+	// Only Gemini calls tools, and not in JSON mode; the other vendors
+	// ignore them. A model with tools doesn't stream.
+	Tools []Tool
+}
+
+// Tool is a function the model can call to fetch data it would otherwise
+// guess, e.g. the nutrition facts of a product. Parameters are its string
+// parameters with their descriptions, all optional. The result of Call is
+// given to the model as JSON, and its error as the text of the result.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]string
+	Call        func(ctx context.Context, args map[string]string) (interface{}, error)
+}
+
+// maxToolRounds bounds the rounds of tool calls of one answer, each a model
+// call.
+const maxToolRounds = 3
+
+// ErrNoResponse is returned when the model answered without any text.
+var ErrNoResponse = errors.New("no response")
+
+// ErrBlocked is returned when the vendor's safety filters blocked the prompt
+// or the answer.
+var ErrBlocked = errors.New("blocked by safety filters")
+
+// ErrTruncated is returned when the answer reached MaxOutputTokens before it
+// was complete.
+var ErrTruncated = errors.New("answer truncated")
+
+// ErrPartial is returned, along with the text received so far, when a
+// streamed answer was cut short. It wraps the cause, e.g.
+// context.DeadlineExceeded.
+var ErrPartial = errors.New("partial answer")
+
+// CompleteSentences returns text up to the end of its last complete
+// sentence, empty when it has none. A sentence ends with punctuation
+// followed by a space, so "3.50" doesn't end one.
+func CompleteSentences(text string) string {
+	end := 0
+	for i, r := range text {
+		if r != '.' && r != '!' && r != '?' && r != '。' {
+			continue
+		}
+		next := i + utf8.RuneLen(r)
+		if r == '。' || next == len(text) || unicode.IsSpace(rune(text[next])) {
+			end = next
+		}
+	}
+	return strings.TrimSpace(text[:end])
+}
+
+const (
+	failureSpeech     = "Buddy couldn't analyze this scene, please try again."
+	unavailableSpeech = "Buddy can't look at images right now, please try again in a minute."
+)
+
+// Problem returns the API error for an error of Generate. When the scene is
+// the problem (the answer was blocked or truncated, 422) or the model is
+// unavailable (timeout, rate limit, outage or open circuit), it carries a
+// message the app can speak. Other errors are internal errors.
+func Problem(err error) apierror.Problem {
+	code := statusCode(err)
+	switch {
+	case errors.Is(err, ErrBlocked):
+		return apierror.New(http.StatusUnprocessableEntity, apierror.CodeContentBlocked, "Content blocked").WithSpeech(persona.Speech(failureSpeech))
+	case errors.Is(err, ErrTruncated):
+		return apierror.New(http.StatusUnprocessableEntity, apierror.CodeResponseTruncated, "Response truncated").WithSpeech(persona.Speech(failureSpeech))
+	case errors.Is(err, context.DeadlineExceeded):
+		return apierror.New(http.StatusGatewayTimeout, apierror.CodeModelTimeout, "Model timed out").WithSpeech(persona.Speech(unavailableSpeech))
+	case code == http.StatusTooManyRequests:
+		return apierror.New(http.StatusTooManyRequests, apierror.CodeRateLimited, "Model rate limited").WithSpeech(persona.Speech(unavailableSpeech))
+	case errors.Is(err, ErrCircuitOpen), code >= http.StatusInternalServerError:
+		return apierror.New(http.StatusServiceUnavailable, apierror.CodeModelUnavailable, "Model unavailable").WithSpeech(persona.Speech(unavailableSpeech))
+	default:
+		return apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Error at processing")
+	}
+}
+
+// Error is an error response of a vendor API.
+type Error struct {
+	Provider string
+	Code     int
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Provider, e.Code, e.Message)
+}
+
+// UsesGemini reports whether models are served by Gemini, which is always
+// the case in the offline modes.
+func UsesGemini() bool {
+	cfg := config.Get()
+	if cfg.MockModel || cfg.ModelReplay != "" {
+		return true
+	}
+	return cfg.ModelProvider == config.ProviderAIStudio || cfg.ModelProvider == config.ProviderVertex
+}
+
+// New returns the named model of the configured provider, behind its
+// circuit breaker.
+func New(ctx context.Context, name string, opts Options) (VisionModel, error) {
+	cfg := config.Get()
+
+	switch {
+	case cfg.MockModel || cfg.ModelReplay != "" || cfg.ModelProvider == config.ProviderAIStudio:
+		model, err := newGemini(ctx, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return guard(name, model), nil
+	case cfg.ModelProvider == config.ProviderVertex:
+		model, err := newVertex(ctx, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return guard(name, model), nil
+	case cfg.ModelProvider == config.ProviderOpenAI:
+		return guard(name, newOpenAI(cfg.OpenAIAPIKey, name, opts)), nil
+	case cfg.ModelProvider == config.ProviderAnthropic:
+		return guard(name, newAnthropic(cfg.AnthropicAPIKey, name, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown model provider %q", cfg.ModelProvider)
+	}
+}
+
+// Probe checks that the named Gemini model can be reached, without
+// generating anything.
+func Probe(ctx context.Context, name string) error {
+	cfg := config.Get()
+	if cfg.ModelProvider == config.ProviderVertex && !cfg.MockModel && cfg.ModelReplay == "" {
+		return probeVertex(ctx, name)
+	}
+
+	client, err := gemini.NewClient(ctx, cfg.VertexAIAPIKey)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	defer client.Close()
+
+	_, err = client.GenerativeModel(name).Info(ctx)
+	return err
+}
+
+// ErrModelNotAllowed is returned by Select for a model outside the
+// allowlist.
+var ErrModelNotAllowed = errors.New("model not allowed")
+
+// Select returns the model a request asked for in its "model" field, which
+// every function accepts, or defaultModel when it didn't ask for one.
+// Clients may trade accuracy for latency this way, e.g. a faster model for
+// the continuous scanning of detect-hazards. Only the models in
+// MODEL_ALLOWLIST can be asked for, so clients can't run up costs with an
+// expensive model.
+func Select(requested, defaultModel string) (string, error) {
+	if requested == "" || requested == defaultModel {
+		return defaultModel, nil
+	}
+	for _, name := range config.Get().ModelAllowlist {
+		if name == requested {
+			return requested, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrModelNotAllowed, requested)
+}
+
+// Retryable reports whether err is worth retrying on another model: the
+// model is rate limited (429), failing (5xx) or its circuit is open. Other
+// errors, such as an invalid request, would fail the same way on any model.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	code := statusCode(err)
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// statusCode returns the HTTP status of a vendor API error, 0 for other
+// errors.
+func statusCode(err error) int {
+	var apiErr *googleapi.Error
+	var providerErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Code
+	case errors.As(err, &providerErr):
+		return providerErr.Code
+	default:
+		return 0
+	}
+}
+
+// Fallback is a VisionModel trying a chain of models in order, moving on to
+// the next one while the error is Retryable.
+type Fallback struct {
+	names  []string
+	models []VisionModel
+	// Answered is the name of the model that produced the last answer.
+	Answered string
+}
+
+// NewFallback returns a Fallback over the named models, all with opts.
+func NewFallback(ctx context.Context, names []string, opts Options) (*Fallback, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no model configured")
+	}
+
+	f := &Fallback{names: names}
+	for _, name := range names {
+		model, err := New(ctx, name, opts)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.models = append(f.models, model)
+	}
+	return f, nil
+}
+
+func (f *Fallback) Generate(ctx context.Context, parts ...Part) (string, error) {
+	var text string
+	var err error
+	for i, model := range f.models {
+		text, err = model.Generate(ctx, parts...)
+		if err == nil {
+			f.Answered = f.names[i]
+			return text, nil
+		}
+		if !Retryable(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	// Keep what a streamed answer cut short gave
+	if !errors.Is(err, ErrPartial) {
+		text = ""
+	}
+	return text, err
+}
+
+func (f *Fallback) Usage() Usage {
+	var total Usage
+	for i, model := range f.models {
+		u := model.Usage()
+		if u.PromptTokens == 0 && u.OutputTokens == 0 {
+			continue
+		}
+		total.add(f.names[i], u.PromptTokens, u.OutputTokens)
+	}
+	if f.Answered != "" {
+		total.Model = f.Answered
+	}
+	return total
+}
+
+func (f *Fallback) Close() error {
+	var errs []error
+	for _, model := range f.models {
+		errs = append(errs, model.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// postJSON sends body to a vendor API and decodes the answer into out.
+func postJSON(ctx context.Context, provider, url string, header http.Header, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", provider, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &Error{Provider: provider, Code: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// mediaType is the MIME type of an image part.
+func mediaType(img Image) string {
+	return "image/" + img.Format
+}
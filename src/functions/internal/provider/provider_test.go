@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// setenv sets the environment of a deployment: PROJECT_ID and MODEL_NAME
+// plus env, and loads it.
+func setenv(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for _, key := range []string{"MODEL_PROVIDER", "VERTEX_AI_API_KEY", "OPENAI_API_KEY", "ANTHROPIC_API_KEY", "MOCK_MODEL", "MODEL_REPLAY", "BREAKER_COOLDOWN"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("PROJECT_ID", "test")
+	t.Setenv("MODEL_NAME", "test-model")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	return config.Reload()
+}
+
+// unguarded returns the model behind its circuit breaker.
+func unguarded(model VisionModel) VisionModel {
+	if g, ok := model.(*guarded); ok {
+		return g.VisionModel
+	}
+	return model
+}
+
+// TestNew switches vendors with MODEL_PROVIDER, the escape hatch during an
+// outage or a price change.
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"default", map[string]string{"VERTEX_AI_API_KEY": "key"}, "*provider.geminiModel"},
+		{"aistudio", map[string]string{"MODEL_PROVIDER": "aistudio", "VERTEX_AI_API_KEY": "key"}, "*provider.geminiModel"},
+		{"openai", map[string]string{"MODEL_PROVIDER": "openai", "OPENAI_API_KEY": "key"}, "*provider.openAIModel"},
+		{"anthropic", map[string]string{"MODEL_PROVIDER": "anthropic", "ANTHROPIC_API_KEY": "key"}, "*provider.anthropicModel"},
+		// The offline modes are Gemini whatever the vendor
+		{"openai mock", map[string]string{"MODEL_PROVIDER": "openai", "MOCK_MODEL": "true"}, "*provider.geminiModel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := setenv(t, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			model, err := New(context.Background(), "test-model", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer model.Close()
+
+			if got := fmt.Sprintf("%T", unguarded(model)); got != tt.want {
+				t.Errorf("New = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestProviderKey checks that a deployment can't switch vendors without
+// the key of the new one, while the offline modes need no key at all.
+func TestProviderKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		missing string
+	}{
+		{"default", nil, "VERTEX_AI_API_KEY"},
+		{"openai", map[string]string{"MODEL_PROVIDER": "openai", "VERTEX_AI_API_KEY": "key"}, "OPENAI_API_KEY"},
+		{"anthropic", map[string]string{"MODEL_PROVIDER": "anthropic", "OPENAI_API_KEY": "key"}, "ANTHROPIC_API_KEY"},
+		{"openai mock", map[string]string{"MODEL_PROVIDER": "openai", "MOCK_MODEL": "true"}, ""},
+		{"anthropic replay", map[string]string{"MODEL_PROVIDER": "anthropic", "MODEL_REPLAY": "cassette.json"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := setenv(t, tt.env)
+			switch {
+			case tt.missing == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.missing != "" && (err == nil || !strings.Contains(err.Error(), tt.missing)):
+				t.Errorf("error = %v, want %s missing", err, tt.missing)
+			}
+		})
+	}
+}
+
+// TestVendors answers the same prompt through each vendor API, served by a
+// test server, and checks that their outages are Retryable so a Fallback
+// moves on.
+func TestVendors(t *testing.T) {
+	tests := []struct {
+		provider string
+		url      *string
+		answer   string
+	}{
+		{"openai", &openAIURL, `{"choices": [{"message": {"content": "A red mug."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 10, "completion_tokens": 4}}`},
+		{"anthropic", &anthropicURL, `{"content": [{"type": "text", "text": "A red mug."}], "stop_reason": "end_turn", "usage": {"input_tokens": 10, "output_tokens": 4}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			down := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if down {
+					http.Error(w, `{"error": {"message": "overloaded"}}`, http.StatusServiceUnavailable)
+					return
+				}
+				var req struct {
+					Model string `json:"model"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model != "test-model" {
+					http.Error(w, "bad request", http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.answer))
+			}))
+			defer server.Close()
+
+			url := *tt.url
+			*tt.url = server.URL
+			defer func() { *tt.url = url }()
+
+			if err := setenv(t, map[string]string{"MODEL_PROVIDER": tt.provider, strings.ToUpper(tt.provider) + "_API_KEY": "key", "BREAKER_COOLDOWN": "0"}); err != nil {
+				t.Fatal(err)
+			}
+			model, err := New(context.Background(), "test-model", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer model.Close()
+
+			text, err := model.Generate(context.Background(), Text("What is this?"), ImageData("jpeg", []byte{0xff, 0xd8}))
+			if err != nil || text != "A red mug." {
+				t.Errorf("Generate = %q, %v, want %q", text, err, "A red mug.")
+			}
+			if usage := model.Usage(); usage.PromptTokens != 10 || usage.OutputTokens != 4 {
+				t.Errorf("usage = %+v, want 10 prompt and 4 output tokens", usage)
+			}
+
+			down = true
+			if _, err := model.Generate(context.Background(), Text("What is this?")); !Retryable(err) {
+				t.Errorf("outage error %v is not Retryable", err)
+			}
+		})
+	}
+}
+
+// TestGuard fails a vendor until its circuit breaker opens, when the
+// breaker is on by default, and checks that BREAKER_COOLDOWN=0 turns it
+// off so every call reaches the vendor.
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		name      string
+		cooldown  string
+		wantCalls int
+		wantErr   error
+	}{
+		{"default", "", breakerMinCalls, ErrCircuitOpen},
+		{"off", "0", breakerMinCalls + 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				http.Error(w, `{"error": {"message": "overloaded"}}`, http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			url := openAIURL
+			openAIURL = server.URL
+			defer func() { openAIURL = url }()
+
+			env := map[string]string{"MODEL_PROVIDER": "openai", "OPENAI_API_KEY": "key"}
+			if tt.cooldown != "" {
+				env["BREAKER_COOLDOWN"] = tt.cooldown
+			}
+			if err := setenv(t, env); err != nil {
+				t.Fatal(err)
+			}
+			// Breakers are per model name, so each case has its own
+			model, err := New(context.Background(), "guard-"+tt.name, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer model.Close()
+
+			for i := 0; i < breakerMinCalls; i++ {
+				model.Generate(context.Background(), Text("What is this?"))
+			}
+			_, err = model.Generate(context.Background(), Text("What is this?"))
+			if calls != tt.wantCalls {
+				t.Errorf("%d calls reached the vendor, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && errors.Is(err, ErrCircuitOpen) {
+				t.Errorf("error = %v, want the vendor error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	vertexai "cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// vertexModel uses Gemini on Vertex AI through the Vertex AI SDK, in
+// PROJECT_ID and VERTEX_LOCATION, authenticated with Application Default
+// Credentials (the function's service account when deployed), so no API key
+// is needed. It mirrors geminiModel, the SDKs having the same shape.
+type vertexModel struct {
+	client *vertexai.Client
+	model  *vertexai.GenerativeModel
+	name   string
+	stream bool
+	tools  map[string]Tool
+	usage  Usage
+}
+
+func newVertex(ctx context.Context, name string, opts Options) (*vertexModel, error) {
+	cfg := config.Get()
+	// Over REST, errors are googleapi errors, which Retryable knows
+	clientOpts := []option.ClientOption{vertexai.WithREST()}
+	if cfg.VertexLocation == "global" {
+		clientOpts = append(clientOpts, option.WithEndpoint("aiplatform.googleapis.com:443"))
+	}
+	client, err := vertexai.NewClient(ctx, cfg.ProjectID, cfg.VertexLocation, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("vertex: %w", err)
+	}
+
+	model := client.GenerativeModel(name)
+	model.GenerationConfig = vertexai.GenerationConfig{
+		ResponseMIMEType: "text/plain",
+	}
+	if opts.JSON {
+		model.ResponseMIMEType = "application/json"
+	}
+	model.SetTemperature(opts.Temperature)
+	model.SetMaxOutputTokens(opts.MaxOutputTokens)
+	model.SafetySettings = vertexSafetySettings(cfg.SafetyThreshold)
+
+	m := &vertexModel{client: client, model: model, name: name, stream: opts.Stream}
+	if len(opts.Tools) > 0 && !opts.JSON {
+		m.tools = map[string]Tool{}
+		var declarations []*vertexai.FunctionDeclaration
+		for _, tool := range opts.Tools {
+			m.tools[tool.Name] = tool
+			declarations = append(declarations, vertexFunctionDeclaration(tool))
+		}
+		model.Tools = []*vertexai.Tool{{FunctionDeclarations: declarations}}
+		m.stream = false
+	}
+	return m, nil
+}
+
+// vertexFunctionDeclaration declares tool to Gemini on Vertex AI.
+func vertexFunctionDeclaration(tool Tool) *vertexai.FunctionDeclaration {
+	params := &vertexai.Schema{Type: vertexai.TypeObject, Properties: map[string]*vertexai.Schema{}}
+	for name, description := range tool.Parameters {
+		params.Properties[name] = &vertexai.Schema{Type: vertexai.TypeString, Description: description}
+	}
+	return &vertexai.FunctionDeclaration{Name: tool.Name, Description: tool.Description, Parameters: params}
+}
+
+// vertexSafetyThresholds maps the SAFETY_THRESHOLD values to Vertex AI
+// thresholds.
+var vertexSafetyThresholds = map[string]vertexai.HarmBlockThreshold{
+	config.SafetyNone:           vertexai.HarmBlockNone,
+	config.SafetyOnlyHigh:       vertexai.HarmBlockOnlyHigh,
+	config.SafetyMediumAndAbove: vertexai.HarmBlockMediumAndAbove,
+	config.SafetyLowAndAbove:    vertexai.HarmBlockLowAndAbove,
+}
+
+// vertexSafetySettings applies threshold to every harm category Gemini
+// filters.
+func vertexSafetySettings(threshold string) []*vertexai.SafetySetting {
+	var settings []*vertexai.SafetySetting
+	for _, category := range []vertexai.HarmCategory{
+		vertexai.HarmCategoryHarassment,
+		vertexai.HarmCategoryHateSpeech,
+		vertexai.HarmCategorySexuallyExplicit,
+		vertexai.HarmCategoryDangerousContent,
+	} {
+		settings = append(settings, &vertexai.SafetySetting{Category: category, Threshold: vertexSafetyThresholds[threshold]})
+	}
+	return settings
+}
+
+func (m *vertexModel) Generate(ctx context.Context, parts ...Part) (string, error) {
+	var content []vertexai.Part
+	for _, p := range parts {
+		switch p := p.(type) {
+		case Text:
+			content = append(content, vertexai.Text(p))
+		case Image:
+			content = append(content, vertexai.ImageData(p.Format, p.Data))
+		}
+	}
+
+	if m.stream {
+		return m.generateStream(ctx, content)
+	}
+	if m.tools != nil {
+		return m.generateWithTools(ctx, content)
+	}
+
+	resp, err := m.model.GenerateContent(ctx, content...)
+	if err != nil {
+		return "", vertexBlockedError(err)
+	}
+	return m.answer(resp)
+}
+
+// generateStream is Generate with the answer streamed. An answer cut short
+// returns the text received with ErrPartial.
+func (m *vertexModel) generateStream(ctx context.Context, content []vertexai.Part) (string, error) {
+	iter := m.model.GenerateContentStream(ctx, content...)
+	var text strings.Builder
+	// finished is set by the last chunk, after which the stream may still
+	// fail to close cleanly
+	finished := false
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done || (err != nil && finished) {
+			break
+		}
+		if err != nil {
+			if merged := iter.MergedResponse(); merged != nil && merged.UsageMetadata != nil {
+				m.usage.add(m.name, int64(merged.UsageMetadata.PromptTokenCount), int64(merged.UsageMetadata.CandidatesTokenCount))
+			}
+			if text.Len() > 0 {
+				return text.String(), fmt.Errorf("%w: %w", ErrPartial, err)
+			}
+			return "", vertexBlockedError(err)
+		}
+		if len(resp.Candidates) == 0 {
+			continue
+		}
+		finished = resp.Candidates[0].FinishReason != vertexai.FinishReasonUnspecified
+		if resp.Candidates[0].Content == nil {
+			continue
+		}
+		for _, p := range resp.Candidates[0].Content.Parts {
+			if t, ok := p.(vertexai.Text); ok {
+				text.WriteString(string(t))
+			}
+		}
+	}
+
+	merged := iter.MergedResponse()
+	if merged == nil || len(merged.Candidates) == 0 {
+		return "", ErrNoResponse
+	}
+	if u := merged.UsageMetadata; u != nil {
+		m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+	}
+	if merged.Candidates[0].FinishReason == vertexai.FinishReasonMaxTokens {
+		return "", ErrTruncated
+	}
+	if text.Len() == 0 {
+		return "", ErrNoResponse
+	}
+	return text.String(), nil
+}
+
+// generateWithTools is Generate with the model calling tools, see
+// geminiModel.generateWithTools.
+func (m *vertexModel) generateWithTools(ctx context.Context, content []vertexai.Part) (string, error) {
+	chat := m.model.StartChat()
+	for round := 0; ; round++ {
+		resp, err := chat.SendMessage(ctx, content...)
+		if err != nil {
+			return "", vertexBlockedError(err)
+		}
+		if len(resp.Candidates) == 0 || round == maxToolRounds {
+			return m.answer(resp)
+		}
+		calls := resp.Candidates[0].FunctionCalls()
+		if len(calls) == 0 {
+			return m.answer(resp)
+		}
+		if u := resp.UsageMetadata; u != nil {
+			m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+		}
+
+		content = make([]vertexai.Part, 0, len(calls))
+		for _, call := range calls {
+			content = append(content, vertexai.FunctionResponse{Name: call.Name, Response: runTool(ctx, m.tools, call.Name, call.Args)})
+		}
+	}
+}
+
+// vertexBlockedError reports an answer blocked by the safety filters as
+// ErrBlocked.
+func vertexBlockedError(err error) error {
+	var blocked *vertexai.BlockedError
+	if errors.As(err, &blocked) {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	return err
+}
+
+// answer returns the text of resp, counting its usage.
+func (m *vertexModel) answer(resp *vertexai.GenerateContentResponse) (string, error) {
+	if u := resp.UsageMetadata; u != nil {
+		m.usage.add(m.name, int64(u.PromptTokenCount), int64(u.CandidatesTokenCount))
+	}
+
+	if len(resp.Candidates) == 0 {
+		return "", ErrNoResponse
+	}
+	if resp.Candidates[0].FinishReason == vertexai.FinishReasonMaxTokens {
+		return "", ErrTruncated
+	}
+	if resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		return "", ErrNoResponse
+	}
+
+	text, ok := resp.Candidates[0].Content.Parts[0].(vertexai.Text)
+	if !ok {
+		return "", ErrNoResponse
+	}
+	return string(text), nil
+}
+
+func (m *vertexModel) Usage() Usage {
+	return m.usage
+}
+
+func (m *vertexModel) Close() error {
+	return m.client.Close()
+}
+
+// probeVertex checks the model can be reached by counting the tokens of a
+// prompt, which is free.
+func probeVertex(ctx context.Context, name string) error {
+	m, err := newVertex(ctx, name, Options{})
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	defer m.Close()
+
+	_, err = m.model.CountTokens(ctx, vertexai.Text("ping"))
+	return err
+}
@@ -0,0 +1,78 @@
+// Package query runs Firestore structured queries. The generated client
+// can't decode the streamed answer of runQuery, so it is called directly.
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/firestore/v1"
+)
+
+const firestoreScope = "https://www.googleapis.com/auth/datastore"
+
+// Run returns the documents of database, "projects/{p}/databases/{d}/documents",
+// matching q.
+func Run(ctx context.Context, database string, q *firestore.StructuredQuery) ([]*firestore.Document, error) {
+	client, err := google.DefaultClient(ctx, firestoreScope)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(firestore.RunQueryRequest{StructuredQuery: q})
+	if err != nil {
+		return nil, err
+	}
+
+	url := "https://firestore.googleapis.com/v1/" + database + ":runQuery"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("runQuery returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var results []firestore.RunQueryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+
+	var docs []*firestore.Document
+	for _, result := range results {
+		if result.Document != nil {
+			docs = append(docs, result.Document)
+		}
+	}
+	return docs, nil
+}
+
+// Where returns the query of the documents of collection whose field
+// compares with op, e.g. "EQUAL" or "LESS_THAN", to value.
+func Where(collection, field, op string, value firestore.Value) *firestore.StructuredQuery {
+	return &firestore.StructuredQuery{
+		From: []*firestore.CollectionSelector{{CollectionId: collection}},
+		Where: &firestore.Filter{
+			FieldFilter: &firestore.FieldFilter{
+				Field: &firestore.FieldReference{FieldPath: field},
+				Op:    op,
+				Value: &value,
+			},
+		},
+	}
+}
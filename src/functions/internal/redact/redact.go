@@ -0,0 +1,253 @@
+// Package redact filters the speech of every function before it reaches
+// the user. Profanity is masked, and personal data read off the image,
+// such as card and ID numbers, is left out unless the user asked for it,
+// e.g. "read the card number". Every redaction is logged to the
+// "redactions" log, without the redacted text, for audit.
+//
+// Only the speechText and originalText of a JSON response are filtered;
+// structured fields, such as the lines of a document, are returned as read.
+package redact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/requestid"
+	"example.com/buddy-paws/internal/usage"
+)
+
+// Kinds of redacted content.
+const (
+	KindProfanity  = "profanity"
+	KindCardNumber = "card number"
+	KindIDNumber   = "ID number"
+)
+
+// logName is the log redactions are recorded in.
+const logName = "redactions"
+
+// filteredFields are the response fields filtered.
+var filteredFields = []string{"speechText", "originalText"}
+
+var (
+	// profanityPattern matches common English profanity and its
+	// inflections, as whole words.
+	profanityPattern = regexp.MustCompile(`(?i)\b(fuck\w*|motherfuck\w*|shit\w*|bullshit\w*|bitch\w*|cunts?|assholes?|bastards?|dickheads?|wankers?|twats?|pricks?)\b`)
+	// cardPattern matches 15 to 19 digits, optionally grouped with spaces
+	// or dashes, the length of payment card numbers.
+	cardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){14,18}\b`)
+	// thaiIDPattern matches a Thai national ID number, 13 digits written
+	// 1-2345-67890-12-3 or run together.
+	thaiIDPattern = regexp.MustCompile(`\b\d[ -]?\d{4}[ -]?\d{5}[ -]?\d{2}[ -]?\d\b`)
+	// ssnPattern matches a US social security number.
+	ssnPattern = regexp.MustCompile(`\b(\d{3})-(\d{2})-(\d{4})\b`)
+
+	// askedPatterns match questions asking for a kind of personal data.
+	askedPatterns = map[string]*regexp.Regexp{
+		KindCardNumber: regexp.MustCompile(`(?i)\b(card|account)\s+(number|no\b|digits)`),
+		KindIDNumber:   regexp.MustCompile(`(?i)\b(id|identification|identity|citizen|national|passport|social\s+security|ssn)\b`),
+	}
+)
+
+// Filter returns speech with profanity masked and personal data left out,
+// except the kinds question asks for, and the kinds redacted.
+func Filter(speech, question string) (string, []string) {
+	var kinds []string
+	add := func(kind string) {
+		for _, k := range kinds {
+			if k == kind {
+				return
+			}
+		}
+		kinds = append(kinds, kind)
+	}
+
+	if !asked(question, KindIDNumber) {
+		speech = thaiIDPattern.ReplaceAllStringFunc(speech, func(s string) string {
+			if !validThaiID(digits(s)) {
+				return s
+			}
+			add(KindIDNumber)
+			return "an ID number"
+		})
+		speech = ssnPattern.ReplaceAllStringFunc(speech, func(s string) string {
+			m := ssnPattern.FindStringSubmatch(s)
+			if m[1] == "000" || m[1] == "666" || m[1][0] == '9' || m[2] == "00" || m[3] == "0000" {
+				return s
+			}
+			add(KindIDNumber)
+			return "an ID number"
+		})
+	}
+
+	if !asked(question, KindCardNumber) {
+		speech = cardPattern.ReplaceAllStringFunc(speech, func(s string) string {
+			d := digits(s)
+			if !luhn(d) {
+				return s
+			}
+			add(KindCardNumber)
+			return "a card number ending in " + d[len(d)-4:]
+		})
+	}
+
+	speech = profanityPattern.ReplaceAllStringFunc(speech, func(string) string {
+		add(KindProfanity)
+		return "bleep"
+	})
+
+	return speech, kinds
+}
+
+// Handle filters the JSON responses of function, see Filter. The question
+// is the "text" field of the request, if it has one.
+func Handle(function string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			// Let the function report the broken body
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var req struct {
+			Text string `json:"text"`
+		}
+		json.Unmarshal(body, &req)
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		out := rec.body.Bytes()
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			if filtered, kinds := filterJSON(out, req.Text); len(kinds) > 0 {
+				out = filtered
+				record(r, function, kinds)
+			}
+		}
+
+		w.WriteHeader(rec.status)
+		w.Write(out)
+	}
+}
+
+// filterJSON filters the filteredFields of a JSON object. body is returned
+// unchanged when nothing was redacted.
+func filterJSON(body []byte, question string) ([]byte, []string) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, nil
+	}
+
+	var kinds []string
+	for _, name := range filteredFields {
+		var text string
+		if err := json.Unmarshal(fields[name], &text); err != nil || text == "" {
+			continue
+		}
+		filtered, redacted := Filter(text, question)
+		if len(redacted) == 0 {
+			continue
+		}
+		fields[name], _ = json.Marshal(filtered)
+		kinds = append(kinds, redacted...)
+	}
+	if len(kinds) == 0 {
+		return body, nil
+	}
+
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body, nil
+	}
+	return out, kinds
+}
+
+// record logs a redaction to the redactions log.
+func record(r *http.Request, function string, kinds []string) {
+	ctx := context.Background()
+	logger, closeLog, err := cloudlog.New(ctx, config.Get().ProjectID, logName)
+	if err != nil {
+		log.Printf("Error creating the %s log: %v", logName, err)
+		return
+	}
+	defer closeLog()
+
+	logger.Printf("Redacted %s from the answer of %s, request %s, user %q",
+		strings.Join(kinds, ", "), function, requestid.FromContext(r.Context()), usage.UserID(r))
+}
+
+// asked reports whether question asks for the kind of personal data.
+func asked(question, kind string) bool {
+	return askedPatterns[kind].MatchString(question)
+}
+
+// digits returns the digits of s.
+func digits(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// luhn reports whether d passes the Luhn check of payment card numbers.
+func luhn(d string) bool {
+	sum := 0
+	for i := 0; i < len(d); i++ {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 1 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// validThaiID reports whether d passes the checksum of Thai national ID
+// numbers.
+func validThaiID(d string) bool {
+	if len(d) != 13 {
+		return false
+	}
+	sum := 0
+	for i := 0; i < 12; i++ {
+		sum += int(d[i]-'0') * (13 - i)
+	}
+	return int(d[12]-'0') == (11-sum%11)%10
+}
+
+// recorder holds the response back until it is filtered.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
@@ -0,0 +1,60 @@
+// Package replaytest runs handler tests against recorded model output, see
+// gemini.Cassette. It is only meant to be imported by tests.
+package replaytest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"example.com/buddy-paws/internal/config"
+)
+
+// Serve posts body as JSON to handler at path, with the model output of the
+// cassette at testdata/<cassette>.json, and returns the response.
+func Serve(t *testing.T, cassette, path string, handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return ServeAs(t, "", cassette, path, handler, body)
+}
+
+// ServeAs is Serve for the signed-in user uid, sent in X-User-ID, which
+// package auth trusts in replay mode. An empty uid is an anonymous caller.
+func ServeAs(t *testing.T, uid, cassette, path string, handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv("PROJECT_ID", "test")
+	t.Setenv("MODEL_NAME", "gemini-1.5-flash")
+	t.Setenv("API_KEY", "test")
+	t.Setenv("MODEL_REPLAY", "testdata/"+cassette+".json")
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	r.Header.Set("X-API-Key", "test")
+	r.Header.Set("Content-Type", "application/json")
+	if uid != "" {
+		r.Header.Set("X-User-ID", uid)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// Image is a blank base64 JPEG; the cassette decides what it shows.
+func Image(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
@@ -0,0 +1,50 @@
+// Package requestid gives every request an ID, echoed in the X-Request-ID
+// response header so a user's report can be matched to the logs. A valid ID
+// sent by the client is kept, so one ID can follow a request across retries.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// Header is the request and response header carrying the ID.
+const Header = "X-Request-ID"
+
+var pattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type contextKey struct{}
+
+// Valid reports whether id is a well-formed request ID.
+func Valid(id string) bool {
+	return pattern.MatchString(id)
+}
+
+// FromContext returns the ID of the request, "" outside of Handle.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Handle serves the request with next, with its ID in the request context
+// and the response header.
+func Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !Valid(id) {
+			id = newID()
+		}
+
+		w.Header().Set(Header, id)
+		next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+	}
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
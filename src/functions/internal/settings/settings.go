@@ -0,0 +1,213 @@
+// Package settings holds runtime tunables of the functions, so a prompt
+// version can be activated or the generation parameters adjusted through
+// the admin function without a redeploy.
+//
+// Settings are Firestore documents settings/{function}, keyed by the
+// function's log name (e.g. "detect-hazards"). They are only read when
+// RUNTIME_SETTINGS is true, and cached for SETTINGS_CACHE_TTL (default 1m),
+// so a change reaches every instance within that time.
+package settings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/provider"
+)
+
+// fetchTimeout bounds the settings read of a request.
+const fetchTimeout = 2 * time.Second
+
+// Settings are the tunables of a function. Unset fields keep the
+// function's defaults.
+type Settings struct {
+	// PromptVersion is the active prompt version.
+	PromptVersion   string   `json:"promptVersion,omitempty"`
+	Temperature     *float32 `json:"temperature,omitempty"`
+	MaxOutputTokens *int32   `json:"maxOutputTokens,omitempty"`
+	// TopHazards caps the hazards returned by detect-hazards, for the
+	// requests that don't ask for another number.
+	TopHazards *int      `json:"topHazards,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
+}
+
+// MaxTopHazards is the most hazards detect-hazards can be asked for.
+const MaxTopHazards = 20
+
+const (
+	maxTemperature  = 2
+	maxOutputTokens = 8192
+)
+
+var (
+	functionPattern = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+	versionPattern  = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+)
+
+// ValidFunction reports whether name can be a function's log name.
+func ValidFunction(name string) bool {
+	return functionPattern.MatchString(name)
+}
+
+// Validate checks the tunables are within the ranges the models accept.
+func (s Settings) Validate() error {
+	switch {
+	case s.PromptVersion != "" && !versionPattern.MatchString(s.PromptVersion):
+		return errors.New("Invalid promptVersion")
+	case s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > maxTemperature):
+		return fmt.Errorf("Invalid temperature, expected 0 to %d", maxTemperature)
+	case s.MaxOutputTokens != nil && (*s.MaxOutputTokens < 1 || *s.MaxOutputTokens > maxOutputTokens):
+		return fmt.Errorf("Invalid maxOutputTokens, expected 1 to %d", maxOutputTokens)
+	case s.TopHazards != nil && (*s.TopHazards < 1 || *s.TopHazards > MaxTopHazards):
+		return fmt.Errorf("Invalid topHazards, expected 1 to %d", MaxTopHazards)
+	}
+	return nil
+}
+
+type cached struct {
+	settings  Settings
+	fetchedAt time.Time
+}
+
+var (
+	mu    sync.Mutex
+	cache = map[string]cached{}
+)
+
+// Get returns the settings of function, or none when runtime settings are
+// off. Failures are logged and fall back to the last fetched settings.
+func Get(ctx context.Context, function string) Settings {
+	cfg := config.Get()
+	if !cfg.RuntimeSettings {
+		return Settings{}
+	}
+
+	mu.Lock()
+	entry, ok := cache[function]
+	mu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < cfg.SettingsCacheTTL {
+		return entry.settings
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	s, err := Load(ctx, function)
+	if err != nil {
+		log.Printf("Error loading settings of %s: %v", function, err)
+		return entry.settings
+	}
+
+	mu.Lock()
+	cache[function] = cached{settings: s, fetchedAt: time.Now()}
+	mu.Unlock()
+	return s
+}
+
+// Tune returns opts with the temperature and output token tunables of
+// function applied.
+func Tune(ctx context.Context, function string, opts provider.Options) provider.Options {
+	return Get(ctx, function).Tune(opts)
+}
+
+// Tune returns opts with the temperature and output token tunables of s
+// applied.
+func (s Settings) Tune(opts provider.Options) provider.Options {
+	if s.Temperature != nil {
+		opts.Temperature = *s.Temperature
+	}
+	if s.MaxOutputTokens != nil {
+		opts.MaxOutputTokens = *s.MaxOutputTokens
+	}
+	return opts
+}
+
+// Load reads the settings of function, bypassing the cache.
+func Load(ctx context.Context, function string) (Settings, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return Settings{}, err
+	}
+
+	doc, err := fs.Projects.Databases.Documents.Get(document(function)).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return Settings{}, nil
+		}
+		return Settings{}, err
+	}
+
+	var s Settings
+	s.PromptVersion = doc.Fields["promptVersion"].StringValue
+	if v, ok := doc.Fields["temperature"]; ok {
+		t := float32(v.DoubleValue)
+		s.Temperature = &t
+	}
+	if v, ok := doc.Fields["maxOutputTokens"]; ok {
+		n := int32(v.IntegerValue)
+		s.MaxOutputTokens = &n
+	}
+	if v, ok := doc.Fields["topHazards"]; ok {
+		n := int(v.IntegerValue)
+		s.TopHazards = &n
+	}
+	s.UpdatedAt, _ = time.Parse(time.RFC3339Nano, doc.Fields["updatedAt"].TimestampValue)
+	return s, nil
+}
+
+// Save replaces the settings of function. Instances pick them up when
+// their cache expires.
+func Save(ctx context.Context, function string, s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]firestore.Value{
+		"updatedAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}
+	if s.PromptVersion != "" {
+		fields["promptVersion"] = firestore.Value{StringValue: s.PromptVersion}
+	}
+	if s.Temperature != nil {
+		// 0 is a valid temperature, not an unset one
+		fields["temperature"] = firestore.Value{DoubleValue: float64(*s.Temperature), ForceSendFields: []string{"DoubleValue"}}
+	}
+	if s.MaxOutputTokens != nil {
+		fields["maxOutputTokens"] = firestore.Value{IntegerValue: int64(*s.MaxOutputTokens)}
+	}
+	if s.TopHazards != nil {
+		fields["topHazards"] = firestore.Value{IntegerValue: int64(*s.TopHazards)}
+	}
+
+	_, err = fs.Projects.Databases.Documents.Patch(document(function), &firestore.Document{Fields: fields}).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	delete(cache, function)
+	mu.Unlock()
+	return nil
+}
+
+func document(function string) string {
+	return fmt.Sprintf("projects/%s/databases/(default)/documents/settings/%s", config.Get().ProjectID, function)
+}
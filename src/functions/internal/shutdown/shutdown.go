@@ -0,0 +1,142 @@
+// Package shutdown drains an instance when the runtime scales it down. On
+// SIGTERM, new requests are turned away with 503 so the client retries on
+// another instance, requests in flight (typically waiting on the model) get
+// up to SHUTDOWN_TIMEOUT to finish, and the registered hooks then flush
+// what is left, e.g. log buffers, before the process exits.
+//
+// Cloud Run and Cloud Functions allow 10 seconds between SIGTERM and
+// SIGKILL, so SHUTDOWN_TIMEOUT (default 8s) should stay below that.
+package shutdown
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+var (
+	mu       sync.Mutex
+	draining bool
+	active   int
+	// idle is closed when the last request ends while draining.
+	idle  chan struct{}
+	hooks []func() error
+
+	listenOnce sync.Once
+)
+
+// Track serves requests with next and counts them as in flight, or answers
+// 503 once the instance is draining.
+func Track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !begin() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			apierror.Write(w, apierror.New(http.StatusServiceUnavailable, apierror.CodeShuttingDown, "Shutting down"))
+			return
+		}
+		defer end()
+
+		next(w, r)
+	}
+}
+
+// Go runs f in the background, counted as a request in flight so the
+// instance waits for it, e.g. work left once a request is answered. Once
+// draining, f runs at once instead.
+func Go(f func()) {
+	if !begin() {
+		f()
+		return
+	}
+	go func() {
+		defer end()
+		f()
+	}()
+}
+
+// OnShutdown registers f to run once requests are drained, or the timeout
+// passed. Hooks run in the order they were registered; errors are logged.
+func OnShutdown(f func() error) {
+	mu.Lock()
+	hooks = append(hooks, f)
+	mu.Unlock()
+}
+
+// Listen drains the instance and exits on SIGTERM. Calling it again has no
+// effect.
+func Listen() {
+	listenOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM)
+
+		go func() {
+			<-signals
+			Drain(config.Get().ShutdownTimeout)
+			os.Exit(0)
+		}()
+	})
+}
+
+// Drain stops accepting requests, waits up to timeout for the ones in
+// flight and runs the hooks.
+func Drain(timeout time.Duration) {
+	mu.Lock()
+	draining = true
+	done := make(chan struct{})
+	if active == 0 {
+		close(done)
+	} else {
+		idle = done
+	}
+	remaining := active
+	mu.Unlock()
+
+	log.Printf("Shutting down, draining %d requests", remaining)
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		mu.Lock()
+		log.Printf("Shutdown timeout, %d requests still in flight", active)
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	run := hooks
+	mu.Unlock()
+	for _, f := range run {
+		if err := f(); err != nil {
+			log.Printf("Error at shutdown: %v", err)
+		}
+	}
+}
+
+func begin() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if draining {
+		return false
+	}
+	active++
+	return true
+}
+
+func end() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	active--
+	if draining && active == 0 && idle != nil {
+		close(idle)
+		idle = nil
+	}
+}
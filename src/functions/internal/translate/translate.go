@@ -0,0 +1,107 @@
+// Package translate translates answers into the language of users reading
+// menus and signs abroad. With CLOUD_TRANSLATION set it uses the Cloud
+// Translation API, which is faster and cheaper than a model call; otherwise
+// the function's model translates. Cloud Translation is never used in the
+// offline modes.
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	translateapi "google.golang.org/api/translate/v3"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/provider"
+)
+
+// timeout bounds the Cloud Translation call.
+const timeout = 2 * time.Second
+
+// languagePattern matches BCP 47 language codes such as "th", "ja" or
+// "zh-TW".
+var languagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8}){0,2}$`)
+
+// ErrNoTranslator is returned by Text when Cloud Translation is off and
+// there is no model to translate with.
+var ErrNoTranslator = errors.New("no translator: Cloud Translation disabled and no model")
+
+// Translation is a translated text. Source is the language code of the
+// original, when the translator detected it.
+type Translation struct {
+	Text   string
+	Source string
+}
+
+// Enabled reports whether Cloud Translation is on.
+func Enabled() bool {
+	cfg := config.Get()
+	return cfg.CloudTranslation && !cfg.MockModel && cfg.ModelReplay == ""
+}
+
+// ValidLanguage reports whether code is a language code Text accepts.
+func ValidLanguage(code string) bool {
+	return languagePattern.MatchString(code)
+}
+
+// Text translates text into the language of code, with Cloud Translation
+// when enabled, else with model, which may be nil.
+func Text(ctx context.Context, model provider.VisionModel, text, code string) (Translation, error) {
+	if Enabled() {
+		return cloudTranslate(ctx, text, code)
+	}
+	if model == nil {
+		return Translation{}, ErrNoTranslator
+	}
+
+	// The model may be set up for JSON answers, so it is asked for JSON
+	answer, err := model.Generate(ctx, provider.Text(fmt.Sprintf(
+		"Translate the following text into the language with the code %q. Keep names, numbers and prices as they are. Return a JSON object {\"translation\": \"...\"}.\n\n%s", code, text)))
+	if err != nil {
+		return Translation{}, err
+	}
+
+	// Models not set up for JSON may fence it as markdown
+	answer = strings.TrimSpace(answer)
+	answer = strings.TrimPrefix(strings.TrimPrefix(answer, "```json"), "```")
+	answer = strings.TrimSuffix(answer, "```")
+
+	var result struct {
+		Translation string `json:"translation"`
+	}
+	if err := json.Unmarshal([]byte(answer), &result); err != nil || result.Translation == "" {
+		return Translation{}, fmt.Errorf("malformed translation %q", answer)
+	}
+	return Translation{Text: strings.TrimSpace(result.Translation)}, nil
+}
+
+func cloudTranslate(ctx context.Context, text, code string) (Translation, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	svc, err := translateapi.NewService(ctx)
+	if err != nil {
+		return Translation{}, err
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/global", config.Get().ProjectID)
+	resp, err := svc.Projects.Locations.TranslateText(parent, &translateapi.TranslateTextRequest{
+		Contents:           []string{text},
+		TargetLanguageCode: code,
+		MimeType:           "text/plain",
+	}).Context(ctx).Do()
+	if err != nil {
+		return Translation{}, err
+	}
+	if len(resp.Translations) == 0 {
+		return Translation{}, errors.New("empty translation")
+	}
+
+	t := resp.Translations[0]
+	return Translation{Text: t.TranslatedText, Source: t.DetectedLanguageCode}, nil
+}
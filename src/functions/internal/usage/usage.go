@@ -0,0 +1,283 @@
+// Package usage exports the token usage and estimated cost of every model
+// call to BigQuery, for cost-per-user dashboards.
+//
+// Records are appended to the default stream of the table named by
+// USAGE_TABLE ("dataset.table" in PROJECT_ID, or "project.dataset.table")
+// with the BigQuery Storage Write API. The table has the schema
+//
+//	time:TIMESTAMP, function:STRING, model:STRING, userId:STRING,
+//	promptTokens:INTEGER, outputTokens:INTEGER, costUsd:FLOAT
+//
+// Without USAGE_TABLE nothing is exported.
+package usage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/shutdown"
+)
+
+// exportTimeout bounds the insert.
+const exportTimeout = 2 * time.Second
+
+// trackTimeout bounds the accounting of a request, which runs after it
+// was answered, the instance waiting for it before shutting down.
+const trackTimeout = 5 * time.Second
+
+// Record is the usage of one request.
+type Record struct {
+	Time         time.Time
+	Function     string
+	Model        string
+	UserID       string
+	PromptTokens int64
+	OutputTokens int64
+	CostUSD      float64
+}
+
+// Price is the price of a model in USD per million tokens.
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultPrices are list prices for short prompts, matched by model name
+// prefix. MODEL_PRICES (a JSON object of the same shape) overrides them when
+// prices change.
+var defaultPrices = map[string]Price{
+	"gemini-1.5-flash-8b": {Input: 0.0375, Output: 0.15},
+	"gemini-1.5-flash":    {Input: 0.075, Output: 0.30},
+	"gemini-1.5-pro":      {Input: 1.25, Output: 5.00},
+	"gemini-2.0-flash":    {Input: 0.10, Output: 0.40},
+	"gpt-4o-mini":         {Input: 0.15, Output: 0.60},
+	"gpt-4o":              {Input: 2.50, Output: 10.00},
+	"claude-3-5-haiku":    {Input: 0.80, Output: 4.00},
+	"claude-3-5-sonnet":   {Input: 3.00, Output: 15.00},
+}
+
+var (
+	pricesOnce sync.Once
+	prices     map[string]Price
+)
+
+// Cost estimates the cost of the tokens in USD. Unknown models cost 0.
+func Cost(model string, promptTokens, outputTokens int64) float64 {
+	pricesOnce.Do(func() {
+		prices = defaultPrices
+		if raw := config.Get().ModelPrices; raw != "" {
+			var override map[string]Price
+			if err := json.Unmarshal([]byte(raw), &override); err != nil {
+				log.Printf("Ignoring MODEL_PRICES: %v", err)
+				return
+			}
+			prices = override
+		}
+	})
+
+	// The longest matching prefix wins, so gemini-1.5-flash-8b isn't priced
+	// as gemini-1.5-flash.
+	var price Price
+	longest := -1
+	for prefix, p := range prices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			price, longest = p, len(prefix)
+		}
+	}
+
+	return (float64(promptTokens)*price.Input + float64(outputTokens)*price.Output) / 1e6
+}
+
+// UserID returns the user to bill a request to, the signed-in one, see
+// package auth, and "" for anonymous requests.
+func UserID(r *http.Request) string {
+	return auth.Caller(r.Context(), r)
+}
+
+// Track exports the usage of the models of a request to function and adds
+// its cost to the daily budget, as one record. It is meant to be deferred
+// right after the models are created, and returns at once: the accounting
+// runs in the background, drained like a request, see package shutdown,
+// and failures are only logged.
+func Track(ctx context.Context, function, userID string, models ...provider.VisionModel) {
+	record := Record{
+		Time:     time.Now().UTC(),
+		Function: function,
+		UserID:   userID,
+	}
+	for _, model := range models {
+		u := model.Usage()
+		if u.PromptTokens == 0 && u.OutputTokens == 0 {
+			continue
+		}
+		if record.Model == "" {
+			record.Model = u.Model
+		}
+		record.PromptTokens += u.PromptTokens
+		record.OutputTokens += u.OutputTokens
+		record.CostUSD += Cost(u.Model, u.PromptTokens, u.OutputTokens)
+	}
+	if record.PromptTokens == 0 && record.OutputTokens == 0 {
+		return
+	}
+
+	shutdown.Go(func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), trackTimeout)
+		defer cancel()
+
+		if err := Export(ctx, record); err != nil {
+			log.Printf("Error exporting usage: %v", err)
+		}
+		if err := budget.Spend(ctx, record.CostUSD); err != nil {
+			log.Printf("Error updating budget: %v", err)
+		}
+	})
+}
+
+// schema is the schema of USAGE_TABLE, see the package doc.
+var schema = &storagepb.TableSchema{Fields: []*storagepb.TableFieldSchema{
+	{Name: "time", Type: storagepb.TableFieldSchema_TIMESTAMP, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "function", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "model", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "userId", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "promptTokens", Type: storagepb.TableFieldSchema_INT64, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "outputTokens", Type: storagepb.TableFieldSchema_INT64, Mode: storagepb.TableFieldSchema_NULLABLE},
+	{Name: "costUsd", Type: storagepb.TableFieldSchema_DOUBLE, Mode: storagepb.TableFieldSchema_NULLABLE},
+}}
+
+// writer is the stream records are appended to, opened on first use and
+// kept for the life of the instance.
+var (
+	writerMu   sync.Mutex
+	client     *managedwriter.Client
+	writer     *managedwriter.ManagedStream
+	descriptor protoreflect.MessageDescriptor
+)
+
+// Export appends the record to USAGE_TABLE.
+func Export(ctx context.Context, record Record) error {
+	cfg := config.Get()
+	if cfg.UsageTable == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	stream, err := openWriter(ctx)
+	if err != nil {
+		return err
+	}
+	row, err := encode(record)
+	if err != nil {
+		return err
+	}
+
+	result, err := stream.AppendRows(ctx, [][]byte{row})
+	if err == nil {
+		_, err = result.GetResult(ctx)
+	}
+	if err != nil {
+		// Reopened by the next export, in case the stream broke
+		closeWriter()
+		return fmt.Errorf("appending to %s: %w", cfg.UsageTable, err)
+	}
+	return nil
+}
+
+// openWriter returns the stream of USAGE_TABLE, opening it if needed.
+func openWriter(ctx context.Context) (*managedwriter.ManagedStream, error) {
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	if writer != nil {
+		return writer, nil
+	}
+
+	if descriptor == nil {
+		d, err := adapt.StorageSchemaToProto2Descriptor(schema, "usage")
+		if err != nil {
+			return nil, err
+		}
+		md, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("schema descriptor is a %T, not a message", d)
+		}
+		descriptor = md
+	}
+	normalized, err := adapt.NormalizeDescriptor(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := config.Get()
+	project, dataset, table := splitTable(cfg.UsageTable, cfg.ProjectID)
+
+	// The client and stream outlive the request that opens them
+	ctx = context.WithoutCancel(ctx)
+	c, err := managedwriter.NewClient(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(project, dataset, table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(normalized),
+	)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	client, writer = c, stream
+	return writer, nil
+}
+
+func closeWriter() {
+	writerMu.Lock()
+	defer writerMu.Unlock()
+	if writer != nil {
+		writer.Close()
+		client.Close()
+		client, writer = nil, nil
+	}
+}
+
+// encode serializes the record as a row of schema. Timestamps are in
+// microseconds.
+func encode(record Record) ([]byte, error) {
+	row := dynamicpb.NewMessage(descriptor)
+	fields := descriptor.Fields()
+	row.Set(fields.ByName("time"), protoreflect.ValueOfInt64(record.Time.UnixMicro()))
+	row.Set(fields.ByName("function"), protoreflect.ValueOfString(record.Function))
+	row.Set(fields.ByName("model"), protoreflect.ValueOfString(record.Model))
+	row.Set(fields.ByName("userId"), protoreflect.ValueOfString(record.UserID))
+	row.Set(fields.ByName("promptTokens"), protoreflect.ValueOfInt64(record.PromptTokens))
+	row.Set(fields.ByName("outputTokens"), protoreflect.ValueOfInt64(record.OutputTokens))
+	row.Set(fields.ByName("costUsd"), protoreflect.ValueOfFloat64(record.CostUSD))
+	return proto.Marshal(row)
+}
+
+// splitTable splits "project.dataset.table" or "dataset.table".
+func splitTable(name, defaultProject string) (project, dataset, table string) {
+	parts := strings.Split(name, ".")
+	if len(parts) == 2 {
+		return defaultProject, parts[0], parts[1]
+	}
+	return parts[0], parts[1], parts[2]
+}
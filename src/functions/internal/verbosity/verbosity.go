@@ -0,0 +1,64 @@
+// Package verbosity holds how much the functions say: "terse" for
+// continuous navigation or a quick glance, "normal", or "detailed" for
+// exploring. A request picks a level, else the deployment's VERBOSITY.
+package verbosity
+
+import "example.com/buddy-paws/internal/config"
+
+// Levels. The normal level is the prompts' own.
+const (
+	Terse    = "terse"
+	Normal   = "normal"
+	Detailed = "detailed"
+)
+
+// Valid reports whether a request can ask for level, "" for the default.
+func Valid(level string) bool {
+	switch level {
+	case "", Terse, Normal, Detailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Level returns the requested level, else the deployment's VERBOSITY.
+func Level(requested string) string {
+	if requested == "" {
+		return config.Get().Verbosity
+	}
+	return requested
+}
+
+// Tokens scales the output token limit of a normal answer to level: a
+// terse answer gets the limit divided by terse, a detailed one twice the
+// limit.
+func Tokens(level string, tokens, terse int32) int32 {
+	switch level {
+	case Terse:
+		return tokens / terse
+	case Detailed:
+		return tokens * 2
+	default:
+		return tokens
+	}
+}
+
+// Prompts are a function's instructions for the terse and detailed levels.
+type Prompts struct {
+	Terse    string
+	Detailed string
+}
+
+// Context renders level as extra prompt text. The normal level renders as
+// nothing.
+func (p Prompts) Context(level string) string {
+	switch level {
+	case Terse:
+		return "# Verbosity:\n" + p.Terse
+	case Detailed:
+		return "# Verbosity:\n" + p.Detailed
+	default:
+		return ""
+	}
+}
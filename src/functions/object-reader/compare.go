@@ -0,0 +1,24 @@
+package objectreader
+
+import "encoding/json"
+
+// comparison is the model's answer to a question about two images, see
+// Request.CompareImage.
+type comparison struct {
+	Answer      string   `json:"answer"`
+	Winner      *int     `json:"winner"`
+	Differences []string `json:"differences"`
+}
+
+// parseComparison returns the answer of a comparison. A winner other than
+// image 1 or 2 is dropped.
+func parseComparison(text string) (comparison, error) {
+	var answer comparison
+	if err := json.Unmarshal([]byte(text), &answer); err != nil {
+		return comparison{}, err
+	}
+	if answer.Winner != nil && *answer.Winner != 1 && *answer.Winner != 2 {
+		answer.Winner = nil
+	}
+	return answer, nil
+}
@@ -0,0 +1,127 @@
+package objectreader
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/model"
+)
+
+const (
+	// maxConversations bounds the conversations an instance keeps; the
+	// least recently used go first.
+	maxConversations = 256
+	// maxTurns is how many earlier questions and answers the model is
+	// given.
+	maxTurns = 6
+)
+
+// sessionIDPattern is the form of session IDs, as for detect-hazards.
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// turn is a question about the image of a conversation and its answer.
+type turn struct {
+	question, answer string
+}
+
+// conversation is the image of a session and the questions asked about
+// it, for follow-up questions without uploading it again, and the unread
+// pages of its last answer, see paginate, or the pages of a document
+// being photographed, see addPage. It lives in the memory of the instance
+// that answered the first question, for CONVERSATION_TTL, under its
+// conversationKey. Anonymous callers have none: the session ID is chosen
+// by the client, and two of them sending the same one would share it.
+type conversation struct {
+	userID    string
+	image     []byte
+	format    string
+	roi       *model.Region
+	turns     []turn
+	unread    []Response
+	document  []page
+	updatedAt time.Time
+}
+
+// conversationKey identifies a conversation by its verified user and the
+// session ID the client chose, so users reusing a session ID don't see
+// each other's images.
+type conversationKey struct {
+	userID, sessionID string
+}
+
+var (
+	conversationsMu sync.Mutex
+	conversations   = map[conversationKey]*conversation{}
+)
+
+// findConversation returns the conversation of a session of userID.
+func findConversation(sessionID, userID string) (conversation, bool) {
+	if userID == "" {
+		return conversation{}, false
+	}
+
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	c, ok := conversations[conversationKey{userID, sessionID}]
+	if !ok || time.Since(c.updatedAt) > config.Get().ConversationTTL {
+		return conversation{}, false
+	}
+	return *c, true
+}
+
+// saveConversation stores the conversation of a session with the latest
+// question and answer added.
+func saveConversation(sessionID string, c conversation, question, answer string) {
+	c.turns = append(c.turns[:len(c.turns):len(c.turns)], turn{question, answer})
+	if len(c.turns) > maxTurns {
+		c.turns = c.turns[len(c.turns)-maxTurns:]
+	}
+	storeConversation(sessionID, c)
+}
+
+// storeConversation stores the conversation of a session of its user,
+// unless conversations are off or the user is anonymous.
+func storeConversation(sessionID string, c conversation) {
+	ttl := config.Get().ConversationTTL
+	if ttl <= 0 || c.userID == "" {
+		return
+	}
+	c.updatedAt = time.Now()
+
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	conversations[conversationKey{c.userID, sessionID}] = &c
+	if len(conversations) <= maxConversations {
+		return
+	}
+	// Drop the expired conversations, or else the oldest
+	var oldest *conversationKey
+	for key, other := range conversations {
+		if time.Since(other.updatedAt) > ttl {
+			delete(conversations, key)
+		} else if oldest == nil || other.updatedAt.Before(conversations[*oldest].updatedAt) {
+			oldest = &key
+		}
+	}
+	if len(conversations) > maxConversations {
+		delete(conversations, *oldest)
+	}
+}
+
+// historyContext renders the earlier questions of a conversation as
+// prompt text, so a follow-up such as "what's the price of the second
+// one" can be answered.
+func historyContext(turns []turn) string {
+	lines := []string{"# Conversation:", "The user asked about this same image before:"}
+	for _, t := range turns {
+		lines = append(lines, fmt.Sprintf("Question: %s", t.question), fmt.Sprintf("Your answer: %s", t.answer))
+	}
+	lines = append(lines, "Answer the new question as a follow-up, e.g. \"the second one\" is the second thing your answers named.")
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,58 @@
+package objectreader
+
+import (
+	"errors"
+	"fmt"
+
+	"example.com/buddy-paws/internal/persona"
+)
+
+// maxDocumentPages bounds the pages of a document, which are kept in
+// memory until it is finished.
+const maxDocumentPages = 10
+
+// maxDocumentTokens bounds the output tokens of a document's reading, which
+// has the tokens of an answer for each page up to it.
+const maxDocumentTokens = 8192
+
+// pageAddedSpeech answers a page added to a document.
+const pageAddedSpeech = "Page %d added. Photograph the next page, or finish the document."
+
+// documentText is the question of a finishDocument request without one.
+const documentText = "Read this document."
+
+// errDocumentFull is returned by addPage for a document of
+// maxDocumentPages.
+var errDocumentFull = errors.New("document full")
+
+// page is a photographed page of a document, see Request.AddPage.
+type page struct {
+	image  []byte
+	format string
+}
+
+// addPage adds a page to the document of a session of userID, starting
+// the session when it has expired, and returns the number of pages.
+func addPage(sessionID, userID string, p page) (int, error) {
+	c, ok := findConversation(sessionID, userID)
+	if !ok {
+		c = conversation{userID: userID, image: p.image, format: p.format}
+	}
+	if len(c.document) == maxDocumentPages {
+		return 0, errDocumentFull
+	}
+	c.document = append(c.document[:len(c.document):len(c.document)], p)
+	storeConversation(sessionID, c)
+	return len(c.document), nil
+}
+
+// pageAdded is the response to a page added to a document.
+func pageAdded(pages int) Response {
+	return Response{SpeechText: persona.Speech(fmt.Sprintf(pageAddedSpeech, pages)), Pages: pages}
+}
+
+// documentTokens is the output token limit of the reading of a document,
+// from the limit of an answer.
+func documentTokens(pages int, tokens int32) int32 {
+	return min(tokens*int32(pages), maxDocumentTokens)
+}
@@ -0,0 +1,71 @@
+package objectreader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/translate"
+)
+
+// Ways to read text in a script foreign to the user's language, see
+// Request.ForeignText.
+const (
+	foreignRead          = "read"
+	foreignTransliterate = "transliterate"
+	foreignTranslate     = "translate"
+)
+
+var foreignTextModes = map[string]bool{
+	"":                   true,
+	foreignRead:          true,
+	foreignTransliterate: true,
+	foreignTranslate:     true,
+}
+
+// foreignTextContext renders extra prompt text on reading text in several
+// languages, in the given mode. scripts are the foreign scripts OCR found,
+// and ocrText its reading, as a hint; both are empty without OCR.
+func foreignTextContext(mode, language string, scripts []string, ocrText string) string {
+	lines := []string{"# Languages:"}
+
+	if len(scripts) > 0 {
+		lines = append(lines, fmt.Sprintf("The image has text in the %s script, besides %s.", strings.Join(scripts, " and "), language))
+	} else {
+		lines = append(lines, "Text in the image may be in several languages or scripts, e.g. a Thai and English sign.")
+	}
+	lines = append(lines, fmt.Sprintf("Read every text in the language it is written in, and name the language before text that isn't in %s, e.g. \"In Thai: ...\". Never mix up the text of different languages.", language))
+
+	switch mode {
+	case foreignTransliterate:
+		lines = append(lines, fmt.Sprintf("After each text that isn't in %s, spell out how it is pronounced, in the alphabet of %s.", language, language))
+	case foreignTranslate:
+		lines = append(lines, fmt.Sprintf("After each text that isn't in %s, translate it into %s, e.g. \"In Thai: ทางออก, meaning Exit\".", language, language))
+	}
+
+	if ocrText != "" {
+		lines = append(lines, "OCR read the text as follows; use it to check your reading:", ocrText)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// translated returns response translated into the language of code, with
+// the original kept. On failure the response is returned untranslated, as
+// an answer in the wrong language beats none. model may be nil when Cloud
+// Translation is enabled.
+func translated(ctx context.Context, logger *log.Logger, model provider.VisionModel, response Response, code string) Response {
+	translation, err := translate.Text(ctx, model, response.SpeechText, code)
+	if err != nil {
+		logger.Printf("Error translating to %s, answering untranslated: %v", code, err)
+		return response
+	}
+
+	response.OriginalText = response.SpeechText
+	response.TranslatedFrom = translation.Source
+	response.SpeechText = translation.Text
+	// The segments are those of the original
+	response.Segments = nil
+	return response
+}
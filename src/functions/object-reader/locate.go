@@ -0,0 +1,42 @@
+package objectreader
+
+import (
+	"encoding/json"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// locateContext asks for the answer as JSON, with the objects it is about
+// and their bounding boxes, see Request.Locate.
+const locateContext = `# Locating:
+Return a JSON object with your answer and the objects it is about:
+{"answer": "[Your answer, as you would speak it]", "objects": [{"name": "[Short name of the object]", "box": {"x": [left edge], "y": [top edge], "w": [width], "h": [height]}}]}
+The box is the bounding box of the object, in fractions of the image width and height from the top left corner, from 0.0 to 1.0. List only objects you can see, at most 5, and none when the answer isn't about an object.`
+
+// located is the model's answer to a locate request.
+type located struct {
+	Answer  string         `json:"answer"`
+	Objects []model.Object `json:"objects"`
+}
+
+// parseLocated returns the answer and the objects of a locate request. The
+// boxes of a cropped image are mapped to the whole image using roi, and
+// boxes outside the image are dropped.
+func parseLocated(text string, roi *model.Region) (string, []model.Object, error) {
+	var answer located
+	if err := json.Unmarshal([]byte(text), &answer); err != nil {
+		return "", nil, err
+	}
+
+	objects := make([]model.Object, 0, len(answer.Objects))
+	for _, object := range answer.Objects {
+		if object.Box.Validate() != nil {
+			continue
+		}
+		if roi != nil {
+			object.Box = object.Box.Within(*roi)
+		}
+		objects = append(objects, object)
+	}
+	return answer.Answer, objects, nil
+}
@@ -1,47 +1,152 @@
-package detecthazards
+package objectreader
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 
-	"cloud.google.com/go/logging"
 	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
+
+	"example.com/buddy-paws/internal/allergens"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/currency"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/ocr"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/places"
+	"example.com/buddy-paws/internal/products"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/translate"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/internal/verbosity"
+	"example.com/buddy-paws/pkg/apierror"
+	"example.com/buddy-paws/pkg/model"
 )
 
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request is an image and a question about it. ROI, if set, limits the
+// question to a region of the image, e.g. the label the user points at.
+// Location lets "where am I" questions name the places around the user.
+// ForeignText is how text in another language than the user's is read:
+// "read" as written (the default), or also "transliterate"d or
+// "translate"d. TranslateTo, a language code such as "th", has the whole
+// answer translated, for travelers. Verbosity is "terse", "normal" or
+// "detailed", by default the deployment's VERBOSITY. Locate has the
+// objects the answer is about returned with their bounding boxes, e.g. for
+// an on-screen highlight or to zoom in on one. Questions with a SessionID
+// start a conversation about their image: a FollowUp question with the
+// same SessionID and no image is about that image again, e.g. "what's the
+// price of the second one", for CONVERSATION_TTL. CompareImage is a
+// second image for a question comparing the two, e.g. "which of these is
+// decaf" or "which door is open". Intent "read-table" has a table read
+// row by row and returned in Response.Table; questions like "read this
+// table" have it too. HomeCurrency, an ISO 4217 code such as "USD", has
+// prices in other currencies converted into it, by default into the one
+// of the user's profile. A long answer to a question with a SessionID is
+// read a page at a time, with Response.HasMore set while pages are left;
+// a ContinueReading request with the same SessionID and no image returns
+// the next one. A letter or bill of several pages is photographed page by
+// page: each AddPage request with the same SessionID adds its image to the
+// session's document, and a FinishDocument request with no image reads
+// the pages as one document, e.g. without the text photographed twice.
+// Sessions are kept for signed-in users only, see package auth.
 type Request struct {
-	Image string `json:"image"`
-	Text  string `json:"text"`
+	Image       string        `json:"image"`
+	Text        string        `json:"text"`
+	Model       string        `json:"model,omitempty"`
+	ROI         *model.Region `json:"roi,omitempty"`
+	Location    *Location     `json:"location,omitempty"`
+	ForeignText string        `json:"foreignText,omitempty"`
+	TranslateTo string        `json:"translateTo,omitempty"`
+	Verbosity   string        `json:"verbosity,omitempty"`
+	Locate      bool          `json:"locate,omitempty"`
+	SessionID   string        `json:"sessionId,omitempty"`
+	FollowUp    bool          `json:"followUp,omitempty"`
+
+	CompareImage string `json:"compareImage,omitempty"`
+	Intent       string `json:"intent,omitempty"`
+	HomeCurrency string `json:"homeCurrency,omitempty"`
+
+	ContinueReading bool `json:"continueReading,omitempty"`
+	AddPage         bool `json:"addPage,omitempty"`
+	FinishDocument  bool `json:"finishDocument,omitempty"`
+}
+
+// Location is the optional GPS fix of the phone. Heading is the compass
+// direction the camera faces, in degrees clockwise from north.
+type Location struct {
+	Lat     float64  `json:"lat"`
+	Lng     float64  `json:"lng"`
+	Heading *float64 `json:"heading,omitempty"`
+}
+
+func (l *Location) valid() bool {
+	if l.Lat < -90 || l.Lat > 90 || l.Lng < -180 || l.Lng > 180 {
+		return false
+	}
+	return l.Heading == nil || (*l.Heading >= 0 && *l.Heading < 360)
 }
 
+// Response is the answer. Segments splits text read by OCR into runs of
+// one script, for a TTS voice per language; it is only set when there are
+// several. A translated answer keeps the original in OriginalText, and
+// the language it was in, if known, in TranslatedFrom. Truncated is set
+// when the model ran out of time and SpeechText is the beginning of its
+// answer. Objects are the located objects of a Locate request, with boxes
+// in fractions of the whole image, even when an ROI was read. Winner is
+// the image, 1 or 2, that answers a comparison, unset when neither or both
+// do, and Differences are what tells the two images apart. Table is the
+// table of a read-table request, which SpeechText reads row by row.
+// Allergens are the allergens of the user's allergy list that a label
+// mentions; SpeechText then starts with a warning. Conversions are the
+// foreign prices of SpeechText, which gives their amount in the home
+// currency after each. HasMore is set when SpeechText is a page of a long
+// answer and more follow, see Request.ContinueReading; the other fields
+// come with the first page. Pages is the number of pages of the document
+// an AddPage request added to.
 type Response struct {
-	SpeechText string `json:"speechText"`
+	SpeechText     string             `json:"speechText"`
+	Segments       []ocr.Segment      `json:"segments,omitempty"`
+	OriginalText   string             `json:"originalText,omitempty"`
+	TranslatedFrom string             `json:"translatedFrom,omitempty"`
+	Truncated      bool               `json:"truncated,omitempty"`
+	Objects        []model.Object     `json:"objects,omitempty"`
+	Winner         *int               `json:"winner,omitempty"`
+	Differences    []string           `json:"differences,omitempty"`
+	Table          *model.Table       `json:"table,omitempty"`
+	Allergens      []string           `json:"allergens,omitempty"`
+	Conversions    []model.Conversion `json:"conversions,omitempty"`
+	HasMore        bool               `json:"hasMore,omitempty"`
+	Pages          int                `json:"pages,omitempty"`
 }
 
-// objectReader is the Cloud Function entry point
+// ObjectReader is the Cloud Function entry point
 func ObjectReader(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 
-	projectID := os.Getenv("PROJECT_ID")
-	vertexApiKey := os.Getenv("VERTEX_AI_API_KEY")
-	modelName := os.Getenv("MODEL_NAME")
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
 
-	// Creates a client.
-	logClient, err := logging.NewClient(ctx, projectID)
+	// Creates a logger.
+	logName := "object-reader"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
-	defer logClient.Close()
-
-	logName := "object-reader"
-	logger := logClient.Logger(logName).StandardLogger(logging.Info)
+	defer closeLog()
 
 	// Handle CORS
 	if r.Method == http.MethodOptions {
@@ -52,209 +157,447 @@ func ObjectReader(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for the main request
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
 	// Verify method
 	if r.Method != http.MethodPost {
-		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	// Verify API key
 	if err := validateAPIKey(r); err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
 		return
 	}
 
 	// Parse request
 	var req Request
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	imageData, format, err := processBase64Image(req.Image)
+	modelName, err = provider.Select(req.Model, modelName)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid image data: %v", err))
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
 		return
 	}
 
-	client, err := genai.NewClient(ctx, option.WithAPIKey(vertexApiKey))
-	if err != nil {
-		logger.Printf("Error creating client: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error creating new client")
+	if !foreignTextModes[req.ForeignText] {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid foreignText")
 		return
 	}
-	defer client.Close()
-
-	model := client.GenerativeModel(modelName)
-	model.SetTemperature(0.45)
-	model.GenerationConfig = genai.GenerationConfig{
-		ResponseMIMEType: "text/plain",
-	}
-	model.SetMaxOutputTokens(1024)
-
-	prompt := fmt.Sprintf(`
-
-    Goal:
-    Your name is "Buddy". You are friendly Golden Retriever Dog AI assistant designed to help visually impaired users interact with their camera using voice commands and visual analysis. Your primary goal is to provide clear, concise, and actionable information based on user requests and the current camera view.
-
-    Input:
-    User Speech: "%s"
-    Camera Image: The current view captured by the camera. (Note: Gemini will receive image data directly, but for this prompt, assume the image is available to you.)
-
-    Output: Should be return only answer don't tell me what is the user ask 
-
-    Processing Steps:
-    Speech Command Recognition: Identify the user's intent from their spoken command.
-		Image Analysis: Analyze the camera image to extract relevant information (text, objects, or scene details), including font size, color contrast, text orientation, and if any text is partially obscured or hard to read.
-    Response Generation: Generate a response that fulfills the user's request, following the guidelines below.
-		
-    Commands to Handle (with Variations):
-    1. Read Everything:
-    Variations: {read all}, {read everything}, {what do you see}, {tell me everything}
-    Response: Provide a complete description of the scene, including all visible text, objects, and details.
-    2. Read Text Only:
-    Variations: {read text}, {just text}, {what does it say}, {read the words}, {what is it}, {read this text}, {read that text}, {what's that}
-    Response: Extract and read only the visible text in the image.
-    3. Describe Scene:
-    Variations: {describe scene}, {what's around}, {where am I}, {what's in front of me}
-    Response: Provide a brief description of the scene, focusing on objects, locations, and context, without reading text.
-    4. Find Specific Item(s):
-    Variations: {find [item]}, {where is [item]}, {is there [item]}, {find the [color] [item]}, {find [item] on the [position]}, {find all [items]}, {where is this}, {where is that}
-		Examples: {find apples}, {where is the red shirt}, {find the bottle on the right}, {find all the cans}
-    Response: Indicate the location and details of the requested item(s), or state if they are not found. If multiple items are present, ask if the user wants a description of each.
-    5. Read Product Details:
-		Variations: {product info}, {what product}, {read label}, {read ingredients}, {read nutritional info}, {read price}, {what is it}, {read this label}, {read that label}
-		Response: Provide detailed product information, prioritizing the most relevant details based on the product type (e.g., ingredients and nutritional information for food items, model number and warranty for electronics) and the user's specific request.
-    6. Read Specific Text:
-    Variations: {read headers}, {read titles}, {read body}, {read section [number/name]}
-    Response: Read the specific text section requested, such as headers, titles, body, or named sections.
-    7. Navigation and Tracking:
-    Variations: {track [item]}, {follow [item]}, {what's moving}
-		Response: Indicate the movement of an item, including its direction (towards, away, left, right, diagonally), estimated speed, and relative distance, as well as whether the tracked object is going behind an obstacle or is about to be obscured.
-    8. Feedback and Clarification:
-    Variations: {was that correct?}, {read that again}, {I don't understand}, {can't recognize this}
-    Response: Respond accordingly by re-reading, clarifying, or indicating errors.
-   
-		Response Guidelines:
-    - Command Priority: Focus on fulfilling the user’s request directly, prioritizing the spoken command.
-    - Clear, Concise Language: Avoid filler phrases like "I see" or "The image shows." Start responses with the requested information.
-		- Spatial Guidance: Use precise spatial references such as "left," "right," "top," "bottom," "slightly to your left", "at the top right corner", "at 3 o'clock, just below the middle" or clock positions (e.g., "at 3 o'clock"), relative positions (e.g., "slightly above the [object]") and directional terms (e.g., "to your right and a little forward").
-    - Text Reading Priority: Prioritize important text like headers and titles before body content. Ignore decorative or irrelevant text. Indicate if text is at an angle, upside down, hard to read due to low color contrast, or if the font size is too small.
-		- Multiple Items: For general descriptions, list items from left to right and top to bottom. For "find" commands, specify precise locations.
-    - Dynamic Content: Indicate movement or changes in the scene where possible.
-		- Ambiguity Handling: If the command is unclear, ask for clarification. For example, "I don't understand. You can try 'read text' or 'find item' ". If clarification fails, provide a general scene description.
-    - Error Handling: Use empathetic language for errors. For example: 
-
-    Special Cases:
-
-    1. No Relevant Content:
-    Response: "Oops! Looks like there's no matching content for this image"
-    2. Not Understand Command: 
-    Response e.g. Could you repeat that? My ears are a bit confused! You can say [dynamic], or Oops! My ears got a bit tangled. Could you say that again? You can say [dynamic]
-    [dynamic - could be random pick Read everything, Read text, Find something]
-    3. Multiple Matches:
-    Response: "Multiple matches found! Would you like Buddy to read out each match in detail?"
-    4. Partial Visibility:
-    Response: "Buddy can see part of the [item/text]. Would you like me to read what’s visible?"
-    5. Blurry Image:
-    Response: "Oops! This image is looking a bit fuzzy. Hold your device steady."
-
-    Examples:
-		1. 
-    Input: What products are on the shelf?
-    Output: "On the shelf from left to right: Coca-Cola 500ml, Pepsi 330ml, and Sprite 1L bottles."
-    2. 
-		Input: Find the diet option
-    Output: "Diet Coca-Cola is on the left side of the shelf."
-    3.
-		Input: read the warning label
-    Output: "The warning label says: 'Contains caffeine. Not recommended for children.'"
-    4. 
-		Input: find all the cans
-    Output: "Buddy found three cans. One is a soda can on the left. Two cans of beans are in the middle shelf. Would you like a description of each?"
-    5.
-		Input: track the moving object
-    Output: "Tracking the object moving left to right. It appears to be a blue ball."
-    6.
-		Input: read the title and author
-    Output: "The title is 'To Kill a Mockingbird,' and the author is Harper Lee."
-    7.
-		Input: read the expiry date
-    Output: "The expiry date is June 2025, printed at the bottom of the bottle."
-		8.
-		Input: Find the red shirt
-		Output: "The red shirt is on the bottom right of the screen"
-		9.
-		Input: How much is it?
-		Output: "The price of the red shirt is 20$"
-
-    Key Reminders:
-    - Process the speech command first.
-    - Analyze the image content next.
-    - Provide clear, actionable, and user-friendly responses.
-    - Include spatial guidance when describing locations. 
-
-	`, req.Text)
-
-	resp, err := model.GenerateContent(ctx,
-		genai.Text(prompt),
-		genai.ImageData(format, imageData),
-	)
-	if err != nil {
-		logger.Printf("Error at processing: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error at processing")
+
+	if req.TranslateTo != "" && !translate.ValidLanguage(req.TranslateTo) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid translateTo")
 		return
 	}
 
-	if len(resp.Candidates) == 0 {
-		respondWithError(w, http.StatusInternalServerError, "No response - candidates")
+	req.HomeCurrency = strings.ToUpper(req.HomeCurrency)
+	if req.HomeCurrency != "" && !currency.ValidCode(req.HomeCurrency) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid homeCurrency")
 		return
 	}
 
-	if len(resp.Candidates[0].Content.Parts) == 0 {
-		respondWithError(w, http.StatusInternalServerError, "No response - parts")
+	if !verbosity.Valid(req.Verbosity) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid verbosity")
 		return
 	}
+	verbosityLevel := verbosity.Level(req.Verbosity)
 
-	text := resp.Candidates[0].Content.Parts[0].(genai.Text)
+	if req.Location != nil && !req.Location.valid() {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid location")
+		return
+	}
 
-	// Return response
-	response := Response{
-		SpeechText: string(text),
+	if req.SessionID != "" && !sessionIDPattern.MatchString(req.SessionID) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid sessionId")
+		return
 	}
+	userID := usage.UserID(r)
 
-	respondWithJSON(w, http.StatusOK, response)
+	// Sessions are scoped by their verified user, see conversationKey
+	if userID == "" && (req.FollowUp || req.ContinueReading || req.AddPage || req.FinishDocument) {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid ID token, followUp, continueReading, addPage and finishDocument need a signed-in user")
+		return
+	}
 
-}
+	// A comparison is about two whole images, see Request.CompareImage
+	compare := req.CompareImage != ""
+	if compare && (req.FollowUp || req.SessionID != "" || req.ROI != nil || req.Locate) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid compareImage, not allowed with followUp, sessionId, roi or locate")
+		return
+	}
 
-func processBase64Image(base64Image string) ([]byte, string, error) {
-	// Check if the string starts with data URI scheme
-	parts := strings.Split(base64Image, ",")
-	var b64Data string
-	var format string
-
-	if len(parts) == 2 {
-		// Data URI scheme present
-		metaParts := strings.Split(parts[0], ";")
-		if len(metaParts) != 2 || !strings.HasPrefix(metaParts[0], "data:image/") {
-			return nil, "", errors.New("invalid image format in data URI")
+	// The rest of a long answer is read without the model
+	if req.ContinueReading {
+		if req.SessionID == "" || req.Image != "" || req.ROI != nil || req.FollowUp || compare || req.AddPage || req.FinishDocument {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid continueReading, expected a sessionId and no image, roi, followUp, compareImage, addPage or finishDocument")
+			return
+		}
+		response, ok := nextPage(req.SessionID, userID)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Conversation not found, send the image again")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// Documents are photographed a page at a time, and read whole once
+	// finished
+	if req.AddPage || req.FinishDocument {
+		switch {
+		case req.AddPage && req.FinishDocument, req.SessionID == "", req.FollowUp, compare, req.ROI != nil, req.Locate, req.Intent != "":
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid addPage or finishDocument, expected a sessionId and no followUp, compareImage, roi, locate or intent")
+			return
+		case req.FinishDocument && req.Image != "":
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid finishDocument, expected no image")
+			return
+		case cfg.ConversationTTL <= 0:
+			respondWithError(w, http.StatusNotImplemented, apierror.CodeNotConfigured, "Documents not configured")
+			return
+		}
+	}
+	if req.AddPage {
+		imageData, format, err := processBase64Image(req.Image)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+			return
+		}
+		pages, err := addPage(req.SessionID, userID, page{image: imageData, format: format})
+		if errors.Is(err, errDocumentFull) {
+			respondWithError(w, http.StatusConflict, apierror.CodeConflict, fmt.Sprintf("Document has the maximum of %d pages, finish it first", maxDocumentPages))
+			return
+		}
+		respondWithJSON(w, http.StatusOK, pageAdded(pages))
+		return
+	}
+
+	if !intents[req.Intent] || (req.Intent != "" && (compare || req.Locate)) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid intent")
+		return
+	}
+	// Tables asked for by voice are read as a table too
+	tableIntent := intentOf(req.Intent, req.Text) == intentReadTable && !compare && !req.Locate && !req.FinishDocument
+
+	// A follow-up is about the image of its session, as it was read, and a
+	// finished document about the pages of its session
+	var session conversation
+	var document []page
+	switch {
+	case req.FollowUp:
+		if req.SessionID == "" || req.Image != "" || req.ROI != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid followUp, expected a sessionId and no image or roi")
+			return
+		}
+		var ok bool
+		session, ok = findConversation(req.SessionID, userID)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Conversation not found, send the image again")
+			return
+		}
+	case req.FinishDocument:
+		var ok bool
+		session, ok = findConversation(req.SessionID, userID)
+		if !ok {
+			respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Conversation not found, add the pages again")
+			return
+		}
+		if len(session.document) == 0 {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid finishDocument, no pages added")
+			return
+		}
+		document, session.document = session.document, nil
+		if req.Text == "" {
+			req.Text = documentText
+		}
+	}
+	fromSession := req.FollowUp || req.FinishDocument
+
+	imageData, format, cropRegion := session.image, session.format, session.roi
+	if !fromSession {
+		imageData, format, err = processBase64Image(req.Image)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+			return
+		}
+	}
+	var compareData []byte
+	var compareFormat string
+	if compare {
+		compareData, compareFormat, err = processBase64Image(req.CompareImage)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid compare image data: %v", err))
+			return
+		}
+	}
+
+	// Only the region of interest is read, which is both more accurate and
+	// cheaper than the whole frame
+	if req.ROI != nil {
+		if err := req.ROI.Validate(); err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid roi: %v", err))
+			return
+		}
+		cropped, err := imagedata.Crop(imageData, format, *req.ROI)
+		switch {
+		case errors.Is(err, imagedata.ErrCropUnsupported):
+			logger.Printf("Reading the whole %s image: %v", format, err)
+		case err != nil:
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+			return
+		default:
+			imageData = cropped
+			cropRegion = req.ROI
+		}
+	}
+
+	if !fromSession {
+		session = conversation{userID: userID, image: imageData, format: format, roi: cropRegion}
+	}
+
+	// Labels are checked against the user's allergy list, see package
+	// allergens
+	var allergies []string
+	if productPattern.MatchString(req.Text) || ocr.IsReadText(req.Text) {
+		profile, err := allergens.Get(ctx, userID)
+		if err != nil {
+			logger.Printf("Error loading allergens: %v", err)
 		}
-		format = strings.TrimPrefix(metaParts[0], "data:image/")
-		b64Data = parts[1]
-	} else {
-		// Assume it's just base64 data and try to determine format
-		b64Data = base64Image
-		// Default to JPEG if we can't determine format
-		format = "jpeg"
+		allergies = profile.Allergens
 	}
 
-	// Decode base64 data
-	imageData, err := base64.StdEncoding.DecodeString(b64Data)
+	// Answers within a session are kept for follow-up questions, and read
+	// a page at a time
+	respond := func(response Response) {
+		response = convertPrices(ctx, logger, response, req.HomeCurrency, userID)
+		if found := allergens.Check(response.SpeechText+" "+response.OriginalText, allergies); len(found) > 0 {
+			response.Allergens = found
+			response.SpeechText = allergens.Warning(found) + " " + response.SpeechText
+		}
+		answer := response.SpeechText
+		session.unread = nil
+		if paginates(req.SessionID, userID) {
+			pages := paginate(response)
+			response, session.unread = pages[0], pages[1:]
+		}
+		if req.SessionID != "" {
+			saveConversation(req.SessionID, session, req.Text, answer)
+		}
+		respondWithJSON(w, http.StatusOK, response)
+	}
+
+	// Read-text commands are answered by OCR, in a fraction of the model's
+	// time; the model only runs when OCR finds no text. OCR doesn't
+	// locate objects, compare images, keep the rows of a table or stitch
+	// pages.
+	vars := prompts.DefaultVars()
+	var ocrText string
+	var foreignScripts []string
+	// Without Cloud Translation, translating takes the model anyway
+	if ocr.Enabled() && ocr.IsReadText(req.Text) && !req.Locate && !compare && !tableIntent && document == nil && (req.TranslateTo == "" || translate.Enabled()) {
+		text, err := ocr.DetectText(ctx, imageData)
+		foreignScripts = ocr.ForeignScripts(text, vars.Language)
+		switch {
+		case err != nil:
+			logger.Printf("Error detecting text, falling back to the model: %v", err)
+		case text != "" && (len(foreignScripts) == 0 || req.ForeignText == "" || req.ForeignText == foreignRead):
+			speech := ocr.Speech(text)
+			response := Response{SpeechText: speech}
+			if segments := ocr.Segments(speech); len(segments) > 1 {
+				response.Segments = segments
+			}
+			if req.TranslateTo != "" {
+				response = translated(ctx, logger, nil, response, req.TranslateTo)
+			}
+			respond(response)
+			return
+		default:
+			// Transliteration and translation need the model
+			ocrText = text
+		}
+	}
+
+	// Streamed, so an answer cut short by MODEL_TIMEOUT still gives the
+	// user its beginning
+	opts := settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.45,
+		MaxOutputTokens: 1024,
+		Stream:          true,
+	})
+	opts.MaxOutputTokens = verbosity.Tokens(verbosityLevel, opts.MaxOutputTokens, terseTokens)
+	if document != nil {
+		opts.MaxOutputTokens = documentTokens(len(document), opts.MaxOutputTokens)
+	}
+	// A JSON answer is only of use whole
+	if req.Locate || compare || tableIntent {
+		opts.JSON, opts.Stream = true, false
+	}
+	// Product questions are answered from verified data where the model
+	// finds it
+	lookupProducts := !opts.JSON && products.Enabled() && productPattern.MatchString(req.Text)
+	if lookupProducts {
+		opts.Tools = []provider.Tool{lookupProductTool()}
+	}
+	// Daily spend guardrail, for the answers that take the model
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+	model, err := provider.New(ctx, modelName, opts)
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, userID, model)
+
+	vars.Text = req.Text
+	promptName := "object-reader"
+	switch {
+	case compare:
+		promptName = "object-reader/compare"
+	case tableIntent:
+		promptName = "object-reader/table"
+	case document != nil:
+		promptName = "object-reader/document"
+	}
+	prompt, err := prompts.Render(ctx, promptName, promptVersion, vars)
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+
+	parts := []provider.Part{provider.Text(prompt)}
+
+	// The prompt is written for the playful persona
+	if text := persona.Context(); text != "" {
+		parts = append(parts, provider.Text(text))
+	}
+
+	// Mixed-language text, or text the user wants transliterated or
+	// translated
+	if len(foreignScripts) > 0 || req.ForeignText != "" {
+		parts = append(parts, provider.Text(foreignTextContext(req.ForeignText, vars.Language, foreignScripts, ocrText)))
+	}
+
+	// "Where am I" is answered from the scene and the map together
+	if req.Location != nil && places.Enabled() && places.IsWhereAmI(req.Text) {
+		nearby, err := places.Nearby(ctx, req.Location.Lat, req.Location.Lng)
+		if err != nil {
+			// Describe the scene alone
+			logger.Printf("Error looking up places: %v", err)
+		} else {
+			parts = append(parts, provider.Text(places.Context(nearby, req.Location.Heading)))
+		}
+	}
+	if text := verbosityPrompts.Context(verbosityLevel); text != "" {
+		parts = append(parts, provider.Text(text))
+	}
+	if req.Locate {
+		parts = append(parts, provider.Text(locateContext))
+	}
+	if lookupProducts {
+		parts = append(parts, provider.Text(productContext))
+	}
+	if len(allergies) > 0 {
+		parts = append(parts, provider.Text(allergens.Context(allergies)))
+	}
+	if len(session.turns) > 0 {
+		parts = append(parts, provider.Text(historyContext(session.turns)))
+	}
+	switch {
+	case compare:
+		parts = append(parts,
+			provider.Text("Image 1:"), provider.ImageData(format, imageData),
+			provider.Text("Image 2:"), provider.ImageData(compareFormat, compareData),
+		)
+	case document != nil:
+		for i, p := range document {
+			parts = append(parts, provider.Text(fmt.Sprintf("Page %d:", i+1)), provider.ImageData(p.format, p.image))
+		}
+	default:
+		parts = append(parts, provider.ImageData(format, imageData))
+	}
+
+	generateCtx := ctx
+	if cfg.ModelTimeout > 0 {
+		var cancel context.CancelFunc
+		generateCtx, cancel = context.WithTimeout(ctx, cfg.ModelTimeout)
+		defer cancel()
+	}
+	text, err := model.Generate(generateCtx, parts...)
+	truncated := false
+	if sentences := provider.CompleteSentences(text); errors.Is(err, provider.ErrPartial) && sentences != "" {
+		logger.Printf("Answer cut short, speaking its complete sentences: %v", err)
+		text, err, truncated = sentences, nil, true
+	}
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode base64 data: %v", err)
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	// Return response
+	response := Response{
+		SpeechText: text,
+		Truncated:  truncated,
+	}
+	if req.Locate {
+		response.SpeechText, response.Objects, err = parseLocated(text, cropRegion)
+		if err != nil {
+			logger.Printf("Error unmarshaling located objects: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+			return
+		}
+	}
+	if compare {
+		answer, err := parseComparison(text)
+		if err != nil {
+			logger.Printf("Error unmarshaling comparison: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+			return
+		}
+		response.SpeechText, response.Winner, response.Differences = answer.Answer, answer.Winner, answer.Differences
 	}
+	if tableIntent {
+		response.SpeechText, response.Table, err = parseTable(text)
+		if err != nil {
+			logger.Printf("Error unmarshaling table: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+			return
+		}
+	}
+
+	// Travelers hear the answer in their language, and can ask for the
+	// original
+	if req.TranslateTo != "" {
+		response = translated(ctx, logger, model, response, req.TranslateTo)
+	}
+
+	respond(response)
 
-	return imageData, format, nil
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
 }
 
 func printResponse(resp *genai.GenerateContentResponse, logger *log.Logger) {
@@ -271,13 +614,13 @@ func printResponse(resp *genai.GenerateContentResponse, logger *log.Logger) {
 func handleCORS(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
 	w.Header().Set("Access-Control-Max-Age", "3600")
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -299,7 +642,7 @@ func validateAPIKey(r *http.Request) error {
 		return errors.New("missing API key")
 	}
 
-	expectedAPIKey := os.Getenv("API_KEY")
+	expectedAPIKey := config.Get().APIKey
 	if expectedAPIKey == "" {
 		// If API_KEY is not set in environment, log a warning and allow the request
 		log.Println("Warning: API_KEY environment variable not set")
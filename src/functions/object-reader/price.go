@@ -0,0 +1,36 @@
+package objectreader
+
+import (
+	"context"
+	"log"
+
+	"example.com/buddy-paws/internal/currency"
+)
+
+// convertPrices appends the amount in the user's home currency to the
+// foreign prices of the answer, see package currency. home is the one of
+// the request, else the one of the user's profile. The answer is kept as
+// is when conversion fails.
+func convertPrices(ctx context.Context, logger *log.Logger, response Response, home, userID string) Response {
+	if !currency.Enabled() || !currency.HasPrice(response.SpeechText) {
+		return response
+	}
+	if home == "" {
+		var err error
+		if home, err = currency.Home(ctx, userID); err != nil {
+			logger.Printf("Error loading home currency: %v", err)
+			return response
+		}
+		if home == "" {
+			return response
+		}
+	}
+
+	text, conversions, err := currency.Convert(ctx, response.SpeechText, home)
+	if err != nil {
+		logger.Printf("Error converting prices to %s: %v", home, err)
+		return response
+	}
+	response.SpeechText, response.Conversions = text, conversions
+	return response
+}
@@ -0,0 +1,33 @@
+package objectreader
+
+import (
+	"context"
+	"regexp"
+
+	"example.com/buddy-paws/internal/products"
+	"example.com/buddy-paws/internal/provider"
+)
+
+// productPattern matches questions about what a packaged product is or
+// contains, which are answered with verified data when the model can look
+// the product up.
+var productPattern = regexp.MustCompile(`(?i)\b(product|barcode|ingredients?|allergens?|allergic|nutrition(al)?|calories|kcal|sugars?|fat|protein|salt|sodium|carbs?|gluten|lactose|dairy|nuts?|vegan|vegetarian|halal|contains?)\b`)
+
+// productContext tells the model when to call lookupProduct.
+const productContext = `# Product Lookup:
+For a packaged product, call lookupProduct with the barcode digits if a barcode is readable, else with the brand and product name on the label. Prefer the nutrition and allergen data it returns over what you read from a partly visible label, and say it comes from the product database. If it finds nothing, answer from the label and say the product wasn't found. Never guess allergens.`
+
+// lookupProductTool looks a product up for the model, see package products.
+func lookupProductTool() provider.Tool {
+	return provider.Tool{
+		Name:        "lookupProduct",
+		Description: "Looks up the verified name, ingredients, allergens and nutrition facts per 100 g of a packaged product, by barcode or by name.",
+		Parameters: map[string]string{
+			"barcode": "The digits of the barcode, e.g. 5449000000996.",
+			"name":    "The brand and product name, e.g. Coca-Cola Zero, when no barcode is readable.",
+		},
+		Call: func(ctx context.Context, args map[string]string) (interface{}, error) {
+			return products.Lookup(ctx, args["barcode"], args["name"])
+		},
+	}
+}
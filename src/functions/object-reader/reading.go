@@ -0,0 +1,103 @@
+package objectreader
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/ocr"
+	"example.com/buddy-paws/internal/persona"
+)
+
+// maxPageLength bounds the characters of an answer read at once, about half
+// a minute of speech. The rest of a long document is read on request, see
+// Request.ContinueReading.
+const maxPageLength = 600
+
+// endSpeech answers a request to continue reading past the end.
+const endSpeech = "That's the end of the text."
+
+// paginates reports whether long answers to userID are read page by page,
+// which takes a session to continue reading.
+func paginates(sessionID, userID string) bool {
+	return sessionID != "" && userID != "" && config.Get().ConversationTTL > 0
+}
+
+// paginate splits a long answer into pages of whole sentences. The first
+// page has the rest of the response, e.g. its objects or table; the others
+// only their text.
+func paginate(response Response) []Response {
+	texts := pages(response.SpeechText)
+	if len(texts) < 2 {
+		return []Response{response}
+	}
+
+	segmented := len(response.Segments) > 0
+	result := make([]Response, len(texts))
+	for i, text := range texts {
+		page := Response{SpeechText: text}
+		if i == 0 {
+			page = response
+			page.SpeechText = text
+		}
+		page.Segments = nil
+		if segments := ocr.Segments(text); segmented && len(segments) > 1 {
+			page.Segments = segments
+		}
+		page.HasMore = i < len(texts)-1
+		result[i] = page
+	}
+	return result
+}
+
+// pages splits text into pages of at most maxPageLength characters, cut
+// at the end of a sentence as for provider.CompleteSentences. A longer
+// sentence is a page of its own.
+func pages(text string) []string {
+	var result []string
+	start, end := 0, 0 // of the page, and of its last sentence
+	add := func(next int) {
+		if utf8.RuneCountInString(text[start:next]) > maxPageLength && end > start {
+			if page := strings.TrimSpace(text[start:end]); page != "" {
+				result = append(result, page)
+			}
+			start = end
+		}
+		end = next
+	}
+	for i, r := range text {
+		if r != '.' && r != '!' && r != '?' && r != '。' {
+			continue
+		}
+		next := i + utf8.RuneLen(r)
+		if r == '。' || next == len(text) || unicode.IsSpace(rune(text[next])) {
+			add(next)
+		}
+	}
+	add(len(text))
+	if page := strings.TrimSpace(text[start:]); page != "" {
+		result = append(result, page)
+	}
+	return result
+}
+
+// nextPage returns the next unread page of the answers of a session of
+// userID, or the end of the text when all were read. ok is false when the
+// session has expired.
+func nextPage(sessionID, userID string) (response Response, ok bool) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	c, ok := conversations[conversationKey{userID, sessionID}]
+	if !ok || time.Since(c.updatedAt) > config.Get().ConversationTTL {
+		return Response{}, false
+	}
+	c.updatedAt = time.Now()
+	if len(c.unread) == 0 {
+		return Response{SpeechText: persona.Speech(endSpeech)}, true
+	}
+	response, c.unread = c.unread[0], c.unread[1:]
+	return response, true
+}
@@ -0,0 +1,142 @@
+package objectreader
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"example.com/buddy-paws/internal/replaytest"
+	"example.com/buddy-paws/pkg/model"
+)
+
+// replay answers req with the model output of the cassette at
+// testdata/<name>.json.
+func replay(t *testing.T, name string, req Request) Response {
+	t.Helper()
+	return replayAs(t, "", name, req)
+}
+
+// replayAs is replay for the signed-in user uid.
+func replayAs(t *testing.T, uid, name string, req Request) Response {
+	t.Helper()
+	w := replaytest.ServeAs(t, uid, name, "/object-reader", ObjectReader, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var response Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestObjectReaderReplay(t *testing.T) {
+	img := replaytest.Image(t)
+	winner := 1
+
+	tests := []struct {
+		cassette string
+		req      Request
+		want     Response
+	}{
+		{
+			// Streamed, in two chunks
+			cassette: "soup",
+			req:      Request{Image: img, Text: "What is this?"},
+			want:     Response{SpeechText: "Campbell's Tomato Soup, 400 grams. Best before March 2027."},
+		},
+		{
+			// The short row is padded to the columns
+			cassette: "schedule",
+			req:      Request{Image: img, Text: "Read this table"},
+			want: Response{
+				SpeechText: "Medication schedule with 2 medicines. Columns: Medicine, Dose, When. Row 1: Paracetamol, 500 mg, twice daily. Row 2: Vitamin D, 1000 IU, blank.",
+				Table: &model.Table{
+					Columns: []string{"Medicine", "Dose", "When"},
+					Rows:    [][]string{{"Paracetamol", "500 mg", "twice daily"}, {"Vitamin D", "1000 IU", ""}},
+				},
+			},
+		},
+		{
+			cassette: "decaf",
+			req:      Request{Image: img, Text: "Which is decaf?", CompareImage: img},
+			want: Response{
+				SpeechText:  "The first one is decaf: its label says Decaffeinato.",
+				Winner:      &winner,
+				Differences: []string{"Image 1 says Decaffeinato, image 2 doesn't", "Image 1 has a red lid, image 2 a black one"},
+			},
+		},
+		{
+			cassette: "mug",
+			req:      Request{Image: img, Text: "Where is my mug?", Locate: true},
+			want: Response{
+				SpeechText: "A red mug, on the left of the desk.",
+				Objects:    []model.Object{{Name: "red mug", Box: model.Region{X: 0.1, Y: 0.4, W: 0.2, H: 0.3}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cassette, func(t *testing.T) {
+			if got := replay(t, tt.cassette, tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestObjectReaderReplayPages reads a long letter a page at a time.
+func TestObjectReaderReplayPages(t *testing.T) {
+	first := replayAs(t, "alice", "letter", Request{Image: replaytest.Image(t), Text: "Read this letter", SessionID: "replay-letter"})
+	if !first.HasMore || !strings.HasPrefix(first.SpeechText, "A letter from City Water") {
+		t.Fatalf("first page = %+v, want the start of the letter and more", first)
+	}
+
+	pages := []string{first.SpeechText}
+	for more := true; more; {
+		next := replayAs(t, "alice", "letter", Request{SessionID: "replay-letter", ContinueReading: true})
+		pages = append(pages, next.SpeechText)
+		more = next.HasMore
+		if len(pages) > 5 {
+			t.Fatal("pages never end")
+		}
+	}
+	for _, page := range pages {
+		if len([]rune(page)) > maxPageLength {
+			t.Errorf("page of %d characters, want at most %d", len([]rune(page)), maxPageLength)
+		}
+	}
+	if last := pages[len(pages)-1]; !strings.HasSuffix(last, "Thank you.") {
+		t.Errorf("last page = %q, want the end of the letter", last)
+	}
+}
+
+// TestObjectReaderReplaySessionOwner reuses the session ID of another
+// caller, which must not reach their conversation.
+func TestObjectReaderReplaySessionOwner(t *testing.T) {
+	first := replayAs(t, "alice", "letter", Request{Image: replaytest.Image(t), Text: "Read this letter", SessionID: "replay-owner"})
+	if !first.HasMore {
+		t.Fatalf("first page = %+v, want more", first)
+	}
+
+	next := Request{SessionID: "replay-owner", ContinueReading: true}
+	for _, tt := range []struct {
+		uid  string
+		want int
+	}{
+		{uid: "bob", want: http.StatusNotFound},
+		{uid: "", want: http.StatusUnauthorized},
+	} {
+		if w := replaytest.ServeAs(t, tt.uid, "letter", "/object-reader", ObjectReader, next); w.Code != tt.want {
+			t.Errorf("caller %q: status %d, want %d: %s", tt.uid, w.Code, tt.want, w.Body)
+		}
+	}
+
+	// An anonymous answer isn't kept, so it can't replace the conversation
+	replay(t, "letter", Request{Image: replaytest.Image(t), Text: "Read this letter", SessionID: "replay-owner"})
+	if got := replayAs(t, "alice", "letter", next); got.SpeechText == "" || got.SpeechText == first.SpeechText {
+		t.Errorf("second page = %+v, want the page after the first", got)
+	}
+}
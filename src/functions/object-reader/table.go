@@ -0,0 +1,112 @@
+package objectreader
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// intentReadTable reads a table row by row, see Request.Intent.
+const intentReadTable = "read-table"
+
+var intents = map[string]bool{
+	"":              true,
+	intentReadTable: true,
+}
+
+// readTablePattern matches questions asking for a table to be read, e.g.
+// "read this table" or "what's in the chart".
+var readTablePattern = regexp.MustCompile(`(?i)\b(read|what('s|\s+is|\s+does)?\s+(in|on|say))\s+(the|this|that)\s+(table|chart|grid|timetable|schedule)\b`)
+
+// intentOf returns the intent of a request, the one the client gave or
+// else the one of the question.
+func intentOf(intent, text string) string {
+	if intent == "" && readTablePattern.MatchString(text) {
+		return intentReadTable
+	}
+	return intent
+}
+
+// maxSpokenRows is the number of rows of a table read out; the rest are
+// only returned in Response.Table.
+const maxSpokenRows = 20
+
+// tableAnswer is the model's answer to a read-table request.
+type tableAnswer struct {
+	Answer  string     `json:"answer"`
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+// parseTable returns the spoken answer and the table of a read-table
+// request, nil when the model found none. Rows are padded or cut to the
+// number of columns.
+func parseTable(text string) (string, *model.Table, error) {
+	var answer tableAnswer
+	if err := json.Unmarshal([]byte(text), &answer); err != nil {
+		return "", nil, err
+	}
+
+	table := model.Table{Columns: trimCells(answer.Columns)}
+	for _, row := range answer.Rows {
+		row = trimCells(row)
+		if len(table.Columns) > 0 {
+			row = append(row, make([]string, max(len(table.Columns)-len(row), 0))...)[:len(table.Columns)]
+		}
+		if strings.Join(row, "") == "" {
+			continue
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	if len(table.Rows) == 0 {
+		return strings.TrimSpace(answer.Answer), nil, nil
+	}
+	return readTable(answer.Answer, table), &table, nil
+}
+
+func trimCells(cells []string) []string {
+	trimmed := make([]string, len(cells))
+	for i, cell := range cells {
+		trimmed[i] = strings.TrimSpace(cell)
+	}
+	return trimmed
+}
+
+// readTable linearizes a table after the model's introduction, e.g.
+// "Columns: Medicine, Dose, When. Row 1: Paracetamol, 500 mg, twice
+// daily.", with "blank" for an empty cell.
+func readTable(intro string, table model.Table) string {
+	var parts []string
+	if intro = strings.TrimSpace(intro); intro != "" {
+		parts = append(parts, intro)
+	}
+	if len(table.Columns) > 0 {
+		parts = append(parts, fmt.Sprintf("Columns: %s.", spokenCells(table.Columns)))
+	}
+	for i, row := range table.Rows {
+		if i == maxSpokenRows {
+			if more := len(table.Rows) - i; more == 1 {
+				parts = append(parts, "And 1 more row.")
+			} else {
+				parts = append(parts, fmt.Sprintf("And %d more rows.", more))
+			}
+			break
+		}
+		parts = append(parts, fmt.Sprintf("Row %d: %s.", i+1, spokenCells(row)))
+	}
+	return strings.Join(parts, " ")
+}
+
+func spokenCells(cells []string) string {
+	spoken := make([]string, len(cells))
+	for i, cell := range cells {
+		if cell == "" {
+			cell = "blank"
+		}
+		spoken[i] = strings.TrimRight(cell, ".")
+	}
+	return strings.Join(spoken, ", ")
+}
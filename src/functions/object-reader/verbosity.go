@@ -0,0 +1,13 @@
+package objectreader
+
+import "example.com/buddy-paws/internal/verbosity"
+
+// terseTokens divides the output token limit of a terse answer, see
+// verbosity.Tokens.
+const terseTokens = 4
+
+// verbosityPrompts describe the levels of Request.Verbosity.
+var verbosityPrompts = verbosity.Prompts{
+	Terse:    `Answer in one short sentence, with only what the user asked for, e.g. "Tomato soup, 400 grams." Leave out descriptions of the object.`,
+	Detailed: "The user is exploring and wants detail. Answer fully: describe the object, its colors, shape, condition and any text on it, then anything around it that helps the user, in a few sentences.",
+}
@@ -0,0 +1,128 @@
+// Package apierror is the error format of the API: RFC 7807 problem details,
+// served as application/problem+json, with a Code the app can map to a
+// spoken message. Some problems carry that message in SpeechText already.
+//
+//	{
+//	  "type": "urn:buddy-paws:error:image-invalid",
+//	  "title": "Bad Request",
+//	  "status": 400,
+//	  "code": "IMAGE_INVALID",
+//	  "detail": "Invalid image data: illegal base64 data at input byte 4",
+//	  "requestId": "5f0c8c4e2a9b1d7e3f6a0b2c",
+//	  "error": "Invalid image data: illegal base64 data at input byte 4"
+//	}
+//
+// Error repeats Detail for clients written against the former
+// {"error": "..."} bodies. Responses with a Retry-After header, such as
+// 429s, repeat it in RetryAfterMs, for clients that don't read headers.
+package apierror
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Code identifies the kind of error, independently of the wording of
+// Detail.
+type Code string
+
+const (
+	// CodeInvalidRequest is a malformed or invalid request, other than its
+	// image.
+	CodeInvalidRequest Code = "INVALID_REQUEST"
+	// CodeImageInvalid is an image that can't be decoded.
+	CodeImageInvalid    Code = "IMAGE_INVALID"
+	CodeRequestTooLarge Code = "REQUEST_TOO_LARGE"
+	// CodeUnsupportedMediaType is a body that isn't JSON.
+	CodeUnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	CodeUnauthorized         Code = "UNAUTHORIZED"
+	// CodeAuthUnavailable is a token that couldn't be verified for now,
+	// e.g. while Google's keys can't be fetched; a retry may succeed.
+	CodeAuthUnavailable  Code = "AUTH_UNAVAILABLE"
+	CodeForbidden        Code = "FORBIDDEN"
+	CodeMethodNotAllowed Code = "METHOD_NOT_ALLOWED"
+	CodeNotFound         Code = "NOT_FOUND"
+	CodeConflict         Code = "CONFLICT"
+	// CodeIdempotencyKeyReused is an Idempotency-Key sent again with a
+	// different request.
+	CodeIdempotencyKeyReused Code = "IDEMPOTENCY_KEY_REUSED"
+	CodeUnsupportedVersion   Code = "UNSUPPORTED_VERSION"
+	CodeModelNotAllowed      Code = "MODEL_NOT_ALLOWED"
+	// CodeContentBlocked and CodeResponseTruncated are scenes the model
+	// couldn't answer for, see provider.Problem.
+	CodeContentBlocked    Code = "CONTENT_BLOCKED"
+	CodeResponseTruncated Code = "RESPONSE_TRUNCATED"
+	CodeModelTimeout      Code = "MODEL_TIMEOUT"
+	CodeModelUnavailable  Code = "MODEL_UNAVAILABLE"
+	CodeRateLimited       Code = "RATE_LIMITED"
+	CodeBudgetExhausted   Code = "BUDGET_EXHAUSTED"
+	CodeNotConfigured     Code = "NOT_CONFIGURED"
+	CodeShuttingDown      Code = "SHUTTING_DOWN"
+	CodeInternal          Code = "INTERNAL"
+)
+
+// ContentType is the media type of problem details.
+const ContentType = "application/problem+json"
+
+// typePrefix makes Type URIs from codes.
+const typePrefix = "urn:buddy-paws:error:"
+
+// requestIDHeader is the response header package requestid sets.
+const requestIDHeader = "X-Request-ID"
+
+// Problem is an error response.
+type Problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Code       Code   `json:"code"`
+	Detail     string `json:"detail,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	SpeechText string `json:"speechText,omitempty"`
+	// RetryAfterMs is how long to wait before retrying, in milliseconds.
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+	Error        string `json:"error"`
+}
+
+// New returns the problem of the given status and code.
+func New(status int, code Code, detail string) Problem {
+	return Problem{
+		Type:   typePrefix + strings.ReplaceAll(strings.ToLower(string(code)), "_", "-"),
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Error:  detail,
+	}
+}
+
+// WithSpeech returns p with a message the app can speak.
+func (p Problem) WithSpeech(text string) Problem {
+	p.SpeechText = text
+	return p
+}
+
+// Write sends p, with the request ID and the Retry-After delay of the
+// response if it has them.
+func Write(w http.ResponseWriter, p Problem) {
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get(requestIDHeader)
+	}
+	if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && p.RetryAfterMs == 0 {
+		p.RetryAfterMs = int64(seconds) * 1000
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
@@ -0,0 +1,79 @@
+// Package haptic maps guidance to vibration patterns, so a watch or phone
+// can give it with the speech muted, e.g. in loud streets. The mapping is
+// shared by the functions and the client SDK, so both agree on what each
+// pattern means:
+//
+//	triple-long   STOP, a HIGH hazard
+//	short-long    go left
+//	long-short    go right
+//	double-long   CAUTION, a MEDIUM scene without a side to go to
+//	single-short  clear, go straight
+package haptic
+
+import (
+	"regexp"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Pattern names a vibration pattern.
+type Pattern string
+
+const (
+	PatternStop    Pattern = "triple-long"
+	PatternLeft    Pattern = "short-long"
+	PatternRight   Pattern = "long-short"
+	PatternCaution Pattern = "double-long"
+	PatternClear   Pattern = "single-short"
+)
+
+// Pulse lengths, in milliseconds.
+const (
+	short = 100
+	long  = 400
+	gap   = 150
+)
+
+// timings are the patterns as alternating vibration and pause lengths, in
+// milliseconds, starting with a vibration.
+var timings = map[Pattern][]int{
+	PatternStop:    {long, gap, long, gap, long},
+	PatternLeft:    {short, gap, long},
+	PatternRight:   {long, gap, short},
+	PatternCaution: {long, gap, long},
+	PatternClear:   {short},
+}
+
+// Haptic is the vibration for a response. Timings plays it, as for
+// Android's VibrationEffect.createWaveform once a leading 0 delay is added.
+type Haptic struct {
+	Pattern Pattern `json:"pattern"`
+	Timings []int   `json:"timings"`
+}
+
+var (
+	stopPattern  = regexp.MustCompile(`(?i)^\s*stop\b`)
+	leftPattern  = regexp.MustCompile(`(?i)\bleft\b`)
+	rightPattern = regexp.MustCompile(`(?i)\bright\b`)
+)
+
+// For returns the vibration for guidance of the given severity, nil for an
+// unchanged scene, which has nothing new to say.
+func For(severity model.Severity, guidance string) *Haptic {
+	var p Pattern
+	switch {
+	case severity == model.SeverityUnchanged:
+		return nil
+	case severity == model.SeverityHigh || stopPattern.MatchString(guidance):
+		p = PatternStop
+	case leftPattern.MatchString(guidance) && !rightPattern.MatchString(guidance):
+		p = PatternLeft
+	case rightPattern.MatchString(guidance) && !leftPattern.MatchString(guidance):
+		p = PatternRight
+	case severity == model.SeverityMedium:
+		p = PatternCaution
+	default:
+		p = PatternClear
+	}
+	return &Haptic{Pattern: p, Timings: timings[p]}
+}
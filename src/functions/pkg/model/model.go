@@ -0,0 +1,225 @@
+// Package model is the vocabulary shared by the functions and the client
+// SDK. Its types validate JSON: values are normalized to upper case and
+// unknown values are rejected, so an off-script model answer fails to decode
+// instead of reaching the user.
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Severity is how urgently a hazard needs the user's attention.
+type Severity string
+
+const (
+	SeverityLow    Severity = "LOW"
+	SeverityMedium Severity = "MEDIUM"
+	SeverityHigh   Severity = "HIGH"
+	// SeverityUnchanged is the severity of a session frame showing the same
+	// view as the previous one. The previous guidance still applies.
+	SeverityUnchanged Severity = "UNCHANGED"
+)
+
+// ParseSeverity returns the severity named by s, in any case.
+func ParseSeverity(s string) (Severity, error) {
+	switch v := Severity(strings.ToUpper(strings.TrimSpace(s))); v {
+	case SeverityLow, SeverityMedium, SeverityHigh, SeverityUnchanged:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown severity %q", s)
+	}
+}
+
+// Rank orders severities from LOW (1) to HIGH (3); other values are 0.
+func (s Severity) Rank() int {
+	switch s {
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 2
+	case SeverityLow:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (s *Severity) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	v, err := ParseSeverity(raw)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// Position is where a hazard is relative to the user's path.
+type Position string
+
+const (
+	PositionFront Position = "FRONT"
+	PositionLeft  Position = "LEFT"
+	PositionRight Position = "RIGHT"
+)
+
+// ParsePosition returns the position named by s, in any case.
+func ParsePosition(s string) (Position, error) {
+	switch v := Position(strings.ToUpper(strings.TrimSpace(s))); v {
+	case PositionFront, PositionLeft, PositionRight:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown position %q", s)
+	}
+}
+
+func (p *Position) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	v, err := ParsePosition(raw)
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// Category is a hazard category of the detect-hazards prompt, as given in
+// the Type of a Hazard.
+type Category string
+
+const (
+	CategoryPathObstructions     Category = "Path Obstructions"
+	CategoryGroundConditions     Category = "Ground Conditions"
+	CategoryEnvironmentalHazards Category = "Environmental Hazards"
+	CategoryProximityHazards     Category = "Proximity Hazards"
+)
+
+// Categories are the hazard categories, in the order of the prompt.
+var Categories = []Category{
+	CategoryPathObstructions,
+	CategoryGroundConditions,
+	CategoryEnvironmentalHazards,
+	CategoryProximityHazards,
+}
+
+// CategoryOf returns the category a hazard type names, in any case and
+// number, e.g. "proximity hazard", and false for other types.
+func CategoryOf(hazardType string) (Category, bool) {
+	lower := strings.ToLower(hazardType)
+	switch {
+	case strings.Contains(lower, "obstruction"):
+		return CategoryPathObstructions, true
+	case strings.Contains(lower, "ground"):
+		return CategoryGroundConditions, true
+	case strings.Contains(lower, "environment"):
+		return CategoryEnvironmentalHazards, true
+	case strings.Contains(lower, "proximity"):
+		return CategoryProximityHazards, true
+	default:
+		return "", false
+	}
+}
+
+// Hazard is a detected hazard as returned to clients. ID identifies the
+// hazard across the frames of a session. Steps is the estimated distance in
+// walking steps and MetersRange the model's estimate in meters, e.g. "1-2",
+// unless Measured is set: the distance is then measured by the phone's depth
+// sensor, e.g. "2.4". Confidence is from 0 to 1. Clock is the position as
+// the hour on a clock face, 12 straight ahead, for clients asking for clock
+// positions. Bearing is the direction in degrees off the camera axis,
+// negative to the left. Box is where the hazard is in the frame, for an
+// on-screen highlight.
+type Hazard struct {
+	ID          string   `json:"id,omitempty"`
+	Position    Position `json:"position"`
+	Clock       int      `json:"clock,omitempty"`
+	Bearing     *int     `json:"bearingDegrees,omitempty"`
+	Type        string   `json:"type"`
+	Severity    Severity `json:"severity"`
+	Description string   `json:"description"`
+	Steps       *int     `json:"steps,omitempty"`
+	MetersRange string   `json:"metersRange,omitempty"`
+	Confidence  *float64 `json:"confidence,omitempty"`
+	Measured    bool     `json:"measured,omitempty"`
+	Box         *Region  `json:"box,omitempty"`
+}
+
+// Feature is a mapped place near the user that matters for walking, e.g. a
+// pedestrian crossing or a stairway. Direction is relative to the way the
+// user faces, e.g. "ahead" or "to the left".
+type Feature struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name,omitempty"`
+	Meters    int    `json:"meters"`
+	Direction string `json:"direction"`
+}
+
+// Region is a rectangle of an image, in fractions of its width and height
+// from the top left corner, e.g. {0.25, 0.25, 0.5, 0.5} for the middle.
+type Region struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// Validate reports whether r lies within the image and isn't empty.
+func (r Region) Validate() error {
+	switch {
+	case r.X < 0 || r.Y < 0 || r.X >= 1 || r.Y >= 1:
+		return fmt.Errorf("region origin (%g, %g) outside the image", r.X, r.Y)
+	case r.W <= 0 || r.H <= 0:
+		return fmt.Errorf("empty region %gx%g", r.W, r.H)
+	case r.X+r.W > 1+regionTolerance || r.Y+r.H > 1+regionTolerance:
+		return errors.New("region extends outside the image")
+	}
+	return nil
+}
+
+// Within maps r, a region of the part outer of an image, to a region of
+// the whole image.
+func (r Region) Within(outer Region) Region {
+	return Region{
+		X: outer.X + r.X*outer.W,
+		Y: outer.Y + r.Y*outer.H,
+		W: r.W * outer.W,
+		H: r.H * outer.H,
+	}
+}
+
+// Object is a thing an answer is about and where it is in the image, so
+// the app can highlight it or zoom in on it.
+type Object struct {
+	Name string `json:"name"`
+	Box  Region `json:"box"`
+}
+
+// Table is a table read from an image. Columns are the column headers,
+// empty when the table has none, and each row has a cell per column, ""
+// for an empty cell.
+type Table struct {
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+// Conversion is a price read in a foreign currency, e.g. "¥1,200", and
+// its amount in the user's home currency. Currencies are ISO 4217 codes.
+type Conversion struct {
+	Price        string  `json:"price"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+	Converted    float64 `json:"converted"`
+	HomeCurrency string  `json:"homeCurrency"`
+}
+
+// regionTolerance absorbs the rounding of regions computed by clients.
+const regionTolerance = 0.01
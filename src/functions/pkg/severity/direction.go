@@ -0,0 +1,156 @@
+package severity
+
+import (
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// maxDirectionLength is the longest safe_direction accepted. Longer output
+// is the model rambling, not a command.
+const maxDirectionLength = 200
+
+var (
+	// prefixPattern matches the urgency prefix the TTS layer keys on, in any
+	// case and with the variants the model sometimes produces.
+	prefixPattern = regexp.MustCompile(`(?i)^(stop|caution|cautious|cautiously|slow)\b[\s.,:!-]*`)
+	// directionPattern matches the unprefixed commands of the prompt.
+	directionPattern = regexp.MustCompile(`(?i)^(left|right|straight|move slightly to the (left|right)|crosswalk in front of you|please find assistance)\b`)
+	// markupPattern matches characters that never belong in speech, left
+	// over from JSON or markdown.
+	markupPattern = regexp.MustCompile("[{}\\[\\]<>*#_`|]")
+)
+
+// defaultDirections replace guidance that can't be salvaged, by severity.
+var defaultDirections = map[model.Severity]string{
+	model.SeverityHigh:   "STOP. Hazard ahead.",
+	model.SeverityMedium: "CAUTION, proceed carefully.",
+	model.SeverityLow:    "STRAIGHT",
+}
+
+// Normalize checks guidance against the command grammar of the prompts: a
+// STOP, CAUTION or SLOW prefix, or one of the direction commands. It
+// returns the guidance in the canonical form, and false when it was out of
+// vocabulary: such guidance gets the prefix its severity calls for, and
+// output that isn't guidance at all is replaced.
+func Normalize(direction string, severity model.Severity) (string, bool) {
+	trimmed := strings.TrimSpace(direction)
+
+	if trimmed == "" || len(trimmed) > maxDirectionLength || markupPattern.MatchString(trimmed) {
+		if fallback, ok := defaultDirections[severity]; ok {
+			return fallback, false
+		}
+		return defaultDirections[model.SeverityMedium], false
+	}
+
+	if m := prefixPattern.FindStringSubmatch(trimmed); m != nil {
+		rest := strings.TrimSpace(trimmed[len(m[0]):])
+		return canonicalPrefix(m[1], rest), true
+	}
+
+	if directionPattern.MatchString(trimmed) {
+		return trimmed, true
+	}
+
+	if severity == model.SeverityHigh {
+		return "STOP. " + trimmed, false
+	}
+	return "CAUTION, " + trimmed, false
+}
+
+// canonicalPrefix writes the prefix the way the prompt does: "STOP. rest",
+// "CAUTION, rest" and "SLOW, rest".
+func canonicalPrefix(prefix, rest string) string {
+	prefix = strings.ToUpper(prefix)
+	if strings.HasPrefix(prefix, "CAUTIOUS") {
+		prefix = "CAUTION"
+	}
+
+	if rest == "" {
+		return prefix
+	}
+	if prefix == "STOP" {
+		return "STOP. " + rest
+	}
+	return prefix + ", " + rest
+}
+
+// maxReasonLength bounds the hazard description spoken after a STOP added
+// by Reconcile.
+const maxReasonLength = 60
+
+// Reconcile applies the rules of the prompts that tie guidance to the
+// hazards, which the model doesn't always follow. direction must be
+// canonical, see Normalize.
+//
+//   - A HIGH hazard, other than a crosswalk, calls for a STOP naming it, and
+//     a HIGH severity. A CAUTION or SLOW prefix is replaced, and a bare
+//     STRAIGHT dropped.
+//   - Otherwise the prefix raises the severity, see Safeguard. A STOP
+//     stands without a HIGH hazard, as the prompts also use it at a red
+//     pedestrian light.
+//
+// It returns the reconciled direction and severity, and whether either
+// changed.
+func Reconcile(direction string, severity model.Severity, hazards []model.Hazard) (string, model.Severity, bool) {
+	original := direction
+
+	if !strings.HasPrefix(direction, "STOP") {
+		for _, hazard := range hazards {
+			if hazard.Severity != model.SeverityHigh || isCrosswalk(hazard) {
+				continue
+			}
+			rest := direction
+			if m := prefixPattern.FindString(direction); m != "" {
+				rest = strings.TrimSpace(direction[len(m):])
+			}
+			if strings.EqualFold(rest, "STRAIGHT") {
+				rest = ""
+			}
+			// Each sentence starts with a capital, as the TTS reads it
+			direction = strings.TrimSpace("STOP. " + stopReason(hazard) + " " + capitalize(rest))
+			return direction, model.SeverityHigh, true
+		}
+	}
+
+	if safeguarded := Safeguard(severity, direction); safeguarded != severity {
+		return direction, safeguarded, true
+	}
+	return direction, severity, direction != original
+}
+
+// stopReason shortens the description of a hazard to a sentence fit to
+// follow a STOP, e.g. "Open manhole ahead."
+func stopReason(hazard model.Hazard) string {
+	reason := strings.TrimSpace(hazard.Description)
+	if m := prefixPattern.FindString(reason); m != "" {
+		reason = strings.TrimSpace(reason[len(m):])
+	}
+	if i := strings.IndexAny(reason, ".!?"); i >= 0 {
+		reason = reason[:i]
+	}
+	if len(reason) > maxReasonLength {
+		// Cut at a word boundary
+		reason = reason[:strings.LastIndex(reason[:maxReasonLength], " ")+1]
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return "Hazard ahead."
+	}
+	return capitalize(reason) + "."
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// isCrosswalk reports whether hazard is a crosswalk, whose guidance follows
+// the crosswalk rules of the prompt rather than the STOP rule.
+func isCrosswalk(hazard model.Hazard) bool {
+	text := strings.ToLower(hazard.Type + " " + hazard.Description)
+	return strings.Contains(text, "crosswalk") || strings.Contains(text, "crossing")
+}
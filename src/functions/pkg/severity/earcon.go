@@ -0,0 +1,39 @@
+package severity
+
+import (
+	"strings"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Earcon is a short sound a client plays at once, before the guidance is
+// spoken, so the user can react to a STOP without waiting for the sentence.
+type Earcon string
+
+const (
+	EarconStop      Earcon = "stop"
+	EarconCaution   Earcon = "caution"
+	EarconClear     Earcon = "clear"
+	EarconCrosswalk Earcon = "crosswalk"
+)
+
+// EarconOf returns the earcon of guidance given with severity: stop for
+// HIGH, crosswalk for other guidance about a crosswalk, caution for MEDIUM
+// and clear otherwise. An unchanged scene has none.
+func EarconOf(severity model.Severity, guidance string) Earcon {
+	if severity == model.SeverityUnchanged {
+		return ""
+	}
+
+	lower := strings.ToLower(guidance)
+	switch severity = Safeguard(severity, guidance); {
+	case severity == model.SeverityHigh:
+		return EarconStop
+	case strings.Contains(lower, "crosswalk") || strings.Contains(lower, "crossing"):
+		return EarconCrosswalk
+	case severity == model.SeverityMedium:
+		return EarconCaution
+	default:
+		return EarconClear
+	}
+}
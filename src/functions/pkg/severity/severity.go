@@ -0,0 +1,68 @@
+// Package severity ties the severity of a scene to the spoken guidance, so
+// that every function telling the user to stop or go decides the same way.
+// The TTS layer keys on the guidance prefix: "STOP. " for HIGH, "CAUTION, "
+// or "SLOW, " for MEDIUM, and none for LOW.
+//
+// Severity only ever goes up. Safeguard combines the severity the model
+// reported with the one its guidance calls for:
+//
+//	reported \ prefix | none   | CAUTION, SLOW | STOP
+//	------------------+--------+---------------+-----
+//	none or unknown   | LOW    | MEDIUM        | HIGH
+//	LOW               | LOW    | MEDIUM        | HIGH
+//	MEDIUM            | MEDIUM | MEDIUM        | MEDIUM
+//	HIGH              | HIGH   | HIGH          | HIGH
+//
+// A MEDIUM the model reported is kept, as detect-hazards always did: a
+// STOP alone, e.g. at a red pedestrian light, doesn't make the scene HIGH.
+//
+// Guidance is put in canonical form by Normalize, and made to agree with
+// the hazards by Reconcile. EarconOf picks the sound played before it.
+package severity
+
+import (
+	"strings"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+// Of returns the severity a guidance prefix calls for: HIGH for STOP, MEDIUM
+// for CAUTION and SLOW, and LOW otherwise.
+func Of(guidance string) model.Severity {
+	upper := strings.ToUpper(strings.TrimSpace(guidance))
+	switch {
+	case strings.HasPrefix(upper, "STOP"):
+		return model.SeverityHigh
+	case strings.HasPrefix(upper, "CAUTION"), strings.HasPrefix(upper, "SLOW"):
+		return model.SeverityMedium
+	default:
+		return model.SeverityLow
+	}
+}
+
+// Safeguard returns the severity to report for guidance the model gave with
+// reported: reported when it is MEDIUM or HIGH, else Of(guidance), see the
+// package documentation.
+func Safeguard(reported model.Severity, guidance string) model.Severity {
+	if reported == model.SeverityMedium {
+		return reported
+	}
+	if prefixed := Of(guidance); prefixed.Rank() > reported.Rank() {
+		return prefixed
+	}
+	return reported
+}
+
+// Guidance prefixes text the way severity calls for: "STOP. text" for HIGH,
+// "CAUTION, text" for MEDIUM, and text alone otherwise.
+func Guidance(severity model.Severity, text string) string {
+	text = strings.TrimSpace(text)
+	switch severity {
+	case model.SeverityHigh:
+		return canonicalPrefix("STOP", text)
+	case model.SeverityMedium:
+		return canonicalPrefix("CAUTION", text)
+	default:
+		return text
+	}
+}
@@ -0,0 +1,184 @@
+package severity
+
+import (
+	"testing"
+
+	"example.com/buddy-paws/pkg/model"
+)
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		guidance string
+		want     model.Severity
+	}{
+		{"", model.SeverityLow},
+		{"STRAIGHT", model.SeverityLow},
+		{"Left", model.SeverityLow},
+		{"Crosswalk in front of you", model.SeverityLow},
+		{"SLOW, wet floor", model.SeverityMedium},
+		{"slow down", model.SeverityMedium},
+		{"CAUTION, step ahead", model.SeverityMedium},
+		{"  caution, step ahead", model.SeverityMedium},
+		{"STOP. Car ahead.", model.SeverityHigh},
+		{"stop", model.SeverityHigh},
+		{"Go left to stop at the door", model.SeverityLow},
+	}
+	for _, tt := range tests {
+		if got := Of(tt.guidance); got != tt.want {
+			t.Errorf("Of(%q) = %s, want %s", tt.guidance, got, tt.want)
+		}
+	}
+}
+
+func TestRankOrder(t *testing.T) {
+	// In increasing order of urgency
+	order := []model.Severity{"", model.SeverityLow, model.SeverityMedium, model.SeverityHigh}
+	for i, lower := range order {
+		for _, higher := range order[i+1:] {
+			if lower.Rank() >= higher.Rank() {
+				t.Errorf("%q ranks %d, not below %q at %d", lower, lower.Rank(), higher, higher.Rank())
+			}
+		}
+	}
+	if got := model.SeverityUnchanged.Rank(); got != 0 {
+		t.Errorf("UNCHANGED ranks %d, want 0", got)
+	}
+}
+
+// TestSafeguard covers the table of the package documentation.
+func TestSafeguard(t *testing.T) {
+	guidance := map[string]string{
+		"none":    "Left",
+		"CAUTION": "CAUTION, step ahead",
+		"SLOW":    "SLOW, wet floor",
+		"STOP":    "STOP. Car ahead.",
+	}
+	tests := []struct {
+		reported model.Severity
+		want     map[string]model.Severity
+	}{
+		{"", map[string]model.Severity{"none": model.SeverityLow, "CAUTION": model.SeverityMedium, "SLOW": model.SeverityMedium, "STOP": model.SeverityHigh}},
+		{"EXTREME", map[string]model.Severity{"none": model.SeverityLow, "CAUTION": model.SeverityMedium, "SLOW": model.SeverityMedium, "STOP": model.SeverityHigh}},
+		{model.SeverityLow, map[string]model.Severity{"none": model.SeverityLow, "CAUTION": model.SeverityMedium, "SLOW": model.SeverityMedium, "STOP": model.SeverityHigh}},
+		{model.SeverityMedium, map[string]model.Severity{"none": model.SeverityMedium, "CAUTION": model.SeverityMedium, "SLOW": model.SeverityMedium, "STOP": model.SeverityMedium}},
+		{model.SeverityHigh, map[string]model.Severity{"none": model.SeverityHigh, "CAUTION": model.SeverityHigh, "SLOW": model.SeverityHigh, "STOP": model.SeverityHigh}},
+	}
+	for _, tt := range tests {
+		for prefix, text := range guidance {
+			if got := Safeguard(tt.reported, text); got != tt.want[prefix] {
+				t.Errorf("Safeguard(%q, %q) = %s, want %s", tt.reported, text, got, tt.want[prefix])
+			}
+		}
+	}
+}
+
+func TestGuidance(t *testing.T) {
+	tests := []struct {
+		severity model.Severity
+		text     string
+		want     string
+	}{
+		{model.SeverityHigh, "Car ahead.", "STOP. Car ahead."},
+		{model.SeverityHigh, "", "STOP"},
+		{model.SeverityMedium, " Step ahead. ", "CAUTION, Step ahead."},
+		{model.SeverityLow, "Path is clear.", "Path is clear."},
+		{"", "Path is clear.", "Path is clear."},
+	}
+	for _, tt := range tests {
+		got := Guidance(tt.severity, tt.text)
+		if got != tt.want {
+			t.Errorf("Guidance(%s, %q) = %q, want %q", tt.severity, tt.text, got, tt.want)
+		}
+		// Guidance calls for the severity it was written for
+		if want := max(tt.severity.Rank(), model.SeverityLow.Rank()); Of(got).Rank() != want {
+			t.Errorf("Of(Guidance(%s, %q)) ranks %d, want %d", tt.severity, tt.text, Of(got).Rank(), want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		direction string
+		severity  model.Severity
+		want      string
+		ok        bool
+	}{
+		{"STOP. Car ahead.", model.SeverityHigh, "STOP. Car ahead.", true},
+		{"stop: car ahead", model.SeverityHigh, "STOP. car ahead", true},
+		{"Cautiously, step ahead", model.SeverityMedium, "CAUTION, step ahead", true},
+		{"slow - wet floor", model.SeverityMedium, "SLOW, wet floor", true},
+		{"CAUTION", model.SeverityMedium, "CAUTION", true},
+		{"Move slightly to the left", model.SeverityLow, "Move slightly to the left", true},
+		{"STRAIGHT", model.SeverityLow, "STRAIGHT", true},
+		{"Car ahead", model.SeverityHigh, "STOP. Car ahead", false},
+		{"Step ahead", model.SeverityMedium, "CAUTION, Step ahead", false},
+		{"Step ahead", model.SeverityLow, "CAUTION, Step ahead", false},
+		{"", model.SeverityHigh, "STOP. Hazard ahead.", false},
+		{"", model.SeverityMedium, "CAUTION, proceed carefully.", false},
+		{"", model.SeverityLow, "STRAIGHT", false},
+		{"", "", "CAUTION, proceed carefully.", false},
+		{`{"safe_direction": "Left"}`, model.SeverityLow, "STRAIGHT", false},
+	}
+	for _, tt := range tests {
+		got, ok := Normalize(tt.direction, tt.severity)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Normalize(%q, %s) = %q, %v, want %q, %v", tt.direction, tt.severity, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	manhole := model.Hazard{Type: "Open manhole", Severity: model.SeverityHigh, Description: "CAUTION, open manhole ahead. Go around it."}
+	crosswalk := model.Hazard{Type: "Crosswalk", Severity: model.SeverityHigh, Description: "Crosswalk ahead."}
+	step := model.Hazard{Type: "Step", Severity: model.SeverityMedium, Description: "Step down."}
+
+	tests := []struct {
+		name         string
+		direction    string
+		severity     model.Severity
+		hazards      []model.Hazard
+		wantDir      string
+		wantSeverity model.Severity
+		wantChanged  bool
+	}{
+		{"agreeing", "STOP. Car ahead.", model.SeverityHigh, nil, "STOP. Car ahead.", model.SeverityHigh, false},
+		{"high hazard replaces caution", "CAUTION, go left", model.SeverityMedium, []model.Hazard{manhole}, "STOP. Open manhole ahead. Go left", model.SeverityHigh, true},
+		{"high hazard drops straight", "STRAIGHT", model.SeverityLow, []model.Hazard{manhole}, "STOP. Open manhole ahead.", model.SeverityHigh, true},
+		{"crosswalk keeps its rules", "Crosswalk in front of you", model.SeverityHigh, []model.Hazard{crosswalk}, "Crosswalk in front of you", model.SeverityHigh, false},
+		{"prefix raises severity", "CAUTION, step down", model.SeverityLow, []model.Hazard{step}, "CAUTION, step down", model.SeverityMedium, true},
+		{"stop without a high hazard", "STOP. Red light.", model.SeverityLow, nil, "STOP. Red light.", model.SeverityHigh, true},
+		{"stop keeps a reported medium", "STOP. Red light.", model.SeverityMedium, nil, "STOP. Red light.", model.SeverityMedium, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, sev, changed := Reconcile(tt.direction, tt.severity, tt.hazards)
+			if dir != tt.wantDir || sev != tt.wantSeverity || changed != tt.wantChanged {
+				t.Errorf("Reconcile(%q, %s) = %q, %s, %v, want %q, %s, %v", tt.direction, tt.severity, dir, sev, changed, tt.wantDir, tt.wantSeverity, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestEarconOf(t *testing.T) {
+	tests := []struct {
+		severity model.Severity
+		guidance string
+		want     Earcon
+	}{
+		{model.SeverityUnchanged, "STOP. Car ahead.", ""},
+		{model.SeverityHigh, "STOP. Car ahead.", EarconStop},
+		{model.SeverityHigh, "Crosswalk in front of you", EarconStop},
+		{model.SeverityLow, "STOP. Red light.", EarconStop},
+		{model.SeverityMedium, "CAUTION, crosswalk ahead", EarconCrosswalk},
+		{model.SeverityLow, "Crossing in front of you", EarconCrosswalk},
+		{model.SeverityMedium, "CAUTION, step ahead", EarconCaution},
+		{model.SeverityLow, "SLOW, wet floor", EarconCaution},
+		{model.SeverityLow, "STRAIGHT", EarconClear},
+		{"", "Left", EarconClear},
+	}
+	for _, tt := range tests {
+		if got := EarconOf(tt.severity, tt.guidance); got != tt.want {
+			t.Errorf("EarconOf(%s, %q) = %q, want %q", tt.severity, tt.guidance, got, tt.want)
+		}
+	}
+}
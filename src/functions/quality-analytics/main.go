@@ -0,0 +1,207 @@
+// Package qualityanalytics serves the guidance quality analytics of package
+// analytics: AggregateQuality rolls up a day, and is meant to be called
+// daily by Cloud Scheduler; QualitySummary returns the rolled-up quality
+// per function and prompt version, for prompt tuning.
+package qualityanalytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/buddy-paws/internal/analytics"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// AggregateRequest selects the UTC day to aggregate, "2006-01-02"; it
+// defaults to yesterday. Scheduler jobs can send an empty body.
+type AggregateRequest struct {
+	Day string `json:"day,omitempty"`
+}
+
+type AggregateResponse struct {
+	Day string `json:"day"`
+}
+
+type SummaryResponse struct {
+	Days    int                 `json:"days"`
+	Quality []analytics.Quality `json:"quality"`
+}
+
+const (
+	defaultSummaryDays = 7
+	maxSummaryDays     = 90
+)
+
+// AggregateQuality is the Cloud Function entry point of the daily rollup.
+func AggregateQuality(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "aggregate-quality"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req AggregateRequest
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+	}
+
+	day := time.Now().UTC().AddDate(0, 0, -1)
+	if req.Day != "" {
+		day, err = time.Parse("2006-01-02", req.Day)
+		if err != nil || day.After(time.Now()) {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid day")
+			return
+		}
+	}
+
+	err = analytics.Aggregate(ctx, day)
+	if errors.Is(err, analytics.ErrDisabled) {
+		respondWithError(w, http.StatusNotImplemented, apierror.CodeNotConfigured, "Analytics not configured")
+		return
+	}
+	if err != nil {
+		logger.Printf("Error aggregating quality: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error aggregating quality")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, AggregateResponse{Day: day.Format("2006-01-02")})
+}
+
+// QualitySummary is the Cloud Function entry point of the summary:
+// GET ?days=N adds up the last N days, 7 by default.
+func QualitySummary(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "quality-summary"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	days := defaultSummaryDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxSummaryDays {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid days")
+			return
+		}
+	}
+
+	quality, err := analytics.Summary(ctx, days)
+	if errors.Is(err, analytics.ErrDisabled) {
+		respondWithError(w, http.StatusNotImplemented, apierror.CodeNotConfigured, "Analytics not configured")
+		return
+	}
+	if err != nil {
+		logger.Printf("Error loading quality summary: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading quality summary")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, SummaryResponse{Days: days, Quality: quality})
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "X-API-Key, X-Request-ID")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
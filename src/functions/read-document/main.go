@@ -0,0 +1,410 @@
+package readdocument
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request carries either a new image to analyze or a document returned by a
+// previous call, together with the spoken command to apply to it.
+type Request struct {
+	Image    string    `json:"image"`
+	Text     string    `json:"text"`
+	Document *Document `json:"document,omitempty"`
+	Model    string    `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string    `json:"speechText"`
+	Document   *Document `json:"document"`
+}
+
+// Document is the structured content of a photographed document. Sections and
+// their blocks are listed in reading order.
+type Document struct {
+	Title    string    `json:"title"`
+	Sections []Section `json:"sections"`
+}
+
+type Section struct {
+	Heading string  `json:"heading"`
+	Blocks  []Block `json:"blocks"`
+}
+
+// Block is a single paragraph, list or table inside a section.
+type Block struct {
+	Type  string     `json:"type"`
+	Text  string     `json:"text,omitempty"`
+	Items []string   `json:"items,omitempty"`
+	Rows  [][]string `json:"rows,omitempty"`
+}
+
+const (
+	BlockParagraph = "paragraph"
+	BlockList      = "list"
+	BlockTable     = "table"
+)
+
+// ReadDocument is the Cloud Function entry point
+func ReadDocument(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-document"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Follow-up commands operate on the document returned by a previous call
+	if req.Image == "" {
+		if req.Document == nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Either image or document is required")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, Response{
+			SpeechText: readCommand(req.Document, req.Text),
+			Document:   req.Document,
+		})
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.2,
+		MaxOutputTokens: 4096,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-document", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var document Document
+	err = json.Unmarshal([]byte(jsonStr), &document)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	response := Response{
+		SpeechText: readCommand(&document, req.Text),
+		Document:   &document,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+var (
+	sectionCommand  = regexp.MustCompile(`\bsection\s+(.+)$`)
+	headingsCommand = regexp.MustCompile(`\b(headings|headers|sections|contents)\b`)
+	titleCommand    = regexp.MustCompile(`\b(title|heading)\b`)
+)
+
+var numberWords = map[string]int{
+	"one": 1, "first": 1,
+	"two": 2, "second": 2,
+	"three": 3, "third": 3,
+	"four": 4, "fourth": 4,
+	"five": 5, "fifth": 5,
+	"six": 6, "sixth": 6,
+	"seven": 7, "seventh": 7,
+	"eight": 8, "eighth": 8,
+	"nine": 9, "ninth": 9,
+	"ten": 10, "tenth": 10,
+}
+
+// readCommand renders the part of the document requested by the spoken
+// command. Unrecognized commands read the whole document.
+func readCommand(document *Document, text string) string {
+	if document.Title == "" && len(document.Sections) == 0 {
+		return persona.Speech("Oops! Buddy couldn't find a document in this image. Hold your device steady over the page.")
+	}
+
+	command := strings.ToLower(strings.TrimSpace(text))
+	command = strings.TrimRight(command, ".?!")
+
+	if match := sectionCommand.FindStringSubmatch(command); match != nil {
+		index, ok := findSection(document, match[1])
+		if !ok {
+			return persona.Speech(fmt.Sprintf("Buddy couldn't find section %s. %s", match[1], listHeadings(document)))
+		}
+		return readSection(document.Sections[index], index)
+	}
+
+	if headingsCommand.MatchString(command) {
+		return listHeadings(document)
+	}
+
+	if titleCommand.MatchString(command) {
+		if document.Title == "" {
+			return "This document has no title."
+		}
+		return fmt.Sprintf("The title is: %s.", document.Title)
+	}
+
+	return readAll(document)
+}
+
+// findSection resolves a spoken section reference, either a number ("2",
+// "two", "second") or words from the section heading.
+func findSection(document *Document, ref string) (int, bool) {
+	ref = strings.TrimSpace(ref)
+
+	n, err := strconv.Atoi(ref)
+	if err != nil {
+		n = numberWords[ref]
+	}
+	if n > 0 {
+		if n > len(document.Sections) {
+			return 0, false
+		}
+		return n - 1, true
+	}
+
+	for i, section := range document.Sections {
+		if section.Heading != "" && strings.Contains(strings.ToLower(section.Heading), ref) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func listHeadings(document *Document) string {
+	var headings []string
+	for i, section := range document.Sections {
+		if section.Heading == "" {
+			continue
+		}
+		headings = append(headings, fmt.Sprintf("Section %d: %s.", i+1, section.Heading))
+	}
+
+	if len(headings) == 0 {
+		return fmt.Sprintf("This document has %d sections without headings.", len(document.Sections))
+	}
+
+	return fmt.Sprintf("This document has %d sections. %s", len(document.Sections), strings.Join(headings, " "))
+}
+
+func readAll(document *Document) string {
+	var parts []string
+	if document.Title != "" {
+		parts = append(parts, document.Title+".")
+	}
+	for i, section := range document.Sections {
+		parts = append(parts, readSection(section, i))
+	}
+	return strings.Join(parts, " ")
+}
+
+func readSection(section Section, index int) string {
+	var parts []string
+	if section.Heading != "" {
+		parts = append(parts, fmt.Sprintf("Section %d: %s.", index+1, section.Heading))
+	}
+
+	for _, block := range section.Blocks {
+		switch block.Type {
+		case BlockList:
+			for i, item := range block.Items {
+				parts = append(parts, fmt.Sprintf("Item %d: %s.", i+1, item))
+			}
+		case BlockTable:
+			parts = append(parts, readTable(block.Rows))
+		default:
+			if block.Text != "" {
+				parts = append(parts, block.Text)
+			}
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// readTable linearizes a table row by row, naming each cell after its column
+// header so the reading makes sense without seeing the grid.
+func readTable(rows [][]string) string {
+	if len(rows) == 0 {
+		return ""
+	}
+
+	header := rows[0]
+	parts := []string{fmt.Sprintf("Table with %d rows. Columns: %s.", len(rows)-1, strings.Join(header, ", "))}
+	for i, row := range rows[1:] {
+		var cells []string
+		for j, cell := range row {
+			if cell == "" {
+				continue
+			}
+			if j < len(header) && header[j] != "" {
+				cells = append(cells, fmt.Sprintf("%s %s", header[j], cell))
+			} else {
+				cells = append(cells, cell)
+			}
+		}
+		parts = append(parts, fmt.Sprintf("Row %d: %s.", i+1, strings.Join(cells, ", ")))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,395 @@
+package readelevatorpanel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request may name the floor the user wants, e.g. "3", "G" or "lobby".
+type Request struct {
+	Image string `json:"image"`
+	Floor string `json:"floor,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string        `json:"speechText"`
+	Panel      ElevatorPanel `json:"panel"`
+}
+
+// ElevatorPanel is the button panel inside an elevator car. Rows and Columns
+// are the size of the button grid.
+type ElevatorPanel struct {
+	Rows    int      `json:"rows"`
+	Columns int      `json:"columns"`
+	Braille bool     `json:"braille"`
+	Buttons []Button `json:"buttons"`
+}
+
+// Button is one button of the grid. Row is counted from the bottom and
+// Column from the left, both starting at 1.
+type Button struct {
+	Label   string `json:"label"`
+	Kind    string `json:"kind"`
+	Row     int    `json:"row"`
+	Column  int    `json:"column"`
+	Braille bool   `json:"braille"`
+	Lit     bool   `json:"lit"`
+}
+
+const (
+	KindFloor = "FLOOR"
+	KindOpen  = "OPEN"
+	KindClose = "CLOSE"
+	KindAlarm = "ALARM"
+	KindOther = "OTHER"
+)
+
+var ordinals = []string{"", "first", "second", "third", "fourth", "fifth", "sixth", "seventh", "eighth", "ninth", "tenth", "eleventh", "twelfth"}
+
+// floorAliases map spoken floor names to labels commonly printed on buttons.
+var floorAliases = map[string][]string{
+	"ground":   {"G", "GF", "0", "L", "1"},
+	"lobby":    {"L", "LOBBY", "G", "GF"},
+	"basement": {"B", "B1"},
+	"parking":  {"P", "P1"},
+	"roof":     {"R", "RF"},
+}
+
+// ReadElevatorPanel is the Cloud Function entry point
+func ReadElevatorPanel(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-elevator-panel"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.1,
+		MaxOutputTokens: 2048,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-elevator-panel", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var panel ElevatorPanel
+	err = json.Unmarshal([]byte(jsonStr), &panel)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	normalizePanel(&panel)
+
+	response := Response{
+		SpeechText: describePanel(panel, req.Floor),
+		Panel:      panel,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// normalizePanel makes the grid size consistent with the button positions,
+// as the model sometimes miscounts one or the other.
+func normalizePanel(panel *ElevatorPanel) {
+	if panel.Buttons == nil {
+		panel.Buttons = []Button{}
+	}
+
+	for i := range panel.Buttons {
+		b := &panel.Buttons[i]
+		b.Kind = strings.ToUpper(b.Kind)
+		if b.Row < 1 {
+			b.Row = 1
+		}
+		if b.Column < 1 {
+			b.Column = 1
+		}
+		if b.Row > panel.Rows {
+			panel.Rows = b.Row
+		}
+		if b.Column > panel.Columns {
+			panel.Columns = b.Column
+		}
+		if b.Braille {
+			panel.Braille = true
+		}
+	}
+}
+
+func describePanel(panel ElevatorPanel, floor string) string {
+	if len(panel.Buttons) == 0 {
+		return persona.Speech("Buddy couldn't find the elevator buttons. Hold your device about a forearm's length from the panel.")
+	}
+
+	braille := "No braille was seen on the buttons."
+	if panel.Braille {
+		braille = "The buttons have braille."
+	}
+
+	if floor != "" {
+		b, ok := findFloor(panel, floor)
+		if !ok {
+			return persona.Speech(fmt.Sprintf("Buddy couldn't find a button for floor %s. %s", floor, listFloors(panel)))
+		}
+		sentence := fmt.Sprintf("Floor %s is %s.", b.Label, locate(panel, b))
+		if b.Lit {
+			sentence += " It is already lit."
+		}
+		return sentence + " " + braille
+	}
+
+	var sentences []string
+	sentences = append(sentences, fmt.Sprintf("The panel has %d rows of buttons in %d columns.", panel.Rows, panel.Columns))
+	sentences = append(sentences, braille)
+	sentences = append(sentences, listFloors(panel))
+	for _, b := range panel.Buttons {
+		if b.Kind == KindOpen || b.Kind == KindClose || b.Kind == KindAlarm {
+			sentences = append(sentences, fmt.Sprintf("%s is %s.", capitalize(b.Label), locate(panel, b)))
+		}
+	}
+
+	return strings.Join(sentences, " ")
+}
+
+// findFloor matches the requested floor against the button labels, first
+// exactly and then through common aliases.
+func findFloor(panel ElevatorPanel, floor string) (Button, bool) {
+	wanted := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(strings.ToLower(floor), "floor")))
+
+	candidates := []string{wanted}
+	candidates = append(candidates, floorAliases[strings.ToLower(wanted)]...)
+
+	for _, c := range candidates {
+		for _, b := range panel.Buttons {
+			if b.Kind == KindFloor && strings.EqualFold(strings.TrimSpace(b.Label), c) {
+				return b, true
+			}
+		}
+	}
+
+	return Button{}, false
+}
+
+func listFloors(panel ElevatorPanel) string {
+	var floors []string
+	for _, b := range panel.Buttons {
+		if b.Kind == KindFloor {
+			floors = append(floors, b.Label)
+		}
+	}
+	if len(floors) == 0 {
+		return persona.Speech("Buddy couldn't read any floor numbers.")
+	}
+	return fmt.Sprintf("Floors: %s.", strings.Join(floors, ", "))
+}
+
+// locate describes a button's place in the grid, e.g. "second row from
+// bottom, left column".
+func locate(panel ElevatorPanel, b Button) string {
+	var row string
+	switch {
+	case panel.Rows == 1:
+		row = "in the only row"
+	case b.Row == 1:
+		row = "bottom row"
+	case b.Row == panel.Rows:
+		row = "top row"
+	default:
+		row = ordinal(b.Row) + " row from bottom"
+	}
+
+	var column string
+	switch {
+	case panel.Columns == 1:
+		return row
+	case b.Column == 1:
+		column = "left column"
+	case b.Column == panel.Columns:
+		column = "right column"
+	case panel.Columns == 3:
+		column = "middle column"
+	default:
+		column = ordinal(b.Column) + " column from left"
+	}
+
+	return row + ", " + column
+}
+
+func ordinal(n int) string {
+	if n >= 1 && n < len(ordinals) {
+		return ordinals[n]
+	}
+	return fmt.Sprintf("number %d", n)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
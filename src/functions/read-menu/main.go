@@ -0,0 +1,492 @@
+package readmenu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/allergens"
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/translate"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request reads a menu photo. Dietary filters from the request are merged
+// with the ones stored in the profile of the signed-in user, see package
+// auth, and dishes mentioning their allergens are flagged, see package
+// allergens.
+type Request struct {
+	Image      string   `json:"image"`
+	Dietary    []string `json:"dietary"`
+	FilterMode string   `json:"filterMode"`
+	Model      string   `json:"model,omitempty"`
+	// TranslateTo, a language code such as "en", has the menu read in
+	// that language, for travelers.
+	TranslateTo string `json:"translateTo,omitempty"`
+}
+
+// Response is the menu. A translated SpeechText keeps the original in
+// OriginalText, and the language it was in, if known, in TranslatedFrom.
+type Response struct {
+	SpeechText     string        `json:"speechText"`
+	Sections       []MenuSection `json:"sections"`
+	Dietary        []string      `json:"dietary"`
+	OriginalText   string        `json:"originalText,omitempty"`
+	TranslatedFrom string        `json:"translatedFrom,omitempty"`
+}
+
+type Menu struct {
+	Sections []MenuSection `json:"sections"`
+}
+
+type MenuSection struct {
+	Name   string `json:"name"`
+	Dishes []Dish `json:"dishes"`
+}
+
+// Dish flags are nil when the menu doesn't say; Suitable is only set when
+// dietary filters or allergens apply. Allergens are the user's allergens
+// the dish mentions.
+type Dish struct {
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	Price        string `json:"price"`
+	Vegetarian   *bool  `json:"vegetarian"`
+	Vegan        *bool  `json:"vegan"`
+	Halal        *bool  `json:"halal"`
+	ContainsNuts *bool  `json:"containsNuts"`
+	Suitable     *bool  `json:"suitable,omitempty"`
+
+	Allergens []string `json:"allergens,omitempty"`
+}
+
+const (
+	DietVegetarian = "vegetarian"
+	DietVegan      = "vegan"
+	DietHalal      = "halal"
+	DietNutAllergy = "nut_allergy"
+)
+
+const (
+	// FilterHighlight reads every dish and marks the suitable ones.
+	FilterHighlight = "highlight"
+	// FilterExclude only reads the suitable dishes.
+	FilterExclude = "exclude"
+)
+
+var (
+	knownDiets = map[string]bool{
+		DietVegetarian: true,
+		DietVegan:      true,
+		DietHalal:      true,
+		DietNutAllergy: true,
+	}
+)
+
+// ReadMenu is the Cloud Function entry point
+func ReadMenu(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-menu"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	switch req.FilterMode {
+	case "":
+		req.FilterMode = FilterHighlight
+	case FilterHighlight, FilterExclude:
+	default:
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid filterMode")
+		return
+	}
+
+	diets, err := normalizeDiets(req.Dietary)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	// The profile is the signed-in user's own, never the one of a uid the
+	// request names: it holds health and religious data
+	uid := auth.Caller(ctx, r)
+	if uid != "" {
+		profile, err := loadDietaryProfile(ctx, projectID, uid)
+		if err != nil {
+			// The menu is still useful without the profile filters.
+			logger.Printf("Error loading dietary profile: %v", err)
+		}
+		// A stored filter this version doesn't know is not the user's fault
+		for _, diet := range profile {
+			if !knownDiets[strings.ToLower(strings.TrimSpace(diet))] {
+				logger.Printf("Ignoring unknown dietary filter %q of %s", diet, uid)
+				continue
+			}
+			diets = append(diets, diet)
+		}
+		diets, _ = normalizeDiets(diets)
+	}
+
+	allergyProfile, err := allergens.Get(ctx, uid)
+	if err != nil {
+		logger.Printf("Error loading allergens: %v", err)
+	}
+	allergies := allergyProfile.Allergens
+
+	if req.TranslateTo != "" && !translate.ValidLanguage(req.TranslateTo) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid translateTo")
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.2,
+		MaxOutputTokens: 4096,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, uid, model)
+
+	prompt, err := prompts.Render(ctx, "read-menu", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	parts := []provider.Part{provider.Text(prompt)}
+	if len(allergies) > 0 {
+		parts = append(parts, provider.Text(allergens.Context(allergies)))
+	}
+	parts = append(parts, provider.ImageData(format, imageData))
+	jsonStr, err := model.Generate(ctx, parts...)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var menu Menu
+	err = json.Unmarshal([]byte(jsonStr), &menu)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	sections := applyDiets(menu.Sections, diets, allergies, req.FilterMode)
+
+	response := Response{
+		SpeechText: describeMenu(sections, diets, allergies, req.FilterMode),
+		Sections:   sections,
+		Dietary:    diets,
+	}
+
+	// Travelers hear the answer in their language, and can ask for the
+	// original
+	if req.TranslateTo != "" {
+		response = translated(ctx, logger, model, response, req.TranslateTo)
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// loadDietaryProfile reads the "dietary" array of the users/{uid} document.
+// A missing document means the user has no stored preferences.
+func loadDietaryProfile(ctx context.Context, projectID, uid string) ([]string, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("projects/%s/databases/(default)/documents/users/%s", projectID, uid)
+	doc, err := fs.Projects.Databases.Documents.Get(name).Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var diets []string
+	if dietary := doc.Fields["dietary"].ArrayValue; dietary != nil {
+		for _, v := range dietary.Values {
+			diets = append(diets, v.StringValue)
+		}
+	}
+
+	return diets, nil
+}
+
+func normalizeDiets(diets []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, diet := range diets {
+		diet = strings.ToLower(strings.TrimSpace(diet))
+		if !knownDiets[diet] {
+			return nil, fmt.Errorf("Unknown dietary filter: %s", diet)
+		}
+		if seen[diet] {
+			continue
+		}
+		seen[diet] = true
+		normalized = append(normalized, diet)
+	}
+	return normalized, nil
+}
+
+// suitable reports whether a dish satisfies every diet. Unknown flags are
+// treated as unsuitable: a nut allergy can't rely on a menu that says nothing.
+func suitable(dish Dish, diets []string) bool {
+	for _, diet := range diets {
+		switch diet {
+		case DietVegetarian:
+			vegan := dish.Vegan != nil && *dish.Vegan
+			if !vegan && (dish.Vegetarian == nil || !*dish.Vegetarian) {
+				return false
+			}
+		case DietVegan:
+			if dish.Vegan == nil || !*dish.Vegan {
+				return false
+			}
+		case DietHalal:
+			if dish.Halal == nil || !*dish.Halal {
+				return false
+			}
+		case DietNutAllergy:
+			if dish.ContainsNuts == nil || *dish.ContainsNuts {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// applyDiets marks the dishes that suit the diets and don't mention any of
+// allergies, and drops the others in FilterExclude mode.
+func applyDiets(sections []MenuSection, diets, allergies []string, mode string) []MenuSection {
+	result := []MenuSection{}
+	for _, section := range sections {
+		var dishes []Dish
+		for _, dish := range section.Dishes {
+			dish.Allergens = allergens.Check(dish.Name+" "+dish.Description, allergies)
+			if len(diets) > 0 || len(allergies) > 0 {
+				ok := suitable(dish, diets) && len(dish.Allergens) == 0
+				if !ok && mode == FilterExclude {
+					continue
+				}
+				dish.Suitable = &ok
+			}
+			dishes = append(dishes, dish)
+		}
+		if len(dishes) == 0 {
+			continue
+		}
+		section.Dishes = dishes
+		result = append(result, section)
+	}
+	return result
+}
+
+func describeMenu(sections []MenuSection, diets, allergies []string, mode string) string {
+	if len(sections) == 0 {
+		if (len(diets) > 0 || len(allergies) > 0) && mode == FilterExclude {
+			return persona.Speech("Buddy couldn't find any dish on this menu that clearly fits your diet. Ask the staff to be sure.")
+		}
+		return persona.Speech("Oops! Buddy couldn't find a menu in this image. Hold your device steady over the page.")
+	}
+
+	var parts []string
+	if len(diets) > 0 {
+		verb := "Dishes that fit your diet are marked as suitable."
+		if mode == FilterExclude {
+			verb = "Only dishes that clearly fit your diet are read."
+		}
+		parts = append(parts, fmt.Sprintf("Filtering for %s. %s", strings.ReplaceAll(strings.Join(diets, ", "), "_", " "), verb))
+	}
+	if len(allergies) > 0 && mode == FilterExclude {
+		parts = append(parts, fmt.Sprintf("Dishes mentioning %s are left out.", strings.Join(allergies, ", ")))
+	}
+
+	for _, section := range sections {
+		if section.Name != "" {
+			parts = append(parts, section.Name+":")
+		}
+		for _, dish := range section.Dishes {
+			sentence := dish.Name
+			if dish.Price != "" {
+				sentence += ", " + dish.Price
+			}
+			if dish.Suitable != nil && *dish.Suitable && mode == FilterHighlight {
+				sentence += ", suitable"
+			}
+			parts = append(parts, sentence+".")
+			if warning := allergens.Warning(dish.Allergens); warning != "" {
+				parts = append(parts, warning)
+			}
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// translated returns response translated into the language of code, with
+// the original kept. On failure the response is returned untranslated, as
+// an answer in the wrong language beats none.
+func translated(ctx context.Context, logger *log.Logger, model provider.VisionModel, response Response, code string) Response {
+	translation, err := translate.Text(ctx, model, response.SpeechText, code)
+	if err != nil {
+		logger.Printf("Error translating to %s, answering untranslated: %v", code, err)
+		return response
+	}
+
+	response.OriginalText = response.SpeechText
+	response.TranslatedFrom = translation.Source
+	response.SpeechText = translation.Text
+	return response
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,388 @@
+package readpanel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request carries either a new image of the panel or a panel returned by a
+// previous call, together with an optional question such as "which button is
+// Start".
+type Request struct {
+	Image string `json:"image"`
+	Text  string `json:"text"`
+	Panel *Panel `json:"panel,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string `json:"speechText"`
+	Panel      *Panel `json:"panel"`
+}
+
+// Panel is the control panel of an appliance. Display is the value currently
+// shown on its screen, if any.
+type Panel struct {
+	Appliance string    `json:"appliance"`
+	Display   string    `json:"display"`
+	Controls  []Control `json:"controls"`
+}
+
+// Control is a button, knob or switch. X and Y are the normalized center of
+// the control within the panel (0-1, from the top-left corner); Clock is the
+// clock-face position derived from them, 0 meaning the center of the panel.
+type Control struct {
+	Label string  `json:"label"`
+	Type  string  `json:"type"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Clock int     `json:"clock"`
+}
+
+const (
+	ControlButton = "BUTTON"
+	ControlKnob   = "KNOB"
+	ControlSwitch = "SWITCH"
+	ControlTouch  = "TOUCH"
+)
+
+// centerRadius is the normalized distance from the panel center within which
+// a control is described as being in the center.
+const centerRadius = 0.12
+
+var (
+	displayQuestion = regexp.MustCompile(`\b(display|screen|showing|shows|say|says|reading)\b`)
+	// questionWords are stripped from a question before matching labels.
+	questionWords = regexp.MustCompile(`\b(which|where|what|is|are|the|a|an|button|buttons|knob|switch|key|for|to|find|press|turn|of|on)\b`)
+)
+
+// ReadPanel is the Cloud Function entry point
+func ReadPanel(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-panel"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	// Follow-up questions operate on the panel returned by a previous call
+	if req.Image == "" {
+		if req.Panel == nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Either image or panel is required")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, Response{
+			SpeechText: answer(req.Panel, req.Text),
+			Panel:      req.Panel,
+		})
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.1,
+		MaxOutputTokens: 2048,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-panel", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var panel Panel
+	err = json.Unmarshal([]byte(jsonStr), &panel)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	if panel.Controls == nil {
+		panel.Controls = []Control{}
+	}
+	for i := range panel.Controls {
+		c := &panel.Controls[i]
+		c.Type = strings.ToUpper(c.Type)
+		c.Clock = clockPosition(c.X, c.Y)
+	}
+
+	response := Response{
+		SpeechText: answer(&panel, req.Text),
+		Panel:      &panel,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// clockPosition converts a position on the panel into a clock-face hour as
+// seen from the panel's center, 12 being straight up. It returns 0 for
+// controls in the center.
+func clockPosition(x, y float64) int {
+	dx, dy := x-0.5, 0.5-y
+	if math.Hypot(dx, dy) < centerRadius {
+		return 0
+	}
+
+	angle := math.Atan2(dx, dy) * 180 / math.Pi
+	hour := int(math.Round(math.Mod(angle+360, 360)/30)) % 12
+	if hour == 0 {
+		hour = 12
+	}
+	return hour
+}
+
+// answer responds to a question about the panel, or describes the whole
+// panel when there is no question.
+func answer(panel *Panel, text string) string {
+	if len(panel.Controls) == 0 && panel.Display == "" {
+		return persona.Speech("Buddy couldn't find a control panel. Hold your device a little further back so the whole panel is in view.")
+	}
+
+	question := strings.ToLower(strings.TrimSpace(text))
+	question = strings.TrimRight(question, ".?!")
+	if question == "" {
+		return describePanel(panel)
+	}
+
+	if displayQuestion.MatchString(question) {
+		return describeDisplay(panel)
+	}
+
+	if control, ok := findControl(panel, question); ok {
+		return fmt.Sprintf("%s is %s.", capitalize(control.Label), describePosition(control))
+	}
+
+	return persona.Speech(fmt.Sprintf("Buddy couldn't find that on the panel. %s", listControls(panel)))
+}
+
+// findControl picks the control whose label shares the most words with the
+// question.
+func findControl(panel *Panel, question string) (Control, bool) {
+	wanted := strings.Fields(questionWords.ReplaceAllString(question, " "))
+	if len(wanted) == 0 {
+		return Control{}, false
+	}
+
+	best, bestScore := -1, 0
+	for i, c := range panel.Controls {
+		label := strings.ToLower(c.Label)
+		score := 0
+		for _, w := range wanted {
+			if strings.Contains(label, w) {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return Control{}, false
+	}
+
+	return panel.Controls[best], true
+}
+
+func describePanel(panel *Panel) string {
+	var sentences []string
+	if panel.Appliance != "" {
+		sentences = append(sentences, fmt.Sprintf("This looks like a %s panel.", panel.Appliance))
+	}
+	sentences = append(sentences, describeDisplay(panel))
+	sentences = append(sentences, listControls(panel))
+	return strings.Join(sentences, " ")
+}
+
+func describeDisplay(panel *Panel) string {
+	if panel.Display == "" {
+		return "The display is off or not visible."
+	}
+	return fmt.Sprintf("The display shows %s.", panel.Display)
+}
+
+func listControls(panel *Panel) string {
+	if len(panel.Controls) == 0 {
+		return persona.Speech("Buddy couldn't find any buttons.")
+	}
+
+	var items []string
+	for _, c := range panel.Controls {
+		items = append(items, fmt.Sprintf("%s %s", c.Label, describePosition(c)))
+	}
+	return fmt.Sprintf("There are %d controls: %s.", len(panel.Controls), strings.Join(items, "; "))
+}
+
+func describePosition(c Control) string {
+	if c.Clock == 0 {
+		return "in the center"
+	}
+	return fmt.Sprintf("at %d o'clock", c.Clock)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
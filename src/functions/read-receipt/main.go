@@ -0,0 +1,399 @@
+package readreceipt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request may ask for the total to be split evenly between SplitBy people.
+type Request struct {
+	Image   string `json:"image"`
+	SplitBy int    `json:"splitBy,omitempty"`
+	Model   string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string  `json:"speechText"`
+	Receipt    Receipt `json:"receipt"`
+	PerPerson  *Amount `json:"perPerson,omitempty"`
+	// Consistent is false when the line items, subtotal, tax and total
+	// printed on the receipt don't add up.
+	Consistent bool `json:"consistent"`
+}
+
+// Receipt amounts are nil when they are not printed or not readable.
+type Receipt struct {
+	Merchant string     `json:"merchant"`
+	Currency string     `json:"currency"`
+	Items    []LineItem `json:"items"`
+	Subtotal *Amount    `json:"subtotal"`
+	Tax      *Amount    `json:"tax"`
+	Service  *Amount    `json:"service"`
+	Discount *Amount    `json:"discount"`
+	Total    *Amount    `json:"total"`
+}
+
+type LineItem struct {
+	Name     string  `json:"name"`
+	Quantity int     `json:"quantity"`
+	Amount   *Amount `json:"amount"`
+}
+
+// Amount is a money value in the receipt's currency.
+type Amount float64
+
+const (
+	maxSplit       = 50
+	maxSpokenItems = 10
+	// tolerance absorbs rounding on printed receipts.
+	tolerance = 0.05
+)
+
+// ReadReceipt is the Cloud Function entry point
+func ReadReceipt(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-receipt"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	if req.SplitBy < 0 || req.SplitBy > maxSplit {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("splitBy must be between 1 and %d", maxSplit))
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0,
+		MaxOutputTokens: 2048,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-receipt", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var receipt Receipt
+	err = json.Unmarshal([]byte(jsonStr), &receipt)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	response := Response{Receipt: receipt}
+	response.Consistent = reconcile(&response.Receipt)
+	if req.SplitBy > 1 && response.Receipt.Total != nil {
+		response.PerPerson = split(*response.Receipt.Total, req.SplitBy)
+	}
+	response.SpeechText = describeReceipt(response, req.SplitBy)
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// reconcile fills in a missing subtotal or total from the other printed
+// values and reports whether the receipt adds up.
+func reconcile(receipt *Receipt) bool {
+	if receipt.Items == nil {
+		receipt.Items = []LineItem{}
+	}
+
+	var itemsSum Amount
+	itemsComplete := len(receipt.Items) > 0
+	for i := range receipt.Items {
+		if receipt.Items[i].Quantity < 1 {
+			receipt.Items[i].Quantity = 1
+		}
+		if receipt.Items[i].Amount == nil {
+			itemsComplete = false
+			continue
+		}
+		itemsSum += *receipt.Items[i].Amount
+	}
+
+	if receipt.Subtotal == nil && itemsComplete {
+		receipt.Subtotal = amountPtr(itemsSum)
+	}
+
+	var expected *Amount
+	if receipt.Subtotal != nil {
+		sum := *receipt.Subtotal + value(receipt.Service) - value(receipt.Discount)
+		// Tax is often already included in the subtotal (VAT-inclusive
+		// prices), so both readings are accepted below.
+		expected = amountPtr(sum + value(receipt.Tax))
+		if receipt.Total == nil {
+			receipt.Total = expected
+			return true
+		}
+		if !equal(*receipt.Total, *expected) && !equal(*receipt.Total, sum) {
+			return false
+		}
+	}
+
+	if itemsComplete && receipt.Subtotal != nil {
+		return equal(itemsSum, *receipt.Subtotal)
+	}
+
+	return true
+}
+
+// split divides the total evenly, rounding each share up to the cent so the
+// shares never add up to less than the bill.
+func split(total Amount, people int) *Amount {
+	share := math.Ceil(float64(total)*100/float64(people)-1e-9) / 100
+	return amountPtr(Amount(share))
+}
+
+func describeReceipt(response Response, splitBy int) string {
+	receipt := response.Receipt
+	if len(receipt.Items) == 0 && receipt.Total == nil {
+		return "I couldn't find a receipt. Hold the receipt flat, about a hand's length from the camera."
+	}
+
+	var sentences []string
+	if receipt.Merchant != "" {
+		sentences = append(sentences, fmt.Sprintf("Receipt from %s.", receipt.Merchant))
+	}
+
+	switch n := len(receipt.Items); {
+	case n == 1:
+		sentences = append(sentences, "1 item.")
+	case n > 1:
+		sentences = append(sentences, fmt.Sprintf("%d items.", n))
+	}
+
+	for i, item := range receipt.Items {
+		if i == maxSpokenItems {
+			sentences = append(sentences, fmt.Sprintf("And %d more items.", len(receipt.Items)-maxSpokenItems))
+			break
+		}
+		name := item.Name
+		if item.Quantity > 1 {
+			name = fmt.Sprintf("%d %s", item.Quantity, name)
+		}
+		if item.Amount == nil {
+			sentences = append(sentences, fmt.Sprintf("%s, price unreadable.", name))
+			continue
+		}
+		sentences = append(sentences, fmt.Sprintf("%s, %s.", name, formatAmount(*item.Amount, receipt.Currency)))
+	}
+
+	var totals []string
+	for _, t := range []struct {
+		label  string
+		amount *Amount
+	}{
+		{"Subtotal", receipt.Subtotal},
+		{"discount", receipt.Discount},
+		{"service charge", receipt.Service},
+		{"tax", receipt.Tax},
+	} {
+		if t.amount != nil {
+			totals = append(totals, fmt.Sprintf("%s %s", t.label, formatAmount(*t.amount, receipt.Currency)))
+		}
+	}
+	if len(totals) > 0 {
+		sentences = append(sentences, strings.Join(totals, ", ")+".")
+	}
+
+	if receipt.Total != nil {
+		sentences = append(sentences, fmt.Sprintf("Total to pay: %s.", formatAmount(*receipt.Total, receipt.Currency)))
+	} else {
+		sentences = append(sentences, "I couldn't read the total.")
+	}
+
+	if !response.Consistent {
+		sentences = append(sentences, "The amounts don't add up, so please double-check the total.")
+	}
+
+	if response.PerPerson != nil {
+		sentences = append(sentences, fmt.Sprintf("Split %d ways, each person pays %s.", splitBy, formatAmount(*response.PerPerson, receipt.Currency)))
+	}
+
+	return strings.Join(sentences, " ")
+}
+
+func formatAmount(a Amount, currency string) string {
+	s := strconv.FormatFloat(float64(a), 'f', 2, 64)
+	if currency != "" {
+		s += " " + currency
+	}
+	return s
+}
+
+func equal(a, b Amount) bool {
+	return math.Abs(float64(a-b)) <= tolerance
+}
+
+func value(a *Amount) Amount {
+	if a == nil {
+		return 0
+	}
+	return *a
+}
+
+func amountPtr(a Amount) *Amount {
+	a = Amount(math.Round(float64(a)*100) / 100)
+	return &a
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
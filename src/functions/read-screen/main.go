@@ -0,0 +1,322 @@
+package readscreen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/consent"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+type Request struct {
+	Image string `json:"image"`
+	Model string `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string `json:"speechText"`
+	Screen     Screen `json:"screen"`
+}
+
+// Screen is the active screen of an ATM or self-service kiosk. Options are
+// listed in reading order.
+type Screen struct {
+	Kind    string   `json:"kind"`
+	Title   string   `json:"title"`
+	Message string   `json:"message"`
+	Options []Option `json:"options"`
+	// PinEntry is true when the screen asks for a PIN or shows a keypad for
+	// one.
+	PinEntry bool `json:"pinEntry"`
+}
+
+// Option is a selectable choice on the screen. Side and Row locate the
+// physical key next to the screen that selects it (Row counted from the
+// top); Side is TOUCH when the option is tapped on the screen itself.
+type Option struct {
+	Label string `json:"label"`
+	Side  string `json:"side"`
+	Row   int    `json:"row"`
+}
+
+const (
+	SideLeft  = "LEFT"
+	SideRight = "RIGHT"
+	SideTouch = "TOUCH"
+)
+
+var ordinals = []string{"", "first", "second", "third", "fourth", "fifth", "sixth", "seventh", "eighth"}
+
+// sensitiveDigits matches runs of digits, optionally grouped by spaces or
+// dashes, long enough to be card or account numbers.
+var sensitiveDigits = regexp.MustCompile(`\d(?:[ -]?\d){5,}`)
+
+// ReadScreen is the Cloud Function entry point
+func ReadScreen(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-screen"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.1,
+		MaxOutputTokens: 1024,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-screen", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var screen Screen
+	err = json.Unmarshal([]byte(jsonStr), &screen)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", maskSensitive(err.Error()))
+		return
+	}
+
+	// Return response
+	if screen.Options == nil {
+		screen.Options = []Option{}
+	}
+	for i := range screen.Options {
+		screen.Options[i].Side = strings.ToUpper(screen.Options[i].Side)
+	}
+
+	response := Response{
+		SpeechText: describeScreen(screen),
+		Screen:     screen,
+	}
+
+	// Screens carry account numbers and balances; only a masked summary is
+	// ever written to the logs, nothing of a PIN entry screen, and nothing
+	// at all without the user's consent.
+	title := screen.Title
+	if screen.PinEntry {
+		title = "[PIN entry]"
+	}
+	consent.Logger(ctx, auth.Caller(ctx, r), logger).Printf("Screen read: %s", maskSensitive(fmt.Sprintf("%s %q, %d options", screen.Kind, title, len(screen.Options))))
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+func describeScreen(screen Screen) string {
+	if screen.Title == "" && screen.Message == "" && len(screen.Options) == 0 {
+		return persona.Speech("Buddy couldn't read a screen. Hold your device level, about a forearm's length from the screen, and avoid reflections.")
+	}
+
+	var sentences []string
+	if screen.Title != "" {
+		sentences = append(sentences, terminate(screen.Title))
+	}
+	if screen.Message != "" {
+		sentences = append(sentences, terminate(screen.Message))
+	}
+
+	if screen.PinEntry {
+		sentences = append(sentences, "This screen asks for your PIN. Cover the keypad with your other hand while typing.")
+	}
+
+	for i, o := range screen.Options {
+		sentences = append(sentences, fmt.Sprintf("Option %d: %s, %s.", i+1, o.Label, describeButton(o)))
+	}
+
+	return strings.Join(sentences, " ")
+}
+
+func describeButton(o Option) string {
+	switch o.Side {
+	case SideLeft, SideRight:
+		side := strings.ToLower(o.Side)
+		if o.Row >= 1 && o.Row < len(ordinals) {
+			return fmt.Sprintf("%s key on the %s", ordinals[o.Row], side)
+		}
+		return fmt.Sprintf("key on the %s", side)
+	default:
+		return "touch the screen"
+	}
+}
+
+// maskSensitive hides long digit runs such as card and account numbers,
+// keeping the last four digits.
+func maskSensitive(s string) string {
+	return sensitiveDigits.ReplaceAllStringFunc(s, func(match string) string {
+		digits := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, match)
+		return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+	})
+}
+
+func terminate(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, ".") || strings.HasSuffix(s, "?") || strings.HasSuffix(s, "!") {
+		return s
+	}
+	return s + "."
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
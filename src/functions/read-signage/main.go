@@ -0,0 +1,328 @@
+package readsignage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/translate"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request optionally narrows the answer to one kind of sign, e.g. "restroom"
+// when the user asked "where is the toilet". TranslateTo, a language code
+// such as "en", has the signs read in that language, for travelers.
+type Request struct {
+	Image       string `json:"image"`
+	Target      string `json:"target"`
+	Model       string `json:"model,omitempty"`
+	TranslateTo string `json:"translateTo,omitempty"`
+}
+
+// Response is the signs. A translated SpeechText keeps the original in
+// OriginalText, and the language it was in, if known, in TranslatedFrom.
+type Response struct {
+	SpeechText     string `json:"speechText"`
+	Signs          []Sign `json:"signs"`
+	OriginalText   string `json:"originalText,omitempty"`
+	TranslatedFrom string `json:"translatedFrom,omitempty"`
+}
+
+type SignageDetection struct {
+	Signs []Sign `json:"signs"`
+}
+
+// Sign is a wayfinding sign. Position is where the sign is in the frame and
+// Direction is where it points, both relative to the camera.
+type Sign struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	Position  string `json:"position"`
+	Direction string `json:"direction"`
+}
+
+var directionPhrases = map[string]string{
+	"AHEAD":       "pointing straight ahead",
+	"LEFT":        "pointing left",
+	"RIGHT":       "pointing right",
+	"AHEAD_LEFT":  "pointing ahead and to the left",
+	"AHEAD_RIGHT": "pointing ahead and to the right",
+	"BACK":        "pointing behind you",
+	"UP":          "pointing upstairs",
+	"DOWN":        "pointing downstairs",
+}
+
+var positionPhrases = map[string]string{
+	"LEFT":   "on your left",
+	"CENTER": "ahead",
+	"RIGHT":  "on your right",
+}
+
+// ReadSignage is the Cloud Function entry point
+func ReadSignage(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+
+	// Creates a logger.
+	logName := "read-signage"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// Daily spend guardrail
+	modelName, err = budget.Apply(ctx, modelName)
+	if err != nil {
+		w.Header().Set("Retry-After", budget.RetryAfter())
+		apierror.Write(w, budget.Exhausted())
+		return
+	}
+
+	if req.TranslateTo != "" && !translate.ValidLanguage(req.TranslateTo) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid translateTo")
+		return
+	}
+
+	imageData, format, err := processBase64Image(req.Image)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+		return
+	}
+
+	model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+		Temperature:     0.2,
+		MaxOutputTokens: 1024,
+		JSON:            true,
+	}))
+	if err != nil {
+		logger.Printf("Error creating client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+	defer model.Close()
+	defer usage.Track(ctx, logName, usage.UserID(r), model)
+
+	prompt, err := prompts.Render(ctx, "read-signage", promptVersion, prompts.DefaultVars())
+	if err != nil {
+		logger.Printf("Error loading prompt: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+		return
+	}
+	jsonStr, err := model.Generate(ctx,
+		provider.Text(prompt),
+		provider.ImageData(format, imageData),
+	)
+	if err != nil {
+		logger.Printf("Error at processing: %v", err)
+		apierror.Write(w, provider.Problem(err))
+		return
+	}
+
+	var detection SignageDetection
+	err = json.Unmarshal([]byte(jsonStr), &detection)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+		logger.Printf("Error unmarshaling JSON: %s", err.Error())
+		return
+	}
+
+	// Return response
+	signs := filterSigns(detection.Signs, req.Target)
+
+	response := Response{
+		SpeechText: describeSigns(signs, req.Target),
+		Signs:      signs,
+	}
+
+	// Travelers hear the answer in their language, and can ask for the
+	// original
+	if req.TranslateTo != "" {
+		response = translated(ctx, logger, model, response, req.TranslateTo)
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+
+}
+
+// filterSigns keeps the signs matching the requested target type or label.
+// An empty target keeps every sign.
+func filterSigns(signs []Sign, target string) []Sign {
+	target = strings.ToLower(strings.TrimSpace(target))
+
+	filtered := []Sign{}
+	for _, sign := range signs {
+		sign.Type = strings.ToLower(sign.Type)
+		sign.Position = strings.ToUpper(sign.Position)
+		sign.Direction = strings.ToUpper(sign.Direction)
+
+		if target != "" && sign.Type != target && !strings.Contains(strings.ToLower(sign.Text), target) {
+			continue
+		}
+		filtered = append(filtered, sign)
+	}
+
+	return filtered
+}
+
+func describeSigns(signs []Sign, target string) string {
+	if len(signs) == 0 {
+		if target != "" {
+			return persona.Speech(fmt.Sprintf("Buddy can't see a %s sign here. Try turning slowly.", target))
+		}
+		return persona.Speech("Buddy can't see any signs here. Try turning slowly.")
+	}
+
+	var parts []string
+	for _, sign := range signs {
+		label := sign.Text
+		if label == "" {
+			label = sign.Type
+		}
+
+		sentence := fmt.Sprintf("%s sign", label)
+		if position, ok := positionPhrases[sign.Position]; ok {
+			sentence += " " + position
+		}
+		if direction, ok := directionPhrases[sign.Direction]; ok {
+			sentence += ", " + direction
+		}
+		parts = append(parts, sentence+".")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// translated returns response translated into the language of code, with
+// the original kept. On failure the response is returned untranslated, as
+// an answer in the wrong language beats none.
+func translated(ctx context.Context, logger *log.Logger, model provider.VisionModel, response Response, code string) Response {
+	translation, err := translate.Text(ctx, model, response.SpeechText, code)
+	if err != nil {
+		logger.Printf("Error translating to %s, answering untranslated: %v", code, err)
+		return response
+	}
+
+	response.OriginalText = response.SpeechText
+	response.TranslatedFrom = translation.Source
+	response.SpeechText = translation.Text
+	return response
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package reapexpired enforces the retention of what is kept about users:
+// ReapExpired deletes archived frames older than FRAME_RETENTION or of
+// users who withdrew their consent, see package consent, and hazard
+// sessions past their expiresAt. It is meant to be called hourly by Cloud
+// Scheduler, and is safe to call again after a failure.
+package reapexpired
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+
+	"example.com/buddy-paws/internal/archive"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/consent"
+	"example.com/buddy-paws/internal/query"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// Response counts what was deleted.
+type Response struct {
+	Frames   int `json:"frames"`
+	Sessions int `json:"sessions"`
+}
+
+// ReapExpired is the Cloud Function entry point. Scheduler jobs can send
+// an empty body.
+func ReapExpired(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "reap-expired"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	now := time.Now().UTC()
+	var response Response
+
+	// Frames of users whose consent can't be read are kept for the next run
+	withdrawn := func(userID string) bool {
+		c, err := consent.Get(ctx, userID)
+		return err == nil && c.Refused()
+	}
+	response.Frames, err = archive.Reap(ctx, now.Add(-cfg.FrameRetention), withdrawn)
+	if err != nil {
+		logger.Printf("Error reaping frames after %d: %v", response.Frames, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error reaping frames")
+		return
+	}
+
+	response.Sessions, err = reapSessions(ctx, projectID, now)
+	if err != nil {
+		logger.Printf("Error reaping sessions after %d: %v", response.Sessions, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error reaping sessions")
+		return
+	}
+
+	logger.Printf("Reaped %d frames and %d sessions", response.Frames, response.Sessions)
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// reapSessions deletes the hazard sessions that expired before now. A
+// Firestore TTL policy on expiresAt does the same, within a day.
+func reapSessions(ctx context.Context, projectID string, now time.Time) (int, error) {
+	database := fmt.Sprintf("projects/%s/databases/(default)/documents", projectID)
+	expired, err := query.Run(ctx, database, query.Where("hazardSessions", "expiresAt", "LESS_THAN",
+		firestore.Value{TimestampValue: now.Format(time.RFC3339Nano)}))
+	if err != nil {
+		return 0, err
+	}
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, doc := range expired {
+		_, err := fs.Projects.Databases.Documents.Delete(doc.Name).Context(ctx).Do()
+		var apiErr *googleapi.Error
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound) {
+			return deleted, fmt.Errorf("deleting %s: %w", doc.Name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
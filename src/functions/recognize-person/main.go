@@ -0,0 +1,681 @@
+package recognizeperson
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/budget"
+	"example.com/buddy-paws/internal/buildinfo"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/imagedata"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/prompts"
+	"example.com/buddy-paws/internal/provider"
+	"example.com/buddy-paws/internal/settings"
+	"example.com/buddy-paws/internal/usage"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// defaultPromptVersion is the prompt of the function unless another one is
+// selected, see prompts.Select.
+const defaultPromptVersion = "v1"
+
+// Request drives every action of the function. Enrollment photos are stored
+// per user and only used to recognize people that user enrolled. The user
+// is the one of the Firebase ID token, see package auth; UID is optional
+// and must be theirs.
+type Request struct {
+	Action  string   `json:"action"`
+	UID     string   `json:"uid,omitempty"`
+	Name    string   `json:"name"`
+	Images  []string `json:"images"`
+	Image   string   `json:"image"`
+	Consent bool     `json:"consent"`
+	Model   string   `json:"model,omitempty"`
+}
+
+type Response struct {
+	SpeechText string   `json:"speechText"`
+	People     []Person `json:"people,omitempty"`
+}
+
+// Person is an enrolled person as returned to the client.
+type Person struct {
+	Name        string `json:"name"`
+	Photos      int    `json:"photos"`
+	ConsentedAt string `json:"consentedAt"`
+}
+
+type Recognition struct {
+	People []RecognizedPerson `json:"people"`
+}
+
+type RecognizedPerson struct {
+	Name     string `json:"name"`
+	Position string `json:"position"`
+}
+
+const (
+	ActionEnroll    = "enroll"
+	ActionRecognize = "recognize"
+	ActionList      = "list"
+	ActionDelete    = "delete"
+)
+
+const (
+	maxPeople          = 10
+	maxPhotosPerPerson = 5
+	// maxReferencePhotos limits how many photos per person are sent to the
+	// model on each recognition.
+	maxReferencePhotos = 2
+)
+
+// enrollment is the stored record of an enrolled person.
+type enrollment struct {
+	ID          string
+	Name        string
+	Photos      []string
+	ConsentedAt time.Time
+}
+
+// RecognizePerson is the Cloud Function entry point
+func RecognizePerson(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+	modelName := cfg.ModelName
+	bucket := cfg.FacesBucket
+
+	// Creates a logger.
+	logName := "recognize-person"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Prompt version, overridable per deployment or per request
+	promptVersion := prompts.Select(r, logName, defaultPromptVersion)
+	w.Header().Set("X-Prompt-Version", promptVersion)
+
+	// Build info for regression reports
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version") {
+		respondWithJSON(w, http.StatusOK, buildinfo.Get(modelName, promptVersion))
+		return
+	}
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	modelName, err = provider.Select(req.Model, modelName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeModelNotAllowed, "Model not allowed")
+		return
+	}
+
+	// The user's own enrollments only
+	uid, err := auth.UID(r.Context(), r)
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid ID token")
+		return
+	case err != nil:
+		logger.Printf("Error verifying ID token: %v", err)
+		respondWithError(w, http.StatusServiceUnavailable, apierror.CodeAuthUnavailable, "Error verifying ID token")
+		return
+	}
+	if req.UID != "" && req.UID != uid {
+		respondWithError(w, http.StatusForbidden, apierror.CodeForbidden, "Invalid uid, not the user of the ID token")
+		return
+	}
+
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		logger.Printf("Error creating Firestore client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		logger.Printf("Error creating Storage client: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+
+	store := &enrollmentStore{
+		fs:       fs,
+		gcs:      gcs,
+		bucket:   bucket,
+		database: fmt.Sprintf("projects/%s/databases/(default)/documents", projectID),
+	}
+
+	switch req.Action {
+	case ActionEnroll:
+		if strings.TrimSpace(req.Name) == "" {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Name is required")
+			return
+		}
+		// Enrolling someone's face requires their explicit consent, confirmed
+		// by the user on their behalf.
+		if !req.Consent {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Consent of the enrolled person is required")
+			return
+		}
+		if len(req.Images) == 0 {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "At least one image is required")
+			return
+		}
+
+		var images [][]byte
+		var formats []string
+		for _, img := range req.Images {
+			imageData, format, err := processBase64Image(img)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+				return
+			}
+			images = append(images, imageData)
+			formats = append(formats, format)
+		}
+
+		person, err := store.enroll(ctx, uid, strings.TrimSpace(req.Name), images, formats)
+		if errors.Is(err, errTooManyPeople) || errors.Is(err, errTooManyPhotos) {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Printf("Error enrolling person: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error enrolling person")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, Response{
+			SpeechText: persona.Speech(fmt.Sprintf("Buddy will now recognize %s.", person.Name)),
+			People:     []Person{person.toPerson()},
+		})
+
+	case ActionList:
+		people, err := store.list(ctx, uid)
+		if err != nil {
+			logger.Printf("Error listing people: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error listing people")
+			return
+		}
+
+		response := Response{SpeechText: describeEnrolled(people)}
+		for _, person := range people {
+			response.People = append(response.People, person.toPerson())
+		}
+		respondWithJSON(w, http.StatusOK, response)
+
+	case ActionDelete:
+		people, err := store.list(ctx, uid)
+		if err != nil {
+			logger.Printf("Error listing people: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error deleting people")
+			return
+		}
+
+		// An empty name deletes every enrolled person of the user.
+		var deleted []string
+		for _, person := range people {
+			if req.Name != "" && person.ID != personID(req.Name) {
+				continue
+			}
+			if err := store.delete(ctx, uid, person); err != nil {
+				logger.Printf("Error deleting person: %v", err)
+				respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error deleting people")
+				return
+			}
+			deleted = append(deleted, person.Name)
+		}
+
+		if req.Name != "" && len(deleted) == 0 {
+			respondWithError(w, http.StatusNotFound, apierror.CodeNotFound, "Person not found")
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, Response{
+			SpeechText: fmt.Sprintf("Deleted %d enrolled people and their photos.", len(deleted)),
+		})
+
+	case ActionRecognize:
+		imageData, format, err := processBase64Image(req.Image)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, apierror.CodeImageInvalid, fmt.Sprintf("Invalid image data: %v", err))
+			return
+		}
+
+		people, err := store.list(ctx, uid)
+		if err != nil {
+			logger.Printf("Error listing people: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading enrolled people")
+			return
+		}
+
+		if len(people) == 0 {
+			respondWithJSON(w, http.StatusOK, Response{
+				SpeechText: persona.Speech("You haven't enrolled anyone yet. Ask Buddy to remember someone first."),
+			})
+			return
+		}
+
+		// Daily spend guardrail, only recognizing takes the model
+		modelName, err = budget.Apply(ctx, modelName)
+		if err != nil {
+			w.Header().Set("Retry-After", budget.RetryAfter())
+			apierror.Write(w, budget.Exhausted())
+			return
+		}
+		model, err := provider.New(ctx, modelName, settings.Tune(ctx, logName, provider.Options{
+			Temperature:     0.1,
+			MaxOutputTokens: 512,
+			JSON:            true,
+		}))
+		if err != nil {
+			logger.Printf("Error creating client: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+			return
+		}
+		defer model.Close()
+		defer usage.Track(ctx, logName, uid, model)
+
+		var names []string
+		for _, person := range people {
+			names = append(names, person.Name)
+		}
+
+		prompt, err := prompts.Render(ctx, "recognize-person", promptVersion, struct {
+			prompts.Vars
+			Names string
+		}{prompts.DefaultVars(), strings.Join(names, ", ")})
+		if err != nil {
+			logger.Printf("Error loading prompt: %v", err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error loading prompt")
+			return
+		}
+
+		parts := []provider.Part{provider.Text(prompt)}
+		for _, person := range people {
+			photos, err := store.referencePhotos(ctx, person)
+			if err != nil {
+				logger.Printf("Error loading photos of %s: %v", person.ID, err)
+				continue
+			}
+			for _, photo := range photos {
+				parts = append(parts, provider.Text(fmt.Sprintf("Reference photo of %s:", person.Name)))
+				parts = append(parts, provider.ImageData(photo.format, photo.data))
+			}
+		}
+		parts = append(parts, provider.Text("Current camera image:"), provider.ImageData(format, imageData))
+
+		jsonStr, err := model.Generate(ctx, parts...)
+		if err != nil {
+			logger.Printf("Error at processing: %v", err)
+			apierror.Write(w, provider.Problem(err))
+			return
+		}
+
+		var recognition Recognition
+		err = json.Unmarshal([]byte(jsonStr), &recognition)
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error unmarshaling JSON")
+			logger.Printf("Error unmarshaling JSON: %s", err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, Response{
+			SpeechText: describeRecognized(onlyEnrolled(recognition.People, people)),
+		})
+
+	default:
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown action")
+	}
+
+}
+
+// onlyEnrolled drops any name the model returned that isn't enrolled, so the
+// function can never announce a stranger.
+func onlyEnrolled(recognized []RecognizedPerson, people []enrollment) []RecognizedPerson {
+	enrolled := map[string]string{}
+	for _, person := range people {
+		enrolled[person.ID] = person.Name
+	}
+
+	var result []RecognizedPerson
+	seen := map[string]bool{}
+	for _, r := range recognized {
+		id := personID(r.Name)
+		name, ok := enrolled[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, RecognizedPerson{Name: name, Position: r.Position})
+	}
+
+	return result
+}
+
+func describeRecognized(people []RecognizedPerson) string {
+	if len(people) == 0 {
+		return persona.Speech("Buddy doesn't see anyone you've enrolled.")
+	}
+
+	var parts []string
+	for _, person := range people {
+		position := person.Position
+		if position == "" {
+			position = "nearby"
+		}
+		parts = append(parts, fmt.Sprintf("%s is %s.", person.Name, position))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func describeEnrolled(people []enrollment) string {
+	if len(people) == 0 {
+		return "You haven't enrolled anyone yet."
+	}
+
+	var names []string
+	for _, person := range people {
+		names = append(names, person.Name)
+	}
+
+	return persona.Speech(fmt.Sprintf("Buddy can recognize %d people: %s.", len(people), strings.Join(names, ", ")))
+}
+
+// personID is the document ID of an enrolled name: a hash of its words,
+// lowercased and without punctuation, so "Mary-Jane" and "mary jane" are
+// one person and names in any script, such as "สมชาย" or "李明", get
+// distinct IDs.
+func personID(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsMark(r)
+	})
+	sum := sha256.Sum256([]byte(strings.Join(words, " ")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (e enrollment) toPerson() Person {
+	return Person{
+		Name:        e.Name,
+		Photos:      len(e.Photos),
+		ConsentedAt: e.ConsentedAt.Format(time.RFC3339),
+	}
+}
+
+var (
+	errTooManyPeople = fmt.Errorf("at most %d people can be enrolled", maxPeople)
+	errTooManyPhotos = fmt.Errorf("at most %d photos can be enrolled per person", maxPhotosPerPerson)
+)
+
+// enrollmentStore keeps enrollment records in Firestore under
+// users/{uid}/people/{personId} and the photos in Cloud Storage under
+// faces/{uid}/{personId}/.
+type enrollmentStore struct {
+	fs       *firestore.Service
+	gcs      *storage.Service
+	bucket   string
+	database string
+}
+
+type photo struct {
+	data   []byte
+	format string
+}
+
+func (s *enrollmentStore) peopleCollection(uid string) string {
+	return fmt.Sprintf("%s/users/%s", s.database, uid)
+}
+
+func (s *enrollmentStore) personDocument(uid, id string) string {
+	return fmt.Sprintf("%s/users/%s/people/%s", s.database, uid, id)
+}
+
+func (s *enrollmentStore) list(ctx context.Context, uid string) ([]enrollment, error) {
+	resp, err := s.fs.Projects.Databases.Documents.
+		List(s.peopleCollection(uid), "people").
+		PageSize(maxPeople).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var people []enrollment
+	for _, doc := range resp.Documents {
+		people = append(people, fromDocument(doc))
+	}
+
+	return people, nil
+}
+
+// enroll adds photos to a person, creating the record on first enrollment.
+func (s *enrollmentStore) enroll(ctx context.Context, uid, name string, images [][]byte, formats []string) (enrollment, error) {
+	people, err := s.list(ctx, uid)
+	if err != nil {
+		return enrollment{}, err
+	}
+
+	id := personID(name)
+	person := enrollment{ID: id, Name: name}
+	existing := false
+	for _, p := range people {
+		if p.ID == id {
+			person = p
+			existing = true
+		}
+	}
+
+	if !existing && len(people) >= maxPeople {
+		return enrollment{}, errTooManyPeople
+	}
+	if len(person.Photos)+len(images) > maxPhotosPerPerson {
+		return enrollment{}, errTooManyPhotos
+	}
+
+	now := time.Now().UTC()
+	for i, data := range images {
+		object := fmt.Sprintf("faces/%s/%s/%d.%s", uid, id, now.UnixNano()+int64(i), formats[i])
+		_, err := s.gcs.Objects.
+			Insert(s.bucket, &storage.Object{Name: object, ContentType: "image/" + formats[i]}).
+			Media(bytes.NewReader(data)).
+			Context(ctx).
+			Do()
+		if err != nil {
+			return enrollment{}, fmt.Errorf("uploading photo: %w", err)
+		}
+		person.Photos = append(person.Photos, object)
+	}
+
+	// Every new enrollment renews the consent timestamp.
+	person.Name = name
+	person.ConsentedAt = now
+
+	_, err = s.fs.Projects.Databases.Documents.
+		Patch(s.personDocument(uid, id), toDocument(person)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return enrollment{}, fmt.Errorf("saving enrollment: %w", err)
+	}
+
+	return person, nil
+}
+
+// delete removes the photos first so a failure never leaves photos behind
+// without a record pointing at them.
+func (s *enrollmentStore) delete(ctx context.Context, uid string, person enrollment) error {
+	for _, object := range person.Photos {
+		err := s.gcs.Objects.Delete(s.bucket, object).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting photo: %w", err)
+		}
+	}
+
+	_, err := s.fs.Projects.Databases.Documents.
+		Delete(s.personDocument(uid, person.ID)).
+		Context(ctx).
+		Do()
+	return err
+}
+
+func (s *enrollmentStore) referencePhotos(ctx context.Context, person enrollment) ([]photo, error) {
+	var photos []photo
+	for i, object := range person.Photos {
+		if i >= maxReferencePhotos {
+			break
+		}
+
+		resp, err := s.gcs.Objects.Get(s.bucket, object).Context(ctx).Download()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		format := object[strings.LastIndex(object, ".")+1:]
+		photos = append(photos, photo{data: data, format: format})
+	}
+
+	return photos, nil
+}
+
+func toDocument(e enrollment) *firestore.Document {
+	photos := &firestore.ArrayValue{}
+	for _, object := range e.Photos {
+		photos.Values = append(photos.Values, &firestore.Value{StringValue: object})
+	}
+
+	return &firestore.Document{
+		Fields: map[string]firestore.Value{
+			"name":        {StringValue: e.Name},
+			"photos":      {ArrayValue: photos},
+			"consent":     {BooleanValue: true},
+			"consentedAt": {TimestampValue: e.ConsentedAt.Format(time.RFC3339Nano)},
+		},
+	}
+}
+
+func fromDocument(doc *firestore.Document) enrollment {
+	e := enrollment{
+		ID:   doc.Name[strings.LastIndex(doc.Name, "/")+1:],
+		Name: doc.Fields["name"].StringValue,
+	}
+	if photos := doc.Fields["photos"].ArrayValue; photos != nil {
+		for _, v := range photos.Values {
+			e.Photos = append(e.Photos, v.StringValue)
+		}
+	}
+	e.ConsentedAt, _ = time.Parse(time.RFC3339Nano, doc.Fields["consentedAt"].TimestampValue)
+
+	return e
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// processBase64Image decodes the request image, see package imagedata.
+func processBase64Image(base64Image string) ([]byte, string, error) {
+	return imagedata.Decode(base64Image)
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Prompt-Version, X-User-ID, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+// Package registerdevice exchanges the credentials of the app for a
+// short-lived access token, see package devicetoken: an App Check token in
+// X-Firebase-AppCheck, required unless APP_CHECK is off, and a Firebase ID
+// token in Authorization, which binds the token to the signed-in user. The
+// app calls it again before the token expires.
+package registerdevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/buddy-paws/internal/appcheck"
+	"example.com/buddy-paws/internal/audit"
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// deviceIDPattern matches installation IDs, e.g. Firebase installation
+// IDs or UUIDs.
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,128}$`)
+
+// Request names the device, by an ID stable across launches.
+type Request struct {
+	DeviceID string `json:"deviceId"`
+}
+
+// Response is the access token, to send as "Authorization: Bearer" to the
+// other functions. ExpiresIn is in seconds, and RateLimit in requests per
+// minute, 0 for none.
+type Response struct {
+	AccessToken string   `json:"accessToken"`
+	TokenType   string   `json:"tokenType"`
+	ExpiresIn   int64    `json:"expiresIn"`
+	Scopes      []string `json:"scopes"`
+	RateLimit   int      `json:"rateLimit"`
+}
+
+// RegisterDevice is the Cloud Function entry point
+func RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "register-device"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	if !devicetoken.Enabled() {
+		respondWithError(w, http.StatusNotImplemented, apierror.CodeNotConfigured, "Device registration not configured")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if !deviceIDPattern.MatchString(req.DeviceID) {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid deviceId")
+		return
+	}
+
+	// The app, unless App Check is off; unlike other functions, there is
+	// no grace mode here
+	appID := ""
+	offline := cfg.MockModel || cfg.ModelReplay != ""
+	if cfg.AppCheck != config.AppCheckOff && !offline {
+		appID, err = appcheck.Verify(r.Context(), r.Header.Get(appcheck.Header))
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			logger.Printf("App Check token of %s refused: %v", req.DeviceID, err)
+			respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid App Check token")
+			return
+		}
+		if err != nil {
+			logger.Printf("Error verifying App Check token: %v", err)
+			respondWithError(w, http.StatusServiceUnavailable, apierror.CodeAuthUnavailable, "Error verifying App Check token")
+			return
+		}
+	}
+
+	// The user, when signed in
+	uid := ""
+	if r.Header.Get("Authorization") != "" || offline {
+		uid, err = auth.UID(r.Context(), r)
+		switch {
+		case errors.Is(err, auth.ErrUnauthenticated) && !offline:
+			respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid ID token")
+			return
+		case errors.Is(err, auth.ErrUnauthenticated):
+			uid = ""
+		case err != nil:
+			logger.Printf("Error verifying ID token: %v", err)
+			respondWithError(w, http.StatusServiceUnavailable, apierror.CodeAuthUnavailable, "Error verifying ID token")
+			return
+		}
+	}
+	if appID == "" && uid == "" && !offline {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "App Check token or ID token required")
+		return
+	}
+
+	token, claims, err := devicetoken.Issue(req.DeviceID, uid, appID)
+	if err != nil {
+		logger.Printf("Error issuing token: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error issuing token")
+		return
+	}
+
+	// No token is handed out without a trace in the audit log
+	actor := "device:" + req.DeviceID
+	if uid != "" {
+		actor = "user:" + uid
+	}
+	err = audit.Record(r.Context(), audit.Entry{
+		Action: audit.ActionKeyIssue,
+		Actor:  actor,
+		Target: req.DeviceID,
+		Details: map[string]string{
+			"tokenId":   claims.ID,
+			"app":       appID,
+			"scopes":    strings.Join(claims.Scopes, " "),
+			"rateLimit": strconv.Itoa(claims.RateLimit),
+			"expiresAt": time.Unix(claims.Expires, 0).UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		logger.Printf("Error recording token of %s in the audit log: %v", req.DeviceID, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error issuing token, please try again")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Response{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   claims.Expires - claims.IssuedAt,
+		Scopes:      claims.Scopes,
+		RateLimit:   claims.RateLimit,
+	})
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Firebase-AppCheck, X-Request-ID")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package api registers every Buddy Paws function with the Functions
+// Framework. Deploy any of them from this directory by entry point, e.g.
+//
+//	gcloud functions deploy detect-hazards --gen2 --runtime=go123 --source=. --entry-point=DetectHazards --trigger-http
+package api
+
+import (
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+
+	"example.com/buddy-paws/admin"
+	checkexpiry "example.com/buddy-paws/check-expiry"
+	checklighting "example.com/buddy-paws/check-lighting"
+	checksignal "example.com/buddy-paws/check-signal"
+	describeoutfit "example.com/buddy-paws/describe-outfit"
+	detecthazards "example.com/buddy-paws/detect-hazards"
+	emergencyassist "example.com/buddy-paws/emergency-assist"
+	"example.com/buddy-paws/healthz"
+	identifycolor "example.com/buddy-paws/identify-color"
+	"example.com/buddy-paws/internal/abuse"
+	"example.com/buddy-paws/internal/apiversion"
+	"example.com/buddy-paws/internal/appcheck"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/contenttype"
+	"example.com/buddy-paws/internal/devicetoken"
+	"example.com/buddy-paws/internal/idempotency"
+	"example.com/buddy-paws/internal/jobs"
+	"example.com/buddy-paws/internal/redact"
+	"example.com/buddy-paws/internal/requestid"
+	"example.com/buddy-paws/internal/shutdown"
+	objectreader "example.com/buddy-paws/object-reader"
+	qualityanalytics "example.com/buddy-paws/quality-analytics"
+	readdocument "example.com/buddy-paws/read-document"
+	readelevatorpanel "example.com/buddy-paws/read-elevator-panel"
+	readmenu "example.com/buddy-paws/read-menu"
+	readpanel "example.com/buddy-paws/read-panel"
+	readreceipt "example.com/buddy-paws/read-receipt"
+	readscreen "example.com/buddy-paws/read-screen"
+	readsignage "example.com/buddy-paws/read-signage"
+	reapexpired "example.com/buddy-paws/reap-expired"
+	recognizeperson "example.com/buddy-paws/recognize-person"
+	registerdevice "example.com/buddy-paws/register-device"
+	submitfeedback "example.com/buddy-paws/submit-feedback"
+	userdata "example.com/buddy-paws/user-data"
+)
+
+// Function is an HTTP function. Name is its entry point and Path the URL
+// path it is served under by the local server. Versioned paths such as
+// Path+"/v2" are served too, see package apiversion.
+type Function struct {
+	Name    string
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// Functions lists every function of the API.
+var Functions = []Function{
+	{"Admin", "/admin", admin.Admin},
+	{"AggregateQuality", "/aggregate-quality", qualityanalytics.AggregateQuality},
+	{"CheckExpiry", "/check-expiry", checkexpiry.CheckExpiry},
+	{"CheckLighting", "/check-lighting", checklighting.CheckLighting},
+	{"CheckSignal", "/check-signal", checksignal.CheckSignal},
+	{"DeleteMyData", "/delete-my-data", userdata.DeleteMyData},
+	{"DescribeOutfit", "/describe-outfit", describeoutfit.DescribeOutfit},
+	{"DetectHazards", "/detect-hazards", detecthazards.DetectHazards},
+	{"EmergencyAssist", "/emergency-assist", emergencyassist.EmergencyAssist},
+	{"ExportMyData", "/export-my-data", userdata.ExportMyData},
+	{"GetJob", "/get-job", jobs.GetJob},
+	{"Healthz", "/healthz", healthz.Healthz},
+	{"IdentifyColor", "/identify-color", identifycolor.IdentifyColor},
+	{"MyAllergens", "/my-allergens", userdata.MyAllergens},
+	{"MyCalibration", "/my-calibration", userdata.MyCalibration},
+	{"MyConsent", "/my-consent", userdata.MyConsent},
+	{"ObjectReader", "/object-reader", objectreader.ObjectReader},
+	{"ProcessJob", "/process-job", jobs.ProcessJob},
+	{"QualitySummary", "/quality-summary", qualityanalytics.QualitySummary},
+	{"ReadDocument", "/read-document", readdocument.ReadDocument},
+	{"ReadElevatorPanel", "/read-elevator-panel", readelevatorpanel.ReadElevatorPanel},
+	{"ReadMenu", "/read-menu", readmenu.ReadMenu},
+	{"ReadPanel", "/read-panel", readpanel.ReadPanel},
+	{"ReadReceipt", "/read-receipt", readreceipt.ReadReceipt},
+	{"ReadScreen", "/read-screen", readscreen.ReadScreen},
+	{"ReadSignage", "/read-signage", readsignage.ReadSignage},
+	{"ReapExpired", "/reap-expired", reapexpired.ReapExpired},
+	{"RecognizePerson", "/recognize-person", recognizeperson.RecognizePerson},
+	{"RegisterDevice", "/register-device", registerdevice.RegisterDevice},
+	{"SubmitFeedback", "/submit-feedback", submitfeedback.SubmitFeedback},
+}
+
+// unguarded are the entry points neither device tokens nor App Check
+// guard: those called by Google Cloud services and operators rather than
+// the app, and RegisterDevice, which checks its credentials itself.
+var unguarded = map[string]bool{
+	"Admin":            true,
+	"AggregateQuality": true,
+	"QualitySummary":   true,
+	"ReapExpired":      true,
+	"ProcessJob":       true,
+	"Healthz":          true,
+	"RegisterDevice":   true,
+}
+
+// ServeHTTP serves the function with a request ID, to registered devices
+// and genuine app builds only, see packages devicetoken and appcheck, that
+// aren't sending junk, see package abuse, with JSON bodies, see package
+// contenttype, behind API version negotiation, asynchronous jobs and
+// idempotency keys, and with its speech filtered, see package redact.
+// Requests are drained on shutdown.
+func (f Function) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := f.serve
+	if !unguarded[f.Name] {
+		handler = devicetoken.Handle(f.Name, appcheck.Handle(f.Name, abuse.Handle(f.Name, contenttype.Handle(f.serve))))
+	}
+	shutdown.Track(requestid.Handle(handler))(w, r)
+}
+
+// replay serves the requests of jobs, which passed the device token and
+// App Check when they were queued.
+func (f Function) replay(w http.ResponseWriter, r *http.Request) {
+	shutdown.Track(requestid.Handle(f.serve))(w, r)
+}
+
+func (f Function) serve(w http.ResponseWriter, r *http.Request) {
+	apiversion.Negotiate(jobs.Async(f.Name, idempotency.Handle(redact.Handle(f.Name, f.Handler))))(w, r)
+}
+
+func init() {
+	// Fail the deployment, not the first request, on a bad configuration.
+	config.Get()
+
+	for _, f := range Functions {
+		functions.HTTP(f.Name, f.ServeHTTP)
+		jobs.Register(f.Name, f.replay)
+	}
+
+	// Let requests finish when the instance is scaled down
+	shutdown.OnShutdown(cloudlog.Flush)
+	shutdown.Listen()
+}
@@ -0,0 +1,236 @@
+package submitfeedback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/api/firestore/v1"
+
+	"example.com/buddy-paws/internal/analytics"
+	"example.com/buddy-paws/internal/archive"
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/persona"
+	"example.com/buddy-paws/internal/requestid"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// Request rates the guidance given for an earlier request, identified by
+// the X-Request-ID it was answered with. ActualOutcome is what really
+// happened, e.g. "there was a pole on the left".
+type Request struct {
+	RequestID     string `json:"requestId"`
+	Rating        int    `json:"rating"`
+	Comment       string `json:"comment,omitempty"`
+	ActualOutcome string `json:"actualOutcome,omitempty"`
+}
+
+type Response struct {
+	SpeechText string `json:"speechText"`
+	FeedbackID string `json:"feedbackId"`
+	// Archived is set when the frame of the request was archived, so the
+	// feedback can go into the evaluation set.
+	Archived bool `json:"archived"`
+}
+
+const (
+	minRating = 1
+	maxRating = 5
+
+	maxCommentLength = 1000
+)
+
+// SubmitFeedback is the Cloud Function entry point. Feedback is stored in
+// the Firestore feedback collection with the path of the archived frame,
+// see package archive, when there is one.
+func SubmitFeedback(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "submit-feedback"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w)
+		return
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return
+	}
+
+	// Parse request
+	var req Request
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	// Link the feedback to the frame it is about, if it was kept
+	archivePath, err := archive.Find(ctx, req.RequestID)
+	if err != nil {
+		// The feedback is still worth keeping without the frame
+		logger.Printf("Error looking up archived frame: %v", err)
+	}
+
+	// Feedback is linked to the signed-in user, never to an X-User-ID
+	// anyone can set
+	userID := auth.Caller(ctx, r)
+	id, err := saveFeedback(ctx, projectID, req, userID, archivePath)
+	if err != nil {
+		logger.Printf("Error saving feedback: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error saving feedback")
+		return
+	}
+
+	// Ratings are joined with the guidance they rate in the quality analytics
+	err = analytics.RecordFeedback(ctx, analytics.Feedback{
+		RequestID:  req.RequestID,
+		Rating:     req.Rating,
+		UserID:     userID,
+		HasOutcome: req.ActualOutcome != "",
+	})
+	if err != nil {
+		// The feedback is saved; only the analytics miss it
+		logger.Printf("Error recording feedback: %v", err)
+	}
+
+	// Return response
+	response := Response{
+		SpeechText: persona.Speech("Thanks, your feedback helps Buddy improve."),
+		FeedbackID: id,
+		Archived:   archivePath != "",
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (req *Request) validate() error {
+	req.Comment = strings.TrimSpace(req.Comment)
+	req.ActualOutcome = strings.TrimSpace(req.ActualOutcome)
+
+	switch {
+	case !requestid.Valid(req.RequestID):
+		return errors.New("Invalid requestId")
+	case req.Rating < minRating || req.Rating > maxRating:
+		return fmt.Errorf("Invalid rating, expected %d to %d", minRating, maxRating)
+	case utf8.RuneCountInString(req.Comment) > maxCommentLength:
+		return fmt.Errorf("Comment longer than %d characters", maxCommentLength)
+	case utf8.RuneCountInString(req.ActualOutcome) > maxCommentLength:
+		return fmt.Errorf("actualOutcome longer than %d characters", maxCommentLength)
+	}
+	return nil
+}
+
+// saveFeedback stores the feedback and returns its document ID.
+func saveFeedback(ctx context.Context, projectID string, req Request, userID, archivePath string) (string, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	fields := map[string]firestore.Value{
+		"requestId": {StringValue: req.RequestID},
+		"rating":    {IntegerValue: int64(req.Rating)},
+		"createdAt": {TimestampValue: time.Now().UTC().Format(time.RFC3339Nano)},
+	}
+	optional := map[string]string{
+		"comment":       req.Comment,
+		"actualOutcome": req.ActualOutcome,
+		"userId":        userID,
+		"archivePath":   archivePath,
+	}
+	for name, value := range optional {
+		if value != "" {
+			fields[name] = firestore.Value{StringValue: value}
+		}
+	}
+
+	parent := fmt.Sprintf("projects/%s/databases/(default)/documents", projectID)
+	doc, err := fs.Projects.Databases.Documents.CreateDocument(parent, "feedback", &firestore.Document{Fields: fields}).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return "", err
+	}
+	return doc.Name[strings.LastIndex(doc.Name, "/")+1:], nil
+}
+
+func handleCORS(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-User-ID, X-Request-ID, Idempotency-Key")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
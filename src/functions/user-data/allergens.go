@@ -0,0 +1,84 @@
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"example.com/buddy-paws/internal/allergens"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// AllergensResponse is the user's allergy list.
+type AllergensResponse struct {
+	SpeechText string `json:"speechText,omitempty"`
+	allergens.Profile
+}
+
+// MyAllergens is the Cloud Function entry point of the allergy list: GET
+// returns it, POST replaces it, e.g. {"allergens": ["peanuts", "milk"]}.
+// object-reader and read-menu warn about them within a few minutes.
+func MyAllergens(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "my-allergens"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	uid, ok := authenticate(w, r, logger, http.MethodGet, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		profile, err := allergens.Get(ctx, uid)
+		if err != nil {
+			logger.Printf("Error reading allergens of %s: %v", uid, err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error reading allergens")
+			return
+		}
+		if profile.Allergens == nil {
+			profile.Allergens = []string{}
+		}
+		respondWithJSON(w, http.StatusOK, AllergensResponse{Profile: profile})
+		return
+	}
+
+	// Parse request
+	var req allergens.Profile
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if err := req.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+	req.UpdatedAt = nil
+
+	profile, err := allergens.Save(ctx, uid, req)
+	if err != nil {
+		logger.Printf("Error saving allergens of %s: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error saving allergens")
+		return
+	}
+
+	logger.Printf("Allergens of %s updated: %d allergens", uid, len(profile.Allergens))
+	respondWithJSON(w, http.StatusOK, AllergensResponse{
+		SpeechText: "Your allergy list has been saved.",
+		Profile:    profile,
+	})
+}
@@ -0,0 +1,85 @@
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"example.com/buddy-paws/internal/calibration"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// CalibrationResponse is the user's calibration of hazard severities.
+type CalibrationResponse struct {
+	SpeechText string `json:"speechText,omitempty"`
+	calibration.Profile
+}
+
+// MyCalibration is the Cloud Function entry point of the calibration: GET
+// returns it, POST replaces its rules, e.g. {"rules": [{"match": "stairs",
+// "severity": "HIGH"}, {"match": "wet surface", "severity": "IGNORE"}]}.
+// detect-hazards applies them within a few minutes.
+func MyCalibration(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "my-calibration"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	uid, ok := authenticate(w, r, logger, http.MethodGet, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		profile, err := calibration.Get(ctx, uid)
+		if err != nil {
+			logger.Printf("Error reading calibration of %s: %v", uid, err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error reading calibration")
+			return
+		}
+		if profile.Rules == nil {
+			profile.Rules = []calibration.Rule{}
+		}
+		respondWithJSON(w, http.StatusOK, CalibrationResponse{Profile: profile})
+		return
+	}
+
+	// Parse request
+	var req calibration.Profile
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if err := req.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error())
+		return
+	}
+	req.UpdatedAt = nil
+
+	profile, err := calibration.Save(ctx, uid, req)
+	if err != nil {
+		logger.Printf("Error saving calibration of %s: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error saving calibration")
+		return
+	}
+
+	logger.Printf("Calibration of %s updated: %d rules", uid, len(profile.Rules))
+	respondWithJSON(w, http.StatusOK, CalibrationResponse{
+		SpeechText: "Your hazard preferences have been saved.",
+		Profile:    profile,
+	})
+}
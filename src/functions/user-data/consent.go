@@ -0,0 +1,105 @@
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"example.com/buddy-paws/internal/audit"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/consent"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// ConsentResponse is the user's consent; a null answer was never given.
+type ConsentResponse struct {
+	SpeechText string `json:"speechText,omitempty"`
+	consent.Record
+}
+
+// MyConsent is the Cloud Function entry point of the consent: GET returns
+// it, POST updates the answers it sends, e.g. {"imageRetention": false}.
+// Frames kept before a withdrawal are deleted by the reap-expired function.
+func MyConsent(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "my-consent"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	uid, ok := authenticate(w, r, logger, http.MethodGet, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		record, err := consent.Get(ctx, uid)
+		if err != nil {
+			logger.Printf("Error reading consent of %s: %v", uid, err)
+			respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error reading consent")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, ConsentResponse{Record: record})
+		return
+	}
+
+	// Parse request
+	var req consent.Record
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.ImageRetention == nil && req.Analytics == nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid consent, expected imageRetention or analytics")
+		return
+	}
+	req.UpdatedAt = nil
+
+	record, err := consent.Save(ctx, uid, req)
+	if err != nil {
+		logger.Printf("Error saving consent of %s: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error saving consent")
+		return
+	}
+
+	logger.Printf("Consent of %s updated: imageRetention=%s analytics=%s", uid, answer(record.ImageRetention), answer(record.Analytics))
+	err = audit.Record(r.Context(), audit.Entry{
+		Action: audit.ActionConsentUpdate,
+		Actor:  "user:" + uid,
+		Target: uid,
+		Details: map[string]string{
+			"imageRetention": answer(record.ImageRetention),
+			"analytics":      answer(record.Analytics),
+		},
+	})
+	if err != nil {
+		logger.Printf("Error recording consent of %s in the audit log: %v", uid, err)
+	}
+	respondWithJSON(w, http.StatusOK, ConsentResponse{
+		SpeechText: "Your privacy choices have been saved.",
+		Record:     record,
+	})
+}
+
+func answer(b *bool) string {
+	switch {
+	case b == nil:
+		return "unanswered"
+	case *b:
+		return "yes"
+	default:
+		return "no"
+	}
+}
@@ -0,0 +1,391 @@
+// Package userdata serves the data requests of users under the GDPR and the
+// CCPA: ExportMyData returns everything stored about the user,
+// DeleteMyData erases it, MyConsent reads and updates what they consent
+// to be kept, see package consent, MyCalibration how they want hazards
+// rated, see package calibration, and MyAllergens what they are allergic
+// to, see package allergens. All act on the user of the Firebase ID token
+// of the request, see package auth, never on a UID the client names.
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/firestore/v1"
+
+	"example.com/buddy-paws/internal/audit"
+	"example.com/buddy-paws/internal/auth"
+	"example.com/buddy-paws/internal/cloudlog"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/pkg/apierror"
+)
+
+// DeleteRequest must confirm the deletion, which can't be undone.
+type DeleteRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+// DeleteResponse counts what was deleted.
+type DeleteResponse struct {
+	SpeechText string `json:"speechText"`
+	Deleted    Counts `json:"deleted"`
+}
+
+// Counts are the numbers of stored items of a user, by kind.
+type Counts struct {
+	Profile  bool `json:"profile"`
+	People   int  `json:"people"`
+	Photos   int  `json:"photos"`
+	Sessions int  `json:"sessions"`
+	Feedback int  `json:"feedback"`
+	Frames   int  `json:"frames"`
+}
+
+// ExportResponse is everything stored about the user. Documents are
+// exported as plain JSON objects with their ID, and files inline, base64
+// encoded.
+type ExportResponse struct {
+	UserID     string                   `json:"userId"`
+	ExportedAt time.Time                `json:"exportedAt"`
+	Profile    map[string]interface{}   `json:"profile,omitempty"`
+	People     []map[string]interface{} `json:"people"`
+	Photos     []file                   `json:"photos"`
+	Sessions   []map[string]interface{} `json:"sessions"`
+	Feedback   []map[string]interface{} `json:"feedback"`
+	Frames     []file                   `json:"frames"`
+}
+
+// ExportMyData is the Cloud Function entry point of the export. Large
+// exports are best requested asynchronously, see package jobs.
+func ExportMyData(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "export-my-data"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	uid, ok := authenticate(w, r, logger, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	store, err := newUserStore(ctx, projectID, uid)
+	if err != nil {
+		logger.Printf("Error creating clients: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+
+	export, err := exportData(ctx, store)
+	if err != nil {
+		logger.Printf("Error exporting data of %s: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error exporting data")
+		return
+	}
+
+	// No data leaves without a trace in the audit log
+	exported := Counts{
+		Profile:  export.Profile != nil,
+		People:   len(export.People),
+		Photos:   len(export.Photos),
+		Sessions: len(export.Sessions),
+		Feedback: len(export.Feedback),
+		Frames:   len(export.Frames),
+	}
+	err = audit.Record(r.Context(), audit.Entry{
+		Action:  audit.ActionDataExport,
+		Actor:   "user:" + uid,
+		Target:  uid,
+		Details: counts(exported),
+	})
+	if err != nil {
+		logger.Printf("Error recording export of %s in the audit log: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error exporting data, please try again")
+		return
+	}
+
+	logger.Printf("Exported data of %s: %+v", uid, exported)
+	respondWithJSON(w, http.StatusOK, export)
+}
+
+// DeleteMyData is the Cloud Function entry point of the deletion. Files
+// are deleted before the documents pointing at them, so a failed deletion
+// can be retried without leaving files behind.
+func DeleteMyData(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	cfg := config.Get()
+	projectID := cfg.ProjectID
+
+	// Creates a logger.
+	logName := "delete-my-data"
+	logger, closeLog, err := cloudlog.New(ctx, projectID, logName)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer closeLog()
+
+	uid, ok := authenticate(w, r, logger, http.MethodPost)
+	if !ok {
+		return
+	}
+
+	// Parse request
+	var req DeleteRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if !req.Confirm {
+		respondWithError(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Deletion not confirmed, set confirm to true")
+		return
+	}
+
+	store, err := newUserStore(ctx, projectID, uid)
+	if err != nil {
+		logger.Printf("Error creating clients: %v", err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error creating new client")
+		return
+	}
+
+	deleted, err := deleteData(ctx, store)
+	if err != nil {
+		logger.Printf("Error deleting data of %s: %v", uid, err)
+		respondWithError(w, http.StatusInternalServerError, apierror.CodeInternal, "Error deleting data, please try again")
+		return
+	}
+
+	logger.Printf("Deleted data of %s: %+v", uid, deleted)
+	err = audit.Record(r.Context(), audit.Entry{
+		Action:  audit.ActionDataDeletion,
+		Actor:   "user:" + uid,
+		Target:  uid,
+		Details: counts(deleted),
+	})
+	if err != nil {
+		logger.Printf("Error recording deletion of %s in the audit log: %v", uid, err)
+	}
+	respondWithJSON(w, http.StatusOK, DeleteResponse{
+		SpeechText: "All your data has been deleted.",
+		Deleted:    deleted,
+	})
+}
+
+// authenticate handles CORS and checks the method, one of methods, API key
+// and ID token of a request, returning the user's UID. It has responded
+// when it returns false.
+func authenticate(w http.ResponseWriter, r *http.Request, logger *log.Logger, methods ...string) (string, bool) {
+	// Handle CORS
+	if r.Method == http.MethodOptions {
+		handleCORS(w, methods)
+		return "", false
+	}
+
+	// Set CORS headers for the main request
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	// Verify method
+	if !slices.Contains(methods, r.Method) {
+		respondWithError(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+		return "", false
+	}
+
+	// Verify API key
+	if err := validateAPIKey(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid API key")
+		return "", false
+	}
+
+	// The user's own data only
+	uid, err := auth.UID(r.Context(), r)
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		respondWithError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid ID token")
+		return "", false
+	case err != nil:
+		logger.Printf("Error verifying ID token: %v", err)
+		respondWithError(w, http.StatusServiceUnavailable, apierror.CodeAuthUnavailable, "Error verifying ID token")
+		return "", false
+	}
+	return uid, true
+}
+
+func exportData(ctx context.Context, store *userStore) (ExportResponse, error) {
+	cfg := config.Get()
+	export := ExportResponse{UserID: store.uid, ExportedAt: time.Now().UTC()}
+
+	profile, err := store.profile(ctx)
+	if err != nil {
+		return export, err
+	}
+	if profile != nil {
+		export.Profile = plain(profile)
+	}
+
+	documents := []struct {
+		load func(context.Context) ([]*firestore.Document, error)
+		into *[]map[string]interface{}
+	}{
+		{store.people, &export.People},
+		{func(ctx context.Context) ([]*firestore.Document, error) { return store.owned(ctx, "hazardSessions") }, &export.Sessions},
+		{func(ctx context.Context) ([]*firestore.Document, error) { return store.owned(ctx, "feedback") }, &export.Feedback},
+	}
+	for _, d := range documents {
+		docs, err := d.load(ctx)
+		if err != nil {
+			return export, err
+		}
+		*d.into = []map[string]interface{}{}
+		for _, doc := range docs {
+			*d.into = append(*d.into, plain(doc))
+		}
+	}
+
+	photos, err := store.photos(ctx)
+	if err != nil {
+		return export, err
+	}
+	if export.Photos, err = store.download(ctx, cfg.FacesBucket, photos); err != nil {
+		return export, err
+	}
+
+	frames, err := store.frames(ctx)
+	if err != nil {
+		return export, err
+	}
+	if export.Frames, err = store.download(ctx, cfg.DebugBucket, frames); err != nil {
+		return export, err
+	}
+
+	return export, nil
+}
+
+func deleteData(ctx context.Context, store *userStore) (Counts, error) {
+	cfg := config.Get()
+	var deleted Counts
+
+	photos, err := store.photos(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	if err := store.deleteObjects(ctx, cfg.FacesBucket, photos); err != nil {
+		return deleted, err
+	}
+	deleted.Photos = len(photos)
+
+	frames, err := store.frames(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	if err := store.deleteObjects(ctx, cfg.DebugBucket, frames); err != nil {
+		return deleted, err
+	}
+	deleted.Frames = len(frames)
+
+	people, err := store.people(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	sessions, err := store.owned(ctx, "hazardSessions")
+	if err != nil {
+		return deleted, err
+	}
+	feedback, err := store.owned(ctx, "feedback")
+	if err != nil {
+		return deleted, err
+	}
+	for _, docs := range [][]*firestore.Document{people, sessions, feedback} {
+		if err := store.deleteDocuments(ctx, docs); err != nil {
+			return deleted, err
+		}
+	}
+	deleted.People, deleted.Sessions, deleted.Feedback = len(people), len(sessions), len(feedback)
+
+	// The profile goes last, as it holds the subcollection of people
+	profile, err := store.profile(ctx)
+	if err != nil {
+		return deleted, err
+	}
+	if profile != nil {
+		if err := store.deleteDocuments(ctx, []*firestore.Document{profile}); err != nil {
+			return deleted, err
+		}
+		deleted.Profile = true
+	}
+
+	return deleted, nil
+}
+
+// counts are the details of an audit entry of c.
+func counts(c Counts) map[string]string {
+	return map[string]string{
+		"profile":  strconv.FormatBool(c.Profile),
+		"people":   strconv.Itoa(c.People),
+		"photos":   strconv.Itoa(c.Photos),
+		"sessions": strconv.Itoa(c.Sessions),
+		"feedback": strconv.Itoa(c.Feedback),
+		"frames":   strconv.Itoa(c.Frames),
+	}
+}
+
+func handleCORS(w http.ResponseWriter, methods []string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Request-ID, Idempotency-Key, Prefer, X-Callback-URL")
+	w.Header().Set("Access-Control-Max-Age", "3600")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apierror.Code, message string) {
+	apierror.Write(w, apierror.New(status, code, message))
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling JSON: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func validateAPIKey(r *http.Request) error {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		return errors.New("missing API key")
+	}
+
+	expectedAPIKey := config.Get().APIKey
+	if expectedAPIKey == "" {
+		// If API_KEY is not set in environment, log a warning and allow the request
+		log.Println("Warning: API_KEY environment variable not set")
+		return nil
+	}
+
+	if apiKey != expectedAPIKey {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
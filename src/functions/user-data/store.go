@@ -0,0 +1,209 @@
+package userdata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"example.com/buddy-paws/internal/archive"
+	"example.com/buddy-paws/internal/config"
+	"example.com/buddy-paws/internal/query"
+)
+
+// userStore finds the data of one user:
+//
+//   - the profile, users/{uid}, and the enrolled people of recognize-person,
+//     users/{uid}/people/{personId}
+//   - the enrollment photos, faces/{uid}/ in FACES_BUCKET
+//   - the hazard sessions, hazardSessions/{uid}:{sessionId} with their
+//     userId
+//   - the feedback, feedback/{id} with their userId
+//   - the archived frames and records in DEBUG_BUCKET, see package archive
+type userStore struct {
+	fs       *firestore.Service
+	gcs      *storage.Service
+	database string
+	uid      string
+}
+
+// file is a stored file, exported inline.
+type file struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+}
+
+func newUserStore(ctx context.Context, projectID, uid string) (*userStore, error) {
+	fs, err := firestore.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gcs, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userStore{
+		fs:       fs,
+		gcs:      gcs,
+		database: fmt.Sprintf("projects/%s/databases/(default)/documents", projectID),
+		uid:      uid,
+	}, nil
+}
+
+func (s *userStore) profileDocument() string {
+	return fmt.Sprintf("%s/users/%s", s.database, s.uid)
+}
+
+// profile returns the user's profile, nil if there is none.
+func (s *userStore) profile(ctx context.Context) (*firestore.Document, error) {
+	doc, err := s.fs.Projects.Databases.Documents.Get(s.profileDocument()).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return doc, err
+}
+
+// people returns the user's enrolled people.
+func (s *userStore) people(ctx context.Context) ([]*firestore.Document, error) {
+	var docs []*firestore.Document
+	err := s.fs.Projects.Databases.Documents.
+		List(s.profileDocument(), "people").
+		Pages(ctx, func(resp *firestore.ListDocumentsResponse) error {
+			docs = append(docs, resp.Documents...)
+			return nil
+		})
+	return docs, err
+}
+
+// owned returns the documents of collection with the user's userId.
+func (s *userStore) owned(ctx context.Context, collection string) ([]*firestore.Document, error) {
+	return query.Run(ctx, s.database, query.Where(collection, "userId", "EQUAL", firestore.Value{StringValue: s.uid}))
+}
+
+// photos returns the names of the user's enrollment photos.
+func (s *userStore) photos(ctx context.Context) ([]string, error) {
+	bucket := config.Get().FacesBucket
+	if bucket == "" {
+		return nil, nil
+	}
+
+	var names []string
+	err := s.gcs.Objects.List(bucket).
+		Prefix("faces/"+s.uid+"/").
+		Pages(ctx, func(objects *storage.Objects) error {
+			for _, o := range objects.Items {
+				names = append(names, o.Name)
+			}
+			return nil
+		})
+	return names, err
+}
+
+// frames returns the names of the user's archived frames and records.
+func (s *userStore) frames(ctx context.Context) ([]string, error) {
+	return archive.UserObjects(ctx, s.uid)
+}
+
+// download returns the objects of bucket.
+func (s *userStore) download(ctx context.Context, bucket string, names []string) ([]file, error) {
+	var files []file
+	for _, name := range names {
+		object, err := s.gcs.Objects.Get(bucket, name).Context(ctx).Do()
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.gcs.Objects.Get(bucket, name).Context(ctx).Download()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file{Name: name, ContentType: object.ContentType, Data: data})
+	}
+	return files, nil
+}
+
+// deleteObjects deletes the objects of bucket. Objects already gone are
+// skipped.
+func (s *userStore) deleteObjects(ctx context.Context, bucket string, names []string) error {
+	for _, name := range names {
+		err := s.gcs.Objects.Delete(bucket, name).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// deleteDocuments deletes documents by name.
+func (s *userStore) deleteDocuments(ctx context.Context, docs []*firestore.Document) error {
+	for _, doc := range docs {
+		_, err := s.fs.Projects.Databases.Documents.Delete(doc.Name).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("deleting %s: %w", doc.Name, err)
+		}
+	}
+	return nil
+}
+
+// plain converts the fields of a document to plain JSON values.
+func plain(doc *firestore.Document) map[string]interface{} {
+	fields := map[string]interface{}{
+		"id": doc.Name[strings.LastIndex(doc.Name, "/")+1:],
+	}
+	for name, value := range doc.Fields {
+		fields[name] = plainValue(&value)
+	}
+	return fields
+}
+
+func plainValue(v *firestore.Value) interface{} {
+	switch {
+	case v.MapValue != nil:
+		m := map[string]interface{}{}
+		for name, value := range v.MapValue.Fields {
+			m[name] = plainValue(&value)
+		}
+		return m
+	case v.ArrayValue != nil:
+		var values []interface{}
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, plainValue(value))
+		}
+		return values
+	case v.StringValue != "":
+		return v.StringValue
+	case v.TimestampValue != "":
+		return v.TimestampValue
+	case v.IntegerValue != 0:
+		return v.IntegerValue
+	case v.DoubleValue != 0:
+		return v.DoubleValue
+	case v.BooleanValue:
+		return true
+	default:
+		// false, 0 and null all decode as an empty Value
+		return nil
+	}
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}